@@ -16,16 +16,22 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net/http"
 	"time"
 
 	gpumanager "github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/allocation"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/driver"
 	healthcheck "github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/health_check"
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/metrics"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migstatus"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
-	"github.com/golang/glog"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -49,6 +55,12 @@ var (
 	gpuMetricsPort                 = flag.Int("gpu-metrics-port", 2112, "Port on which GPU metrics for containers are exposed")
 	gpuMetricsCollectionIntervalMs = flag.Int("gpu-metrics-collection-interval", 30000, "Collection interval (in milli seconds) for container GPU metrics")
 	gpuConfigFile                  = flag.String("gpu-config", "/etc/nvidia/gpu_config.json", "File with GPU configurations for device plugin")
+	enableCDI                      = flag.Bool("enable-cdi", false, "If true, the device plugin will write a CDI spec for the GPUs on the node to '-cdi-spec-dir' and allocate GPUs as CDI devices. Requires the DevicePluginCDIDevices kubelet feature gate and a CDI enabled container runtime")
+	cdiSpecDir                     = flag.String("cdi-spec-dir", "/var/run/cdi", "Directory to write the CDI spec to when '-enable-cdi' is set")
+	cdiHookPath                    = flag.String("cdi-hook-path", "", "Path on the host to nvidia-ctk. If set, the CDI spec updates the ldcache of containers with the mounted NVIDIA libraries")
+	migStatusFile                  = flag.String("mig-status-file", migstatus.DefaultPath, "File the GPU partitioner reports the state of the GPU partitions to. The device plugin rediscovers the GPU partitions when they change. If empty, GPU partitions are only discovered on start")
+	allocationCheckpointFile       = flag.String("allocation-checkpoint", allocation.DefaultCheckpointFile, "File to save the device allocations made by the device plugin to. It must not be in '-plugin-directory', which the kubelet wipes when it restarts. If empty, allocations are only tracked in memory")
+	tolerateMisconfiguredGPUs      = flag.Bool("tolerate-misconfigured-gpus", false, "If true, the partitions of the GPUs that are partitioned as expected are advertised when other GPUs are not. GPUs with unexpected partitions are advertised as unhealthy, GPUs that are not partitioned are left out, and GPU partitions are rediscovered until all GPUs recover")
 )
 
 func parseGPUConfig(gpuConfigFile string) (gpumanager.GPUConfig, error) {
@@ -71,30 +83,46 @@ func parseGPUConfig(gpuConfigFile string) (gpumanager.GPUConfig, error) {
 }
 
 func main() {
+	logging.AddFlags(flag.CommandLine)
 	flag.Parse()
-	glog.Infoln("device-plugin started")
+	if err := logging.Setup("nvidia-gpu-device-plugin"); err != nil {
+		logging.Fatal("Failed to set up logging", logging.Error, err)
+	}
+	slog.Info("Device plugin started")
 	mountPaths := []pluginapi.Mount{
 		{HostPath: *hostPathPrefix, ContainerPath: *containerPathPrefix, ReadOnly: true},
 		{HostPath: *hostVulkanICDPathPrefix, ContainerPath: *containerVulkanICDPathPrefix, ReadOnly: true}}
 
 	var gpuConfig gpumanager.GPUConfig
 	if *gpuConfigFile != "" {
-		glog.Infof("Reading GPU config file: %s", *gpuConfigFile)
+		slog.Info("Reading GPU config file", "path", *gpuConfigFile)
 		var err error
 		gpuConfig, err = parseGPUConfig(*gpuConfigFile)
 		if err != nil {
-			glog.Infof("Failed to parse GPU config file %s: %v", *gpuConfigFile, err)
-			glog.Infof("Falling back to default GPU config.")
+			slog.Error("Failed to parse GPU config file, falling back to the default GPU config", "path", *gpuConfigFile, logging.Error, err)
 			gpuConfig = gpumanager.GPUConfig{}
 		}
 	}
 	err := gpuConfig.AddHealthCriticalXid()
 	if err != nil {
-		glog.Infof("Failed to Add HealthCriticalXid : %v", err)
+		slog.Error("Failed to add health critical Xids", logging.Error, err)
 	}
 
-	glog.Infof("Using gpu config: %v", gpuConfig)
+	slog.Info("Using GPU config", "config", fmt.Sprintf("%+v", gpuConfig))
 	ngm := gpumanager.NewNvidiaGPUManager(devDirectory, procDirectory, mountPaths, gpuConfig)
+	if *enableCDI {
+		ngm.EnableCDI(*cdiSpecDir, *cdiHookPath)
+	}
+	if *migStatusFile != "" {
+		ngm.SetMigStatusFile(*migStatusFile)
+	}
+	ngm.SetTolerateMisconfiguredGPUs(*tolerateMisconfiguredGPUs)
+	if *allocationCheckpointFile != "" {
+		if err := ngm.SetAllocationCheckpoint(*allocationCheckpointFile); err != nil {
+			slog.Error("Failed to restore device allocations, they will be reconciled with the kubelet", logging.Error, err)
+		}
+	}
+	http.Handle(allocation.Path, allocation.Handler(ngm.ListAllocations))
 
 	// Retry until nvidiactl and nvidia-uvm are detected. This is required
 	// because Nvidia drivers may not be installed initially.
@@ -103,35 +131,42 @@ func main() {
 		if err == nil {
 			break
 		}
-		// Use non-default level to avoid log spam.
-		glog.V(3).Infof("nvidiaGPUManager.CheckDevicePaths() failed: %v", err)
+		// Use debug level to avoid log spam.
+		slog.Debug("NVIDIA device paths not found", logging.Error, err)
 		time.Sleep(5 * time.Second)
 	}
 
 	if ret := nvml.Init(); ret != nvml.SUCCESS {
-		glog.Fatalf("failed to initialize nvml: %v", nvml.ErrorString(ret))
+		logging.Fatal("Failed to initialize NVML", logging.Error, nvml.ErrorString(ret))
 	}
 	defer nvml.Shutdown()
+	logDriverVersion()
 
 	for {
 		err := ngm.Start()
 		if err == nil {
 			break
 		}
+		// The driver doesn't change until the node is rebooted, so retrying
+		// can't help.
+		var unsupported *driver.UnsupportedError
+		if errors.As(err, &unsupported) {
+			logging.Fatal("The NVIDIA driver doesn't support the GPU config", logging.Error, err)
+		}
 
-		glog.Errorf("failed to start GPU device manager: %v", err)
+		slog.Error("Failed to start GPU device manager", logging.Error, err)
 		time.Sleep(5 * time.Second)
 	}
 
 	if *enableContainerGPUMetrics {
 		if gpuConfig.GPUPartitionSize != "" {
-			glog.Info("Using multi-instance GPU, metrics are not supported.")
+			slog.Info("Using multi-instance GPU, metrics are not supported")
 		} else {
-			glog.Infof("Starting metrics server on port: %d, endpoint path: %s, collection frequency: %d", *gpuMetricsPort, "/metrics", *gpuMetricsCollectionIntervalMs)
+			slog.Info("Starting metrics server", "port", *gpuMetricsPort, "path", "/metrics", "collection_interval_ms", *gpuMetricsCollectionIntervalMs)
 			metricServer := metrics.NewMetricServer(*gpuMetricsCollectionIntervalMs, *gpuMetricsPort, "/metrics")
 			err := metricServer.Start()
 			if err != nil {
-				glog.Infof("Failed to start metric server: %v", err)
+				slog.Error("Failed to start metrics server", logging.Error, err)
 				return
 			}
 			defer metricServer.Stop()
@@ -141,11 +176,28 @@ func main() {
 	if *enableHealthMonitoring {
 		hc := healthcheck.NewGPUHealthChecker(ngm.ListPhysicalDevices(), ngm.Health, ngm.ListHealthCriticalXid())
 		if err := hc.Start(); err != nil {
-			glog.Infof("Failed to start GPU Health Checker: %v", err)
+			slog.Error("Failed to start GPU health checker", logging.Error, err)
 			return
 		}
 		defer hc.Stop()
+		ngm.SetDevicesRefreshedHandler(hc.UpdateDevices)
 	}
 
 	ngm.Serve(*pluginMountPath, kubeletEndpoint, fmt.Sprintf("%s-%d.sock", pluginEndpointPrefix, time.Now().Unix()))
 }
+
+// logDriverVersion logs the versions of the NVIDIA driver and of the CUDA
+// driver API reported by NVML.
+func logDriverVersion() {
+	driverVersion, err := driver.FromNVML()
+	if err != nil {
+		slog.Error("Failed to get NVIDIA driver version", logging.Error, err)
+		return
+	}
+	cudaVersion, err := driver.CUDAFromNVML()
+	if err != nil {
+		slog.Error("Failed to get CUDA driver version", logging.Error, err)
+		return
+	}
+	slog.Info("Found NVIDIA driver", "driver_version", driverVersion.String(), "cuda_version", cudaVersion.String())
+}
@@ -8,23 +8,21 @@ require (
 	github.com/NVIDIA/go-nvml v0.12.0-2
 	github.com/NVIDIA/gpu-monitoring-tools v0.0.0-20211102125545-5a2c58442e48
 	github.com/containerd/nri v0.5.0
+	github.com/containerd/ttrpc v1.1.1-0.20220420014843-944ef4a40df3
 	github.com/fsnotify/fsnotify v1.7.0
-	github.com/golang/glog v1.2.4
 	github.com/google/go-cmp v0.6.0
 	github.com/prometheus/client_golang v1.16.0
-	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/net v0.38.0
 	golang.org/x/sys v0.31.0
 	google.golang.org/grpc v1.64.1
-	k8s.io/kubelet v0.27.2
+	k8s.io/kubelet v0.28.15
 	sigs.k8s.io/yaml v1.3.0
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
-	github.com/containerd/ttrpc v1.1.1-0.20220420014843-944ef4a40df3 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
@@ -34,10 +32,11 @@ require (
 	github.com/prometheus/client_model v0.4.0 // indirect
 	github.com/prometheus/common v0.44.0 // indirect
 	github.com/prometheus/procfs v0.10.1 // indirect
+	github.com/sirupsen/logrus v1.8.1 // indirect
 	golang.org/x/text v0.23.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	k8s.io/cri-api v0.25.3 // indirect
+	k8s.io/cri-api v0.28.15 // indirect
 )
@@ -0,0 +1,204 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+var (
+	// injections counts the devices, mounts, env vars and resource limits
+	// injected into created containers.
+	injections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nri_device_injector_injections_total",
+			Help: "Number of devices, mounts, env vars and resource limits injected into containers.",
+		},
+		[]string{"kind"},
+	)
+	// injectionFailures counts the containers that failed to be created
+	// because of their annotations.
+	injectionFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "nri_device_injector_injection_failures_total",
+			Help: "Number of containers whose annotated injections failed.",
+		},
+	)
+	// missingDevices is the number of devices annotated for running containers
+	// whose node is missing on the host, or that were not injected into the
+	// container, e.g. because it was created while the plugin was down.
+	missingDevices = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nri_device_injector_missing_devices",
+			Help: "Number of devices annotated for running containers that are missing, by reason: node or container.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(injections, injectionFailures, missingDevices)
+}
+
+// trackedContainer is a running container with annotated devices.
+type trackedContainer struct {
+	l *slog.Logger
+	// devices are the host paths of the annotated devices.
+	devices []string
+	// notInjected are the annotated devices that are not in the container.
+	notInjected []string
+	// missing are the devices whose node was missing in the last audit.
+	missing map[string]bool
+}
+
+// track starts auditing the annotated devices of the container with the given
+// ID.
+func (p *plugin) track(id string, l *slog.Logger, devices, notInjected []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.containers == nil {
+		p.containers = make(map[string]*trackedContainer)
+	}
+	p.containers[id] = &trackedContainer{l: l, devices: devices, notInjected: notInjected, missing: make(map[string]bool)}
+}
+
+// untrack stops auditing the devices of the container with the given ID.
+func (p *plugin) untrack(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.containers, id)
+	p.updateMissingDevicesLocked()
+}
+
+// Synchronize audits the containers that were created before the plugin
+// connected to NRI, e.g. after the plugin or containerd restarted, against
+// their annotations. The devices that are annotated but not in the container,
+// or whose node is missing on the host, are logged and counted.
+func (p *plugin) Synchronize(ctx context.Context, pods []*api.PodSandbox, containers []*api.Container) ([]*api.ContainerUpdate, error) {
+	podsByID := make(map[string]*api.PodSandbox)
+	for _, pod := range pods {
+		podsByID[pod.Id] = pod
+	}
+
+	p.mu.Lock()
+	p.containers = make(map[string]*trackedContainer)
+	p.mu.Unlock()
+	annotated := 0
+	for _, c := range containers {
+		pod := podsByID[c.PodSandboxId]
+		if pod == nil || c.State == api.ContainerState_CONTAINER_STOPPED {
+			continue
+		}
+		l := slog.With(logging.Container, c.Name, logging.Pod, pod.Name, logging.Namespace, pod.Namespace)
+		inj, err := getInjection(c.Name, pod.Annotations, p.isInitContainer(ctx, pod, c.Name))
+		if err != nil {
+			l.Warn("Failed to get device from pod annotation of running container", logging.Error, err)
+			continue
+		}
+		if inj.empty() {
+			continue
+		}
+		devices, err := injectionDevices(l, pod, inj)
+		if err != nil {
+			l.Warn("Failed to expand annotated devices of running container", logging.Error, err)
+			continue
+		}
+
+		injected := make(map[string]bool)
+		for _, d := range c.GetLinux().GetDevices() {
+			injected[d.Path] = true
+		}
+		var paths, notInjected []string
+		for _, d := range devices {
+			paths = append(paths, d.Path)
+			if !injected[d.Path] {
+				l.Warn("Annotated device not injected into running container", logging.DeviceID, d.Path)
+				notInjected = append(notInjected, d.Path)
+			}
+		}
+		p.track(c.Id, l, paths, notInjected)
+		annotated++
+	}
+	slog.Info("Synchronized containers", "containers", len(containers), "annotated", annotated)
+	p.audit()
+	return nil, nil
+}
+
+// StopContainer stops auditing the devices of the stopped container.
+func (p *plugin) StopContainer(_ context.Context, _ *api.PodSandbox, container *api.Container) ([]*api.ContainerUpdate, error) {
+	p.untrack(container.Id)
+	return nil, nil
+}
+
+// RemoveContainer stops auditing the devices of the removed container, in
+// case it was never started.
+func (p *plugin) RemoveContainer(_ context.Context, _ *api.PodSandbox, container *api.Container) error {
+	p.untrack(container.Id)
+	return nil
+}
+
+// runAudits audits the devices of the running containers every interval.
+func (p *plugin) runAudits(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.audit()
+		}
+	}
+}
+
+// audit checks that the device nodes of the running containers still exist,
+// logs the ones that disappeared or came back, and updates the missing devices
+// metric.
+func (p *plugin) audit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.containers {
+		for _, path := range c.devices {
+			_, err := os.Lstat(path)
+			switch {
+			case err != nil && !c.missing[path]:
+				c.l.Warn("Device node of running container disappeared", logging.DeviceID, path, logging.Error, err)
+				c.missing[path] = true
+			case err == nil && c.missing[path]:
+				c.l.Info("Device node of running container is back", logging.DeviceID, path)
+				delete(c.missing, path)
+			}
+		}
+	}
+	p.updateMissingDevicesLocked()
+}
+
+func (p *plugin) updateMissingDevicesLocked() {
+	var nodes, notInjected int
+	for _, c := range p.containers {
+		nodes += len(c.missing)
+		notInjected += len(c.notInjected)
+	}
+	missingDevices.WithLabelValues("node").Set(float64(nodes))
+	missingDevices.WithLabelValues("container").Set(float64(notInjected))
+}
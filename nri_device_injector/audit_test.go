@@ -0,0 +1,274 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	nrinet "github.com/containerd/nri/pkg/net"
+	"github.com/containerd/nri/pkg/net/multiplex"
+	"github.com/containerd/nri/pkg/stub"
+	"github.com/containerd/ttrpc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSynchronize(t *testing.T) {
+	root := makeDevTree(t, "nvidia0", "nvidia1", "nvidia2")
+	pods := []*api.PodSandbox{{
+		Id:        "pod-1",
+		Name:      "trainer",
+		Namespace: "default",
+		Annotations: map[string]string{
+			ctrDeviceKeyPrefix + "main":  "- path: " + root + "/nvidia[01]",
+			ctrDeviceKeyPrefix + "other": "- path: " + root + "/nvidia2",
+		},
+	}}
+	containers := []*api.Container{{
+		Id:           "ctr-main",
+		PodSandboxId: "pod-1",
+		Name:         "main",
+		State:        api.ContainerState_CONTAINER_RUNNING,
+		Linux:        &api.LinuxContainer{Devices: []*api.LinuxDevice{{Path: root + "/nvidia0"}, {Path: root + "/nvidia1"}}},
+	}, {
+		// Created while the plugin was down.
+		Id:           "ctr-other",
+		PodSandboxId: "pod-1",
+		Name:         "other",
+		State:        api.ContainerState_CONTAINER_RUNNING,
+	}, {
+		Id:           "ctr-sidecar",
+		PodSandboxId: "pod-1",
+		Name:         "sidecar",
+		State:        api.ContainerState_CONTAINER_RUNNING,
+	}, {
+		Id:           "ctr-stopped",
+		PodSandboxId: "pod-1",
+		Name:         "main",
+		State:        api.ContainerState_CONTAINER_STOPPED,
+	}, {
+		Id:           "ctr-unknown-pod",
+		PodSandboxId: "pod-2",
+		Name:         "main",
+		State:        api.ContainerState_CONTAINER_RUNNING,
+	}}
+	missing := func(reason string) float64 {
+		return testutil.ToFloat64(missingDevices.WithLabelValues(reason))
+	}
+
+	p := &plugin{}
+	updates, err := p.Synchronize(context.Background(), pods, containers)
+	assert.NoError(t, err)
+	assert.Empty(t, updates)
+	assert.ElementsMatch(t, []string{"ctr-main", "ctr-other"}, keys(p.containers))
+	assert.Equal(t, 0.0, missing("node"))
+	assert.Equal(t, 1.0, missing("container"))
+
+	if err := os.Remove(root + "/nvidia1"); err != nil {
+		t.Fatalf("failed to remove device: %v", err)
+	}
+	p.audit()
+	assert.Equal(t, 1.0, missing("node"))
+	p.audit()
+	assert.Equal(t, 1.0, missing("node"))
+
+	if err := os.WriteFile(root+"/nvidia1", nil, 0644); err != nil {
+		t.Fatalf("failed to restore device: %v", err)
+	}
+	p.audit()
+	assert.Equal(t, 0.0, missing("node"))
+
+	_, err = p.StopContainer(context.Background(), pods[0], containers[1])
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, missing("container"))
+	assert.NoError(t, p.RemoveContainer(context.Background(), pods[0], containers[0]))
+	assert.Empty(t, p.containers)
+}
+
+func TestCreateContainerTracking(t *testing.T) {
+	p := &plugin{}
+	pod := &api.PodSandbox{
+		Name:        "pod",
+		Namespace:   "default",
+		Annotations: map[string]string{ctrDeviceKeyPrefix + "test": "{devices: [{path: /dev/null}], env: [{name: A, value: B}]}"},
+	}
+
+	devices := testutil.ToFloat64(injections.WithLabelValues("device"))
+	env := testutil.ToFloat64(injections.WithLabelValues("env"))
+	_, _, err := p.CreateContainer(context.Background(), pod, &api.Container{Id: "ctr-1", Name: "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, devices+1, testutil.ToFloat64(injections.WithLabelValues("device")))
+	assert.Equal(t, env+1, testutil.ToFloat64(injections.WithLabelValues("env")))
+	assert.Equal(t, []string{"ctr-1"}, keys(p.containers))
+
+	failures := testutil.ToFloat64(injectionFailures)
+	pod.Annotations[ctrDeviceKeyPrefix+"test"] = "- path: /dev/missing"
+	_, _, err = p.CreateContainer(context.Background(), pod, &api.Container{Id: "ctr-2", Name: "test"})
+	assert.Error(t, err)
+	assert.Equal(t, failures+1, testutil.ToFloat64(injectionFailures))
+	assert.Equal(t, []string{"ctr-1"}, keys(p.containers))
+}
+
+// fakeRuntime is the runtime end of an NRI connection to the plugin.
+type fakeRuntime struct {
+	mux multiplex.Mux
+	// plugin calls the plugin over the connection.
+	plugin     api.PluginService
+	registered chan struct{}
+	// done receives the result of the plugin run once the connection is closed.
+	done chan error
+}
+
+func (r *fakeRuntime) RegisterPlugin(context.Context, *api.RegisterPluginRequest) (*api.Empty, error) {
+	close(r.registered)
+	return &api.Empty{}, nil
+}
+
+func (r *fakeRuntime) UpdateContainers(context.Context, *api.UpdateContainersRequest) (*api.UpdateContainersResponse, error) {
+	return &api.UpdateContainersResponse{}, nil
+}
+
+// connectFakeRuntime runs p over a socket pair whose other end is served by a
+// fake runtime, and returns the runtime once the plugin registered.
+func connectFakeRuntime(t *testing.T, p *plugin) *fakeRuntime {
+	t.Helper()
+	pair, err := nrinet.NewSocketPair()
+	if err != nil {
+		t.Fatalf("failed to create socket pair: %v", err)
+	}
+	pluginConn, err := pair.LocalConn()
+	if err != nil {
+		t.Fatalf("failed to get plugin connection: %v", err)
+	}
+	runtimeConn, err := pair.PeerConn()
+	if err != nil {
+		t.Fatalf("failed to get runtime connection: %v", err)
+	}
+
+	r := &fakeRuntime{mux: multiplex.Multiplex(runtimeConn), registered: make(chan struct{}), done: make(chan error, 1)}
+	l, err := r.mux.Listen(multiplex.RuntimeServiceConn)
+	if err != nil {
+		t.Fatalf("failed to listen for the runtime service: %v", err)
+	}
+	srv, err := ttrpc.NewServer()
+	if err != nil {
+		t.Fatalf("failed to create runtime server: %v", err)
+	}
+	api.RegisterRuntimeService(srv, r)
+	go srv.Serve(context.Background(), l)
+	t.Cleanup(func() { srv.Close() })
+	conn, err := r.mux.Open(multiplex.PluginServiceConn)
+	if err != nil {
+		t.Fatalf("failed to open the plugin service: %v", err)
+	}
+	r.plugin = api.NewPluginClient(ttrpc.NewClient(conn))
+
+	go func() { r.done <- p.run(context.Background(), stub.WithConnection(pluginConn)) }()
+	select {
+	case <-r.registered:
+	case err := <-r.done:
+		t.Fatalf("plugin exited before registering: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("plugin did not register")
+	}
+	return r
+}
+
+// TestReconnect drives the plugin through NRI connections to a fake runtime:
+// the containers are audited from Synchronize until they stop or are removed,
+// and again after the plugin reconnects once the connection closed.
+func TestReconnect(t *testing.T) {
+	root := makeDevTree(t, "nvidia0", "nvidia1")
+	pod := &api.PodSandbox{
+		Id:        "pod-1",
+		Name:      "trainer",
+		Namespace: "default",
+		Annotations: map[string]string{
+			ctrDeviceKeyPrefix + "main":    "- path: " + root + "/nvidia0",
+			ctrDeviceKeyPrefix + "sidecar": "- path: " + root + "/nvidia1",
+		},
+	}
+	main := &api.Container{Id: "ctr-main", PodSandboxId: "pod-1", Name: "main", State: api.ContainerState_CONTAINER_RUNNING}
+	sidecar := &api.Container{Id: "ctr-sidecar", PodSandboxId: "pod-1", Name: "sidecar", State: api.ContainerState_CONTAINER_CREATED}
+	missing := func() float64 {
+		return testutil.ToFloat64(missingDevices.WithLabelValues("container"))
+	}
+	ctx := context.Background()
+	p := &plugin{}
+	tracked := func() []string {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return keys(p.containers)
+	}
+
+	r := connectFakeRuntime(t, p)
+	cfg, err := r.plugin.Configure(ctx, &api.ConfigureRequest{RuntimeName: "fake", RuntimeVersion: "v1"})
+	assert.NoError(t, err)
+	events := api.EventMask(cfg.Events)
+	for _, e := range []api.Event{api.Event_CREATE_CONTAINER, api.Event_STOP_CONTAINER, api.Event_REMOVE_CONTAINER} {
+		assert.True(t, events.IsSet(e), "plugin is not subscribed to %v", e)
+	}
+	_, err = r.plugin.Synchronize(ctx, &api.SynchronizeRequest{Pods: []*api.PodSandbox{pod}, Containers: []*api.Container{main, sidecar}})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ctr-main", "ctr-sidecar"}, tracked())
+	assert.Equal(t, 2.0, missing())
+
+	_, err = r.plugin.StopContainer(ctx, &api.StopContainerRequest{Pod: pod, Container: main})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ctr-sidecar"}, tracked())
+	_, err = r.plugin.StateChange(ctx, &api.StateChangeEvent{Event: api.Event_REMOVE_CONTAINER, Pod: pod, Container: sidecar})
+	assert.NoError(t, err)
+	assert.Empty(t, tracked())
+	assert.Equal(t, 0.0, missing())
+
+	_, err = r.plugin.Synchronize(ctx, &api.SynchronizeRequest{Pods: []*api.PodSandbox{pod}, Containers: []*api.Container{main}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, missing())
+
+	// Closing the connection stops the plugin run through the close handler,
+	// which drops the containers whose events can no longer be received.
+	r.mux.Close()
+	select {
+	case err := <-r.done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("plugin run did not return after the connection closed")
+	}
+	assert.Empty(t, tracked())
+	assert.Equal(t, 0.0, missing())
+
+	r = connectFakeRuntime(t, p)
+	_, err = r.plugin.Configure(ctx, &api.ConfigureRequest{RuntimeName: "fake", RuntimeVersion: "v1"})
+	assert.NoError(t, err)
+	main.Linux = &api.LinuxContainer{Devices: []*api.LinuxDevice{{Path: root + "/nvidia0"}}}
+	_, err = r.plugin.Synchronize(ctx, &api.SynchronizeRequest{Pods: []*api.PodSandbox{pod}, Containers: []*api.Container{main, sidecar}})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ctr-main", "ctr-sidecar"}, tracked())
+	assert.Equal(t, 1.0, missing())
+	r.mux.Close()
+	<-r.done
+}
+
+func keys(containers map[string]*trackedContainer) []string {
+	var ids []string
+	for id := range containers {
+		ids = append(ids, id)
+	}
+	return ids
+}
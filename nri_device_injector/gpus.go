@@ -0,0 +1,223 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/allocation"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/deviceid"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/gpusharing"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+const gpuResourceName = "nvidia.com/gpu"
+
+var (
+	// devDir and procDir are the host /dev and /proc, replaced in tests.
+	devDir  = "/dev"
+	procDir = "/proc"
+	// kubeletAssignments is replaced in tests to fake the pod-resources API.
+	kubeletAssignments = allocation.KubeletAssignments
+
+	// lookupInternalID resolves MIG device UUIDs through NVML, replaced in
+	// tests.
+	lookupInternalID = lookupInternalIDWithNVML
+	initNVMLOnce     sync.Once
+	initNVMLErr      error
+
+	gpuDeviceIDRegexp       = regexp.MustCompile(`^nvidia([0-9]+)$`)
+	partitionDeviceIDRegexp = regexp.MustCompile(`^nvidia([0-9]+)/gi([0-9]+)(?:/ci([0-9]+))?$`)
+	capabilityMinorRegexp   = regexp.MustCompile(`DeviceFileMinor: ([0-9]+)`)
+	gpuUUIDRegexp           = regexp.MustCompile(`(?m)^GPU UUID:\s*(\S+)$`)
+	gpuMinorRegexp          = regexp.MustCompile(`(?m)^Device Minor:\s*([0-9]+)$`)
+)
+
+// sameGPUs returns the devices the device plugin gave to the container ctrName
+// of the pod, as reported by the kubelet pod-resources API.
+func sameGPUs(namespace, pod, ctrName string) ([]device, error) {
+	assignments, err := kubeletAssignments(gpuResourceName)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id, owner := range assignments {
+		if owner == (allocation.Owner{Namespace: namespace, Pod: pod, Container: ctrName}) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("container %s of pod %s/%s has no %s devices", ctrName, namespace, pod, gpuResourceName)
+	}
+	sort.Strings(ids)
+
+	var devices []device
+	for _, id := range ids {
+		paths, err := gpuDevicePaths(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			devices = append(devices, device{Path: p})
+		}
+	}
+	// Like the device plugin, but devices that don't exist can't be injected.
+	for _, d := range allocation.ControlDevices {
+		p := filepath.Join(devDir, d.Name)
+		if _, err := os.Stat(p); err == nil {
+			devices = append(devices, device{Path: p})
+		}
+	}
+	return devices, nil
+}
+
+// gpuDevicePaths returns the device nodes of the nvidia.com/gpu device ID, like
+// the device plugin's DeviceSpec: /dev/nvidia<minor> for a GPU, along with the
+// GPU instance and compute instance capability devices for a GPU partition.
+func gpuDevicePaths(deviceID string) ([]string, error) {
+	if gpusharing.IsVirtualDeviceID(deviceID) {
+		physicalID, err := gpusharing.VirtualToPhysicalDeviceID(deviceID)
+		if err != nil {
+			return nil, err
+		}
+		deviceID = physicalID
+	}
+
+	switch {
+	case gpuDeviceIDRegexp.MatchString(deviceID):
+		return []string{filepath.Join(devDir, deviceID)}, nil
+	case partitionDeviceIDRegexp.MatchString(deviceID):
+		m := partitionDeviceIDRegexp.FindStringSubmatch(deviceID)
+		return partitionDevicePaths(m[1], m[2], m[3])
+	case strings.HasPrefix(deviceID, "GPU-"):
+		minor, err := gpuMinorFromUUID(deviceID)
+		if err != nil {
+			return nil, err
+		}
+		return []string{filepath.Join(devDir, "nvidia"+minor)}, nil
+	case strings.HasPrefix(deviceID, "MIG-"):
+		internalID, err := lookupInternalID(deviceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s device ID %q: %w", gpuResourceName, deviceID, err)
+		}
+		m := partitionDeviceIDRegexp.FindStringSubmatch(internalID)
+		if m == nil {
+			return nil, fmt.Errorf("%s device ID %q is not a GPU partition: %s", gpuResourceName, deviceID, internalID)
+		}
+		return partitionDevicePaths(m[1], m[2], m[3])
+	default:
+		return nil, fmt.Errorf("unsupported %s device ID %q", gpuResourceName, deviceID)
+	}
+}
+
+// partitionDevicePaths returns the device nodes of the GPU partition gi of the
+// GPU with the given minor number. If ci is empty, the GPU instance must have a
+// single compute instance.
+func partitionDevicePaths(gpu, gi, ci string) ([]string, error) {
+	giDir := filepath.Join(procDir, "driver/nvidia/capabilities", "gpu"+gpu, "mig", "gi"+gi)
+	giMinor, err := capabilityMinor(filepath.Join(giDir, "access"))
+	if err != nil {
+		return nil, err
+	}
+	ciName := "ci" + ci
+	if ci == "" {
+		cis, err := filepath.Glob(filepath.Join(giDir, "ci[0-9]*"))
+		if err != nil {
+			return nil, err
+		}
+		if len(cis) != 1 {
+			return nil, fmt.Errorf("GPU instance nvidia%s/gi%s has %d compute instances, want 1", gpu, gi, len(cis))
+		}
+		ciName = filepath.Base(cis[0])
+	}
+	ciMinor, err := capabilityMinor(filepath.Join(giDir, ciName, "access"))
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		filepath.Join(devDir, "nvidia"+gpu),
+		filepath.Join(devDir, "nvidia-caps", "nvidia-cap"+giMinor),
+		filepath.Join(devDir, "nvidia-caps", "nvidia-cap"+ciMinor),
+	}, nil
+}
+
+// capabilityMinor returns the minor number of the capability device from its
+// access file.
+func capabilityMinor(accessFile string) (string, error) {
+	content, err := os.ReadFile(accessFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read access file: %w", err)
+	}
+	m := capabilityMinorRegexp.FindStringSubmatch(string(content))
+	if m == nil {
+		return "", fmt.Errorf("unexpected contents in access file %s: %s", accessFile, content)
+	}
+	return m[1], nil
+}
+
+// gpuMinorFromUUID returns the minor number of the GPU with the given UUID,
+// from the information files of the driver. MIG device UUIDs are not listed
+// there, they are resolved with lookupInternalID.
+func gpuMinorFromUUID(uuid string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(procDir, "driver/nvidia/gpus/*/information"))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return "", fmt.Errorf("failed to read GPU information: %w", err)
+		}
+		if m := gpuUUIDRegexp.FindSubmatch(content); m == nil || string(m[1]) != uuid {
+			continue
+		}
+		m := gpuMinorRegexp.FindSubmatch(content)
+		if m == nil {
+			return "", fmt.Errorf("no device minor in %s", f)
+		}
+		if _, err := strconv.Atoi(string(m[1])); err != nil {
+			return "", fmt.Errorf("invalid device minor in %s: %w", f, err)
+		}
+		return string(m[1]), nil
+	}
+	return "", fmt.Errorf("GPU %s not found", uuid)
+}
+
+// lookupInternalIDWithNVML returns the minor number based device ID of the MIG
+// device with the given UUID. NVML is only initialized for the first MIG device
+// UUID, so that nodes without MIG device UUIDs don't need libnvidia-ml.
+func lookupInternalIDWithNVML(uuid string) (string, error) {
+	initNVMLOnce.Do(func() {
+		switch ret := nvml.Init(); ret {
+		case nvml.SUCCESS:
+		case nvml.ERROR_LIBRARY_NOT_FOUND:
+			// nvml.ErrorString is not available without the library.
+			initNVMLErr = fmt.Errorf("failed to initialize NVML: libnvidia-ml.so.1 not found")
+		default:
+			initNVMLErr = fmt.Errorf("failed to initialize NVML: %s", nvml.ErrorString(ret))
+		}
+	})
+	if initNVMLErr != nil {
+		return "", initNVMLErr
+	}
+	return deviceid.LookupInternalID(uuid)
+}
@@ -0,0 +1,234 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/allocation"
+)
+
+// fakeGPUHost points devDir and procDir to a temporary host with GPU 0, GPU 1
+// partitioned into gi1 with ci0, and gi2 with ci0 and ci1, and the given extra
+// device nodes. NVML reports MIG-1111 as gi2/ci1 of GPU 1.
+func fakeGPUHost(t *testing.T, devices ...string) {
+	t.Helper()
+	origDev, origProc, origLookup := devDir, procDir, lookupInternalID
+	t.Cleanup(func() { devDir, procDir, lookupInternalID = origDev, origProc, origLookup })
+	lookupInternalID = func(uuid string) (string, error) {
+		if uuid == "MIG-1111" {
+			return "nvidia1/gi2/ci1", nil
+		}
+		return "", fmt.Errorf("no accessible GPU or MIG device with UUID %s", uuid)
+	}
+	devDir = makeDevTree(t, devices...)
+	procDir = t.TempDir()
+
+	files := map[string]string{
+		"driver/nvidia/gpus/0000:00:04.0/information":        "Model:\t\t NVIDIA A100\nIRQ:\t\t 34\nGPU UUID:\t GPU-aaaa\nDevice Minor:\t 0\n",
+		"driver/nvidia/gpus/0000:00:05.0/information":        "Model:\t\t NVIDIA A100\nIRQ:\t\t 35\nGPU UUID:\t GPU-bbbb\nDevice Minor:\t 1\n",
+		"driver/nvidia/capabilities/gpu1/mig/gi1/access":     "DeviceFileMinor: 12\nDeviceFileMode: 292\nDeviceFileModify: 1\n",
+		"driver/nvidia/capabilities/gpu1/mig/gi1/ci0/access": "DeviceFileMinor: 13\n",
+		"driver/nvidia/capabilities/gpu1/mig/gi2/access":     "DeviceFileMinor: 21\n",
+		"driver/nvidia/capabilities/gpu1/mig/gi2/ci0/access": "DeviceFileMinor: 22\n",
+		"driver/nvidia/capabilities/gpu1/mig/gi2/ci1/access": "DeviceFileMinor: 23\n",
+		"driver/nvidia/capabilities/gpu1/mig/gi3/access":     "garbage\n",
+		"driver/nvidia/capabilities/gpu1/mig/gi3/ci0/access": "DeviceFileMinor: 32\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(procDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to make directory for %s: %v", path, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", path, err)
+		}
+	}
+}
+
+// fakeKubeletAssignments makes the pod-resources API report assignments.
+func fakeKubeletAssignments(t *testing.T, assignments map[string]allocation.Owner, err error) {
+	orig := kubeletAssignments
+	t.Cleanup(func() { kubeletAssignments = orig })
+	kubeletAssignments = func(resourceName string) (map[string]allocation.Owner, error) {
+		assert.Equal(t, gpuResourceName, resourceName)
+		return assignments, err
+	}
+}
+
+func TestGPUDevicePaths(t *testing.T) {
+	fakeGPUHost(t)
+
+	tests := map[string]struct {
+		deviceID string
+		want     []string
+		wantErr  bool
+	}{
+		"GPU": {
+			deviceID: "nvidia0",
+			want:     []string{"nvidia0"},
+		},
+		"Shared GPU": {
+			deviceID: "nvidia1/vgpu3",
+			want:     []string{"nvidia1"},
+		},
+		"GPU partition with compute instance": {
+			deviceID: "nvidia1/gi2/ci1",
+			want:     []string{"nvidia1", "nvidia-caps/nvidia-cap21", "nvidia-caps/nvidia-cap23"},
+		},
+		"GPU partition with a single compute instance": {
+			deviceID: "nvidia1/gi1",
+			want:     []string{"nvidia1", "nvidia-caps/nvidia-cap12", "nvidia-caps/nvidia-cap13"},
+		},
+		"Shared GPU partition": {
+			deviceID: "nvidia1/gi1/vgpu0",
+			want:     []string{"nvidia1", "nvidia-caps/nvidia-cap12", "nvidia-caps/nvidia-cap13"},
+		},
+		"GPU partition with several compute instances": {
+			deviceID: "nvidia1/gi2",
+			wantErr:  true,
+		},
+		"GPU partition with invalid access file": {
+			deviceID: "nvidia1/gi3/ci0",
+			wantErr:  true,
+		},
+		"Unknown GPU partition": {
+			deviceID: "nvidia1/gi9",
+			wantErr:  true,
+		},
+		"GPU UUID": {
+			deviceID: "GPU-bbbb",
+			want:     []string{"nvidia1"},
+		},
+		"Unknown GPU UUID": {
+			deviceID: "GPU-cccc",
+			wantErr:  true,
+		},
+		"MIG device UUID": {
+			deviceID: "MIG-1111",
+			want:     []string{"nvidia1", "nvidia-caps/nvidia-cap21", "nvidia-caps/nvidia-cap23"},
+		},
+		"Shared MIG device UUID": {
+			deviceID: "MIG-1111/vgpu2",
+			want:     []string{"nvidia1", "nvidia-caps/nvidia-cap21", "nvidia-caps/nvidia-cap23"},
+		},
+		"Unknown MIG device UUID": {
+			deviceID: "MIG-aaaa",
+			wantErr:  true,
+		},
+		"Invalid device ID": {
+			deviceID: "gpu0",
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := gpuDevicePaths(tc.deviceID)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			var want []string
+			for _, p := range tc.want {
+				want = append(want, filepath.Join(devDir, p))
+			}
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestSameGPUs(t *testing.T) {
+	fakeGPUHost(t, "nvidia-modeset", "nvidiactl", "nvidia-uvm")
+	fakeKubeletAssignments(t, map[string]allocation.Owner{
+		"nvidia0":         {Namespace: "default", Pod: "pod", Container: "main"},
+		"nvidia1/gi1/ci0": {Namespace: "default", Pod: "pod", Container: "main"},
+		"nvidia1/gi2/ci0": {Namespace: "default", Pod: "pod", Container: "other"},
+		"nvidia1/gi2/ci1": {Namespace: "other", Pod: "pod", Container: "main"},
+	}, nil)
+
+	got, err := sameGPUs("default", "pod", "main")
+	assert.NoError(t, err)
+	var paths []string
+	for _, d := range got {
+		paths = append(paths, d.Path)
+	}
+	assert.Equal(t, []string{
+		filepath.Join(devDir, "nvidia0"),
+		filepath.Join(devDir, "nvidia1"),
+		filepath.Join(devDir, "nvidia-caps/nvidia-cap12"),
+		filepath.Join(devDir, "nvidia-caps/nvidia-cap13"),
+		filepath.Join(devDir, "nvidiactl"),
+		filepath.Join(devDir, "nvidia-uvm"),
+		filepath.Join(devDir, "nvidia-modeset"),
+	}, paths)
+
+	_, err = sameGPUs("default", "pod", "sidecar")
+	assert.ErrorContains(t, err, "has no nvidia.com/gpu devices")
+
+	fakeKubeletAssignments(t, nil, errors.New("kubelet is down"))
+	_, err = sameGPUs("default", "pod", "main")
+	assert.ErrorContains(t, err, "kubelet is down")
+}
+
+func TestCreateContainerSameGPUs(t *testing.T) {
+	fakeGPUHost(t)
+	fakeKubeletAssignments(t, map[string]allocation.Owner{
+		"nvidia0/vgpu0": {Namespace: "default", Pod: "pod", Container: "main"},
+	}, nil)
+	gpu := filepath.Join(devDir, "nvidia0")
+	fakeLstat(t, map[string]unix.Stat_t{
+		gpu:                {Mode: unix.S_IFCHR | 0666, Rdev: unix.Mkdev(195, 0)},
+		"/dev/infiniband0": {Mode: unix.S_IFCHR | 0666, Rdev: unix.Mkdev(231, 64)},
+	})
+	pod := &api.PodSandbox{
+		Name:      "pod",
+		Namespace: "default",
+		Annotations: map[string]string{
+			ctrDeviceKeyPrefix + "sidecar": `
+sameGPUsAs: main
+devices:
+- path: /dev/infiniband0
+- path: ` + gpu + `
+  file_mode: 0600
+`,
+			ctrDeviceKeyPrefix + "idle": "sameGPUsAs: sidecar",
+		},
+	}
+
+	adjust, _, err := (&plugin{}).CreateContainer(context.Background(), pod, &api.Container{Id: "ctr", Name: "sidecar"})
+	assert.NoError(t, err)
+	devices := adjust.GetLinux().GetDevices()
+	if assert.Len(t, devices, 2) {
+		assert.Equal(t, "/dev/infiniband0", devices[0].Path)
+		// The annotated device comes first, so its file mode wins.
+		assert.Equal(t, gpu, devices[1].Path)
+		assert.Equal(t, uint32(0600), devices[1].FileMode.GetValue())
+	}
+	assert.Len(t, adjust.GetLinux().GetResources().GetDevices(), 2)
+
+	_, _, err = (&plugin{}).CreateContainer(context.Background(), pod, &api.Container{Id: "idle", Name: "idle"})
+	assert.ErrorContains(t, err, "has no nvidia.com/gpu devices")
+}
@@ -0,0 +1,234 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"sigs.k8s.io/yaml"
+)
+
+// Container types of selectors.
+const (
+	initContainerType    = "init"
+	regularContainerType = "regular"
+)
+
+// Resource limits that can be injected, by their short name.
+var rlimitTypes = map[string]string{
+	"as":         "RLIMIT_AS",
+	"core":       "RLIMIT_CORE",
+	"cpu":        "RLIMIT_CPU",
+	"data":       "RLIMIT_DATA",
+	"fsize":      "RLIMIT_FSIZE",
+	"locks":      "RLIMIT_LOCKS",
+	"memlock":    "RLIMIT_MEMLOCK",
+	"msgqueue":   "RLIMIT_MSGQUEUE",
+	"nice":       "RLIMIT_NICE",
+	"nofile":     "RLIMIT_NOFILE",
+	"nproc":      "RLIMIT_NPROC",
+	"rss":        "RLIMIT_RSS",
+	"rtprio":     "RLIMIT_RTPRIO",
+	"rttime":     "RLIMIT_RTTIME",
+	"sigpending": "RLIMIT_SIGPENDING",
+	"stack":      "RLIMIT_STACK",
+}
+
+// injection is everything a pod annotation asks to inject into a container.
+// SameGPUsAs is the name of a container of the same pod whose nvidia.com/gpu
+// devices, as allocated by the device plugin, are injected too.
+type injection struct {
+	Devices    []device `json:"devices"`
+	Mounts     []mount  `json:"mounts"`
+	Env        []envVar `json:"env"`
+	Rlimits    []rlimit `json:"rlimits"`
+	SameGPUsAs string   `json:"sameGPUsAs"`
+}
+
+// mount is a host path bind mounted into the container, read-only unless
+// ReadWrite is set.
+type mount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadWrite   bool   `json:"read_write"`
+}
+
+type envVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// selector is an injection into the containers whose name matches the
+// ContainerName regular expression, if set, and whose type is ContainerType,
+// if set.
+type selector struct {
+	ContainerName string `json:"container_name"`
+	ContainerType string `json:"container_type"`
+	injection
+
+	nameRegexp *regexp.Regexp
+}
+
+// parseSelector parses the selector annotation value of key.
+func parseSelector(key, value string) (*selector, error) {
+	sel := &selector{}
+	if err := yaml.Unmarshal([]byte(value), sel); err != nil {
+		return nil, fmt.Errorf("invalid device annotation %q: %w", key, err)
+	}
+	if sel.ContainerType != "" && sel.ContainerType != initContainerType && sel.ContainerType != regularContainerType {
+		return nil, fmt.Errorf("invalid device annotation %q: container_type %q is not %s or %s", key, sel.ContainerType, initContainerType, regularContainerType)
+	}
+	if sel.ContainerName != "" {
+		re, err := regexp.Compile(sel.ContainerName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device annotation %q: container_name: %w", key, err)
+		}
+		sel.nameRegexp = re
+	}
+	if err := sel.validateDevices(); err != nil {
+		return nil, fmt.Errorf("invalid device annotation %q: %w", key, err)
+	}
+	return sel, nil
+}
+
+// matches returns true if the container named ctrName is selected. isInit is
+// only called if the selector has a container type.
+func (sel *selector) matches(ctrName string, isInit func() (bool, error)) (bool, error) {
+	if sel.nameRegexp != nil && !sel.nameRegexp.MatchString(ctrName) {
+		return false, nil
+	}
+	if sel.ContainerType == "" {
+		return true, nil
+	}
+	initCtr, err := isInit()
+	if err != nil {
+		return false, err
+	}
+	return initCtr == (sel.ContainerType == initContainerType), nil
+}
+
+// rlimit is a resource limit of the container. Type is either the short name,
+// e.g. memlock, or the full name, e.g. RLIMIT_MEMLOCK. A limit of -1 is
+// unlimited.
+type rlimit struct {
+	Type string `json:"type"`
+	Hard int64  `json:"hard"`
+	Soft int64  `json:"soft"`
+}
+
+// empty returns true if there is nothing to inject.
+func (inj *injection) empty() bool {
+	return inj == nil || len(inj.Devices)+len(inj.Mounts)+len(inj.Env)+len(inj.Rlimits) == 0 && inj.SameGPUsAs == ""
+}
+
+// validateDevices checks that each device sets exactly one of path and dir.
+func (inj *injection) validateDevices() error {
+	for _, d := range inj.Devices {
+		if (d.Path == "") == (d.Dir == "") {
+			return fmt.Errorf("exactly one of path and dir must be set, got path %q and dir %q", d.Path, d.Dir)
+		}
+	}
+	return nil
+}
+
+// validate checks the mounts, env vars and resource limits, normalizes the
+// resource limit types, and keeps only the first mount with a given
+// destination, env var with a given name and resource limit of a given type.
+func (inj *injection) validate() error {
+	var (
+		mounts  []mount
+		env     []envVar
+		rlimits []rlimit
+		seen    = make(map[string]bool)
+	)
+	for _, m := range inj.Mounts {
+		for _, path := range []string{m.Source, m.Destination} {
+			if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+				return fmt.Errorf("invalid mount %s:%s: paths must be absolute and clean", m.Source, m.Destination)
+			}
+		}
+		if !seen["mount:"+m.Destination] {
+			seen["mount:"+m.Destination] = true
+			mounts = append(mounts, m)
+		}
+	}
+	for _, e := range inj.Env {
+		if e.Name == "" || strings.Contains(e.Name, "=") {
+			return fmt.Errorf("invalid env var name %q", e.Name)
+		}
+		if !seen["env:"+e.Name] {
+			seen["env:"+e.Name] = true
+			env = append(env, e)
+		}
+	}
+	for _, r := range inj.Rlimits {
+		typ, err := rlimitType(r.Type)
+		if err != nil {
+			return err
+		}
+		r.Type = typ
+		if r.Hard < -1 || r.Soft < -1 {
+			return fmt.Errorf("invalid %s limits: soft %d and hard %d must be -1 or more", typ, r.Soft, r.Hard)
+		}
+		if hard, soft := r.limits(); soft > hard {
+			return fmt.Errorf("invalid %s limits: soft %d is above hard %d", typ, r.Soft, r.Hard)
+		}
+		if !seen["rlimit:"+typ] {
+			seen["rlimit:"+typ] = true
+			rlimits = append(rlimits, r)
+		}
+	}
+	inj.Mounts, inj.Env, inj.Rlimits = mounts, env, rlimits
+	return nil
+}
+
+// toNRIMount returns the NRI bind mount of m.
+func (m *mount) toNRIMount() *api.Mount {
+	mode := "ro"
+	if m.ReadWrite {
+		mode = "rw"
+	}
+	return &api.Mount{
+		Source:      m.Source,
+		Destination: m.Destination,
+		Type:        "bind",
+		Options:     []string{"rbind", "rprivate", "nosuid", "nodev", mode},
+	}
+}
+
+// limits returns the hard and soft limits, with -1 replaced by RLIM_INFINITY.
+func (r *rlimit) limits() (hard, soft uint64) {
+	toLimit := func(v int64) uint64 {
+		if v == -1 {
+			return math.MaxUint64
+		}
+		return uint64(v)
+	}
+	return toLimit(r.Hard), toLimit(r.Soft)
+}
+
+// rlimitType returns the full name of the resource limit type name.
+func rlimitType(name string) (string, error) {
+	short := strings.TrimPrefix(strings.ToLower(name), "rlimit_")
+	if typ, ok := rlimitTypes[short]; ok {
+		return typ, nil
+	}
+	return "", fmt.Errorf("invalid resource limit type %q", name)
+}
@@ -15,143 +15,494 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sys/unix"
 	"sigs.k8s.io/yaml"
 
 	"github.com/containerd/nri/pkg/api"
 	"github.com/containerd/nri/pkg/stub"
-	log "github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/driver"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 )
 
 const (
 	deviceKeyPrefix = "devices.gke.io"
 	// Key prefix for device injection to a container, followed by container name
 	ctrDeviceKeyPrefix = deviceKeyPrefix + "/container."
-	pluginName         = "device_injector_nri"
-	pluginIdx          = "10"
+	// Key prefix for device injection to the containers matching a selector,
+	// followed by any name
+	selectorDeviceKeyPrefix = deviceKeyPrefix + "/selector."
+	// Key for device injection to all containers of the pod
+	podDeviceKey = deviceKeyPrefix + "/pod"
+	pluginName   = "device_injector_nri"
+	pluginIdx    = "10"
 	// Device types.
 	blockDevice = "b"
 	charDevice  = "c"
 	fifoDevice  = "p"
 )
 
+// device is a device annotated for injection. Path can be a filepath.Match
+// glob, e.g. /dev/nvidia[0-9]*, which is expanded to the matching devices. If
+// Dir is set instead of Path, all the char devices directly under Dir are
+// injected. FileMode, UID and GID are only set on the device node in the
+// container when they are annotated, so 0 forces root ownership or mode 0.
 type device struct {
-	Path     string `json:"path"`
-	Type     string `json:"type"`
-	Major    int64  `json:"major"`
-	Minor    int64  `json:"minor"`
-	FileMode uint32 `json:"file_mode"`
-	UID      uint32 `json:"uid"`
-	GID      uint32 `json:"gid"`
+	Path     string  `json:"path"`
+	Dir      string  `json:"dir"`
+	Type     string  `json:"type"`
+	Major    int64   `json:"major"`
+	Minor    int64   `json:"minor"`
+	FileMode *uint32 `json:"file_mode"`
+	UID      *uint32 `json:"uid"`
+	GID      *uint32 `json:"gid"`
 }
 
+// lstat is unix.Lstat, replaced in tests to fake device nodes.
+var lstat = unix.Lstat
+
+var (
+	policyFile    = flag.String("policy-file", "", "Path of the device policy file. If empty, all annotated devices are injected")
+	metricsPort   = flag.Int("metrics-port", 0, "Port to serve Prometheus metrics on. If 0, they are only served on -admin-port")
+	auditInterval = flag.Duration("audit-interval", time.Minute, "Interval at which the device nodes of running containers are checked")
+)
+
 type plugin struct {
 	stub stub.Stub
+	// policy restricts the devices that can be injected. If nil, all
+	// annotated devices are injected.
+	policy *policy
+	// pods looks up init containers for selectors on the container type. If
+	// nil, such selectors fail.
+	pods *podClient
+
+	mu sync.Mutex
+	// containers are the running containers with annotated devices, by ID.
+	containers map[string]*trackedContainer
 }
 
 func main() {
-	var (
-		opts []stub.Option
-		err  error
-	)
+	var err error
 
-	opts = append(opts, stub.WithPluginName(pluginName))
-	opts = append(opts, stub.WithPluginIdx(pluginIdx))
+	logging.AddFlags(flag.CommandLine)
+	flag.Parse()
+	if err := logging.Setup("nri-device-injector"); err != nil {
+		logging.Fatal("Failed to set up logging", logging.Error, err)
+	}
 
 	p := &plugin{}
+	if *policyFile != "" {
+		if p.policy, err = loadPolicy(*policyFile); err != nil {
+			logging.Fatal("Failed to load device policy", "policy_file", *policyFile, logging.Error, err)
+		}
+		slog.Info("Loaded device policy", "policy_file", *policyFile, "rules", len(p.policy.Rules))
+	} else {
+		slog.Warn("No device policy file set, all annotated devices will be injected")
+	}
+	// The driver may not be installed yet, or at all on nodes without GPUs.
+	if version, err := driver.FromProcfs(procDir); err != nil {
+		slog.Info("No NVIDIA driver loaded", logging.Error, err)
+	} else {
+		slog.Info("Found NVIDIA driver", "driver_version", version.String())
+	}
+	if p.pods, err = newInClusterPodClient(); err != nil {
+		logging.Fatal("Failed to create API server client", logging.Error, err)
+	}
+	// Served on -admin-port and -metrics-port along with the log level endpoint.
+	http.Handle("/metrics", promhttp.Handler())
+	if *metricsPort != 0 {
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), nil); err != nil {
+				logging.Fatal("Metrics server stopped", logging.Error, err)
+			}
+		}()
+	}
 
-	if p.stub, err = stub.New(p, append(opts, stub.WithOnClose(p.onClose))...); err != nil {
-		log.Errorf("Failed to create plugin stub: %v", err)
-		os.Exit(1)
+	ctx := context.Background()
+	go p.runAudits(ctx, *auditInterval)
+	for {
+		if err := p.run(ctx); err != nil {
+			logging.Fatal("Plugin exited with error", logging.Error, err)
+		}
+		slog.Info("Reconnecting to NRI")
 	}
+}
 
-	err = p.stub.Run(context.Background())
+// run connects the plugin to NRI and handles its requests until the connection
+// is closed, e.g. when containerd restarts.
+func (p *plugin) run(ctx context.Context, opts ...stub.Option) error {
+	closed := make(chan struct{})
+	onClose := func() {
+		p.onClose()
+		close(closed)
+	}
+	opts = append(opts, stub.WithPluginName(pluginName), stub.WithPluginIdx(pluginIdx), stub.WithOnClose(onClose))
+	s, err := stub.New(p, opts...)
 	if err != nil {
-		log.Errorf("plugin exited with error %v", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create plugin stub: %w", err)
+	}
+	p.stub = s
+	if err := s.Run(ctx); err != nil {
+		return err
 	}
+	// The stub stops serving before it calls the close handler, which must not
+	// drop the containers synchronized by the next connection.
+	<-closed
+	return nil
 }
 
+// onClose stops auditing the running containers when the NRI connection is
+// closed, as their stop and remove events are missed until the plugin
+// reconnects and synchronizes them again.
 func (p *plugin) onClose() {
-	log.Info("NRI connection closed")
+	slog.Info("NRI connection closed")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.containers = nil
+	p.updateMissingDevicesLocked()
 }
 
 // CreateContainer handles CreateContainer requests relayed to the plugin by containerd NRI.
 // The plugin makes adjustment on containers with device injection annotations.
-// When multiple annotations annotate devices with the same path, only the first one will be injected.
-func (p *plugin) CreateContainer(_ context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+// When multiple annotations annotate devices with the same path, only the first one will be injected,
+// in the order of getInjection.
+// If any annotated device, mount, env var or resource limit is denied by the policy, the container is not created.
+func (p *plugin) CreateContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
 	if pod == nil {
 		return nil, nil, nil
 	}
 
-	var (
-		ctrName = container.Name
-		l       = log.WithFields(log.Fields{"container": ctrName, "pod": pod.Name, "namespace": pod.Namespace})
-
-		devices []device
-		err     error
-	)
-
+	l := slog.With(logging.Container, container.Name, logging.Pod, pod.Name, logging.Namespace, pod.Namespace)
 	defer l.Info("Finished CreateContainer")
 	l.Info("Started CreateContainer")
-	devices, err = getDevices(ctrName, pod.Annotations)
+	adjust, err := p.adjust(ctx, l, pod, container)
 	if err != nil {
-		l.WithError(err).Warn("Failed to get device from pod annotation")
+		injectionFailures.Inc()
 		return nil, nil, err
 	}
+
+	devices := adjust.GetLinux().GetDevices()
+	injections.WithLabelValues("device").Add(float64(len(devices)))
+	injections.WithLabelValues("mount").Add(float64(len(adjust.GetMounts())))
+	injections.WithLabelValues("env").Add(float64(len(adjust.GetEnv())))
+	injections.WithLabelValues("rlimit").Add(float64(len(adjust.GetRlimits())))
+	if len(devices) > 0 {
+		var paths []string
+		for _, d := range devices {
+			paths = append(paths, d.Path)
+		}
+		p.track(container.Id, l, paths, nil)
+	}
+	return adjust, nil, nil
+}
+
+// adjust returns the adjustment that injects what the annotations ask for
+// into the container.
+func (p *plugin) adjust(ctx context.Context, l *slog.Logger, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, error) {
+	inj, err := getInjection(container.Name, pod.Annotations, p.isInitContainer(ctx, pod, container.Name))
+	if err != nil {
+		l.Warn("Failed to get device from pod annotation", logging.Error, err)
+		return nil, err
+	}
 	adjust := &api.ContainerAdjustment{}
 
-	if len(devices) == 0 {
-		l.Debug("No devices annotated...")
-		return adjust, nil, nil
+	if inj.empty() {
+		l.Debug("No devices annotated")
+		return adjust, nil
+	}
+	devices, err := injectionDevices(l, pod, inj)
+	if err != nil {
+		l.Warn("Failed to expand annotated devices", logging.Error, err)
+		return nil, err
+	}
+	s := subject{Namespace: pod.Namespace}
+	if p.policy.needsServiceAccount(pod.Namespace) {
+		if s.ServiceAccount, err = p.serviceAccount(ctx, pod); err != nil {
+			// Rules on service accounts could deny what other rules allow, so
+			// nothing is injected without knowing the service account.
+			policyDecisions.WithLabelValues("service_account", "deny", "").Inc()
+			l.Warn("Failed to get service account of pod, denying injection", logging.Error, err)
+			return nil, fmt.Errorf("injection denied by policy: %w", err)
+		}
 	}
 	for _, d := range devices {
-		l.WithField("device", d.Path).Info("Annotated device")
+		l.Info("Annotated device", logging.DeviceID, d.Path)
 		deviceNRI, err := d.toNRIDevice()
 		if err != nil {
-			l.WithField("device", d.Path).WithError(err).Warn("Failed to get device from path")
-			return nil, nil, err
+			l.Warn("Failed to get device from path", logging.DeviceID, d.Path, logging.Error, err)
+			return nil, err
+		}
+		if err := p.checkPolicy(l, "device", deviceNRI.Path, func(pol *policy) (string, error) { return pol.checkDevice(s, deviceNRI) }); err != nil {
+			return nil, err
 		}
 		adjust.AddDevice(deviceNRI)
-		l.WithField("device", d.Path).Info("Injected device")
+		addDeviceCgroupRule(adjust, deviceNRI)
+		l.Info("Injected device", logging.DeviceID, d.Path)
 	}
-	return adjust, nil, nil
+	for _, m := range inj.Mounts {
+		if err := p.checkPolicy(l, "mount", m.Source, func(pol *policy) (string, error) { return pol.checkMount(s, &m) }); err != nil {
+			return nil, err
+		}
+		adjust.AddMount(m.toNRIMount())
+		l.Info("Injected mount", "source", m.Source, "destination", m.Destination, "read_write", m.ReadWrite)
+	}
+	for _, e := range inj.Env {
+		if err := p.checkPolicy(l, "env", e.Name, func(pol *policy) (string, error) { return pol.checkEnv(s, e.Name) }); err != nil {
+			return nil, err
+		}
+		adjust.AddEnv(e.Name, e.Value)
+		l.Info("Injected env var", "name", e.Name)
+	}
+	for _, r := range inj.Rlimits {
+		if err := p.checkPolicy(l, "rlimit", r.Type, func(pol *policy) (string, error) { return pol.checkRlimit(s, r.Type) }); err != nil {
+			return nil, err
+		}
+		hard, soft := r.limits()
+		adjust.AddRlimit(r.Type, hard, soft)
+		l.Info("Injected resource limit", "type", r.Type, "hard", r.Hard, "soft", r.Soft)
+	}
+	return adjust, nil
 }
 
-// getDevices returns parsed devices from pod annotations of device injections.
-func getDevices(ctrName string, podAnnotations map[string]string) ([]device, error) {
-	var (
-		deviceKey string = ctrDeviceKeyPrefix + ctrName
+// isInitContainer returns a function that looks up whether the container
+// named ctrName is an init container of pod.
+func (p *plugin) isInitContainer(ctx context.Context, pod *api.PodSandbox, ctrName string) func() (bool, error) {
+	return func() (bool, error) {
+		if p.pods == nil {
+			return false, fmt.Errorf("container_type selectors need the plugin to run in a pod")
+		}
+		names, err := p.pods.initContainers(ctx, pod.Namespace, pod.Name)
+		return slices.Contains(names, ctrName), err
+	}
+}
+
+// serviceAccount looks up the service account of pod on the API server.
+func (p *plugin) serviceAccount(ctx context.Context, pod *api.PodSandbox) (string, error) {
+	if p.pods == nil {
+		return "", fmt.Errorf("service_accounts rules need the plugin to run in a pod")
+	}
+	return p.pods.serviceAccount(ctx, pod.Namespace, pod.Name)
+}
+
+// checkPolicy logs and counts whether the policy allows the kind of target to
+// be injected according to check, and returns an error if it does not.
+func (p *plugin) checkPolicy(l *slog.Logger, kind, target string, check func(*policy) (string, error)) error {
+	if p.policy == nil {
+		return nil
+	}
+	rule, err := check(p.policy)
+	if err != nil {
+		policyDecisions.WithLabelValues(kind, "deny", "").Inc()
+		l.Warn("Denied by policy", "kind", kind, "target", target, logging.Error, err)
+		return err
+	}
+	policyDecisions.WithLabelValues(kind, "allow", rule).Inc()
+	l.Info("Allowed by policy", "kind", kind, "target", target, "rule", rule)
+	return nil
+}
 
-		annotation    []byte
-		parsedDevices []device
-		devices       []device
+// getInjection returns what the pod annotations ask to inject into the
+// container, or nil if no annotation applies to it. The annotation for the
+// container comes first, then the selector annotations that match it in the
+// order of their keys, then the annotation for the whole pod. When several
+// devices have the same path, mounts the same destination, env vars the same
+// name or resource limits the same type, only the first one is kept, and so is
+// the first container to share the GPUs of.
+// isInit is only called for selectors on the container type.
+func getInjection(ctrName string, podAnnotations map[string]string, isInit func() (bool, error)) (*injection, error) {
+	var (
+		merged  *injection
+		devices []device
 	)
+	add := func(inj *injection) {
+		if merged == nil {
+			merged = &injection{}
+		}
+		merged.Devices = append(merged.Devices, inj.Devices...)
+		merged.Mounts = append(merged.Mounts, inj.Mounts...)
+		merged.Env = append(merged.Env, inj.Env...)
+		merged.Rlimits = append(merged.Rlimits, inj.Rlimits...)
+		if merged.SameGPUsAs == "" {
+			merged.SameGPUsAs = inj.SameGPUsAs
+		}
+	}
 
-	if value, ok := podAnnotations[deviceKey]; ok {
-		annotation = []byte(value)
+	if value, ok := podAnnotations[ctrDeviceKeyPrefix+ctrName]; ok {
+		inj, err := parseInjection(ctrDeviceKeyPrefix+ctrName, value)
+		if err != nil {
+			return nil, err
+		}
+		add(inj)
+	}
+	var selectorKeys []string
+	for key := range podAnnotations {
+		if strings.HasPrefix(key, selectorDeviceKeyPrefix) {
+			selectorKeys = append(selectorKeys, key)
+		}
 	}
-	if annotation == nil {
+	sort.Strings(selectorKeys)
+	for _, key := range selectorKeys {
+		sel, err := parseSelector(key, podAnnotations[key])
+		if err != nil {
+			return nil, err
+		}
+		matches, err := sel.matches(ctrName, isInit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to match device annotation %q: %w", key, err)
+		}
+		if matches {
+			add(&sel.injection)
+		}
+	}
+	if value, ok := podAnnotations[podDeviceKey]; ok {
+		inj, err := parseInjection(podDeviceKey, value)
+		if err != nil {
+			return nil, err
+		}
+		add(inj)
+	}
+	if merged == nil {
 		return nil, nil
 	}
 
-	if err := yaml.Unmarshal(annotation, &parsedDevices); err != nil {
-		return nil, fmt.Errorf("invalid device annotation %q: %w", deviceKey, err)
-	}
 	paths := make(map[string]bool)
-	for _, d := range parsedDevices {
-		if _, got := paths[d.Path]; got {
+	for _, d := range merged.Devices {
+		key := d.Path
+		if d.Dir != "" {
+			key = "dir:" + d.Dir
+		}
+		if _, got := paths[key]; got {
 			continue
 		} else {
-			paths[d.Path] = true
+			paths[key] = true
 			devices = append(devices, d)
 		}
 	}
-	return devices, nil
+	merged.Devices = devices
+	if err := merged.validate(); err != nil {
+		return nil, fmt.Errorf("invalid device annotation: %w", err)
+	}
+	return merged, nil
+}
+
+// parseInjection parses the device annotation value of key, which is either a
+// list of devices, or a mapping with lists of devices, mounts, env vars and
+// resource limits.
+func parseInjection(key, value string) (*injection, error) {
+	inj := &injection{}
+	js, err := yaml.YAMLToJSON([]byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid device annotation %q: %w", key, err)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(js), []byte("{")) {
+		err = yaml.Unmarshal([]byte(value), inj)
+	} else {
+		err = yaml.Unmarshal([]byte(value), &inj.Devices)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid device annotation %q: %w", key, err)
+	}
+	if err := inj.validateDevices(); err != nil {
+		return nil, fmt.Errorf("invalid device annotation %q: %w", key, err)
+	}
+	return inj, nil
+}
+
+// injectionDevices returns the devices of inj, followed by the GPUs of the
+// container it shares the GPUs of, with globs and directories expanded.
+func injectionDevices(l *slog.Logger, pod *api.PodSandbox, inj *injection) ([]device, error) {
+	devices := inj.Devices
+	if inj.SameGPUsAs != "" {
+		gpus, err := sameGPUs(pod.Namespace, pod.Name, inj.SameGPUsAs)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(slices.Clone(devices), gpus...)
+	}
+	return expandDevices(l, devices)
+}
+
+// expandDevices replaces the globs and directories of devices with the device
+// paths they match on the host. Like in getInjection, only the first device with
+// a given path is kept. Globs and directories that match nothing are skipped.
+func expandDevices(l *slog.Logger, devices []device) ([]device, error) {
+	var (
+		expanded []device
+		paths    = make(map[string]bool)
+	)
+	add := func(d device, path string) {
+		if paths[path] {
+			return
+		}
+		paths[path] = true
+		d.Path, d.Dir = path, ""
+		expanded = append(expanded, d)
+	}
+
+	for _, d := range devices {
+		var (
+			matches []string
+			err     error
+		)
+		switch {
+		case d.Dir != "":
+			matches, err = charDevicesIn(d.Dir)
+		case isGlob(d.Path):
+			matches, err = filepath.Glob(d.Path)
+		default:
+			add(d, d.Path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			l.Warn("Annotated device pattern matched no devices", logging.DeviceID, d.Path+d.Dir)
+		}
+		for _, m := range matches {
+			add(d, m)
+		}
+	}
+	return expanded, nil
+}
+
+// isGlob returns true if path contains any filepath.Match meta characters.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// charDevicesIn returns the paths of the char devices directly under dir, in
+// lexical order. Symlinks are not followed.
+func charDevicesIn(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list devices in %s: %w", dir, err)
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.Type()&os.ModeCharDevice != 0 {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return paths, nil
 }
 
 // toNRIDevice retrieves device's major, minor and type from its path, and returns a NRI device
@@ -159,7 +510,7 @@ func (d *device) toNRIDevice() (*api.LinuxDevice, error) {
 	var (
 		stat unix.Stat_t
 	)
-	if err := unix.Lstat(d.Path, &stat); err != nil {
+	if err := lstat(d.Path, &stat); err != nil {
 		return nil, fmt.Errorf("failed to get info from device path %s: %v", d.Path, err)
 	}
 
@@ -186,14 +537,32 @@ func (d *device) toNRIDevice() (*api.LinuxDevice, error) {
 		Major: int64(major),
 		Minor: int64(minor),
 	}
-	if d.FileMode != 0 {
-		apiDev.FileMode = api.FileMode(d.FileMode)
+	if d.FileMode != nil {
+		apiDev.FileMode = api.FileMode(*d.FileMode)
 	}
-	if d.UID != 0 {
-		apiDev.Uid = api.UInt32(d.UID)
+	apiDev.Uid = api.UInt32(d.UID)
+	apiDev.Gid = api.UInt32(d.GID)
+	return apiDev, nil
+}
+
+// addDeviceCgroupRule allows the container to read, write and mknod dev,
+// instead of relying on the device rules of the runtime. FIFOs are not
+// governed by the device cgroup, so they get no rule.
+func addDeviceCgroupRule(adjust *api.ContainerAdjustment, dev *api.LinuxDevice) {
+	if dev.Type == fifoDevice {
+		return
 	}
-	if d.GID != 0 {
-		apiDev.Gid = api.UInt32(d.GID)
+	if adjust.Linux == nil {
+		adjust.Linux = &api.LinuxContainerAdjustment{}
 	}
-	return apiDev, nil
+	if adjust.Linux.Resources == nil {
+		adjust.Linux.Resources = &api.LinuxResources{}
+	}
+	adjust.Linux.Resources.Devices = append(adjust.Linux.Resources.Devices, &api.LinuxDeviceCgroup{
+		Allow:  true,
+		Type:   dev.Type,
+		Major:  api.Int64(dev.Major),
+		Minor:  api.Int64(dev.Minor),
+		Access: "rwm",
+	})
 }
@@ -15,9 +15,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/containerd/nri/pkg/api"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/sys/unix"
 )
@@ -92,6 +98,116 @@ func TestToNRIDevice(t *testing.T) {
 	}
 }
 
+func uint32Ptr(v uint32) *uint32 {
+	return &v
+}
+
+// fakeLstat makes lstat return the given mode and device number for every
+// path in nodes, and ENOENT for other paths, until the test ends.
+func fakeLstat(t *testing.T, nodes map[string]unix.Stat_t) {
+	t.Helper()
+	orig := lstat
+	t.Cleanup(func() { lstat = orig })
+	lstat = func(path string, stat *unix.Stat_t) error {
+		s, ok := nodes[path]
+		if !ok {
+			return unix.ENOENT
+		}
+		*stat = s
+		return nil
+	}
+}
+
+func TestToNRIDeviceOwnership(t *testing.T) {
+	fakeLstat(t, map[string]unix.Stat_t{
+		"/dev/nvidia0": {Mode: unix.S_IFCHR | 0666, Rdev: unix.Mkdev(195, 0)},
+		"/dev/sda":     {Mode: unix.S_IFBLK | 0660, Rdev: unix.Mkdev(8, 0)},
+		"/dev/pipe":    {Mode: unix.S_IFIFO | 0600},
+		"/dev/dir":     {Mode: unix.S_IFDIR | 0755},
+	})
+
+	tests := map[string]struct {
+		device  device
+		want    *api.LinuxDevice
+		wantErr bool
+	}{
+		"Ownership and mode not annotated": {
+			device: device{Path: "/dev/nvidia0"},
+			want:   &api.LinuxDevice{Path: "/dev/nvidia0", Type: charDevice, Major: 195, Minor: 0},
+		},
+		"Root ownership and mode 0": {
+			device: device{Path: "/dev/nvidia0", FileMode: uint32Ptr(0), UID: uint32Ptr(0), GID: uint32Ptr(0)},
+			want: &api.LinuxDevice{
+				Path: "/dev/nvidia0", Type: charDevice, Major: 195, Minor: 0,
+				FileMode: api.FileMode(uint32(0)), Uid: api.UInt32(uint32(0)), Gid: api.UInt32(uint32(0)),
+			},
+		},
+		"Annotated ownership and mode": {
+			device: device{Path: "/dev/sda", FileMode: uint32Ptr(0640), UID: uint32Ptr(1000), GID: uint32Ptr(6)},
+			want: &api.LinuxDevice{
+				Path: "/dev/sda", Type: blockDevice, Major: 8, Minor: 0,
+				FileMode: api.FileMode(uint32(0640)), Uid: api.UInt32(uint32(1000)), Gid: api.UInt32(uint32(6)),
+			},
+		},
+		"FIFO": {
+			device: device{Path: "/dev/pipe"},
+			want:   &api.LinuxDevice{Path: "/dev/pipe", Type: fifoDevice},
+		},
+		"Not a device": {
+			device:  device{Path: "/dev/dir"},
+			wantErr: true,
+		},
+		"Missing device": {
+			device:  device{Path: "/dev/missing"},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.device.toNRIDevice()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestCreateContainerDeviceCgroupRules(t *testing.T) {
+	fakeLstat(t, map[string]unix.Stat_t{
+		"/dev/nvidia0":   {Mode: unix.S_IFCHR | 0666, Rdev: unix.Mkdev(195, 0)},
+		"/dev/nvidiactl": {Mode: unix.S_IFCHR | 0666, Rdev: unix.Mkdev(195, 255)},
+		"/dev/sda":       {Mode: unix.S_IFBLK | 0660, Rdev: unix.Mkdev(8, 0)},
+		"/dev/pipe":      {Mode: unix.S_IFIFO | 0600},
+	})
+	pod := &api.PodSandbox{
+		Name:      "pod",
+		Namespace: "default",
+		Annotations: map[string]string{ctrDeviceKeyPrefix + "test": `
+- path: /dev/nvidia0
+  uid: 0
+  gid: 0
+- path: /dev/nvidiactl
+- path: /dev/sda
+- path: /dev/pipe
+`},
+	}
+
+	adjust, _, err := (&plugin{}).CreateContainer(context.Background(), pod, &api.Container{Id: "ctr", Name: "test"})
+	assert.NoError(t, err)
+	devices := adjust.GetLinux().GetDevices()
+	assert.Len(t, devices, 4)
+	assert.Equal(t, api.UInt32(uint32(0)), devices[0].Uid)
+	assert.Nil(t, devices[1].Uid)
+	assert.Equal(t, []*api.LinuxDeviceCgroup{
+		{Allow: true, Type: charDevice, Major: api.Int64(int64(195)), Minor: api.Int64(int64(0)), Access: "rwm"},
+		{Allow: true, Type: charDevice, Major: api.Int64(int64(195)), Minor: api.Int64(int64(255)), Access: "rwm"},
+		{Allow: true, Type: blockDevice, Major: api.Int64(int64(8)), Minor: api.Int64(int64(0)), Access: "rwm"},
+	}, adjust.GetLinux().GetResources().GetDevices())
+}
+
 func TestGetDevices(t *testing.T) {
 	tests := map[string]struct {
 		container   string
@@ -155,6 +271,37 @@ func TestGetDevices(t *testing.T) {
 				Path: "/dev/test0",
 			}},
 		},
+		"Glob and directory device annotations": {
+			container: "test",
+			annotations: map[string]string{
+				"devices.gke.io/container.test": `
+- path: /dev/nvidia[0-9]*
+- dir: /dev/infiniband
+- dir: /dev/infiniband
+- dir: /dev/nvidia-caps
+`}, want: []device{{
+				Path: "/dev/nvidia[0-9]*",
+			}, {
+				Dir: "/dev/infiniband",
+			}, {
+				Dir: "/dev/nvidia-caps",
+			}},
+		},
+		"Device annotation with both path and dir": {
+			container: "test",
+			annotations: map[string]string{
+				"devices.gke.io/container.test": `
+- path: /dev/nvidia0
+  dir: /dev/infiniband
+`}, wantErr: true,
+		},
+		"Device annotation without path or dir": {
+			container: "test",
+			annotations: map[string]string{
+				"devices.gke.io/container.test": `
+- major: 195
+`}, wantErr: true,
+		},
 		"Invalid device annotation": {
 			container: "test",
 			annotations: map[string]string{
@@ -176,15 +323,361 @@ path: /dev/test1
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			devices, err := getDevices(tc.container, tc.annotations)
+			inj, err := getInjection(tc.container, tc.annotations, nil)
 			if (err != nil) != tc.wantErr {
-				t.Errorf("getDevices() error = %v, wantErr %v", err, tc.wantErr)
+				t.Errorf("getInjection() error = %v, wantErr %v", err, tc.wantErr)
 				return
 			}
 			if !tc.wantErr {
 				assert.NoError(t, err)
+				var devices []device
+				if inj != nil {
+					devices = inj.Devices
+				}
 				assert.EqualValues(t, tc.want, devices)
 			}
 		})
 	}
 }
+
+func TestGetInjection(t *testing.T) {
+	tests := map[string]struct {
+		annotation string
+		want       *injection
+		wantErr    bool
+	}{
+		"Devices, mounts, env vars and resource limits": {
+			annotation: `
+devices:
+- path: /dev/nvidia0
+mounts:
+- source: /home/kubernetes/bin/nvidia/lib64
+  destination: /usr/local/nvidia/lib64
+- source: /var/lib/tcpx
+  destination: /usr/local/tcpx
+  read_write: true
+env:
+- name: NCCL_DEBUG
+  value: INFO
+- name: LD_LIBRARY_PATH
+  value: /usr/local/nvidia/lib64
+rlimits:
+- type: memlock
+  hard: -1
+  soft: -1
+- type: RLIMIT_NOFILE
+  hard: 1048576
+  soft: 65536
+`,
+			want: &injection{
+				Devices: []device{{Path: "/dev/nvidia0"}},
+				Mounts: []mount{
+					{Source: "/home/kubernetes/bin/nvidia/lib64", Destination: "/usr/local/nvidia/lib64"},
+					{Source: "/var/lib/tcpx", Destination: "/usr/local/tcpx", ReadWrite: true},
+				},
+				Env: []envVar{
+					{Name: "NCCL_DEBUG", Value: "INFO"},
+					{Name: "LD_LIBRARY_PATH", Value: "/usr/local/nvidia/lib64"},
+				},
+				Rlimits: []rlimit{
+					{Type: "RLIMIT_MEMLOCK", Hard: -1, Soft: -1},
+					{Type: "RLIMIT_NOFILE", Hard: 1048576, Soft: 65536},
+				},
+			},
+		},
+		"Only the first of each is kept": {
+			annotation: `
+mounts:
+- {source: /var/lib/tcpx, destination: /usr/local/tcpx}
+- {source: /var/lib/tcpxo, destination: /usr/local/tcpx}
+env:
+- {name: NCCL_DEBUG, value: INFO}
+- {name: NCCL_DEBUG, value: WARN}
+rlimits:
+- {type: memlock, hard: -1, soft: -1}
+- {type: RLIMIT_MEMLOCK, hard: 0, soft: 0}
+`,
+			want: &injection{
+				Mounts:  []mount{{Source: "/var/lib/tcpx", Destination: "/usr/local/tcpx"}},
+				Env:     []envVar{{Name: "NCCL_DEBUG", Value: "INFO"}},
+				Rlimits: []rlimit{{Type: "RLIMIT_MEMLOCK", Hard: -1, Soft: -1}},
+			},
+		},
+		"Relative mount source": {
+			annotation: `mounts: [{source: lib64, destination: /usr/local/nvidia/lib64}]`,
+			wantErr:    true,
+		},
+		"Unclean mount destination": {
+			annotation: `mounts: [{source: /var/lib/tcpx, destination: /usr/local/../../etc}]`,
+			wantErr:    true,
+		},
+		"Invalid env var name": {
+			annotation: `env: [{name: "A=B", value: C}]`,
+			wantErr:    true,
+		},
+		"Invalid resource limit type": {
+			annotation: `rlimits: [{type: memory, hard: 1, soft: 1}]`,
+			wantErr:    true,
+		},
+		"Soft resource limit above hard limit": {
+			annotation: `rlimits: [{type: memlock, hard: 1024, soft: -1}]`,
+			wantErr:    true,
+		},
+		"Invalid resource limit": {
+			annotation: `rlimits: [{type: memlock, hard: -2, soft: -2}]`,
+			wantErr:    true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			inj, err := getInjection("test", map[string]string{"devices.gke.io/container.test": tc.annotation}, nil)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, inj)
+		})
+	}
+}
+
+func TestGetInjectionMerge(t *testing.T) {
+	annotations := map[string]string{
+		"devices.gke.io/pod": `
+devices:
+- path: /dev/nvidia0
+  uid: 3
+- path: /dev/nvidiactl
+env:
+- {name: NCCL_DEBUG, value: pod}
+`,
+		"devices.gke.io/container.main": `
+- path: /dev/nvidia0
+  uid: 1
+`,
+		"devices.gke.io/selector.b-workers": `
+container_name: ^worker-[0-9]+$
+devices:
+- path: /dev/nvidia1
+env:
+- {name: NCCL_DEBUG, value: workers}
+`,
+		"devices.gke.io/selector.a-init": `
+container_type: init
+devices:
+- path: /dev/nvidia0
+  uid: 2
+`,
+		"devices.gke.io/selector.c-regular": `
+container_name: ^worker-
+container_type: regular
+env:
+- {name: NCCL_DEBUG, value: regular}
+- {name: NCCL_SOCKET_IFNAME, value: eth0}
+`,
+	}
+
+	tests := map[string]struct {
+		container string
+		isInit    bool
+		want      *injection
+	}{
+		"Container key comes before selectors and pod key": {
+			container: "main",
+			want: &injection{
+				Devices: []device{{Path: "/dev/nvidia0", UID: uint32Ptr(1)}, {Path: "/dev/nvidiactl"}},
+				Env:     []envVar{{Name: "NCCL_DEBUG", Value: "pod"}},
+			},
+		},
+		"Init container selector": {
+			container: "setup",
+			isInit:    true,
+			want: &injection{
+				Devices: []device{{Path: "/dev/nvidia0", UID: uint32Ptr(2)}, {Path: "/dev/nvidiactl"}},
+				Env:     []envVar{{Name: "NCCL_DEBUG", Value: "pod"}},
+			},
+		},
+		"Selectors in key order before pod key": {
+			container: "worker-12",
+			want: &injection{
+				Devices: []device{{Path: "/dev/nvidia1"}, {Path: "/dev/nvidia0", UID: uint32Ptr(3)}, {Path: "/dev/nvidiactl"}},
+				Env:     []envVar{{Name: "NCCL_DEBUG", Value: "workers"}, {Name: "NCCL_SOCKET_IFNAME", Value: "eth0"}},
+			},
+		},
+		"Regular container selector after a name regex not matching": {
+			container: "worker-sidecar",
+			want: &injection{
+				Devices: []device{{Path: "/dev/nvidia0", UID: uint32Ptr(3)}, {Path: "/dev/nvidiactl"}},
+				Env:     []envVar{{Name: "NCCL_DEBUG", Value: "regular"}, {Name: "NCCL_SOCKET_IFNAME", Value: "eth0"}},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			inj, err := getInjection(tc.container, annotations, func() (bool, error) { return tc.isInit, nil })
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, inj)
+		})
+	}
+}
+
+func TestGetInjectionSelectors(t *testing.T) {
+	tests := map[string]struct {
+		annotation string
+		isInit     func() (bool, error)
+		wantNil    bool
+		wantErr    bool
+	}{
+		"Selector without container type does not look up the pod": {
+			annotation: "{container_name: ^test$, devices: [{path: /dev/nvidia0}]}",
+		},
+		"Selector not matching": {
+			annotation: "{container_name: ^worker, devices: [{path: /dev/nvidia0}]}",
+			wantNil:    true,
+		},
+		"Failed container type lookup": {
+			annotation: "{container_type: init, devices: [{path: /dev/nvidia0}]}",
+			isInit:     func() (bool, error) { return false, errors.New("forbidden") },
+			wantErr:    true,
+		},
+		"Invalid container type": {
+			annotation: "{container_type: sidecar, devices: [{path: /dev/nvidia0}]}",
+			wantErr:    true,
+		},
+		"Invalid container name regex": {
+			annotation: "{container_name: \"worker-(\", devices: [{path: /dev/nvidia0}]}",
+			wantErr:    true,
+		},
+		"Device without path": {
+			annotation: "{devices: [{major: 195}]}",
+			wantErr:    true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			inj, err := getInjection("test", map[string]string{"devices.gke.io/selector.gpus": tc.annotation}, tc.isInit)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantNil, inj == nil)
+		})
+	}
+}
+
+// makeDevTree creates the given files and directories under a temporary
+// directory, and returns its path.
+func makeDevTree(t *testing.T, files ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to make directory for %s: %v", path, err)
+		}
+		if strings.HasSuffix(f, "/") {
+			continue
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", path, err)
+		}
+	}
+	return root
+}
+
+func TestExpandDevices(t *testing.T) {
+	root := makeDevTree(t,
+		"nvidia0", "nvidia1", "nvidia10", "nvidiactl", "nvidia-uvm",
+		"infiniband/uverbs0", "infiniband/uverbs1", "infiniband/rdma_cm",
+		"empty/",
+	)
+
+	tests := map[string]struct {
+		devices []device
+		want    []device
+	}{
+		"Plain paths are kept": {
+			devices: []device{{Path: root + "/nvidia0"}, {Path: root + "/missing"}},
+			want:    []device{{Path: root + "/nvidia0"}, {Path: root + "/missing"}},
+		},
+		"GPU glob": {
+			devices: []device{{Path: root + "/nvidia[0-9]*", FileMode: uint32Ptr(0666)}},
+			want: []device{
+				{Path: root + "/nvidia0", FileMode: uint32Ptr(0666)},
+				{Path: root + "/nvidia1", FileMode: uint32Ptr(0666)},
+				{Path: root + "/nvidia10", FileMode: uint32Ptr(0666)},
+			},
+		},
+		"Directory glob": {
+			devices: []device{{Path: root + "/infiniband/*"}},
+			want: []device{
+				{Path: root + "/infiniband/rdma_cm"},
+				{Path: root + "/infiniband/uverbs0"},
+				{Path: root + "/infiniband/uverbs1"},
+			},
+		},
+		"Expanded paths are de-duplicated": {
+			devices: []device{
+				{Path: root + "/nvidia1", UID: uint32Ptr(1000)},
+				{Path: root + "/nvidia[01]"},
+				{Path: root + "/nvidia*"},
+			},
+			want: []device{
+				{Path: root + "/nvidia1", UID: uint32Ptr(1000)},
+				{Path: root + "/nvidia0"},
+				{Path: root + "/nvidia-uvm"},
+				{Path: root + "/nvidia10"},
+				{Path: root + "/nvidiactl"},
+			},
+		},
+		"Glob matching nothing": {
+			devices: []device{{Path: root + "/infiniband/umad*"}, {Path: root + "/nvidiactl"}},
+			want:    []device{{Path: root + "/nvidiactl"}},
+		},
+		"Directory without char devices": {
+			devices: []device{{Dir: root + "/infiniband"}, {Dir: root + "/empty"}, {Dir: root + "/missing"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := expandDevices(slog.Default(), tc.devices)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestExpandDevicesDir(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping TestExpandDevicesDir as it requires root privileges.")
+	}
+	root := makeDevTree(t, "infiniband/README", "infiniband/by-path/")
+	dir := filepath.Join(root, "infiniband")
+	for name, mode := range map[string]uint32{
+		"uverbs0": unix.S_IFCHR,
+		"uverbs1": unix.S_IFCHR,
+		"rdma_cm": unix.S_IFCHR,
+		"disk":    unix.S_IFBLK,
+		"fifo":    unix.S_IFIFO,
+	} {
+		if err := unix.Mknod(filepath.Join(dir, name), mode|0644, int(unix.Mkdev(231, 0))); err != nil {
+			t.Fatalf("failed to mknod %s: %v", name, err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "uverbs0"), filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	got, err := expandDevices(slog.Default(), []device{{Dir: dir, FileMode: uint32Ptr(0666)}, {Path: dir + "/uverbs0"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []device{
+		{Path: dir + "/rdma_cm", FileMode: uint32Ptr(0666)},
+		{Path: dir + "/uverbs0", FileMode: uint32Ptr(0666)},
+		{Path: dir + "/uverbs1", FileMode: uint32Ptr(0666)},
+	}, got)
+}
@@ -0,0 +1,132 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// podRequestTimeout bounds the API server requests made while NRI waits for
+// CreateContainer to return.
+const podRequestTimeout = 2 * time.Second
+
+// podClient gets pods from the API server. NRI tells neither init containers
+// apart from regular ones nor the service account of pods, so selectors on the
+// container type and policy rules on service accounts look them up in the pod
+// spec.
+type podClient struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+// newInClusterPodClient returns a podClient that uses the service account of
+// the plugin, or nil if the plugin does not run in a pod.
+func newInClusterPodClient() (*podClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, nil
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountMountPath, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API server CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in API server CA")
+	}
+	return &podClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccountMountPath, "token"),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   podRequestTimeout,
+		},
+	}, nil
+}
+
+// podSpec is the part of the pod spec the plugin looks up.
+type podSpec struct {
+	ServiceAccountName string `json:"serviceAccountName"`
+	InitContainers     []struct {
+		Name string `json:"name"`
+	} `json:"initContainers"`
+}
+
+// initContainers returns the names of the init containers of the pod.
+func (c *podClient) initContainers(ctx context.Context, namespace, name string) ([]string, error) {
+	spec, err := c.spec(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, c := range spec.InitContainers {
+		names = append(names, c.Name)
+	}
+	return names, nil
+}
+
+// serviceAccount returns the name of the service account of the pod.
+func (c *podClient) serviceAccount(ctx context.Context, namespace, name string) (string, error) {
+	spec, err := c.spec(ctx, namespace, name)
+	if err != nil {
+		return "", err
+	}
+	if spec.ServiceAccountName == "" {
+		return "", fmt.Errorf("pod %s/%s has no service account", namespace, name)
+	}
+	return spec.ServiceAccountName, nil
+}
+
+// spec gets the spec of the pod from the API server.
+func (c *podClient) spec(ctx context.Context, namespace, name string) (*podSpec, error) {
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", c.server, url.PathEscape(namespace), url.PathEscape(name)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %w", namespace, name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %s", namespace, name, resp.Status)
+	}
+
+	var pod struct {
+		Spec podSpec `json:"spec"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pod); err != nil {
+		return nil, fmt.Errorf("invalid pod %s/%s: %w", namespace, name, err)
+	}
+	return &pod.Spec, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPodSpec(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/default/pods/trainer":
+			w.Write([]byte(`{"spec":{"serviceAccountName":"trainer","initContainers":[{"name":"setup"},{"name":"tcpx-daemon"}],"containers":[{"name":"main"}]}}`))
+		case "/api/v1/namespaces/default/pods/no-sa":
+			w.Write([]byte(`{"spec":{}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token\n"), 0600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+	c := &podClient{server: ts.URL, tokenFile: tokenFile, client: ts.Client()}
+
+	names, err := c.initContainers(context.Background(), "default", "trainer")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"setup", "tcpx-daemon"}, names)
+
+	_, err = c.initContainers(context.Background(), "default", "missing")
+	assert.ErrorContains(t, err, "404")
+
+	sa, err := c.serviceAccount(context.Background(), "default", "trainer")
+	assert.NoError(t, err)
+	assert.Equal(t, "trainer", sa)
+
+	_, err = c.serviceAccount(context.Background(), "default", "no-sa")
+	assert.ErrorContains(t, err, "no service account")
+}
+
+func TestNewInClusterPodClient(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	c, err := newInClusterPodClient()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+}
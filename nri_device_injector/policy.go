@@ -0,0 +1,249 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/yaml"
+)
+
+// Mount point of the service account token in containers.
+const serviceAccountMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// policyDecisions counts the devices, mounts, env vars and resource limits
+// allowed or denied by the policy, by the name of the rule that allowed them.
+var policyDecisions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "nri_device_injector_policy_decisions_total",
+		Help: "Number of annotated devices, mounts, env vars and resource limits allowed or denied by the policy.",
+	},
+	[]string{"kind", "decision", "rule"},
+)
+
+func init() {
+	prometheus.MustRegister(policyDecisions)
+}
+
+// policy is the allow-list of devices, mounts, env vars and resource limits
+// that pods may have injected. Each of them is injected only if at least one
+// rule matches both it and the pod.
+type policy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// policyRule allows the devices that match all of its non-empty device fields,
+// the mounts, env vars and resource limits that match its other fields, to the
+// pods that match its namespaces and service accounts.
+type policyRule struct {
+	Name string `json:"name"`
+	// Paths are filepath.Match globs of the allowed device paths, e.g.
+	// /dev/nvidia*. A * does not match across a /.
+	Paths []string `json:"paths"`
+	// Types are the allowed device types: b, c or p.
+	Types []string `json:"types"`
+	// Majors are the allowed device major numbers.
+	Majors []int64 `json:"majors"`
+	// MountSources are filepath.Match globs of the host paths that can be
+	// mounted.
+	MountSources []string `json:"mount_sources"`
+	// Env are filepath.Match globs of the names of the allowed env vars, e.g.
+	// NCCL_*.
+	Env []string `json:"env"`
+	// Rlimits are the types of the resource limits that can be set, e.g.
+	// memlock.
+	Rlimits []string `json:"rlimits"`
+	// Namespaces are the namespaces of the pods the rule applies to.
+	Namespaces []string `json:"namespaces"`
+	// ServiceAccounts are the names of the service accounts of the pods the
+	// rule applies to. The service account is looked up in the pod spec on the
+	// API server, as anything mounted into the container can be forged.
+	ServiceAccounts []string `json:"service_accounts"`
+}
+
+// subject identifies the pod a device is injected for.
+type subject struct {
+	Namespace      string
+	ServiceAccount string
+}
+
+// loadPolicy reads and validates the policy file at path.
+func loadPolicy(path string) (*policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device policy: %w", err)
+	}
+	return parsePolicy(data)
+}
+
+// parsePolicy parses and validates a YAML or JSON device policy.
+func parsePolicy(data []byte) (*policy, error) {
+	p := &policy{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("invalid device policy: %w", err)
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if len(r.Paths)+len(r.MountSources)+len(r.Env)+len(r.Rlimits) == 0 {
+			return nil, fmt.Errorf("invalid device policy rule %q: no paths, mount sources, env or rlimits", r.Name)
+		}
+		paths := append(slices.Clone(r.Paths), r.MountSources...)
+		for _, glob := range paths {
+			if !filepath.IsAbs(glob) {
+				return nil, fmt.Errorf("invalid device policy rule %q: path %q is not absolute", r.Name, glob)
+			}
+		}
+		for _, glob := range append(paths, r.Env...) {
+			if _, err := filepath.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid device policy rule %q: pattern %q: %w", r.Name, glob, err)
+			}
+		}
+		for j, t := range r.Rlimits {
+			typ, err := rlimitType(t)
+			if err != nil {
+				return nil, fmt.Errorf("invalid device policy rule %q: %w", r.Name, err)
+			}
+			r.Rlimits[j] = typ
+		}
+		for _, t := range r.Types {
+			if t != blockDevice && t != charDevice && t != fifoDevice {
+				return nil, fmt.Errorf("invalid device policy rule %q: type %q is not one of %s, %s or %s", r.Name, t, blockDevice, charDevice, fifoDevice)
+			}
+		}
+	}
+	return p, nil
+}
+
+// needsServiceAccount returns true if any rule selects the pods of namespace
+// by service account.
+func (p *policy) needsServiceAccount(namespace string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Rules {
+		if len(r.ServiceAccounts) > 0 && (len(r.Namespaces) == 0 || slices.Contains(r.Namespaces, namespace)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDevice returns the name of the first rule that allows dev to be
+// injected for s, or an error if none does. A nil policy allows all devices.
+func (p *policy) checkDevice(s subject, dev *api.LinuxDevice) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	if filepath.Clean(dev.Path) != dev.Path || !filepath.IsAbs(dev.Path) {
+		return "", fmt.Errorf("device %s denied by policy: path must be absolute and clean", dev.Path)
+	}
+	if rule, ok := p.find(s, func(r *policyRule) bool { return r.matchesDevice(dev) }); ok {
+		return rule, nil
+	}
+	return "", fmt.Errorf("device %s (type %s, major %d) denied by policy: %s", dev.Path, dev.Type, dev.Major, s.noRule())
+}
+
+// checkMount returns the name of the first rule that allows m to be mounted
+// for s, or an error if none does.
+func (p *policy) checkMount(s subject, m *mount) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	if rule, ok := p.find(s, func(r *policyRule) bool { return matchesAny(r.MountSources, m.Source) }); ok {
+		return rule, nil
+	}
+	return "", fmt.Errorf("mount of %s denied by policy: %s", m.Source, s.noRule())
+}
+
+// checkEnv returns the name of the first rule that allows the env var name to
+// be set for s, or an error if none does.
+func (p *policy) checkEnv(s subject, name string) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	if rule, ok := p.find(s, func(r *policyRule) bool { return matchesAny(r.Env, name) }); ok {
+		return rule, nil
+	}
+	return "", fmt.Errorf("env var %s denied by policy: %s", name, s.noRule())
+}
+
+// checkRlimit returns the name of the first rule that allows the resource
+// limit of type typ to be set for s, or an error if none does.
+func (p *policy) checkRlimit(s subject, typ string) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	if rule, ok := p.find(s, func(r *policyRule) bool { return slices.Contains(r.Rlimits, typ) }); ok {
+		return rule, nil
+	}
+	return "", fmt.Errorf("resource limit %s denied by policy: %s", typ, s.noRule())
+}
+
+// find returns the name of the first rule that selects s and matches.
+func (p *policy) find(s subject, matches func(*policyRule) bool) (string, bool) {
+	for i := range p.Rules {
+		if r := &p.Rules[i]; r.selects(s) && matches(r) {
+			return r.Name, true
+		}
+	}
+	return "", false
+}
+
+// noRule describes why nothing was allowed for s.
+func (s subject) noRule() string {
+	sa := s.ServiceAccount
+	if sa == "" {
+		sa = "<unknown>"
+	}
+	return fmt.Sprintf("no rule allows it for namespace %q and service account %q", s.Namespace, sa)
+}
+
+func (r *policyRule) selects(s subject) bool {
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, s.Namespace) {
+		return false
+	}
+	if len(r.ServiceAccounts) > 0 && (s.ServiceAccount == "" || !slices.Contains(r.ServiceAccounts, s.ServiceAccount)) {
+		return false
+	}
+	return true
+}
+
+func (r *policyRule) matchesDevice(dev *api.LinuxDevice) bool {
+	if len(r.Types) > 0 && !slices.Contains(r.Types, dev.Type) {
+		return false
+	}
+	if len(r.Majors) > 0 && !slices.Contains(r.Majors, dev.Major) {
+		return false
+	}
+	return matchesAny(r.Paths, dev.Path)
+}
+
+// matchesAny returns true if name matches any of the filepath.Match globs.
+func matchesAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,504 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/yaml"
+)
+
+const testPolicy = `
+rules:
+- name: gpudirect
+  mount_sources: ["/home/kubernetes/bin/nvidia/*", "/var/lib/tcpx"]
+  env: ["NCCL_*", "LD_LIBRARY_PATH"]
+  rlimits: [memlock]
+- name: gpus
+  paths: ["/dev/nvidia[0-9]*", "/dev/nvidiactl", "/dev/nvidia-caps/*"]
+  types: [c]
+- name: tools
+  paths: ["/dev/null"]
+  majors: [1]
+  namespaces: [tools]
+  service_accounts: [debugger]
+`
+
+func TestParsePolicy(t *testing.T) {
+	tests := map[string]struct {
+		policy    string
+		wantRules []string
+		wantErr   bool
+	}{
+		"valid policy": {
+			policy:    testPolicy,
+			wantRules: []string{"gpudirect", "gpus", "tools"},
+		},
+		"unnamed rule": {
+			policy:    `rules: [{paths: ["/dev/nvidia0"]}]`,
+			wantRules: []string{"rule-0"},
+		},
+		"no rules": {
+			policy: "rules: []",
+		},
+		"no paths": {
+			policy:  `rules: [{name: gpus, types: [c]}]`,
+			wantErr: true,
+		},
+		"relative path": {
+			policy:  `rules: [{name: gpus, paths: ["nvidia0"]}]`,
+			wantErr: true,
+		},
+		"invalid glob": {
+			policy:  `rules: [{name: gpus, paths: ["/dev/nvidia["]}]`,
+			wantErr: true,
+		},
+		"mount sources, env and rlimits only": {
+			policy:    `rules: [{name: nccl, mount_sources: ["/var/lib/tcpx"], env: ["NCCL_*"], rlimits: [RLIMIT_MEMLOCK]}]`,
+			wantRules: []string{"nccl"},
+		},
+		"relative mount source": {
+			policy:  `rules: [{name: nccl, mount_sources: ["lib64"]}]`,
+			wantErr: true,
+		},
+		"invalid env glob": {
+			policy:  `rules: [{name: nccl, env: ["NCCL_["]}]`,
+			wantErr: true,
+		},
+		"invalid rlimit": {
+			policy:  `rules: [{name: nccl, rlimits: [memory]}]`,
+			wantErr: true,
+		},
+		"invalid type": {
+			policy:  `rules: [{name: gpus, paths: ["/dev/nvidia0"], types: [x]}]`,
+			wantErr: true,
+		},
+		"unknown field": {
+			policy:  `rules: [{name: gpus, path: ["/dev/nvidia0"]}]`,
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := parsePolicy([]byte(tc.policy))
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			var rules []string
+			for _, r := range p.Rules {
+				rules = append(rules, r.Name)
+			}
+			assert.Equal(t, tc.wantRules, rules)
+		})
+	}
+}
+
+func TestPolicyCheckDevice(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("failed to parse test policy: %v", err)
+	}
+
+	tests := map[string]struct {
+		policy   *policy
+		subject  subject
+		device   *api.LinuxDevice
+		wantRule string
+		wantErr  bool
+	}{
+		"no policy": {
+			subject: subject{Namespace: "default"},
+			device:  &api.LinuxDevice{Path: "/dev/sda", Type: blockDevice, Major: 8},
+		},
+		"gpu allowed": {
+			policy:   p,
+			subject:  subject{Namespace: "default"},
+			device:   &api.LinuxDevice{Path: "/dev/nvidia0", Type: charDevice, Major: 195},
+			wantRule: "gpus",
+		},
+		"mig capability allowed": {
+			policy:   p,
+			subject:  subject{Namespace: "default"},
+			device:   &api.LinuxDevice{Path: "/dev/nvidia-caps/nvidia-cap21", Type: charDevice, Major: 237},
+			wantRule: "gpus",
+		},
+		"block device denied": {
+			policy:  p,
+			subject: subject{Namespace: "default"},
+			device:  &api.LinuxDevice{Path: "/dev/sda", Type: blockDevice, Major: 8},
+			wantErr: true,
+		},
+		"wrong type denied": {
+			policy:  p,
+			subject: subject{Namespace: "default"},
+			device:  &api.LinuxDevice{Path: "/dev/nvidia0", Type: blockDevice, Major: 195},
+			wantErr: true,
+		},
+		"glob does not match across directories": {
+			policy:  p,
+			subject: subject{Namespace: "default"},
+			device:  &api.LinuxDevice{Path: "/dev/nvidia-caps/sub/nvidia-cap1", Type: charDevice, Major: 237},
+			wantErr: true,
+		},
+		"unclean path denied": {
+			policy:  p,
+			subject: subject{Namespace: "default"},
+			device:  &api.LinuxDevice{Path: "/dev/nvidia0/../mem", Type: charDevice, Major: 1},
+			wantErr: true,
+		},
+		"namespace and service account allowed": {
+			policy:   p,
+			subject:  subject{Namespace: "tools", ServiceAccount: "debugger"},
+			device:   &api.LinuxDevice{Path: "/dev/null", Type: charDevice, Major: 1},
+			wantRule: "tools",
+		},
+		"wrong namespace denied": {
+			policy:  p,
+			subject: subject{Namespace: "default", ServiceAccount: "debugger"},
+			device:  &api.LinuxDevice{Path: "/dev/null", Type: charDevice, Major: 1},
+			wantErr: true,
+		},
+		"unknown service account denied": {
+			policy:  p,
+			subject: subject{Namespace: "tools"},
+			device:  &api.LinuxDevice{Path: "/dev/null", Type: charDevice, Major: 1},
+			wantErr: true,
+		},
+		"wrong major denied": {
+			policy:  p,
+			subject: subject{Namespace: "tools", ServiceAccount: "debugger"},
+			device:  &api.LinuxDevice{Path: "/dev/null", Type: charDevice, Major: 2},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rule, err := tc.policy.checkDevice(tc.subject, tc.device)
+			if tc.wantErr {
+				assert.ErrorContains(t, err, "denied by policy")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantRule, rule)
+		})
+	}
+}
+
+func TestPolicyCheckOthers(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("failed to parse test policy: %v", err)
+	}
+	s := subject{Namespace: "default"}
+
+	tests := map[string]struct {
+		check    func(*policy) (string, error)
+		wantRule string
+		wantErr  bool
+	}{
+		"mount allowed": {
+			check: func(p *policy) (string, error) {
+				return p.checkMount(s, &mount{Source: "/home/kubernetes/bin/nvidia/lib64"})
+			},
+			wantRule: "gpudirect",
+		},
+		"mount denied": {
+			check:   func(p *policy) (string, error) { return p.checkMount(s, &mount{Source: "/etc"}) },
+			wantErr: true,
+		},
+		"mount glob does not match across directories": {
+			check: func(p *policy) (string, error) {
+				return p.checkMount(s, &mount{Source: "/home/kubernetes/bin/nvidia/lib64/sub"})
+			},
+			wantErr: true,
+		},
+		"env var allowed": {
+			check:    func(p *policy) (string, error) { return p.checkEnv(s, "NCCL_DEBUG") },
+			wantRule: "gpudirect",
+		},
+		"env var denied": {
+			check:   func(p *policy) (string, error) { return p.checkEnv(s, "LD_PRELOAD") },
+			wantErr: true,
+		},
+		"rlimit allowed": {
+			check:    func(p *policy) (string, error) { return p.checkRlimit(s, "RLIMIT_MEMLOCK") },
+			wantRule: "gpudirect",
+		},
+		"rlimit denied": {
+			check:   func(p *policy) (string, error) { return p.checkRlimit(s, "RLIMIT_NOFILE") },
+			wantErr: true,
+		},
+		"device not allowed by a rule without paths": {
+			check: func(p *policy) (string, error) {
+				return p.checkDevice(s, &api.LinuxDevice{Path: "/var/lib/tcpx", Type: charDevice, Major: 1})
+			},
+			wantErr: true,
+		},
+		"no policy": {
+			check: func(*policy) (string, error) { return (*policy)(nil).checkEnv(s, "LD_PRELOAD") },
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rule, err := tc.check(p)
+			if tc.wantErr {
+				assert.ErrorContains(t, err, "denied by policy")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantRule, rule)
+		})
+	}
+}
+
+func TestCreateContainerPolicy(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("failed to parse test policy: %v", err)
+	}
+	pl := &plugin{policy: p}
+	container := &api.Container{Name: "test"}
+	pod := func(namespace string) *api.PodSandbox {
+		return &api.PodSandbox{
+			Name:        "pod",
+			Namespace:   namespace,
+			Annotations: map[string]string{ctrDeviceKeyPrefix + "test": "- path: /dev/null"},
+		}
+	}
+
+	denied := testutil.ToFloat64(policyDecisions.WithLabelValues("device", "deny", ""))
+	adjust, _, err := pl.CreateContainer(context.Background(), pod("default"), container)
+	assert.ErrorContains(t, err, "device /dev/null (type c, major 1) denied by policy")
+	assert.Nil(t, adjust)
+	assert.Equal(t, denied+1, testutil.ToFloat64(policyDecisions.WithLabelValues("device", "deny", "")))
+
+	pl.policy.Rules = append(pl.policy.Rules, policyRule{Name: "null", Paths: []string{"/dev/null"}, Namespaces: []string{"default"}})
+	allowed := testutil.ToFloat64(policyDecisions.WithLabelValues("device", "allow", "null"))
+	adjust, _, err = pl.CreateContainer(context.Background(), pod("default"), container)
+	assert.NoError(t, err)
+	assert.Len(t, adjust.GetLinux().GetDevices(), 1)
+	assert.Equal(t, allowed+1, testutil.ToFloat64(policyDecisions.WithLabelValues("device", "allow", "null")))
+}
+
+func TestCreateContainerServiceAccount(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/tools/pods/debug":
+			w.Write([]byte(`{"spec":{"serviceAccountName":"debugger"}}`))
+		case "/api/v1/namespaces/tools/pods/other":
+			w.Write([]byte(`{"spec":{"serviceAccountName":"default"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token"), 0600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("failed to parse test policy: %v", err)
+	}
+	pods := &podClient{server: ts.URL, tokenFile: tokenFile, client: ts.Client()}
+	container := &api.Container{Name: "test"}
+
+	tests := map[string]struct {
+		pods    *podClient
+		pod     string
+		wantErr string
+	}{
+		"service account allowed": {
+			pods: pods,
+			pod:  "debug",
+		},
+		"other service account denied": {
+			pods:    pods,
+			pod:     "other",
+			wantErr: `no rule allows it for namespace "tools" and service account "default"`,
+		},
+		"lookup failure denied": {
+			pods:    pods,
+			pod:     "missing",
+			wantErr: "injection denied by policy: failed to get pod tools/missing: 404",
+		},
+		"no API server denied": {
+			pod:     "debug",
+			wantErr: "injection denied by policy: service_accounts rules need the plugin to run in a pod",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			pl := &plugin{policy: p, pods: tc.pods}
+			pod := &api.PodSandbox{
+				Name:        tc.pod,
+				Namespace:   "tools",
+				Annotations: map[string]string{ctrDeviceKeyPrefix + "test": "- path: /dev/null"},
+			}
+			adjust, _, err := pl.CreateContainer(context.Background(), pod, container)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				assert.Nil(t, adjust)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, adjust.GetLinux().GetDevices(), 1)
+		})
+	}
+}
+
+func TestCreateContainerInjection(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("failed to parse test policy: %v", err)
+	}
+	pl := &plugin{policy: p}
+	container := &api.Container{Name: "test"}
+	pod := func(annotation string) *api.PodSandbox {
+		return &api.PodSandbox{
+			Name:        "pod",
+			Namespace:   "default",
+			Annotations: map[string]string{ctrDeviceKeyPrefix + "test": annotation},
+		}
+	}
+
+	adjust, _, err := pl.CreateContainer(context.Background(), pod(`
+mounts:
+- {source: /var/lib/tcpx, destination: /usr/local/tcpx}
+env:
+- {name: NCCL_DEBUG, value: INFO}
+rlimits:
+- {type: memlock, hard: -1, soft: -1}
+`), container)
+	assert.NoError(t, err)
+	assert.Equal(t, []*api.Mount{{
+		Source:      "/var/lib/tcpx",
+		Destination: "/usr/local/tcpx",
+		Type:        "bind",
+		Options:     []string{"rbind", "rprivate", "nosuid", "nodev", "ro"},
+	}}, adjust.GetMounts())
+	assert.Equal(t, []*api.KeyValue{{Key: "NCCL_DEBUG", Value: "INFO"}}, adjust.GetEnv())
+	assert.Equal(t, []*api.POSIXRlimit{{Type: "RLIMIT_MEMLOCK", Hard: math.MaxUint64, Soft: math.MaxUint64}}, adjust.GetRlimits())
+
+	denied := testutil.ToFloat64(policyDecisions.WithLabelValues("env", "deny", ""))
+	adjust, _, err = pl.CreateContainer(context.Background(), pod(`env: [{name: LD_PRELOAD, value: /tmp/evil.so}]`), container)
+	assert.ErrorContains(t, err, "env var LD_PRELOAD denied by policy")
+	assert.Nil(t, adjust)
+	assert.Equal(t, denied+1, testutil.ToFloat64(policyDecisions.WithLabelValues("env", "deny", "")))
+}
+
+// manifestDocs returns the YAML documents of the manifest at path.
+func manifestDocs(t *testing.T, path string) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	var docs [][]byte
+	for _, doc := range regexp.MustCompile(`(?m)^---\s*$`).Split(string(data), -1) {
+		docs = append(docs, []byte(doc))
+	}
+	return docs
+}
+
+// TestShippedPolicyAllowsGPUDirect checks that the policy shipped in the
+// manifests allows the devices annotated by the GPUDirect manifests.
+func TestShippedPolicyAllowsGPUDirect(t *testing.T) {
+	type object struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name        string            `json:"name"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Data map[string]string `json:"data"`
+	}
+
+	var podAnnotations []map[string]string
+	gpuDirectManifests, err := filepath.Glob("../gpudirect-tcpx*/*.yaml")
+	if err != nil || len(gpuDirectManifests) == 0 {
+		t.Fatalf("no GPUDirect manifests found: %v", err)
+	}
+	for _, path := range gpuDirectManifests {
+		for _, doc := range manifestDocs(t, path) {
+			var obj object
+			if err := yaml.Unmarshal(doc, &obj); err != nil || obj.Kind != "Pod" {
+				continue
+			}
+			podAnnotations = append(podAnnotations, obj.Metadata.Annotations)
+		}
+	}
+
+	for _, manifest := range []string{"nri-device-injector.yaml", "nri-device-injector-autopilot.yaml"} {
+		t.Run(manifest, func(t *testing.T) {
+			var p *policy
+			for _, doc := range manifestDocs(t, manifest) {
+				var obj object
+				if err := yaml.Unmarshal(doc, &obj); err != nil {
+					t.Fatalf("invalid manifest: %v", err)
+				}
+				if obj.Kind == "ConfigMap" && obj.Metadata.Name == "device-injector-policy" {
+					if p, err = parsePolicy([]byte(obj.Data["policy.yaml"])); err != nil {
+						t.Fatalf("invalid shipped policy: %v", err)
+					}
+				}
+			}
+			if p == nil {
+				t.Fatal("no device-injector-policy ConfigMap in manifest")
+			}
+
+			checked := 0
+			s := subject{Namespace: "default"}
+			for _, annotations := range podAnnotations {
+				for key, value := range annotations {
+					if !strings.HasPrefix(key, deviceKeyPrefix) {
+						continue
+					}
+					inj, err := parseInjection(key, value)
+					if err != nil {
+						t.Fatalf("invalid annotation %q: %v", key, err)
+					}
+					for _, d := range inj.Devices {
+						_, err := p.checkDevice(s, &api.LinuxDevice{Path: d.Path, Type: charDevice})
+						assert.NoError(t, err, "annotation %q", key)
+						checked++
+					}
+					for _, m := range inj.Mounts {
+						_, err := p.checkMount(s, &m)
+						assert.NoError(t, err, "annotation %q", key)
+					}
+					for _, e := range inj.Env {
+						_, err := p.checkEnv(s, e.Name)
+						assert.NoError(t, err, "annotation %q", key)
+					}
+				}
+			}
+			assert.NotZero(t, checked, "no annotated devices in the GPUDirect manifests")
+		})
+	}
+}
@@ -18,21 +18,22 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
-	"regexp"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/confidential"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/driver"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 )
 
-const (
-	minUVMSupportedVersion = 550
-)
+// procDirectory is where the version of the loaded NVIDIA driver is read from.
+const procDirectory = "/proc"
 
 var (
 	readFile = os.ReadFile
@@ -40,76 +41,158 @@ var (
 	containerPathPrefix = flag.String("container-path", "/usr/local/nvidia", "Path on the container that mounts host nvidia install directory")
 	cgpuConfigFile      = flag.String("cgpu-config", "/etc/nvidia/confidential_node_type.txt", "File with Confidential Node Type used on Node")
 	readyDelay          = flag.Int64("ready-delay-ms", 1000, "How much time to wait before setting GPU to ready state. Adding a delay helps to reduce the chances of a start up error.")
+	statusFile          = flag.String("status-file", "/etc/nvidia/confidential_gpu_status.json", "File on the host mount that the steps of enabling confidential GPUs are reported to. If empty, they are only logged.")
+	attestationCommand  = flag.String("attestation-command", "", "Local GPU attestation command, split on spaces, run before setting GPU to ready state. If empty, attestation is skipped.")
+	attestationTimeout  = flag.Duration("attestation-timeout", 5*time.Minute, "Timeout of the attestation command")
+	superviseInterval   = flag.Duration("supervise-interval", 10*time.Second, "Interval at which nvidia-persistenced is checked and restarted if it is not running")
+	healthPort          = flag.Int("health-port", 8083, "Port to serve "+healthPath+" on for liveness probes. If 0, it is only served on -admin-port")
 )
 
+// healthPath serves the health of nvidia-persistenced for liveness probes, on
+// -health-port and -admin-port.
+const healthPath = "/healthz"
+
 func main() {
+	logging.AddFlags(flag.CommandLine)
 	flag.Parse()
-	ctx := context.Background()
+	if err := logging.Setup("nvidia-persistenced-installer"); err != nil {
+		logging.Fatal("Failed to set up logging", logging.Error, err)
+	}
+	// Stop on termination signals (SIGINT and SIGTERM).
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// Only run persistence daemon on confidential GPU nodes.
-	enabled, err := checkConfidentialGPUEnablement(ctx)
+	nodeType, enabled, err := checkConfidentialGPUEnablement(ctx)
 	if err != nil {
-		glog.ExitContextf(ctx, "parseCGPUConfig failed: %v", err)
+		logging.Fatal("Failed to check if confidential GPU is enabled", logging.Error, err)
 	}
+	r := confidential.NewReporter(*statusFile, nodeType)
 
-	if enabled {
-		// This is necessary to be able to use nvidia smi from the container to set the GPU to a ready state.
-		if err := updateContainerLdCache(); err != nil {
-			glog.ExitContextf(ctx, "updateContainerLdCache failed: %v", err)
-		}
-
-		if err := enablePersistenceMode(ctx); err != nil {
-			glog.ExitContextf(ctx, "failed to start persistence mode: %v", err)
-		}
-		// Add small delay before setting the ready state for consistency.
-		// If the workload starts too close to when the persistence daemon has started sometimes there can be errors.
-		time.Sleep(time.Duration(*readyDelay) * time.Millisecond)
-		if err := setGPUReadyState(ctx); err != nil {
-			glog.ExitContextf(ctx, "failed to set gpu to ready state: %v", err)
-		}
-	} else {
-		glog.InfoContext(ctx, "Confidential GPU is NOT enabled, skipping nvidia persistenced enablement.")
+	if !enabled {
+		r.Skipped(confidential.StepNodeType, fmt.Sprintf("node type %q does not support confidential GPUs", nodeType))
+		slog.InfoContext(ctx, "Confidential GPU is not enabled, skipping nvidia-persistenced enablement")
+		serveHealth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprintln(w, "ok, not supervising") }))
 		// Don't exit as this is intended for a side car which would cause it to restart infinitely.
+		<-ctx.Done()
+		slog.InfoContext(ctx, "Received signal, shutting down")
+		return
+	}
+
+	r.Succeeded(confidential.StepNodeType, fmt.Sprintf("confidential node type %s", nodeType))
+	// This is necessary to be able to use NVML from the container to set the GPU to a ready state.
+	if err := updateContainerLdCache(); err != nil {
+		logging.Fatal("Failed to update the container ld cache", logging.Error, err)
+	}
+
+	if err := enablePersistenceMode(ctx); err != nil {
+		r.Failed(confidential.StepPersistenceDaemon, err)
+		logging.Fatal("Failed to start persistence mode", logging.Error, err)
+	}
+	r.Succeeded(confidential.StepPersistenceDaemon, "NVIDIA persistence daemon started")
+	sup := newSupervisor(*superviseInterval, enablePersistenceMode, func(ctx context.Context) error {
+		return ensureConfidentialGPUReady(ctx, r, nodeType)
+	}, r)
+	serveHealth(sup)
+	// Add small delay before setting the ready state for consistency.
+	// If the workload starts too close to when the persistence daemon has started sometimes there can be errors.
+	time.Sleep(time.Duration(*readyDelay) * time.Millisecond)
+	if err := enableConfidentialGPU(ctx, r, nodeType); err != nil {
+		sup.stop(context.Background())
+		logging.Fatal("Failed to set GPU to ready state", logging.Error, err)
 	}
 
 	// Need to keep the container running so that the nvidia persistence daemon can keep running.
-	// Create a channel to listen for termination signals (SIGINT and SIGTERM)
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sup.run(ctx)
+	slog.InfoContext(ctx, "Received signal, shutting down")
+	sup.stop(context.Background())
+	// The driver may reinitialize the GPUs without nvidia-persistenced, which
+	// takes them out of the ready state.
+	r.SetReady(false)
+}
 
-	// Block indefinitely until a signal is received
-	sig := <-sigChan
-	fmt.Printf("Received signal: %v. Shutting down...\n", sig)
+// serveHealth serves h on healthPath of -admin-port, and of -health-port if set.
+// The health port only serves healthPath, as the liveness probe needs it on all
+// the addresses of the node.
+func serveHealth(h http.Handler) {
+	http.Handle(healthPath, h)
+	if *healthPort == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(healthPath, h)
+	go func() {
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", *healthPort), mux); err != nil {
+			slog.Error("Health server stopped", logging.Error, err)
+		}
+	}()
 }
 
 func enablePersistenceMode(ctx context.Context) error {
-	glog.InfoContext(ctx, "Starting NVIDIA persistence daemon.")
-	cmdArgs := []string{}
-	if versionMajor, err := nvidiaVersionMajor(ctx); err != nil {
+	slog.InfoContext(ctx, "Starting NVIDIA persistence daemon")
+	version, err := driver.FromProcfs(procDirectory)
+	if err != nil {
 		return err
-	} else if versionMajor >= minUVMSupportedVersion {
-		// UVM persistence mode is only available starting at R550.
+	}
+	cmdArgs := []string{}
+	if driver.UVMPersistence.Supported(version) {
 		cmdArgs = append(cmdArgs, "--uvm-persistence-mode")
-		glog.InfoContext(ctx, "using --uvm-persistence-mode")
+		slog.InfoContext(ctx, "Using --uvm-persistence-mode", "driver_version", version.String())
 	}
 	cmdArgs = append(cmdArgs, "--nvidia-cfg-path="+*containerPathPrefix+"/lib64")
 	persistencedCMD := exec.Command(*containerPathPrefix+"/bin/nvidia-persistenced", cmdArgs...)
 	if err := persistencedCMD.Run(); err != nil {
 		return err
 	}
-	glog.InfoContext(ctx, "NVIDIA Persistence Mode Enabled.")
+	slog.InfoContext(ctx, "NVIDIA persistence mode enabled")
 	return nil
 }
 
-func setGPUReadyState(ctx context.Context) error {
-	gpuReadyCMD := exec.Command(*containerPathPrefix+"/bin/nvidia-smi", "conf-compute", "-srs", "1")
-	if err := gpuReadyCMD.Run(); err != nil {
+// enableConfidentialGPU checks that the driver supports confidential computing,
+// checks the CC mode and capabilities of the GPUs through NVML, attests them if
+// configured, and sets them to the ready state.
+func enableConfidentialGPU(ctx context.Context, r *confidential.Reporter, nodeType confidential.NodeType) error {
+	version, err := driver.FromProcfs(procDirectory)
+	if err != nil {
+		return r.Failed(confidential.StepCCMode, err)
+	}
+	if err := driver.Check(version, driver.ConfidentialComputing); err != nil {
+		return r.Failed(confidential.StepCCMode, err)
+	}
+	lib, shutdown, err := confidential.NewNVML()
+	if err != nil {
+		return r.Failed(confidential.StepCCMode, err)
+	}
+	defer shutdown()
+	if err := confidential.Enable(ctx, lib, r, confidentialConfig(nodeType)); err != nil {
 		return err
 	}
-	glog.InfoContext(ctx, "Confidential GPU is ready.")
+	slog.InfoContext(ctx, "Confidential GPU is ready", "node_type", nodeType)
 	return nil
 }
 
+// ensureConfidentialGPUReady enables the GPUs again after nvidia-persistenced
+// restarted, if they left the ready state. Their CC mode and capabilities are
+// checked and they are attested again before they are set to the ready state.
+func ensureConfidentialGPUReady(ctx context.Context, r *confidential.Reporter, nodeType confidential.NodeType) error {
+	lib, shutdown, err := confidential.NewNVML()
+	if err != nil {
+		return r.Failed(confidential.StepReadyState, err)
+	}
+	defer shutdown()
+	return confidential.EnsureReady(ctx, lib, r, confidentialConfig(nodeType))
+}
+
+// confidentialConfig returns the configuration of enabling the GPUs of a node
+// of nodeType.
+func confidentialConfig(nodeType confidential.NodeType) confidential.Config {
+	return confidential.Config{
+		NodeType:           nodeType,
+		AttestationCommand: strings.Fields(*attestationCommand),
+		AttestationTimeout: *attestationTimeout,
+	}
+}
+
 func updateContainerLdCache() error {
 	f, err := os.Create("/etc/ld.so.conf.d/nvidia.conf")
 	if err != nil {
@@ -125,50 +208,18 @@ func updateContainerLdCache() error {
 	return nil
 }
 
-func getLoadedNVIDIAKernelModuleVersion(ctx context.Context, versionFilePath string) string {
-	glog.InfoContextf(ctx, "Attempting to read nvidia gpu driver version from: %s", versionFilePath)
-	content, err := os.ReadFile(versionFilePath)
-	if err != nil {
-		glog.ErrorContextf(ctx, "Failed to read version file: %v", err)
-		return ""
-	}
-	contentStr := string(content)
-	kernelModuleVersionPattern := regexp.MustCompile(`\d+\.\d+\.\d+`)
-	kernelModuleVersion := kernelModuleVersionPattern.FindString(contentStr)
-	glog.InfoContextf(ctx, "nvidia gpu driver version: %s", kernelModuleVersion)
-	return kernelModuleVersion
-}
-
-func nvidiaVersionMajor(ctx context.Context) (int, error) {
-	version := getLoadedNVIDIAKernelModuleVersion(ctx, "/proc/driver/nvidia/version")
-	if version == "" {
-		return 0, fmt.Errorf("failed to read nvidia gpu driver version at /proc/driver/nvidia/version")
-	}
-
-	// Will be in this format as it was validated by the regex beforehand: 535.230.02
-	before, _, found := strings.Cut(version, ".")
-	if !found || len(before) != 3 {
-		return 0, fmt.Errorf("invalid nvidia gpu driver version: %v", version)
-	}
-
-	versionMajor, err := strconv.Atoi(before)
-	if err != nil {
-		return 0, fmt.Errorf("invalid nvidia gpu driver version(%v), %w", version, err)
-	}
-	return versionMajor, nil
-}
-
-func checkConfidentialGPUEnablement(ctx context.Context) (bool, error) {
+// checkConfidentialGPUEnablement returns the confidential node type of the node,
+// and whether it supports confidential GPUs.
+func checkConfidentialGPUEnablement(ctx context.Context) (confidential.NodeType, bool, error) {
 	file, err := readFile(*cgpuConfigFile)
 	if err != nil {
 		// Treat non existence of file as disabled.
 		if os.IsNotExist(err) {
-			glog.InfoContextf(ctx, "confidential node type file not found at %v, skipping persistenced installation", *cgpuConfigFile)
-			return false, nil
+			slog.InfoContext(ctx, "Confidential node type file not found, skipping nvidia-persistenced installation", "path", *cgpuConfigFile)
+			return "", false, nil
 		}
-		return false, err
+		return "", false, err
 	}
-	// Remove any trailing spaces and null strings to avoid issues in comparison.
-	confidentialNodeType := strings.ToLower(strings.Trim(string(file), " \r\n\x00"))
-	return confidentialNodeType == "tdx", nil
+	nodeType, enabled := confidential.ParseNodeType(string(file))
+	return nodeType, enabled, nil
 }
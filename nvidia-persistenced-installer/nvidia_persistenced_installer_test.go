@@ -62,6 +62,20 @@ func TestCheckConfidentialGPUEnabled(t *testing.T) {
 			readFileFunc: func(name string) ([]byte, error) {
 				return []byte("snp_sev"), nil
 			},
+			wantEnabled: true,
+		},
+		{
+			name: "sev-snp",
+			readFileFunc: func(name string) ([]byte, error) {
+				return []byte("SEV-SNP\n"), nil
+			},
+			wantEnabled: true,
+		},
+		{
+			name: "sev",
+			readFileFunc: func(name string) ([]byte, error) {
+				return []byte("sev"), nil
+			},
 			wantEnabled: false,
 		},
 		{
@@ -84,7 +98,7 @@ func TestCheckConfidentialGPUEnabled(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			readFile = tc.readFileFunc
 
-			enabled, err := checkConfidentialGPUEnablement(context.Background())
+			_, enabled, err := checkConfidentialGPUEnablement(context.Background())
 
 			if err != nil && !tc.wantErr {
 				t.Errorf("checkConfidentialGPUEnablement returned unexpected error %v", err)
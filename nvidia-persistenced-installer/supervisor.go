@@ -0,0 +1,234 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/confidential"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/persistenced"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 5 * time.Minute
+	stopTimeout       = 10 * time.Second
+)
+
+// supervisor checks that nvidia-persistenced, which daemonizes itself, keeps
+// running, and restarts it with exponential backoff when it does not. Its
+// health is served for liveness probes. The daemon is not restarted while it
+// is held, e.g. by partition-gpus to reset GPUs, and is restarted as soon as
+// the hold is released.
+type supervisor struct {
+	pidFile  string
+	socket   string
+	holdFile string
+	comm     string
+	// procDir is /proc, replaced in tests.
+	procDir  string
+	interval time.Duration
+	// minBackoff and maxBackoff bound the delay before a restart.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// start starts the daemon and returns once it is running.
+	start func(context.Context) error
+	// restarted is called after each restart, e.g. to set confidential GPUs
+	// back to the ready state. It can be nil.
+	restarted func(context.Context) error
+	r         *confidential.Reporter
+
+	mu sync.Mutex
+	// err is why the daemon is unhealthy, or nil.
+	err      error
+	restarts int
+}
+
+func newSupervisor(interval time.Duration, start, restarted func(context.Context) error, r *confidential.Reporter) *supervisor {
+	return &supervisor{
+		pidFile:    persistenced.PidFile,
+		socket:     persistenced.Socket,
+		holdFile:   persistenced.HoldFile,
+		comm:       persistenced.Comm,
+		procDir:    "/proc",
+		interval:   interval,
+		minBackoff: minRestartBackoff,
+		maxBackoff: maxRestartBackoff,
+		start:      start,
+		restarted:  restarted,
+		r:          r,
+	}
+}
+
+// run checks the daemon every interval until ctx is done. The restart backoff
+// doubles after each restart, and is reset once the daemon has been running
+// for maxBackoff.
+func (s *supervisor) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	backoff := s.minBackoff
+	var lastRestart time.Time
+	wasHeld := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := s.check()
+		if err == nil {
+			wasHeld = false
+			if backoff > s.minBackoff && time.Since(lastRestart) >= s.maxBackoff {
+				backoff = s.minBackoff
+			}
+			continue
+		}
+		if holder, held := persistenced.Held(s.holdFile, time.Now()); held {
+			if !wasHeld {
+				slog.InfoContext(ctx, "nvidia-persistenced is held, not restarting it", "holder", holder, logging.Error, err)
+			}
+			wasHeld = true
+			s.setHealth(nil)
+			continue
+		}
+		if wasHeld {
+			// The holder stopped the daemon on purpose, restart it right away.
+			wasHeld = false
+			slog.InfoContext(ctx, "nvidia-persistenced was released, restarting it")
+			if err := s.restart(ctx); err != nil {
+				s.setHealth(err)
+				s.r.Failed(confidential.StepPersistenceDaemon, err)
+			}
+			continue
+		}
+		s.setHealth(err)
+		s.r.Failed(confidential.StepPersistenceDaemon, fmt.Errorf("nvidia-persistenced is not running: %w", err))
+		slog.WarnContext(ctx, "Restarting nvidia-persistenced", "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		lastRestart = time.Now()
+		backoff = min(2*backoff, s.maxBackoff)
+		if err := s.restart(ctx); err != nil {
+			s.setHealth(err)
+			s.r.Failed(confidential.StepPersistenceDaemon, err)
+		}
+	}
+}
+
+// restart starts the daemon again and calls restarted.
+func (s *supervisor) restart(ctx context.Context) error {
+	if err := s.start(ctx); err != nil {
+		return fmt.Errorf("failed to restart nvidia-persistenced: %w", err)
+	}
+	if err := s.check(); err != nil {
+		return fmt.Errorf("nvidia-persistenced is not running after restart: %w", err)
+	}
+	s.mu.Lock()
+	s.restarts++
+	restarts := s.restarts
+	s.mu.Unlock()
+	s.r.Succeeded(confidential.StepPersistenceDaemon, fmt.Sprintf("NVIDIA persistence daemon restarted (%d restarts)", restarts))
+	if s.restarted != nil {
+		if err := s.restarted(ctx); err != nil {
+			return err
+		}
+	}
+	s.setHealth(nil)
+	return nil
+}
+
+// check returns an error if the process of the pid file is not
+// nvidia-persistenced, or its socket is missing.
+func (s *supervisor) check() error {
+	pid, err := s.pid()
+	if err != nil {
+		return err
+	}
+	comm, err := os.ReadFile(fmt.Sprintf("%s/%d/comm", s.procDir, pid))
+	if err != nil {
+		return fmt.Errorf("process %d is gone: %w", pid, err)
+	}
+	if got := strings.TrimSpace(string(comm)); got != s.comm {
+		return fmt.Errorf("process %d is %s, not %s", pid, got, s.comm)
+	}
+	if _, err := os.Stat(s.socket); err != nil {
+		return fmt.Errorf("socket is missing: %w", err)
+	}
+	return nil
+}
+
+func (s *supervisor) pid() (int, error) {
+	return persistenced.ReadPid(s.pidFile)
+}
+
+// stop sends SIGTERM to the daemon, and SIGKILL if it is still running after
+// stopTimeout.
+func (s *supervisor) stop(ctx context.Context) {
+	if err := s.check(); err != nil {
+		slog.InfoContext(ctx, "nvidia-persistenced is not running, nothing to stop", logging.Error, err)
+		return
+	}
+	pid, _ := s.pid()
+	slog.InfoContext(ctx, "Stopping nvidia-persistenced", "pid", pid)
+	if err := unix.Kill(pid, unix.SIGTERM); err != nil {
+		slog.ErrorContext(ctx, "Failed to stop nvidia-persistenced", logging.Error, err)
+		return
+	}
+	deadline := time.Now().Add(stopTimeout)
+	for time.Now().Before(deadline) {
+		if err := unix.Kill(pid, 0); errors.Is(err, unix.ESRCH) {
+			slog.InfoContext(ctx, "nvidia-persistenced stopped")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	slog.WarnContext(ctx, "nvidia-persistenced did not stop, killing it", "timeout", stopTimeout)
+	if err := unix.Kill(pid, unix.SIGKILL); err != nil && !errors.Is(err, unix.ESRCH) {
+		slog.ErrorContext(ctx, "Failed to kill nvidia-persistenced", logging.Error, err)
+	}
+}
+
+func (s *supervisor) setHealth(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// ServeHTTP serves the health of the daemon: 200 if it is running, 503
+// otherwise.
+func (s *supervisor) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	err, restarts := s.err, s.restarts
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("nvidia-persistenced is unhealthy: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok, %d restarts\n", restarts)
+}
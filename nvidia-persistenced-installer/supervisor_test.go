@@ -0,0 +1,294 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/confidential"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/persistenced"
+)
+
+// newTestSupervisor returns a supervisor of a daemon whose pid file, socket and
+// hold file are in a temporary directory, and whose process name is the one of the test.
+func newTestSupervisor(t *testing.T, start, restarted func(context.Context) error) *supervisor {
+	t.Helper()
+	comm, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatalf("failed to read process name: %v", err)
+	}
+	dir := t.TempDir()
+	s := newSupervisor(10*time.Millisecond, start, restarted, confidential.NewReporter("", confidential.TDX))
+	s.pidFile = filepath.Join(dir, "nvidia-persistenced.pid")
+	s.socket = filepath.Join(dir, "socket")
+	s.holdFile = filepath.Join(dir, "hold")
+	s.comm = strings.TrimSpace(string(comm))
+	s.minBackoff = time.Millisecond
+	s.maxBackoff = 10 * time.Millisecond
+	return s
+}
+
+// writeDaemon makes the test process look like the running daemon.
+func writeDaemon(t *testing.T, s *supervisor) {
+	t.Helper()
+	if err := os.WriteFile(s.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write pid file: %v", err)
+	}
+	if err := os.WriteFile(s.socket, nil, 0644); err != nil {
+		t.Fatalf("failed to create socket: %v", err)
+	}
+}
+
+func healthCode(s *supervisor) int {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	return w.Code
+}
+
+func TestSupervisorCheck(t *testing.T) {
+	testcases := []struct {
+		name    string
+		setup   func(t *testing.T, s *supervisor)
+		wantErr string
+	}{
+		{
+			name:  "running",
+			setup: writeDaemon,
+		},
+		{
+			name:    "no pid file",
+			setup:   func(t *testing.T, s *supervisor) {},
+			wantErr: "failed to read pid file",
+		},
+		{
+			name: "invalid pid file",
+			setup: func(t *testing.T, s *supervisor) {
+				writeDaemon(t, s)
+				os.WriteFile(s.pidFile, []byte("abc"), 0644)
+			},
+			wantErr: "invalid pid file",
+		},
+		{
+			name: "pid reused by another process",
+			setup: func(t *testing.T, s *supervisor) {
+				writeDaemon(t, s)
+				s.comm = "other-daemon"
+			},
+			wantErr: "not other-daemon",
+		},
+		{
+			name: "no socket",
+			setup: func(t *testing.T, s *supervisor) {
+				writeDaemon(t, s)
+				os.Remove(s.socket)
+			},
+			wantErr: "socket is missing",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSupervisor(t, nil, nil)
+			tc.setup(t, s)
+			err := s.check()
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("check() returned unexpected error %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("check() returned error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	restarted := make(chan struct{}, 1)
+	var s *supervisor
+	s = newTestSupervisor(t, func(context.Context) error {
+		writeDaemon(t, s)
+		return nil
+	}, func(context.Context) error {
+		select {
+		case restarted <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-restarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon was not restarted")
+	}
+	// Wait for the health to be updated after restarted returned.
+	deadline := time.Now().Add(5 * time.Second)
+	for healthCode(s) != http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := healthCode(s); got != http.StatusOK {
+		t.Errorf("health after restart = %d, want %d", got, http.StatusOK)
+	}
+
+	steps := s.r.Status().Steps
+	if len(steps) < 2 || steps[0].State != confidential.StepFailed || steps[1].State != confidential.StepSucceeded {
+		t.Errorf("steps = %+v, want a failed then succeeded %s step", steps, confidential.StepPersistenceDaemon)
+	}
+}
+
+func TestSupervisorHeld(t *testing.T) {
+	started := make(chan struct{}, 1)
+	var s *supervisor
+	s = newTestSupervisor(t, func(context.Context) error {
+		writeDaemon(t, s)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		return nil
+	}, nil)
+	release, err := persistenced.Hold(s.holdFile, "partition-gpus")
+	if err != nil {
+		t.Fatalf("Hold() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("held daemon was restarted")
+	case <-time.After(20 * s.interval):
+	}
+	if got := healthCode(s); got != http.StatusOK {
+		t.Errorf("health while held = %d, want %d", got, http.StatusOK)
+	}
+
+	if err := release(); err != nil {
+		t.Fatalf("release() error = %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon was not restarted after the hold was released")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.r.Status().Steps) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Stopping a held daemon is not a failure.
+	for _, step := range s.r.Status().Steps {
+		if step.State == confidential.StepFailed {
+			t.Errorf("steps = %+v, want no failed step", s.r.Status().Steps)
+		}
+	}
+}
+
+func TestSupervisorRestartFails(t *testing.T) {
+	testcases := []struct {
+		name      string
+		start     func(t *testing.T, s *supervisor) error
+		restarted error
+	}{
+		{
+			name:  "daemon fails to start",
+			start: func(t *testing.T, s *supervisor) error { return errors.New("exit status 1") },
+		},
+		{
+			name:  "daemon is not running after start",
+			start: func(t *testing.T, s *supervisor) error { return nil },
+		},
+		{
+			name: "ready state fails",
+			start: func(t *testing.T, s *supervisor) error {
+				writeDaemon(t, s)
+				return nil
+			},
+			restarted: errors.New("failed to set GPUs to ready state"),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var s *supervisor
+			s = newTestSupervisor(t, func(context.Context) error { return tc.start(t, s) }, func(context.Context) error { return tc.restarted })
+			s.setHealth(errors.New("not running"))
+			if err := s.restart(context.Background()); err == nil {
+				t.Fatal("restart() returned no error")
+			}
+			if got := healthCode(s); got != http.StatusServiceUnavailable {
+				t.Errorf("health = %d, want %d", got, http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+func TestSupervisorStop(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("failed to start sleep: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	s := newTestSupervisor(t, nil, nil)
+	s.comm = "sleep"
+	if err := os.WriteFile(s.pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("failed to write pid file: %v", err)
+	}
+	if err := os.WriteFile(s.socket, nil, 0644); err != nil {
+		t.Fatalf("failed to create socket: %v", err)
+	}
+
+	s.stop(context.Background())
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		t.Fatal("daemon was not stopped")
+	}
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || !ws.Signaled() {
+		t.Errorf("daemon exited with %v, want it to be stopped by a signal", cmd.ProcessState)
+	}
+}
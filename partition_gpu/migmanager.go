@@ -0,0 +1,97 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+const (
+	backendAuto      = "auto"
+	backendNVML      = "nvml"
+	backendNvidiaSmi = "nvidia-smi"
+)
+
+// migManager manages MIG mode and MIG instances on the GPUs of a node. GPUs are
+// identified by their index.
+type migManager interface {
+	// GPUs returns the indexes of the GPUs on the node.
+	GPUs() ([]string, error)
+	// MigMode returns whether MIG mode is currently enabled on a GPU, and whether
+	// it will be enabled after the next GPU reset.
+	MigMode(gpu string) (current, pending bool, err error)
+	// SetMigMode enables or disables MIG mode on a GPU.
+	SetMigMode(gpu string, enabled bool) error
+	// GPUInstanceProfiles returns the GPU instance profiles supported by a GPU.
+	GPUInstanceProfiles(gpu string) ([]migprofile.Profile, error)
+	// GPUInstances returns the GPU instances on each GPU, keyed by GPU index.
+	GPUInstances() (map[string][]gpuInstance, error)
+	// CreateGPUInstances creates a GPU instance of each of the given profiles on a GPU,
+	// each with the compute instances of the layout. A nil layout creates a single
+	// compute instance that spans the whole GPU instance.
+	CreateGPUInstances(gpu string, profileIDs []string, ci *computeInstanceLayout) error
+	// DestroyGPUInstances destroys all compute and GPU instances on a GPU.
+	DestroyGPUInstances(gpu string) error
+	// Processes returns the number of compute processes running on a GPU, including its GPU instances.
+	Processes(gpu string) (int, error)
+	// PersistenceMode returns whether persistence mode is enabled on a GPU.
+	PersistenceMode(gpu string) (bool, error)
+	// SetPersistenceMode enables or disables persistence mode on a GPU.
+	SetPersistenceMode(gpu string, enabled bool) error
+	// Reset resets a GPU that isn't used by any process, which applies its pending MIG mode.
+	Reset(gpu string) error
+}
+
+// gpuInstance is a MIG GPU instance.
+type gpuInstance struct {
+	ID        string
+	ProfileID string
+	// ComputeInstances is the number of compute instances in the GPU instance.
+	ComputeInstances int
+}
+
+// computeInstanceLayout describes the compute instances to create in each GPU
+// instance, to share a GPU instance between containers.
+type computeInstanceLayout struct {
+	// ProfileID is the compute instance profile. NVML and nvidia-smi use the same
+	// IDs for compute instance profiles.
+	ProfileID int `json:"profileID"`
+	// Count is the number of compute instances in each GPU instance.
+	Count int `json:"count"`
+}
+
+// newMigManager returns the migManager for a backend. With backendAuto, NVML is
+// used if it can be initialized, and nvidia-smi otherwise.
+func newMigManager(backend string) (migManager, error) {
+	switch backend {
+	case backendNVML:
+		return newNvmlMigManager()
+	case backendNvidiaSmi:
+		return &nvidiaSmiMigManager{}, nil
+	case backendAuto:
+		m, err := newNvmlMigManager()
+		if err == nil {
+			return m, nil
+		}
+		slog.Warn("Falling back to nvidia-smi to manage MIG", logging.Error, err)
+		return &nvidiaSmiMigManager{}, nil
+	default:
+		return nil, fmt.Errorf("invalid MIG backend %q, should be one of %s, %s or %s", backend, backendAuto, backendNVML, backendNvidiaSmi)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+)
+
+var (
+	// runNvidiaSmi runs nvidia-smi and returns its output. It is overridden in tests.
+	runNvidiaSmi = func(args ...string) ([]byte, error) {
+		return exec.Command(*nvidiaSmiPath, args...).Output()
+	}
+
+	lgiLineRegexp  = regexp.MustCompile(`^\s*(\d+)\s+MIG\s+\S+\s+(\d+)\s+(\d+)\s+([\d:]+)\s*$`)
+	lciLineRegexp  = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+MIG\s+\S+\s+(\d+)\s+(\d+)\s+([\d:]+)\s*$`)
+	lgipLineRegexp = regexp.MustCompile(`^\s*(\d+)\s+MIG\s+(\S+)\s+(\d+)\s+(\d+)/(\d+)\s+([\d\.]+)\s+\w+\s+(\d+)\s+(\d+)\s+(\d+)\s*$`)
+	sliceRegexp    = regexp.MustCompile(`^(\d+)g\.`)
+)
+
+// nvidiaSmiMigManager manages MIG by running nvidia-smi and parsing its output.
+type nvidiaSmiMigManager struct{}
+
+func (m *nvidiaSmiMigManager) GPUs() ([]string, error) {
+	out, err := runNvidiaSmi("--query-gpu=index", "--format=csv,noheader")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list GPUs: output: %s, error: %v", string(out), err)
+	}
+	var gpus []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if gpu := strings.TrimSpace(line); gpu != "" {
+			gpus = append(gpus, gpu)
+		}
+	}
+	sort.Strings(gpus)
+	return gpus, nil
+}
+
+func (m *nvidiaSmiMigManager) MigMode(gpu string) (bool, bool, error) {
+	out, err := runNvidiaSmi("--query-gpu=mig.mode.current,mig.mode.pending", "--format=csv,noheader", "-i", gpu)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to query MIG mode of GPU %s: output: %s, error: %v", gpu, string(out), err)
+	}
+	modes := strings.Split(strings.TrimSpace(string(out)), ",")
+	if len(modes) != 2 {
+		return false, false, fmt.Errorf("nvidia-smi returned invalid MIG mode: %s", out)
+	}
+	current, err := parseMigMode(modes[0])
+	if err != nil {
+		return false, false, err
+	}
+	pending, err := parseMigMode(modes[1])
+	if err != nil {
+		return false, false, err
+	}
+	return current, pending, nil
+}
+
+func parseMigMode(mode string) (bool, error) {
+	switch strings.TrimSpace(mode) {
+	case "Enabled":
+		return true, nil
+	case "Disabled":
+		return false, nil
+	}
+	return false, fmt.Errorf("nvidia-smi returned invalid MIG mode: %s", mode)
+}
+
+func (m *nvidiaSmiMigManager) SetMigMode(gpu string, enabled bool) error {
+	mode := "0"
+	if enabled {
+		mode = "1"
+	}
+	return m.run("-i", gpu, "-mig", mode)
+}
+
+func (m *nvidiaSmiMigManager) GPUInstanceProfiles(gpu string) ([]migprofile.Profile, error) {
+	out, err := runNvidiaSmi("mig", "-lgip", "-i", gpu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list GPU instance profiles: output: %s, error: %v", string(out), err)
+	}
+	return parseGPUInstanceProfiles(string(out))
+}
+
+func (m *nvidiaSmiMigManager) GPUInstances() (map[string][]gpuInstance, error) {
+	out, err := runNvidiaSmi("mig", "-lgi")
+	if err != nil && !strings.Contains(string(out), "No GPU instances found") {
+		return nil, fmt.Errorf("failed to list GPU instances: output: %s, error: %v", string(out), err)
+	}
+	instances, err := parseGPUInstances(string(out))
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = runNvidiaSmi("mig", "-lci")
+	if err != nil && !strings.Contains(string(out), "No compute instances found") &&
+		!strings.Contains(string(out), "No GPU instances found") {
+		return nil, fmt.Errorf("failed to list compute instances: output: %s, error: %v", string(out), err)
+	}
+	computeInstances, err := parseComputeInstances(string(out))
+	if err != nil {
+		return nil, err
+	}
+	for gpu := range instances {
+		for i := range instances[gpu] {
+			instances[gpu][i].ComputeInstances = computeInstances[gpu][instances[gpu][i].ID]
+		}
+	}
+	return instances, nil
+}
+
+func (m *nvidiaSmiMigManager) CreateGPUInstances(gpu string, profileIDs []string, ci *computeInstanceLayout) error {
+	if len(profileIDs) == 0 {
+		return nil
+	}
+	if err := m.run("mig", "-cgi", strings.Join(profileIDs, ","), "-i", gpu); err != nil {
+		return err
+	}
+	if ci == nil {
+		return m.run("mig", "-cci", "-i", gpu)
+	}
+	// Without -gi, the compute instances are created in every GPU instance on the GPU.
+	return m.run("mig", "-cci", computeInstanceProfileIDs(ci), "-i", gpu)
+}
+
+// computeInstanceProfileIDs returns the comma separated compute instance profile
+// IDs that nvidia-smi mig -cci takes to create the compute instances of a layout.
+func computeInstanceProfileIDs(ci *computeInstanceLayout) string {
+	ids := make([]string, ci.Count)
+	for i := range ids {
+		ids[i] = strconv.Itoa(ci.ProfileID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func (m *nvidiaSmiMigManager) DestroyGPUInstances(gpu string) error {
+	if err := m.run("mig", "-dci", "-i", gpu); err != nil && !containsAny(err.Error(), []string{"No GPU instances found", "No compute instances found"}) {
+		return err
+	}
+	if err := m.run("mig", "-dgi", "-i", gpu); err != nil && !strings.Contains(err.Error(), "No GPU instances found") {
+		return err
+	}
+	return nil
+}
+
+func (m *nvidiaSmiMigManager) Processes(gpu string) (int, error) {
+	out, err := runNvidiaSmi("--query-compute-apps=pid", "--format=csv,noheader", "-i", gpu)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list processes on GPU %s: output: %s, error: %v", gpu, string(out), err)
+	}
+	processes := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) != "" {
+			processes++
+		}
+	}
+	return processes, nil
+}
+
+func (m *nvidiaSmiMigManager) PersistenceMode(gpu string) (bool, error) {
+	out, err := runNvidiaSmi("--query-gpu=persistence_mode", "--format=csv,noheader", "-i", gpu)
+	if err != nil {
+		return false, fmt.Errorf("failed to query persistence mode of GPU %s: output: %s, error: %v", gpu, string(out), err)
+	}
+	switch strings.TrimSpace(string(out)) {
+	case "Enabled":
+		return true, nil
+	case "Disabled":
+		return false, nil
+	}
+	return false, fmt.Errorf("nvidia-smi returned invalid persistence mode: %s", out)
+}
+
+func (m *nvidiaSmiMigManager) SetPersistenceMode(gpu string, enabled bool) error {
+	mode := "0"
+	if enabled {
+		mode = "1"
+	}
+	return m.run("-i", gpu, "-pm", mode)
+}
+
+func (m *nvidiaSmiMigManager) Reset(gpu string) error {
+	return m.run("-i", gpu, "-r")
+}
+
+// run runs nvidia-smi and logs its output. The output is part of the returned error.
+func (m *nvidiaSmiMigManager) run(args ...string) error {
+	slog.Info("Running nvidia-smi", "path", *nvidiaSmiPath, "args", strings.Join(args, " "))
+	out, err := runNvidiaSmi(args...)
+	if err != nil {
+		return fmt.Errorf("failed to run nvidia-smi %s: output: %s, error: %v", strings.Join(args, " "), string(out), err)
+	}
+	slog.Info("nvidia-smi finished", "output", string(out))
+	return nil
+}
+
+// parseGPUInstances parses the output of nvidia-smi mig -lgi.
+func parseGPUInstances(lgiOutput string) (map[string][]gpuInstance, error) {
+	instances := make(map[string][]gpuInstance)
+	err := scanTableRows(lgiOutput, func(row string) {
+		m := lgiLineRegexp.FindStringSubmatch(row)
+		if m == nil {
+			return
+		}
+		instances[m[1]] = append(instances[m[1]], gpuInstance{ID: m[3], ProfileID: m[2]})
+	})
+	return instances, err
+}
+
+// parseComputeInstances parses the output of nvidia-smi mig -lci, and returns the
+// number of compute instances in each GPU instance, keyed by GPU index and GPU instance ID.
+func parseComputeInstances(lciOutput string) (map[string]map[string]int, error) {
+	counts := make(map[string]map[string]int)
+	err := scanTableRows(lciOutput, func(row string) {
+		m := lciLineRegexp.FindStringSubmatch(row)
+		if m == nil {
+			return
+		}
+		if counts[m[1]] == nil {
+			counts[m[1]] = make(map[string]int)
+		}
+		counts[m[1]][m[2]]++
+	})
+	return counts, err
+}
+
+// parseGPUInstanceProfiles parses the output of nvidia-smi mig -lgip for a single GPU.
+func parseGPUInstanceProfiles(lgipOutput string) ([]migprofile.Profile, error) {
+	var profiles []migprofile.Profile
+	err := scanTableRows(lgipOutput, func(row string) {
+		m := lgipLineRegexp.FindStringSubmatch(row)
+		if m == nil {
+			return
+		}
+		id, _ := strconv.Atoi(m[3])
+		maxCount, _ := strconv.Atoi(m[5])
+		memoryGiB, _ := strconv.ParseFloat(m[6], 64)
+		multiprocessors, _ := strconv.Atoi(m[7])
+		slices := 0
+		if s := sliceRegexp.FindStringSubmatch(m[2]); s != nil {
+			slices, _ = strconv.Atoi(s[1])
+		}
+		profiles = append(profiles, migprofile.Profile{
+			ID:                  id,
+			Name:                m[2],
+			MaxCount:            maxCount,
+			MemoryMB:            uint64(math.Round(memoryGiB * 1024)),
+			SliceCount:          slices,
+			MultiprocessorCount: multiprocessors,
+		})
+	})
+	return profiles, err
+}
+
+// scanTableRows calls f with the content of each row of a table printed by nvidia-smi.
+func scanTableRows(output string, f func(row string)) error {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.Contains(line, "====") || !strings.HasPrefix(line, "|") || !strings.HasSuffix(line, "|") {
+			continue
+		}
+		f(strings.TrimSpace(line[1 : len(line)-1]))
+	}
+	return scanner.Err()
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,358 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_parseGPUInstances(t *testing.T) {
+	tests := []struct {
+		name      string
+		lgiOutput string
+		want      map[string][]gpuInstance
+	}{
+		{
+			name:      "Empty input",
+			lgiOutput: "",
+			want:      map[string][]gpuInstance{},
+		},
+		{
+			name: "Header and footer only",
+			lgiOutput: `
++-----------------------------------------------------------------------------+
+| GPU instances:                                                              |
+| GPU   Profile Name   Profile ID   CI_ID   Address                           |
+|=============================================================================|
++-----------------------------------------------------------------------------+
+			`,
+			want: map[string][]gpuInstance{},
+		},
+		{
+			name: "Single GPU, multiple GIs",
+			lgiOutput: `
++-----------------------------------------------------------------------------+
+| GPU   Profile Name   Profile ID   CI_ID   Address                           |
+|=============================================================================|
+|   0   MIG 1g.5gb     19           0       00000000                          |
+|   0   MIG 1g.5gb     19           1       00000001                          |
++-----------------------------------------------------------------------------+
+			`,
+			want: map[string][]gpuInstance{"0": {{ID: "0", ProfileID: "19"}, {ID: "1", ProfileID: "19"}}},
+		},
+		{
+			name: "Single GPU, non-uniform profile IDs",
+			lgiOutput: `
++-----------------------------------------------------------------------------+
+| GPU   Profile Name   Profile ID   CI_ID   Address                           |
+|=============================================================================|
+|   0   MIG 1g.5gb     19           0       00000000                          |
+|   0   MIG 2g.10gb    14           0       01000000                          |
++-----------------------------------------------------------------------------+
+			`,
+			want: map[string][]gpuInstance{"0": {{ID: "0", ProfileID: "19"}, {ID: "0", ProfileID: "14"}}},
+		},
+		{
+			name: "Multiple GPUs, different profile IDs",
+			lgiOutput: `
++-------------------------------------------------------+
+| GPU instances:                                        |
+| GPU   Name             Profile  Instance   Placement  |
+|                          ID       ID       Start:Size |
+|=======================================================|
+|   0  MIG 1g.10gb+me      20        13         6:1     |
+|   1  MIG 3g.40gb          9         2         4:4     |
+|   1  MIG 3g.40gb          9         1         0:4     |
++-------------------------------------------------------+
+			`,
+			want: map[string][]gpuInstance{
+				"0": {{ID: "13", ProfileID: "20"}},
+				"1": {{ID: "2", ProfileID: "9"}, {ID: "1", ProfileID: "9"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGPUInstances(tt.lgiOutput)
+			if err != nil {
+				t.Fatalf("parseGPUInstances() error = %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseGPUInstances() (-want, +got) = %s", diff)
+			}
+		})
+	}
+}
+
+func Test_parseComputeInstances(t *testing.T) {
+	lciOutput := `
++--------------------------------------------------------------------+
+| Compute instances:                                                 |
+| GPU     GPU       Name             Profile   Instance   Placement  |
+|       Instance                       ID        ID       Start:Size |
+|         ID                                                         |
+|====================================================================|
+|   0      1       MIG 1g.5gb           0         0          0:1     |
+|   0      2       MIG 1g.5gb           0         0          0:1     |
+|   0      2       MIG 1g.5gb           0         1          1:1     |
+|   1      1       MIG 3g.20gb          2         0          0:3     |
++--------------------------------------------------------------------+
+`
+	want := map[string]map[string]int{
+		"0": {"1": 1, "2": 2},
+		"1": {"1": 1},
+	}
+	got, err := parseComputeInstances(lciOutput)
+	if err != nil {
+		t.Fatalf("parseComputeInstances() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseComputeInstances() (-want, +got) = %s", diff)
+	}
+}
+
+// fakeNvidiaSmi emulates the nvidia-smi commands used by nvidiaSmiMigManager on a set of GPUs.
+type fakeNvidiaSmi struct {
+	// profiles is the profile ID of each GPU instance, keyed by GPU index.
+	profiles map[string][]string
+	// processes is the number of processes running on each GPU.
+	processes map[string]int
+	// failCreate makes creating GPU instances fail on the given GPU.
+	failCreate      string
+	persistenceMode bool
+	commands        []string
+}
+
+func (f *fakeNvidiaSmi) run(args ...string) ([]byte, error) {
+	f.commands = append(f.commands, strings.Join(args, " "))
+	var gpus []string
+	instances := 0
+	for gpu := range f.profiles {
+		gpus = append(gpus, gpu)
+		instances += len(f.profiles[gpu])
+	}
+	sort.Strings(gpus)
+
+	switch {
+	case args[0] == "--query-gpu=index":
+		return []byte(strings.Join(gpus, "\n") + "\n"), nil
+	case args[0] == "--query-gpu=mig.mode.current,mig.mode.pending":
+		return []byte("Disabled, Enabled\n"), nil
+	case args[0] == "--query-gpu=persistence_mode":
+		if f.persistenceMode {
+			return []byte("Enabled\n"), nil
+		}
+		return []byte("Disabled\n"), nil
+	case len(args) == 4 && args[2] == "-pm":
+		f.persistenceMode = args[3] == "1"
+		return nil, nil
+	case len(args) == 3 && args[2] == "-r":
+		if f.persistenceMode {
+			return []byte("Unable to reset GPU in persistence mode."), errors.New("exit status 255")
+		}
+		return nil, nil
+	case args[0] == "--query-compute-apps=pid":
+		gpu := args[3]
+		var out string
+		for i := 0; i < f.processes[gpu]; i++ {
+			out += fmt.Sprintf("%d\n", 1000+i)
+		}
+		return []byte(out), nil
+	case args[1] == "-lgi":
+		if instances == 0 {
+			return []byte("No GPU instances found: Not Found"), errors.New("exit status 6")
+		}
+		out := "| GPU   Name             Profile  Instance   Placement  |\n|=======================================================|\n"
+		for _, gpu := range gpus {
+			for i, p := range f.profiles[gpu] {
+				out += fmt.Sprintf("|   %s  MIG profile          %s        %d          0:1     |\n", gpu, p, i+1)
+			}
+		}
+		return []byte(out), nil
+	case args[1] == "-lci":
+		if instances == 0 {
+			return []byte("No compute instances found: Not Found"), errors.New("exit status 6")
+		}
+		out := "|====================================================================|\n"
+		for _, gpu := range gpus {
+			for i := range f.profiles[gpu] {
+				out += fmt.Sprintf("|   %s      %d       MIG profile          0         0          0:1     |\n", gpu, i+1)
+			}
+		}
+		return []byte(out), nil
+	case args[1] == "-dci":
+		if len(f.profiles[args[3]]) == 0 {
+			return []byte("No compute instances found: Not Found"), errors.New("exit status 6")
+		}
+		return nil, nil
+	case args[1] == "-dgi":
+		if len(f.profiles[args[3]]) == 0 {
+			return []byte("No GPU instances found: Not Found"), errors.New("exit status 6")
+		}
+		f.profiles[args[3]] = nil
+		return nil, nil
+	case args[1] == "-cgi":
+		if args[4] == f.failCreate {
+			return []byte("Insufficient resources"), errors.New("exit status 2")
+		}
+		f.profiles[args[4]] = strings.Split(args[2], ",")
+		return nil, nil
+	}
+	return nil, nil
+}
+
+func Test_parseGPUInstanceProfiles(t *testing.T) {
+	lgipOutput := `
++-----------------------------------------------------------------------------+
+| GPU instance profiles:                                                      |
+| GPU   Name             ID    Instances   Memory     P2P    SM    DEC   ENC  |
+|                              Free/Total   GiB              CE    JPEG  OFA  |
+|=============================================================================|
+|   0  MIG 1g.5gb        19     7/7        4.75       No     14     0     0   |
+|                                                             1     0     0   |
++-----------------------------------------------------------------------------+
+|   0  MIG 1g.5gb+me     20     1/1        4.75       No     14     1     0   |
+|                                                             1     1     1   |
++-----------------------------------------------------------------------------+
+|   0  MIG 3g.20gb        9     0/2        19.50      No     42     2     0   |
+|                                                             3     0     0   |
++-----------------------------------------------------------------------------+
+`
+	want := []migprofile.Profile{
+		{ID: 19, Name: "1g.5gb", MaxCount: 7, MemoryMB: 4864, SliceCount: 1, MultiprocessorCount: 14},
+		{ID: 20, Name: "1g.5gb+me", MaxCount: 1, MemoryMB: 4864, SliceCount: 1, MultiprocessorCount: 14},
+		{ID: 9, Name: "3g.20gb", MaxCount: 2, MemoryMB: 19968, SliceCount: 3, MultiprocessorCount: 42},
+	}
+	got, err := parseGPUInstanceProfiles(lgipOutput)
+	if err != nil {
+		t.Fatalf("parseGPUInstanceProfiles() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseGPUInstanceProfiles() (-want, +got) = %s", diff)
+	}
+}
+
+func Test_nvidiaSmiMigManager(t *testing.T) {
+	fake := &fakeNvidiaSmi{
+		profiles:   map[string][]string{"0": {}, "1": {"19", "19"}},
+		processes:  map[string]int{"1": 2},
+		failCreate: "2",
+	}
+	defer func(orig func(...string) ([]byte, error)) { runNvidiaSmi = orig }(runNvidiaSmi)
+	runNvidiaSmi = fake.run
+	m := &nvidiaSmiMigManager{}
+
+	gpus, err := m.GPUs()
+	if err != nil {
+		t.Fatalf("GPUs() error = %v", err)
+	}
+	if diff := cmp.Diff([]string{"0", "1"}, gpus); diff != "" {
+		t.Errorf("GPUs() (-want, +got) = %s", diff)
+	}
+
+	current, pending, err := m.MigMode("0")
+	if err != nil || current || !pending {
+		t.Errorf("MigMode() = %v, %v, %v, want false, true, nil", current, pending, err)
+	}
+
+	if n, err := m.Processes("1"); err != nil || n != 2 {
+		t.Errorf("Processes() = %v, %v, want 2, nil", n, err)
+	}
+
+	instances, err := m.GPUInstances()
+	if err != nil {
+		t.Fatalf("GPUInstances() error = %v", err)
+	}
+	want := map[string][]gpuInstance{"1": {{ID: "1", ProfileID: "19", ComputeInstances: 1}, {ID: "2", ProfileID: "19", ComputeInstances: 1}}}
+	if diff := cmp.Diff(want, instances); diff != "" {
+		t.Errorf("GPUInstances() (-want, +got) = %s", diff)
+	}
+
+	if err := m.DestroyGPUInstances("0"); err != nil {
+		t.Errorf("DestroyGPUInstances() on a GPU without instances error = %v", err)
+	}
+	if err := m.DestroyGPUInstances("1"); err != nil {
+		t.Errorf("DestroyGPUInstances() error = %v", err)
+	}
+	instances, err = m.GPUInstances()
+	if err != nil {
+		t.Fatalf("GPUInstances() without instances error = %v", err)
+	}
+	if len(instances) != 0 {
+		t.Errorf("GPUInstances() = %v, want no instances", instances)
+	}
+
+	if err := m.CreateGPUInstances("1", []string{"9", "9"}, nil); err != nil {
+		t.Errorf("CreateGPUInstances() error = %v", err)
+	}
+	if err := m.CreateGPUInstances("0", []string{"9"}, &computeInstanceLayout{ProfileID: 0, Count: 3}); err != nil {
+		t.Errorf("CreateGPUInstances() with compute instances error = %v", err)
+	}
+	wantErr := "failed to run nvidia-smi mig -cgi 9 -i 2: output: Insufficient resources, error: exit status 2"
+	if err := m.CreateGPUInstances("2", []string{"9"}, nil); err == nil || err.Error() != wantErr {
+		t.Errorf("CreateGPUInstances() error = %v, want %s", err, wantErr)
+	}
+
+	if err := m.SetPersistenceMode("0", true); err != nil {
+		t.Errorf("SetPersistenceMode() error = %v", err)
+	}
+	if enabled, err := m.PersistenceMode("0"); err != nil || !enabled {
+		t.Errorf("PersistenceMode() = %v, %v, want true, nil", enabled, err)
+	}
+	wantErr = "failed to run nvidia-smi -i 0 -r: output: Unable to reset GPU in persistence mode., error: exit status 255"
+	if err := m.Reset("0"); err == nil || err.Error() != wantErr {
+		t.Errorf("Reset() in persistence mode error = %v, want %s", err, wantErr)
+	}
+	if err := m.SetPersistenceMode("0", false); err != nil {
+		t.Errorf("SetPersistenceMode() error = %v", err)
+	}
+	if err := m.Reset("0"); err != nil {
+		t.Errorf("Reset() error = %v", err)
+	}
+
+	wantCommands := []string{
+		"--query-gpu=index --format=csv,noheader",
+		"--query-gpu=mig.mode.current,mig.mode.pending --format=csv,noheader -i 0",
+		"--query-compute-apps=pid --format=csv,noheader -i 1",
+		"mig -lgi",
+		"mig -lci",
+		"mig -dci -i 0",
+		"mig -dgi -i 0",
+		"mig -dci -i 1",
+		"mig -dgi -i 1",
+		"mig -lgi",
+		"mig -lci",
+		"mig -cgi 9,9 -i 1",
+		"mig -cci -i 1",
+		"mig -cgi 9 -i 0",
+		"mig -cci 0,0,0 -i 0",
+		"mig -cgi 9 -i 2",
+		"-i 0 -pm 1",
+		"--query-gpu=persistence_mode --format=csv,noheader -i 0",
+		"-i 0 -r",
+		"-i 0 -pm 0",
+		"-i 0 -r",
+	}
+	if diff := cmp.Diff(wantCommands, fake.commands); diff != "" {
+		t.Errorf("unexpected nvidia-smi commands (-want, +got) = %s", diff)
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// nvmlDevice is the subset of nvml.Device used to manage MIG. It allows the
+// NVML backend to be tested with fake devices.
+type nvmlDevice interface {
+	GetMigMode() (int, int, nvml.Return)
+	SetMigMode(mode int) (nvml.Return, nvml.Return)
+	migprofile.Device
+	GpuInstances(info *nvml.GpuInstanceProfileInfo) ([]nvmlGpuInstance, nvml.Return)
+	CreateGpuInstance(info *nvml.GpuInstanceProfileInfo) (nvmlGpuInstance, nvml.Return)
+	GetComputeRunningProcesses() ([]nvml.ProcessInfo, nvml.Return)
+	GetPersistenceMode() (nvml.EnableState, nvml.Return)
+	SetPersistenceMode(mode nvml.EnableState) nvml.Return
+}
+
+// nvmlGpuInstance is the subset of nvml.GpuInstance used to manage MIG.
+type nvmlGpuInstance interface {
+	GetInfo() (nvml.GpuInstanceInfo, nvml.Return)
+	GetComputeInstanceProfileInfo(profile int, engProfile int) (nvml.ComputeInstanceProfileInfo, nvml.Return)
+	ComputeInstances(info *nvml.ComputeInstanceProfileInfo) ([]nvmlComputeInstance, nvml.Return)
+	CreateComputeInstance(info *nvml.ComputeInstanceProfileInfo) nvml.Return
+	Destroy() nvml.Return
+}
+
+// nvmlComputeInstance is the subset of nvml.ComputeInstance used to manage MIG.
+type nvmlComputeInstance interface {
+	Destroy() nvml.Return
+}
+
+// nvmlMigManager manages MIG through NVML.
+type nvmlMigManager struct {
+	devices []nvmlDevice
+}
+
+// newNvmlMigManager initializes NVML and returns a migManager for all GPUs on the node.
+func newNvmlMigManager() (*nvmlMigManager, error) {
+	if ret := nvml.Init(); ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("failed to initialize nvml: %v", nvml.ErrorString(ret))
+	}
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("failed to get device count: %v", nvml.ErrorString(ret))
+	}
+	m := &nvmlMigManager{}
+	for i := 0; i < count; i++ {
+		device, ret := nvml.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("failed to get handle of GPU %d: %v", i, nvml.ErrorString(ret))
+		}
+		m.devices = append(m.devices, &nvmlDeviceAdapter{device})
+	}
+	return m, nil
+}
+
+func (m *nvmlMigManager) GPUs() ([]string, error) {
+	var gpus []string
+	for i := range m.devices {
+		gpus = append(gpus, strconv.Itoa(i))
+	}
+	return gpus, nil
+}
+
+func (m *nvmlMigManager) MigMode(gpu string) (bool, bool, error) {
+	d, err := m.device(gpu)
+	if err != nil {
+		return false, false, err
+	}
+	current, pending, ret := d.GetMigMode()
+	if ret != nvml.SUCCESS {
+		return false, false, fmt.Errorf("failed to get MIG mode of GPU %s: %v", gpu, nvml.ErrorString(ret))
+	}
+	return current == nvml.DEVICE_MIG_ENABLE, pending == nvml.DEVICE_MIG_ENABLE, nil
+}
+
+func (m *nvmlMigManager) SetMigMode(gpu string, enabled bool) error {
+	d, err := m.device(gpu)
+	if err != nil {
+		return err
+	}
+	mode := nvml.DEVICE_MIG_DISABLE
+	if enabled {
+		mode = nvml.DEVICE_MIG_ENABLE
+	}
+	activation, ret := d.SetMigMode(mode)
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("failed to set MIG mode of GPU %s: %v", gpu, nvml.ErrorString(ret))
+	}
+	if activation != nvml.SUCCESS {
+		slog.Info("MIG mode takes effect after a GPU reset", logging.DeviceID, gpu, "activation_status", activation)
+	}
+	return nil
+}
+
+func (m *nvmlMigManager) GPUInstanceProfiles(gpu string) ([]migprofile.Profile, error) {
+	d, err := m.device(gpu)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := migprofile.Query(d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GPU instance profiles of GPU %s: %v", gpu, err)
+	}
+	return profiles, nil
+}
+
+func (m *nvmlMigManager) GPUInstances() (map[string][]gpuInstance, error) {
+	instances := make(map[string][]gpuInstance)
+	for i, d := range m.devices {
+		gpu := strconv.Itoa(i)
+		if current, _, ret := d.GetMigMode(); ret != nvml.SUCCESS || current != nvml.DEVICE_MIG_ENABLE {
+			continue
+		}
+		gis, err := gpuInstancesOf(d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list GPU instances of GPU %s: %v", gpu, err)
+		}
+		for _, gi := range gis {
+			info, ret := gi.GetInfo()
+			if ret != nvml.SUCCESS {
+				return nil, fmt.Errorf("failed to get GPU instance info on GPU %s: %v", gpu, nvml.ErrorString(ret))
+			}
+			cis, err := computeInstancesOf(gi)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list compute instances of GPU instance %d on GPU %s: %v", info.Id, gpu, err)
+			}
+			instances[gpu] = append(instances[gpu], gpuInstance{
+				ID:               strconv.Itoa(int(info.Id)),
+				ProfileID:        strconv.Itoa(int(info.ProfileId)),
+				ComputeInstances: len(cis),
+			})
+		}
+	}
+	return instances, nil
+}
+
+func (m *nvmlMigManager) CreateGPUInstances(gpu string, profileIDs []string, ci *computeInstanceLayout) error {
+	d, err := m.device(gpu)
+	if err != nil {
+		return err
+	}
+	infos, err := supportedProfiles(d)
+	if err != nil {
+		return fmt.Errorf("failed to get GPU instance profiles of GPU %s: %v", gpu, err)
+	}
+	byID := make(map[string]nvml.GpuInstanceProfileInfo)
+	for _, info := range infos {
+		byID[strconv.Itoa(int(info.Id))] = info
+	}
+	for _, id := range profileIDs {
+		info, ok := byID[id]
+		if !ok {
+			return fmt.Errorf("GPU instance profile %s is not supported by GPU %s", id, gpu)
+		}
+		gi, ret := d.CreateGpuInstance(&info)
+		if ret != nvml.SUCCESS {
+			return fmt.Errorf("failed to create GPU instance of profile %s on GPU %s: %v", id, gpu, nvml.ErrorString(ret))
+		}
+		if err := createComputeInstances(gi, ci); err != nil {
+			return fmt.Errorf("failed to create compute instances for GPU instance of profile %s on GPU %s: %v", id, gpu, err)
+		}
+	}
+	return nil
+}
+
+// createComputeInstances creates the compute instances of a layout in a GPU
+// instance, or a single compute instance that spans it if the layout is nil.
+func createComputeInstances(gi nvmlGpuInstance, ci *computeInstanceLayout) error {
+	if ci == nil {
+		info, err := fullComputeInstanceProfile(gi)
+		if err != nil {
+			return err
+		}
+		if ret := gi.CreateComputeInstance(&info); ret != nvml.SUCCESS {
+			return fmt.Errorf("failed to create compute instance: %v", nvml.ErrorString(ret))
+		}
+		return nil
+	}
+	info, ret := gi.GetComputeInstanceProfileInfo(ci.ProfileID, nvml.COMPUTE_INSTANCE_ENGINE_PROFILE_SHARED)
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("compute instance profile %d is not supported: %v", ci.ProfileID, nvml.ErrorString(ret))
+	}
+	for i := 0; i < ci.Count; i++ {
+		if ret := gi.CreateComputeInstance(&info); ret != nvml.SUCCESS {
+			return fmt.Errorf("failed to create compute instance %d of profile %d: %v", i, ci.ProfileID, nvml.ErrorString(ret))
+		}
+	}
+	return nil
+}
+
+func (m *nvmlMigManager) DestroyGPUInstances(gpu string) error {
+	d, err := m.device(gpu)
+	if err != nil {
+		return err
+	}
+	gis, err := gpuInstancesOf(d)
+	if err != nil {
+		return fmt.Errorf("failed to list GPU instances of GPU %s: %v", gpu, err)
+	}
+	for _, gi := range gis {
+		cis, err := computeInstancesOf(gi)
+		if err != nil {
+			return fmt.Errorf("failed to list compute instances on GPU %s: %v", gpu, err)
+		}
+		for _, ci := range cis {
+			if ret := ci.Destroy(); ret != nvml.SUCCESS {
+				return fmt.Errorf("failed to destroy compute instance on GPU %s: %v", gpu, nvml.ErrorString(ret))
+			}
+		}
+		if ret := gi.Destroy(); ret != nvml.SUCCESS {
+			return fmt.Errorf("failed to destroy GPU instance on GPU %s: %v", gpu, nvml.ErrorString(ret))
+		}
+	}
+	return nil
+}
+
+func (m *nvmlMigManager) Processes(gpu string) (int, error) {
+	d, err := m.device(gpu)
+	if err != nil {
+		return 0, err
+	}
+	processes, ret := d.GetComputeRunningProcesses()
+	if ret != nvml.SUCCESS {
+		return 0, fmt.Errorf("failed to list processes on GPU %s: %v", gpu, nvml.ErrorString(ret))
+	}
+	return len(processes), nil
+}
+
+func (m *nvmlMigManager) PersistenceMode(gpu string) (bool, error) {
+	d, err := m.device(gpu)
+	if err != nil {
+		return false, err
+	}
+	mode, ret := d.GetPersistenceMode()
+	if ret != nvml.SUCCESS {
+		return false, fmt.Errorf("failed to get persistence mode of GPU %s: %v", gpu, nvml.ErrorString(ret))
+	}
+	return mode == nvml.FEATURE_ENABLED, nil
+}
+
+func (m *nvmlMigManager) SetPersistenceMode(gpu string, enabled bool) error {
+	d, err := m.device(gpu)
+	if err != nil {
+		return err
+	}
+	mode := nvml.FEATURE_DISABLED
+	if enabled {
+		mode = nvml.FEATURE_ENABLED
+	}
+	if ret := d.SetPersistenceMode(mode); ret != nvml.SUCCESS {
+		return fmt.Errorf("failed to set persistence mode of GPU %s: %v", gpu, nvml.ErrorString(ret))
+	}
+	return nil
+}
+
+// Reset resets a GPU with nvidia-smi, as NVML has no API to reset a GPU. NVML
+// and nvidia-smi enumerate GPUs in the same order, so the index is the same.
+func (m *nvmlMigManager) Reset(gpu string) error {
+	if _, err := m.device(gpu); err != nil {
+		return err
+	}
+	return (&nvidiaSmiMigManager{}).Reset(gpu)
+}
+
+func (m *nvmlMigManager) device(gpu string) (nvmlDevice, error) {
+	i, err := strconv.Atoi(gpu)
+	if err != nil || i < 0 || i >= len(m.devices) {
+		return nil, fmt.Errorf("GPU %s not found", gpu)
+	}
+	return m.devices[i], nil
+}
+
+// supportedProfiles returns the info of the GPU instance profiles supported by a
+// device, keyed by NVML profile index.
+func supportedProfiles(d nvmlDevice) (map[int]nvml.GpuInstanceProfileInfo, error) {
+	infos := make(map[int]nvml.GpuInstanceProfileInfo)
+	for i := 0; i < nvml.GPU_INSTANCE_PROFILE_COUNT; i++ {
+		info, ret := d.GetGpuInstanceProfileInfo(i)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("failed to get GPU instance profile %d: %v", i, nvml.ErrorString(ret))
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+// gpuInstancesOf returns the GPU instances of all profiles on a device.
+func gpuInstancesOf(d nvmlDevice) ([]nvmlGpuInstance, error) {
+	infos, err := supportedProfiles(d)
+	if err != nil {
+		return nil, err
+	}
+	var gis []nvmlGpuInstance
+	for i := 0; i < nvml.GPU_INSTANCE_PROFILE_COUNT; i++ {
+		info, ok := infos[i]
+		if !ok {
+			continue
+		}
+		instances, ret := d.GpuInstances(&info)
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("failed to get GPU instances of profile %d: %v", info.Id, nvml.ErrorString(ret))
+		}
+		gis = append(gis, instances...)
+	}
+	return gis, nil
+}
+
+// computeInstancesOf returns the compute instances of all profiles in a GPU instance.
+func computeInstancesOf(gi nvmlGpuInstance) ([]nvmlComputeInstance, error) {
+	var cis []nvmlComputeInstance
+	for i := 0; i < nvml.COMPUTE_INSTANCE_PROFILE_COUNT; i++ {
+		info, ret := gi.GetComputeInstanceProfileInfo(i, nvml.COMPUTE_INSTANCE_ENGINE_PROFILE_SHARED)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("failed to get compute instance profile %d: %v", i, nvml.ErrorString(ret))
+		}
+		instances, ret := gi.ComputeInstances(&info)
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("failed to get compute instances of profile %d: %v", info.Id, nvml.ErrorString(ret))
+		}
+		cis = append(cis, instances...)
+	}
+	return cis, nil
+}
+
+// fullComputeInstanceProfile returns the compute instance profile that spans the
+// whole GPU instance, which is what nvidia-smi mig -cci creates by default.
+func fullComputeInstanceProfile(gi nvmlGpuInstance) (nvml.ComputeInstanceProfileInfo, error) {
+	var full nvml.ComputeInstanceProfileInfo
+	found := false
+	for i := 0; i < nvml.COMPUTE_INSTANCE_PROFILE_COUNT; i++ {
+		info, ret := gi.GetComputeInstanceProfileInfo(i, nvml.COMPUTE_INSTANCE_ENGINE_PROFILE_SHARED)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return full, fmt.Errorf("failed to get compute instance profile %d: %v", i, nvml.ErrorString(ret))
+		}
+		if !found || info.SliceCount > full.SliceCount {
+			full = info
+			found = true
+		}
+	}
+	if !found {
+		return full, fmt.Errorf("no compute instance profile is supported")
+	}
+	return full, nil
+}
+
+// nvmlDeviceAdapter implements nvmlDevice with an nvml.Device.
+type nvmlDeviceAdapter struct {
+	nvml.Device
+}
+
+func (d *nvmlDeviceAdapter) GpuInstanceProfileName(profile int) string {
+	return migprofile.NVMLDevice{Device: d.Device}.GpuInstanceProfileName(profile)
+}
+
+func (d *nvmlDeviceAdapter) GpuInstances(info *nvml.GpuInstanceProfileInfo) ([]nvmlGpuInstance, nvml.Return) {
+	instances, ret := d.Device.GetGpuInstances(info)
+	var gis []nvmlGpuInstance
+	for _, gi := range instances {
+		gis = append(gis, &nvmlGpuInstanceAdapter{gi})
+	}
+	return gis, ret
+}
+
+func (d *nvmlDeviceAdapter) CreateGpuInstance(info *nvml.GpuInstanceProfileInfo) (nvmlGpuInstance, nvml.Return) {
+	gi, ret := d.Device.CreateGpuInstance(info)
+	return &nvmlGpuInstanceAdapter{gi}, ret
+}
+
+// nvmlGpuInstanceAdapter implements nvmlGpuInstance with an nvml.GpuInstance.
+type nvmlGpuInstanceAdapter struct {
+	nvml.GpuInstance
+}
+
+func (gi *nvmlGpuInstanceAdapter) ComputeInstances(info *nvml.ComputeInstanceProfileInfo) ([]nvmlComputeInstance, nvml.Return) {
+	instances, ret := gi.GpuInstance.GetComputeInstances(info)
+	var cis []nvmlComputeInstance
+	for _, ci := range instances {
+		cis = append(cis, ci)
+	}
+	return cis, ret
+}
+
+func (gi *nvmlGpuInstanceAdapter) CreateComputeInstance(info *nvml.ComputeInstanceProfileInfo) nvml.Return {
+	_, ret := gi.GpuInstance.CreateComputeInstance(info)
+	return ret
+}
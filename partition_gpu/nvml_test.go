@@ -0,0 +1,288 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeNvmlDevice emulates an A100 40GB with the 1g.5gb and 3g.20gb profiles.
+type fakeNvmlDevice struct {
+	migMode    int
+	needsReset bool
+	pending    int
+	instances  []*fakeNvmlGpuInstance
+	nextID     uint32
+	processes  int
+	// persistenceMode is nvml.FEATURE_ENABLED or nvml.FEATURE_DISABLED.
+	persistenceMode nvml.EnableState
+}
+
+var fakeProfiles = map[int]nvml.GpuInstanceProfileInfo{
+	nvml.GPU_INSTANCE_PROFILE_1_SLICE: {Id: 19, SliceCount: 1, InstanceCount: 7, MultiprocessorCount: 14, MemorySizeMB: 4864},
+	nvml.GPU_INSTANCE_PROFILE_3_SLICE: {Id: 9, SliceCount: 3, InstanceCount: 2, MultiprocessorCount: 42, MemorySizeMB: 19968},
+}
+
+func (d *fakeNvmlDevice) GetMigMode() (int, int, nvml.Return) {
+	return d.migMode, d.pending, nvml.SUCCESS
+}
+
+func (d *fakeNvmlDevice) SetMigMode(mode int) (nvml.Return, nvml.Return) {
+	d.pending = mode
+	if d.needsReset {
+		return nvml.ERROR_RESET_REQUIRED, nvml.SUCCESS
+	}
+	d.migMode = mode
+	return nvml.SUCCESS, nvml.SUCCESS
+}
+
+func (d *fakeNvmlDevice) GetGpuInstanceProfileInfo(profile int) (nvml.GpuInstanceProfileInfo, nvml.Return) {
+	info, ok := fakeProfiles[profile]
+	if !ok {
+		return info, nvml.ERROR_NOT_SUPPORTED
+	}
+	return info, nvml.SUCCESS
+}
+
+func (d *fakeNvmlDevice) GpuInstanceProfileName(profile int) string {
+	if profile == nvml.GPU_INSTANCE_PROFILE_3_SLICE {
+		return "MIG 3g.20gb"
+	}
+	return ""
+}
+
+func (d *fakeNvmlDevice) GpuInstances(info *nvml.GpuInstanceProfileInfo) ([]nvmlGpuInstance, nvml.Return) {
+	var gis []nvmlGpuInstance
+	for _, gi := range d.instances {
+		if gi.profileID == info.Id && !gi.destroyed {
+			gis = append(gis, gi)
+		}
+	}
+	return gis, nvml.SUCCESS
+}
+
+func (d *fakeNvmlDevice) CreateGpuInstance(info *nvml.GpuInstanceProfileInfo) (nvmlGpuInstance, nvml.Return) {
+	d.nextID++
+	gi := &fakeNvmlGpuInstance{id: d.nextID, profileID: info.Id, sliceCount: info.SliceCount}
+	d.instances = append(d.instances, gi)
+	return gi, nvml.SUCCESS
+}
+
+func (d *fakeNvmlDevice) GetComputeRunningProcesses() ([]nvml.ProcessInfo, nvml.Return) {
+	return make([]nvml.ProcessInfo, d.processes), nvml.SUCCESS
+}
+
+func (d *fakeNvmlDevice) GetPersistenceMode() (nvml.EnableState, nvml.Return) {
+	return d.persistenceMode, nvml.SUCCESS
+}
+
+func (d *fakeNvmlDevice) SetPersistenceMode(mode nvml.EnableState) nvml.Return {
+	d.persistenceMode = mode
+	return nvml.SUCCESS
+}
+
+type fakeNvmlGpuInstance struct {
+	id, profileID, sliceCount uint32
+	// computeInstances holds the slice count of each compute instance.
+	computeInstances []*fakeNvmlComputeInstance
+	destroyed        bool
+}
+
+func (gi *fakeNvmlGpuInstance) GetInfo() (nvml.GpuInstanceInfo, nvml.Return) {
+	return nvml.GpuInstanceInfo{Id: gi.id, ProfileId: gi.profileID}, nvml.SUCCESS
+}
+
+func (gi *fakeNvmlGpuInstance) GetComputeInstanceProfileInfo(profile int, engProfile int) (nvml.ComputeInstanceProfileInfo, nvml.Return) {
+	if uint32(profile) >= gi.sliceCount {
+		return nvml.ComputeInstanceProfileInfo{}, nvml.ERROR_NOT_SUPPORTED
+	}
+	return nvml.ComputeInstanceProfileInfo{Id: uint32(profile), SliceCount: uint32(profile) + 1}, nvml.SUCCESS
+}
+
+func (gi *fakeNvmlGpuInstance) ComputeInstances(info *nvml.ComputeInstanceProfileInfo) ([]nvmlComputeInstance, nvml.Return) {
+	var cis []nvmlComputeInstance
+	for _, ci := range gi.computeInstances {
+		if ci.sliceCount == info.SliceCount && !ci.destroyed {
+			cis = append(cis, ci)
+		}
+	}
+	return cis, nvml.SUCCESS
+}
+
+func (gi *fakeNvmlGpuInstance) CreateComputeInstance(info *nvml.ComputeInstanceProfileInfo) nvml.Return {
+	gi.computeInstances = append(gi.computeInstances, &fakeNvmlComputeInstance{sliceCount: info.SliceCount})
+	return nvml.SUCCESS
+}
+
+func (gi *fakeNvmlGpuInstance) Destroy() nvml.Return {
+	for _, ci := range gi.computeInstances {
+		if !ci.destroyed {
+			return nvml.ERROR_IN_USE
+		}
+	}
+	gi.destroyed = true
+	return nvml.SUCCESS
+}
+
+type fakeNvmlComputeInstance struct {
+	sliceCount uint32
+	destroyed  bool
+}
+
+func (ci *fakeNvmlComputeInstance) Destroy() nvml.Return {
+	ci.destroyed = true
+	return nvml.SUCCESS
+}
+
+func Test_nvmlMigManager_GPUInstanceProfiles(t *testing.T) {
+	m := &nvmlMigManager{devices: []nvmlDevice{&fakeNvmlDevice{}}}
+	want := []migprofile.Profile{
+		{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE, ID: 19, Name: "1g.5gb", MaxCount: 7, MemoryMB: 4864, SliceCount: 1, MultiprocessorCount: 14},
+		{Index: nvml.GPU_INSTANCE_PROFILE_3_SLICE, ID: 9, Name: "3g.20gb", MaxCount: 2, MemoryMB: 19968, SliceCount: 3, MultiprocessorCount: 42},
+	}
+	got, err := m.GPUInstanceProfiles("0")
+	if err != nil {
+		t.Fatalf("GPUInstanceProfiles() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GPUInstanceProfiles() (-want, +got) = %s", diff)
+	}
+	if _, err := m.GPUInstanceProfiles("1"); err == nil {
+		t.Errorf("GPUInstanceProfiles() of a missing GPU succeeded, want error")
+	}
+}
+
+func Test_nvmlMigManager_MigMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		device      *fakeNvmlDevice
+		wantCurrent bool
+		wantPending bool
+	}{
+		{name: "Takes effect immediately", device: &fakeNvmlDevice{}, wantCurrent: true, wantPending: true},
+		{name: "Needs GPU reset", device: &fakeNvmlDevice{needsReset: true}, wantCurrent: false, wantPending: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &nvmlMigManager{devices: []nvmlDevice{tt.device}}
+			if err := m.SetMigMode("0", true); err != nil {
+				t.Fatalf("SetMigMode() error = %v", err)
+			}
+			current, pending, err := m.MigMode("0")
+			if err != nil {
+				t.Fatalf("MigMode() error = %v", err)
+			}
+			if current != tt.wantCurrent || pending != tt.wantPending {
+				t.Errorf("MigMode() = %v, %v, want %v, %v", current, pending, tt.wantCurrent, tt.wantPending)
+			}
+		})
+	}
+}
+
+func Test_nvmlMigManager_PersistenceMode(t *testing.T) {
+	m := &nvmlMigManager{devices: []nvmlDevice{&fakeNvmlDevice{persistenceMode: nvml.FEATURE_ENABLED}}}
+	if enabled, err := m.PersistenceMode("0"); err != nil || !enabled {
+		t.Errorf("PersistenceMode() = %v, %v, want true, nil", enabled, err)
+	}
+	if err := m.SetPersistenceMode("0", false); err != nil {
+		t.Fatalf("SetPersistenceMode() error = %v", err)
+	}
+	if enabled, err := m.PersistenceMode("0"); err != nil || enabled {
+		t.Errorf("PersistenceMode() after disabling = %v, %v, want false, nil", enabled, err)
+	}
+	if err := m.SetPersistenceMode("1", true); err == nil {
+		t.Errorf("SetPersistenceMode() of a missing GPU succeeded, want error")
+	}
+	if err := m.Reset("1"); err == nil {
+		t.Errorf("Reset() of a missing GPU succeeded, want error")
+	}
+}
+
+func Test_nvmlMigManager_GPUInstances(t *testing.T) {
+	d0 := &fakeNvmlDevice{migMode: nvml.DEVICE_MIG_ENABLE, processes: 3}
+	d1 := &fakeNvmlDevice{migMode: nvml.DEVICE_MIG_ENABLE}
+	m := &nvmlMigManager{devices: []nvmlDevice{d0, d1}}
+
+	if err := m.CreateGPUInstances("0", []string{"19", "19"}, nil); err != nil {
+		t.Fatalf("CreateGPUInstances() error = %v", err)
+	}
+	if err := m.CreateGPUInstances("1", []string{"9"}, nil); err != nil {
+		t.Fatalf("CreateGPUInstances() error = %v", err)
+	}
+	if err := m.CreateGPUInstances("1", []string{"14"}, nil); err == nil {
+		t.Errorf("CreateGPUInstances() with an unsupported profile succeeded, want error")
+	}
+	if got := d1.instances[0].computeInstances[0].sliceCount; got != 3 {
+		t.Errorf("compute instance slice count = %d, want the whole GPU instance 3", got)
+	}
+
+	want := map[string][]gpuInstance{
+		"0": {{ID: "1", ProfileID: "19", ComputeInstances: 1}, {ID: "2", ProfileID: "19", ComputeInstances: 1}},
+		"1": {{ID: "1", ProfileID: "9", ComputeInstances: 1}},
+	}
+	got, err := m.GPUInstances()
+	if err != nil {
+		t.Fatalf("GPUInstances() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GPUInstances() (-want, +got) = %s", diff)
+	}
+
+	if err := m.DestroyGPUInstances("0"); err != nil {
+		t.Fatalf("DestroyGPUInstances() error = %v", err)
+	}
+	delete(want, "0")
+	got, err = m.GPUInstances()
+	if err != nil {
+		t.Fatalf("GPUInstances() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GPUInstances() after destroy (-want, +got) = %s", diff)
+	}
+
+	if n, err := m.Processes("0"); err != nil || n != 3 {
+		t.Errorf("Processes() = %v, %v, want 3, nil", n, err)
+	}
+}
+
+func Test_nvmlMigManager_CreateComputeInstances(t *testing.T) {
+	d := &fakeNvmlDevice{migMode: nvml.DEVICE_MIG_ENABLE}
+	m := &nvmlMigManager{devices: []nvmlDevice{d}}
+
+	ci := &computeInstanceLayout{ProfileID: nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE, Count: 3}
+	if err := m.CreateGPUInstances("0", []string{"9", "9"}, ci); err != nil {
+		t.Fatalf("CreateGPUInstances() error = %v", err)
+	}
+	want := map[string][]gpuInstance{
+		"0": {{ID: "1", ProfileID: "9", ComputeInstances: 3}, {ID: "2", ProfileID: "9", ComputeInstances: 3}},
+	}
+	got, err := m.GPUInstances()
+	if err != nil {
+		t.Fatalf("GPUInstances() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GPUInstances() (-want, +got) = %s", diff)
+	}
+	for _, gi := range d.instances {
+		for _, ci := range gi.computeInstances {
+			if ci.sliceCount != 1 {
+				t.Errorf("compute instance slice count = %d, want 1", ci.sliceCount)
+			}
+		}
+	}
+}
@@ -15,425 +15,215 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"os/exec"
-	"regexp"
-	"strings"
 	"syscall"
+	"time"
 
-	"github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/driver"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migstatus"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 )
 
 var (
-	nvidiaSmiPath = flag.String("nvidia-smi-path", "/usr/local/nvidia/bin/nvidia-smi", "Path where nvidia-smi is installed.")
-	gpuConfigFile = flag.String("gpu-config", "/etc/nvidia/gpu_config.json", "File with GPU configurations for device plugin")
+	nvidiaSmiPath     = flag.String("nvidia-smi-path", "/usr/local/nvidia/bin/nvidia-smi", "Path where nvidia-smi is installed.")
+	gpuConfigFile     = flag.String("gpu-config", "/etc/nvidia/gpu_config.json", "File with GPU configurations for device plugin")
+	statusFile        = flag.String("status-file", migstatus.DefaultPath, "File to report the state of the GPU partitions to. The device plugin watches it to pick up new partitions. If empty, no status is reported")
+	reconcileInterval = flag.Duration("reconcile-interval", 0, "Interval at which the GPU partitions are compared with the GPU config and reconfigured. If 0, the GPUs are partitioned once and the partitioner exits")
+	gpuReset          = flag.Bool("gpu-reset", true, "Reset the GPUs on which MIG mode only takes effect after a GPU reset, instead of rebooting the node. The node is still rebooted if a GPU can't be reset")
+	noReboot          = flag.Bool("no-reboot", false, "Don't reboot the node when MIG mode only takes effect after a reboot. The GPUs are reported as RebootRequired in the status file, and the partitioner exits with code 3")
+	migBackend        = flag.String("mig-backend", backendAuto, "How MIG is managed: nvml, nvidia-smi, or auto to use NVML and fall back to nvidia-smi if NVML is not available")
 )
 
-var partitionSizeToProfileID = map[string]string{
-	//nvidia-tesla-a100
-	"1g.5gb":  "19",
-	"2g.10gb": "14",
-	"3g.20gb": "9",
-	"4g.20gb": "5",
-	"7g.40gb": "0",
-	//nvidia-a100-80gb, nvidia-h100-80gb
-	"1g.10gb": "19",
-	"2g.20gb": "14",
-	"3g.40gb": "9",
-	"4g.40gb": "5",
-	"7g.80gb": "0",
-	//nvidia-h100-80gb
-	"1g.20gb": "15",
+var dryRun bool
 
-	//nvidia-h200-141gb
-	"1g.18gb":  "19",
-	"1g.35gb":  "15",
-	"2g.35gb":  "14",
-	"3g.71gb":  "9",
-	"4g.71gb":  "5",
-	"7g.141gb": "0",
-
-	//nvidia-b200, nvidia-gb200
-	"1g.23gb": "19",
-	//nvidia-b200
-	"1g.45gb":  "15",
-	"2g.45gb":  "14",
-	"3g.90gb":  "9",
-	"4g.90gb":  "5",
-	"7g.180gb": "0",
-
-	//nvidia-gb200
-	"1g.47gb":  "15",
-	"2g.47gb":  "14",
-	"3g.93gb":  "9",
-	"4g.93gb":  "5",
-	"7g.186gb": "0",
-}
-
-var partitionSizeMaxCount = map[string]int{
-	//nvidia-tesla-a100
-	"1g.5gb":  7,
-	"2g.10gb": 3,
-	"3g.20gb": 2,
-	"4g.20gb": 1,
-	"7g.40gb": 1,
-	//nvidia-a100-80gb, nvidia-h100-80gb
-	"1g.10gb": 7,
-	"2g.20gb": 3,
-	"3g.40gb": 2,
-	"4g.40gb": 1,
-	"7g.80gb": 1,
-	//nvidia-h100-80gb
-	"1g.20gb": 4,
-	//nvidia-h200-141gb
-	"1g.18gb":  7,
-	"1g.35gb":  4,
-	"2g.35gb":  3,
-	"3g.71gb":  2,
-	"4g.71gb":  1,
-	"7g.141gb": 1,
-	//nvidia-b200, nvidia-gb200
-	"1g.23gb": 7,
-	//nvidia-b200
-	"1g.45gb":  4,
-	"2g.45gb":  3,
-	"3g.90gb":  2,
-	"4g.90gb":  1,
-	"7g.180gb": 1,
-	//nvidia-gb200
-	"1g.47gb":  4,
-	"2g.47gb":  3,
-	"3g.93gb":  2,
-	"4g.93gb":  1,
-	"7g.186gb": 1,
+func init() {
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the plan to partition the GPUs as JSON, without changing anything")
+	flag.BoolVar(&dryRun, "plan", false, "Same as -dry-run")
 }
 
 const (
-	SIGRTMIN        = 34
-	NvidiaGB200     = "NVIDIA GB200"          //nvidia-gb200
-	NvidiaB200      = "NVIDIA B200"           //nvidia-b200
-	Nvidia141gbH200 = "NVIDIA H200"           //nvidia-h200-141gb
-	Nvidia80gbH100  = "NVIDIA H100 80GB HBM3" //nvidia-h100-80gb
-	Nvidia40gbA100  = "NVIDIA A100-SXM4-40GB" //nvidia-tesla-a100
-	Nvidia80gbA100  = "NVIDIA A100-SXM4-80GB" //nvidia-a100-80gb
+	SIGRTMIN = 34
+	// procDirectory is where the version of the loaded NVIDIA driver is read
+	// from.
+	procDirectory = "/proc"
+	// exitRebootRequired is the exit code with -no-reboot when the node must be
+	// rebooted for MIG mode to take effect.
+	exitRebootRequired = 3
 )
 
+var errRebootRequired = errors.New("node reboot required for MIG mode to take effect")
+
 // GPUConfig stores the settings used to configure the GPUs on a node.
 type GPUConfig struct {
 	GPUPartitionSize string
+	// ComputeInstanceSize is the size of the compute instances to split each GPU
+	// instance into, as a number of slices, e.g. 1c. If empty, each GPU instance
+	// has a single compute instance.
+	ComputeInstanceSize string
 }
 
 func main() {
+	logging.AddFlags(flag.CommandLine)
 	flag.Parse()
-
-	if _, err := os.Stat(*gpuConfigFile); os.IsNotExist(err) {
-		glog.Infof("No GPU config file given, nothing to do.")
-		return
-	}
-	gpuConfig, err := parseGPUConfig(*gpuConfigFile)
-	if err != nil {
-		glog.Infof("failed to parse GPU config file, taking no action.")
-		return
-	}
-	glog.Infof("Using gpu config: %v", gpuConfig)
-	if gpuConfig.GPUPartitionSize == "" {
-		glog.Infof("No GPU partitions are required, exiting")
-		return
-	}
-
-	if _, err := os.Stat(*nvidiaSmiPath); os.IsNotExist(err) {
-		glog.Errorf("nvidia-smi path %s not found: %v", *nvidiaSmiPath, err)
-		os.Exit(1)
+	if err := logging.Setup("gpu-partitioner"); err != nil {
+		logging.Fatal("Failed to set up logging", logging.Error, err)
 	}
 
-	migModeEnabled, err := currentMigMode()
+	m, err := newMigManager(*migBackend)
 	if err != nil {
-		glog.Errorf("Failed to check if MIG mode is enabled: %v", err)
-		os.Exit(1)
-	}
-	if !migModeEnabled {
-		glog.Infof("MIG mode is not enabled. Enabling now.")
-		glog.Infof("Checking the GPU type now.")
-		gpuType, err := checkGpuType()
-		if err != nil {
-			glog.Errorf("Failed to check GPU Type: %v", err)
-			os.Exit(1)
-		}
-		glog.Infof("Got GPU type used: %s", gpuType)
-		if err := enableMigMode(); err != nil {
-			glog.Errorf("Failed to enable MIG mode: %v", err)
-			os.Exit(1)
-		}
-		// On NVIDIA Ampere GPUs, when MIG mode is enabled, the driver will attempt to reset the GPU so that MIG mode can take effect.
-		// Starting with the Hopper generation of GPUs, enabling MIG mode no longer requires a GPU reset to take effect.
-		// See https://docs.nvidia.com/datacenter/tesla/mig-user-guide/#enable-mig-mode for more information
-		if gpuType == Nvidia40gbA100 || gpuType == Nvidia80gbA100 {
-			glog.Infof("Rebooting node to enable MIG mode")
-			if err := rebootNode(); err != nil {
-				glog.Errorf("Failed to trigger node reboot after enabling MIG mode: %v", err)
+		logging.Fatal("Failed to set up MIG management", logging.Error, err)
+	}
+	r := newReconciler(m, *statusFile)
+	for {
+		if err := run(r); err != nil {
+			if err == errRebootRequired {
+				slog.Error("Not rebooting the node", logging.Error, err)
+				os.Exit(exitRebootRequired)
+			}
+			var unsupported *driver.UnsupportedError
+			if errors.As(err, &unsupported) {
+				logging.Fatal("The NVIDIA driver doesn't support GPU partitions", logging.Error, err)
+			}
+			slog.Error("Failed to partition GPUs", logging.Error, err)
+			if *reconcileInterval <= 0 || dryRun {
+				os.Exit(1)
 			}
-			// Exit, since we cannot proceed until node has rebooted, for MIG changes to take effect on NVIDIA Ampere GPUs.
-			os.Exit(1)
 		}
+		if *reconcileInterval <= 0 || dryRun {
+			return
+		}
+		time.Sleep(*reconcileInterval)
 	}
-
-	glog.Infof("MIG mode is enabled on all GPUs, proceeding to create GPU partitions.")
-
-	// get the current partitions
-	desiredMaxCount := partitionSizeMaxCount[gpuConfig.GPUPartitionSize]
-	isDesiredPartition := checkCurrentPartitionProfileCounts(desiredMaxCount)
-	if isDesiredPartition {
-		glog.Infof("Current GPU partition configuration matches the desired state. No changes needed.")
-		runNvidiaSmiStatus()
-		return
-	}
-
-	glog.Infof("Current GPU partition configuration does not match the desired state. Reconfiguring partitions...")
-	glog.Infof("Cleaning up any existing GPU partitions")
-	if err := cleanupAllGPUPartitions(); err != nil {
-		glog.Errorf("Failed to cleanup GPU partitions: %v", err)
-		os.Exit(1)
-	}
-
-	glog.Infof("Creating new GPU partitions")
-	if err := createGPUPartitions(gpuConfig.GPUPartitionSize); err != nil {
-		glog.Errorf("Failed to create GPU partitions: %v", err)
-		os.Exit(1)
-	}
-
-	runNvidiaSmiStatus()
 }
 
-func parseGPUConfig(gpuConfigFile string) (GPUConfig, error) {
-	var gpuConfig GPUConfig
-
-	gpuConfigContent, err := ioutil.ReadFile(gpuConfigFile)
-	if err != nil {
-		return gpuConfig, fmt.Errorf("unable to read gpu config file %s: %v", gpuConfigFile, err)
-	}
-
-	if err = json.Unmarshal(gpuConfigContent, &gpuConfig); err != nil {
-		return gpuConfig, fmt.Errorf("failed to parse GPU config file contents: %s, error: %v", gpuConfigContent, err)
+// run enables MIG mode if needed and partitions the GPUs as defined in the GPU config.
+func run(r *reconciler) error {
+	if _, err := os.Stat(*gpuConfigFile); os.IsNotExist(err) {
+		slog.Info("No GPU config file given, nothing to do")
+		return nil
 	}
-	return gpuConfig, nil
-}
-
-// currentMigMode returns whether mig mode is currently enabled all GPUs attached to this node.
-func currentMigMode() (bool, error) {
-	out, err := exec.Command(*nvidiaSmiPath, "--query-gpu=mig.mode.current", "--format=csv,noheader").Output()
+	gpuConfig, err := parseGPUConfig(*gpuConfigFile)
 	if err != nil {
-		return false, err
-	}
-	if strings.HasPrefix(string(out), "Enabled") {
-		return true, nil
+		slog.Error("Failed to parse GPU config file, taking no action", "path", *gpuConfigFile, logging.Error, err)
+		return nil
 	}
-	if strings.HasPrefix(string(out), "Disabled") {
-		return false, nil
+	if gpuConfig.GPUPartitionSize == "" {
+		slog.Info("No GPU partitions are required, nothing to do")
+		return nil
 	}
-	return false, fmt.Errorf("nvidia-smi returned invalid output: %s", out)
-}
-
-// enableMigMode enables MIG mode on all GPUs attached to the node. Requires node restart to take effect.
-func enableMigMode() error {
-	return exec.Command(*nvidiaSmiPath, "-mig", "1").Run()
-}
 
-// checkGpuType checkes the GPU type used
-func checkGpuType() (string, error) {
-	gpuType, err := exec.Command(*nvidiaSmiPath, "--query-gpu=gpu_name", "--format=csv,noheader").Output()
+	version, err := driver.FromProcfs(procDirectory)
 	if err != nil {
-		return "", err
+		return err
 	}
-	switch {
-	case strings.HasPrefix(string(gpuType), NvidiaGB200):
-		return NvidiaGB200, nil
-	case strings.HasPrefix(string(gpuType), NvidiaB200):
-		return NvidiaB200, nil
-	case strings.HasPrefix(string(gpuType), Nvidia141gbH200):
-		return Nvidia141gbH200, nil
-	case strings.HasPrefix(string(gpuType), Nvidia80gbH100):
-		return Nvidia80gbH100, nil
-	case strings.HasPrefix(string(gpuType), Nvidia40gbA100):
-		return Nvidia40gbA100, nil
-	case strings.HasPrefix(string(gpuType), Nvidia80gbA100):
-		return Nvidia80gbA100, nil
+	if err := driver.Check(version, driver.MIG); err != nil {
+		return err
 	}
-	return "", fmt.Errorf("nvidia-smi returned invalid GPU type for MIG: %s", gpuType)
-}
 
-func rebootNode() error {
-	// Gracefully reboot systemd: https://man7.org/linux/man-pages/man1/systemd.1.html#SIGNALS
-	return syscall.Kill(1, SIGRTMIN+5)
-}
-
-func cleanupAllGPUPartitions() error {
-	args := []string{"mig", "-dci"}
-	glog.Infof("Running %s %s", *nvidiaSmiPath, strings.Join(args, " "))
-	out, err := exec.Command(*nvidiaSmiPath, args...).Output()
-	if err != nil && !strings.Contains(string(out), "No GPU instances found") &&
-		!strings.Contains(string(out), "No compute instances found") {
-		return fmt.Errorf("failed to destroy compute instance, nvidia-smi output: %s, error: %v ", string(out), err)
+	if _, ok := r.mig.(*nvidiaSmiMigManager); ok {
+		if _, err := os.Stat(*nvidiaSmiPath); os.IsNotExist(err) {
+			return fmt.Errorf("nvidia-smi path %s not found: %v", *nvidiaSmiPath, err)
+		}
 	}
-	glog.Infof("Output:\n %s", string(out))
 
-	args = []string{"mig", "-dgi"}
-	glog.Infof("Running %s %s", *nvidiaSmiPath, strings.Join(args, " "))
-	out, err = exec.Command(*nvidiaSmiPath, args...).Output()
-	if err != nil && !strings.Contains(string(out), "No GPU instances found") &&
-		!strings.Contains(string(out), "No compute instances found") {
-		return fmt.Errorf("failed to destroy gpu instance, nvidia-smi output: %s, error: %v ", string(out), err)
+	if dryRun {
+		return printPlan(r.mig, gpuConfig, os.Stdout)
 	}
-	glog.Infof("Output:\n %s", string(out))
-	return nil
-}
 
-func createGPUPartitions(partitionSize string) error {
-	p, err := buildPartitionStr(partitionSize)
+	resetRequired, err := enableMigMode(r.mig)
 	if err != nil {
 		return err
 	}
-
-	args := []string{"mig", "-cgi", p}
-	glog.Infof("Running %s %s", *nvidiaSmiPath, strings.Join(args, " "))
-	out, err := exec.Command(*nvidiaSmiPath, args...).Output()
-	if err != nil {
-		return fmt.Errorf("failed to create GPU Instances: output: %s, error: %v", string(out), err)
-	}
-	glog.Infof("Output:\n %s", string(out))
-
-	args = []string{"mig", "-cci"}
-	glog.Infof("Running %s %s", *nvidiaSmiPath, strings.Join(args, " "))
-	out, err = exec.Command(*nvidiaSmiPath, args...).Output()
-	if err != nil {
-		return fmt.Errorf("failed to create compute instances: output: %s, error: %v", string(out), err)
-	}
-	glog.Infof("Output:\n %s", string(out))
-
-	return nil
-
-}
-
-func buildPartitionStr(partitionSize string) (string, error) {
-	if partitionSize == "" {
-		return "", nil
+	if len(resetRequired) > 0 && *gpuReset {
+		resetRequired = resetGPUs(r.mig, resetRequired)
 	}
-
-	p, ok := partitionSizeToProfileID[partitionSize]
-	if !ok {
-		return "", fmt.Errorf("%s is not a valid partition size", partitionSize)
+	if len(resetRequired) > 0 {
+		if *noReboot {
+			if err := r.reportRebootRequired(gpuConfig); err != nil {
+				slog.Error("Failed to report the GPUs that need a reboot", logging.Error, err)
+			}
+			return errRebootRequired
+		}
+		slog.Info("Rebooting node to enable MIG mode")
+		if err := rebootNode(); err != nil {
+			slog.Error("Failed to trigger node reboot after enabling MIG mode", logging.Error, err)
+		}
+		// Exit, since we cannot proceed until node has rebooted, for MIG changes to take effect.
+		os.Exit(1)
 	}
 
-	partitionStr := p
-	for i := 1; i < partitionSizeMaxCount[partitionSize]; i++ {
-		partitionStr += fmt.Sprintf(",%s", p)
+	changed, err := r.reconcile(gpuConfig)
+	if changed {
+		runNvidiaSmiStatus()
 	}
-
-	return partitionStr, nil
+	return err
 }
 
-// getCurrentPartitionProfileCounts checks for active MIG GPU instances,
-// and outputs a map of their profileIDs -> counts
-func checkCurrentPartitionProfileCounts(desiredMaxCount int) bool {
-	args := []string{"mig", "-lgi"}
-	out, err := exec.Command(*nvidiaSmiPath, args...).Output()
+func parseGPUConfig(gpuConfigFile string) (GPUConfig, error) {
+	var gpuConfig GPUConfig
+
+	gpuConfigContent, err := ioutil.ReadFile(gpuConfigFile)
 	if err != nil {
-		glog.Errorf("failed to execute 'nvidia-smi mig -lgi': %v", err)
-		return false
+		return gpuConfig, fmt.Errorf("unable to read gpu config file %s: %v", gpuConfigFile, err)
 	}
 
-	glog.Infof("Output:\n %s", string(out))
-	outputText := string(out)
-	partitions, uniform, lgiError := parseLGIOutput(outputText)
-	if lgiError != nil {
-		glog.Errorf("failed to parse 'nvidia-smi mig -lgi' output: %v", lgiError)
-		return false
-	}
-	if !uniform {
-		glog.Info("Partitions are not uniform, partition reconstruction needed.")
-		return uniform
+	if err = json.Unmarshal(gpuConfigContent, &gpuConfig); err != nil {
+		return gpuConfig, fmt.Errorf("failed to parse GPU config file contents: %s, error: %v", gpuConfigContent, err)
 	}
-	desiredPartition := checkDesired(partitions, desiredMaxCount)
-
-	return desiredPartition
+	return gpuConfig, nil
 }
 
-// returns profile id map and if uniform
-func parseLGIOutput(lgiOutput string) (map[string][]string, bool, error) {
-	dataLineRegex, err := regexp.Compile(`^\s*(\d+)\s+(MIG\s+[\w\.]+)\s+(\d+)\s+(\d+)\s+([\d:]+)\s*$`)
+// enableMigMode enables MIG mode on all GPUs on which it isn't enabled yet. It
+// returns the GPUs on which MIG mode only takes effect after a GPU reset.
+func enableMigMode(m migManager) ([]string, error) {
+	gpus, err := m.GPUs()
 	if err != nil {
-		glog.Errorf("Internal error: failed to compile regex: %v", err)
-		return make(map[string][]string), false, err
+		return nil, err
 	}
-
-	gpuProfileIDsMap := make(map[string][]string)
-	profileIDFirst := ""
-
-	scanner := bufio.NewScanner(strings.NewReader(lgiOutput))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		if strings.Contains(line, "====") {
-			continue
+	var resetRequired []string
+	for _, gpu := range gpus {
+		current, _, err := m.MigMode(gpu)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if MIG mode is enabled: %v", err)
 		}
-		if !strings.HasPrefix(line, "|") || !strings.HasSuffix(line, "|") {
+		if current {
 			continue
 		}
-
-		contentInPipes := strings.TrimSpace(line[1 : len(line)-1])
-		matches := dataLineRegex.FindStringSubmatch(contentInPipes)
-
-		if len(matches) == 6 {
-			gpuIndex := matches[1]
-			profileID := matches[3]
-			if profileIDFirst == "" {
-				profileIDFirst = profileID
-			} else {
-				if profileIDFirst != profileID {
-					return gpuProfileIDsMap, false, nil
-				}
-			}
-			gpuProfileIDsMap[gpuIndex] = append(gpuProfileIDsMap[gpuIndex], profileID)
-			glog.Infof("Parsed GI on GPU %s: Profile ID %s", gpuIndex, profileID)
-		} else if contentInPipes != "" {
-			glog.Infof("Line did not match expected GI data format: '%s' (Content: '%s')", line, contentInPipes)
+		slog.Info("MIG mode is not enabled, enabling it now", logging.DeviceID, gpu)
+		if err := m.SetMigMode(gpu, true); err != nil {
+			return nil, fmt.Errorf("failed to enable MIG mode: %v", err)
 		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return gpuProfileIDsMap, false, err
-	}
-
-	if len(gpuProfileIDsMap) == 0 {
-		return gpuProfileIDsMap, false, nil
-	}
-	glog.Infof("map: %v", gpuProfileIDsMap)
-	return gpuProfileIDsMap, true, nil
-}
-
-func checkDesired(partitions map[string][]string, desiredMaxCount int) bool {
-	if len(partitions) == 0 {
-		return false
-	}
-
-	for _, profileIDsOnGpu := range partitions {
-		if len(profileIDsOnGpu) != desiredMaxCount {
-			return false
+		// On NVIDIA Ampere GPUs, when MIG mode is enabled, the driver will attempt to reset the GPU so that MIG mode can take effect.
+		// Starting with the Hopper generation of GPUs, enabling MIG mode no longer requires a GPU reset to take effect.
+		// See https://docs.nvidia.com/datacenter/tesla/mig-user-guide/#enable-mig-mode for more information
+		current, pending, err := m.MigMode(gpu)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if MIG mode is enabled: %v", err)
+		}
+		if !current && pending {
+			resetRequired = append(resetRequired, gpu)
 		}
 	}
+	return resetRequired, nil
+}
 
-	return true
+func rebootNode() error {
+	// Gracefully reboot systemd: https://man7.org/linux/man-pages/man1/systemd.1.html#SIGNALS
+	return syscall.Kill(1, SIGRTMIN+5)
 }
 
 func runNvidiaSmiStatus() {
-	glog.Infof("Running %s", *nvidiaSmiPath)
+	slog.Info("Running nvidia-smi", "path", *nvidiaSmiPath)
 	out, err := exec.Command(*nvidiaSmiPath).Output()
 	if err != nil {
-		glog.Errorf("Failed to run nvidia-smi, output: %s, error: %v", string(out), err)
+		slog.Error("Failed to run nvidia-smi", "output", string(out), logging.Error, err)
 	}
-	glog.Infof("Output:\n %s", string(out))
+	slog.Info("nvidia-smi finished", "output", string(out))
 }
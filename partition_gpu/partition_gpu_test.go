@@ -15,183 +15,83 @@
 package main
 
 import (
-	"reflect"
 	"testing"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+	"github.com/google/go-cmp/cmp"
 )
 
-func Test_buildPartitionStr(t *testing.T) {
+func Test_desiredProfileIDs(t *testing.T) {
 	tests := []struct {
 		name          string
 		partitionSize string
-		want          string
+		want          []string
 		wantErr       bool
 	}{
 		{
 			name:          "Empty partition size",
 			partitionSize: "",
-			want:          "",
+			want:          nil,
 			wantErr:       false,
 		},
 		{
 			name:          "Single partition",
 			partitionSize: "7g.40gb",
-			want:          "0",
+			want:          []string{"0"},
 			wantErr:       false,
 		},
 		{
 			name:          "Invalid partition",
 			partitionSize: "8g.40gb",
-			want:          "",
+			want:          nil,
 			wantErr:       true,
 		},
 		{
 			name:          "Two partitions",
 			partitionSize: "3g.20gb",
-			want:          "9,9",
+			want:          []string{"9", "9"},
 			wantErr:       false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := buildPartitionStr(tt.partitionSize)
+			got, err := desiredProfileIDs(migprofile.Static, tt.partitionSize)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("buildPartitionStr() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("desiredProfileIDs() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if got != tt.want {
-				t.Errorf("buildPartitionStr() = %v, want %v", got, tt.want)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("desiredProfileIDs() returned unexpected diff (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
-func Test_parseLGIOutput(t *testing.T) {
+func Test_enableMigMode(t *testing.T) {
 	tests := []struct {
-		name        string
-		lgiOutput   string
-		wantMap     map[string][]string
-		wantUniform bool
+		name               string
+		needsReset         bool
+		wantRebootRequired bool
 	}{
-		{
-			name:        "Empty input",
-			lgiOutput:   "",
-			wantMap:     make(map[string][]string),
-			wantUniform: false,
-		},
-		{
-			name: "Header and footer only",
-			lgiOutput: `
-+-----------------------------------------------------------------------------+
-| GPU instances:                                                              |
-| GPU   Profile Name   Profile ID   CI_ID   Address                           |
-|=============================================================================|
-+-----------------------------------------------------------------------------+
-			`,
-			wantMap:     make(map[string][]string),
-			wantUniform: false,
-		},
-		{
-			name: "Single GPU, single GI, uniform",
-			lgiOutput: `
-+-----------------------------------------------------------------------------+
-| GPU   Profile Name   Profile ID   CI_ID   Address                           |
-|=============================================================================|
-|   0   MIG 1g.5gb     19           0       00000000                          |
-+-----------------------------------------------------------------------------+
-			`,
-			wantMap:     map[string][]string{"0": {"19"}},
-			wantUniform: true,
-		},
-		{
-			name: "Single GPU, multiple GIs, uniform",
-			lgiOutput: `
-+-----------------------------------------------------------------------------+
-| GPU   Profile Name   Profile ID   CI_ID   Address                           |
-|=============================================================================|
-|   0   MIG 1g.5gb     19           0       00000000                          |
-|   0   MIG 1g.5gb     19           1       00000001                          |
-+-----------------------------------------------------------------------------+
-			`,
-			wantMap:     map[string][]string{"0": {"19", "19"}},
-			wantUniform: true,
-		},
-		{
-			name: "Single GPU, multiple GIs, non-uniform profile IDs",
-			lgiOutput: `
-+-----------------------------------------------------------------------------+
-| GPU   Profile Name   Profile ID   CI_ID   Address                           |
-|=============================================================================|
-|   0   MIG 1g.5gb     19           0       00000000                          |
-|   0   MIG 2g.10gb    14           0       01000000                          |
-+-----------------------------------------------------------------------------+
-			`,
-			wantMap:     map[string][]string{"0": {"19"}},
-			wantUniform: false,
-		},
-		{
-			name: "Multiple GPUs, multiple GIs, all uniform",
-			lgiOutput: `
-+-----------------------------------------------------------------------------+
-| GPU   Profile Name   Profile ID   CI_ID   Address                           |
-|=============================================================================|
-|   0   MIG 1g.5gb     19           0       00000000                          |
-|   0   MIG 1g.5gb     19           1       01000000                          |
-|   1   MIG 1g.5gb     19           0       00000000                          |
-|   1   MIG 1g.5gb     19           1       01000000                          |
-+-----------------------------------------------------------------------------+
-			`,
-			wantMap:     map[string][]string{"0": {"19", "19"}, "1": {"19", "19"}},
-			wantUniform: true,
-		},
-		{
-			name: "Multiple GPUs, non-uniform profile IDs between GPUs",
-			lgiOutput: `
-+-----------------------------------------------------------------------------+
-| GPU   Profile Name   Profile ID   CI_ID   Address                           |
-|=============================================================================|
-|   0   MIG 1g.5gb     19           0       00000000                          |
-|   1   MIG 2g.10gb    14           0       00000000                          |
-+-----------------------------------------------------------------------------+
-			`,
-			wantMap:     map[string][]string{"0": {"19"}},
-			wantUniform: false,
-		},
+		{name: "Takes effect immediately", needsReset: false, wantRebootRequired: false},
+		{name: "Needs GPU reset", needsReset: true, wantRebootRequired: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotMap, gotUniform, _ := parseLGIOutput(tt.lgiOutput)
-			if !reflect.DeepEqual(gotMap, tt.wantMap) {
-				t.Errorf("parseLGIOutput() gotMap = %v, want %v", gotMap, tt.wantMap)
+			m := &fakeMigManager{
+				profiles:   map[string][]string{"0": nil, "1": nil},
+				migMode:    map[string]bool{"0": true, "1": false},
+				needsReset: tt.needsReset,
 			}
-			if gotUniform != tt.wantUniform {
-				t.Errorf("parseLGIOutput() gotUniform = %v, want %v", gotUniform, tt.wantUniform)
+			resetRequired, err := enableMigMode(m)
+			if err != nil {
+				t.Fatalf("enableMigMode() error = %v", err)
 			}
-		})
-	}
-}
-
-func Test_checkDesired(t *testing.T) {
-	tests := []struct {
-		name            string
-		partitions      map[string][]string
-		desiredMaxCount int
-		want            bool
-	}{
-		{name: "Empty partitions map", partitions: make(map[string][]string), desiredMaxCount: 2, want: false},
-		{name: "Single GPU, count matches", partitions: map[string][]string{"0": {"19", "19"}}, desiredMaxCount: 2, want: true},
-		{name: "Single GPU, count less than desired", partitions: map[string][]string{"0": {"19"}}, desiredMaxCount: 2, want: false},
-		{name: "Single GPU, count more than desired", partitions: map[string][]string{"0": {"19", "19", "19"}}, desiredMaxCount: 2, want: false},
-		{name: "Multiple GPUs, all counts match", partitions: map[string][]string{"0": {"19", "19"}, "1": {"14", "14"}}, desiredMaxCount: 2, want: true},
-		{name: "Multiple GPUs, first GPU matches, second does not", partitions: map[string][]string{"0": {"19", "19"}, "1": {"14"}}, desiredMaxCount: 2, want: false},
-		{name: "Multiple GPUs, first GPU does not match, second matches", partitions: map[string][]string{"0": {"19"}, "1": {"14", "14"}}, desiredMaxCount: 2, want: false},
-		{name: "Multiple GPUs, no counts match", partitions: map[string][]string{"0": {"19"}, "1": {"14"}}, desiredMaxCount: 2, want: false},
-		{name: "Partitions map has GPUs, but desired count is 0 (should be false as GPUs exist)", partitions: map[string][]string{"0": {}}, desiredMaxCount: 0, want: true},
-		{name: "Partitions map has GPUs with items, desired count is 0", partitions: map[string][]string{"0": {"19"}}, desiredMaxCount: 0, want: false},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := checkDesired(tt.partitions, tt.desiredMaxCount); got != tt.want {
-				t.Errorf("checkDesired() = %v, want %v for partitions %v, desiredMaxCount %d", got, tt.want, tt.partitions, tt.desiredMaxCount)
+			if rebootRequired := len(resetRequired) > 0; rebootRequired != tt.wantRebootRequired {
+				t.Errorf("enableMigMode() = %v, want reset required %v", resetRequired, tt.wantRebootRequired)
+			}
+			if diff := cmp.Diff(map[string]bool{"1": true}, m.pending); diff != "" {
+				t.Errorf("enableMigMode() set MIG mode on unexpected GPUs (-want, +got) = %s", diff)
 			}
 		})
 	}
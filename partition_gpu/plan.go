@@ -0,0 +1,171 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migstatus"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+// plan describes the changes needed to partition the GPUs of a node as described
+// by the GPU config. It is printed with -dry-run, and applied by the reconciler.
+type plan struct {
+	PartitionSize       string    `json:"partitionSize"`
+	ComputeInstanceSize string    `json:"computeInstanceSize,omitempty"`
+	GPUs                []gpuPlan `json:"gpus"`
+	// RebootRequired is true if MIG mode is pending on a GPU, and only takes
+	// effect after a GPU reset or node reboot.
+	RebootRequired bool `json:"rebootRequired"`
+}
+
+// gpuPlan describes the changes needed on a single GPU.
+type gpuPlan struct {
+	GPU string `json:"gpu"`
+	// MigMode and PendingMigMode are whether MIG mode is enabled now, and after
+	// the next GPU reset.
+	MigMode        bool `json:"migMode"`
+	PendingMigMode bool `json:"pendingMigMode"`
+	// Current and Desired are the profile IDs of the GPU instances on the GPU,
+	// and of the GPU instances the GPU config asks for.
+	Current []string `json:"current"`
+	Desired []string `json:"desired"`
+	// ComputeInstances are the compute instances the GPU config asks for in each
+	// GPU instance. If nil, each GPU instance has a single compute instance.
+	ComputeInstances *computeInstanceLayout `json:"computeInstances,omitempty"`
+	// State is the state the GPU is reported in while the plan is applied:
+	// Ready if nothing needs to change, Reconfiguring if the GPU will be
+	// partitioned, Blocked if processes are using it, RebootRequired if MIG mode
+	// is pending a reset, and Failed if the desired partitions can't be determined.
+	State   migstatus.State `json:"state"`
+	Message string          `json:"message,omitempty"`
+	// Commands are the nvidia-smi commands equivalent to the changes, whichever
+	// MIG backend is used to apply them.
+	Commands []string `json:"commands,omitempty"`
+	// ResetRequired is true if MIG mode only takes effect after a GPU reset.
+	// When MIG mode is not enabled yet, whether enabling it needs a reset is
+	// only known after enabling it; it does on Ampere GPUs.
+	ResetRequired bool `json:"resetRequired"`
+}
+
+// makePlan compares the GPUs of a node with the partition and compute instance
+// sizes in the GPU config, without changing anything.
+func makePlan(m migManager, config GPUConfig) (*plan, error) {
+	gpus, err := m.GPUs()
+	if err != nil {
+		return nil, err
+	}
+	instances, err := m.GPUInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan{PartitionSize: config.GPUPartitionSize, ComputeInstanceSize: config.ComputeInstanceSize}
+	for _, gpu := range gpus {
+		g := gpuPlan{GPU: gpu}
+		for _, gi := range instances[gpu] {
+			g.Current = append(g.Current, gi.ProfileID)
+		}
+		g.MigMode, g.PendingMigMode, err = m.MigMode(gpu)
+		if err != nil {
+			return nil, err
+		}
+		if !g.MigMode && g.PendingMigMode {
+			g.ResetRequired = true
+			p.RebootRequired = true
+		}
+
+		profiles := gpuProfiles(m, gpu)
+		g.Desired, err = desiredProfileIDs(profiles, config.GPUPartitionSize)
+		if err == nil {
+			g.ComputeInstances, err = desiredComputeInstances(profiles, config)
+		}
+		if err != nil {
+			g.State, g.Message = migstatus.Failed, err.Error()
+			p.GPUs = append(p.GPUs, g)
+			continue
+		}
+		if g.MigMode && matchesLayout(instances[gpu], g.Desired, g.ComputeInstances) {
+			g.State = migstatus.Ready
+			p.GPUs = append(p.GPUs, g)
+			continue
+		}
+		processes, err := m.Processes(gpu)
+		if err != nil {
+			g.State, g.Message = migstatus.Failed, err.Error()
+			p.GPUs = append(p.GPUs, g)
+			continue
+		}
+		if processes > 0 {
+			g.State, g.Message = migstatus.Blocked, fmt.Sprintf("%d processes are using the GPU", processes)
+			p.GPUs = append(p.GPUs, g)
+			continue
+		}
+
+		g.State = migstatus.Reconfiguring
+		if g.ResetRequired {
+			g.State, g.Message = migstatus.RebootRequired, "MIG mode is pending a GPU reset"
+		}
+		if !g.MigMode && !g.PendingMigMode {
+			g.Commands = append(g.Commands, fmt.Sprintf("nvidia-smi -i %s -mig 1", gpu))
+		}
+		if len(g.Current) > 0 {
+			g.Commands = append(g.Commands,
+				fmt.Sprintf("nvidia-smi mig -dci -i %s", gpu),
+				fmt.Sprintf("nvidia-smi mig -dgi -i %s", gpu))
+		}
+		if len(g.Desired) > 0 {
+			g.Commands = append(g.Commands, fmt.Sprintf("nvidia-smi mig -cgi %s -i %s", strings.Join(g.Desired, ","), gpu))
+			if g.ComputeInstances == nil {
+				g.Commands = append(g.Commands, fmt.Sprintf("nvidia-smi mig -cci -i %s", gpu))
+			} else {
+				g.Commands = append(g.Commands, fmt.Sprintf("nvidia-smi mig -cci %s -i %s", computeInstanceProfileIDs(g.ComputeInstances), gpu))
+			}
+		}
+		p.GPUs = append(p.GPUs, g)
+	}
+	return p, nil
+}
+
+// printPlan writes the plan to partition the GPUs as JSON to w.
+func printPlan(m migManager, config GPUConfig, w io.Writer) error {
+	p, err := makePlan(m, config)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plan: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(content))
+	return err
+}
+
+// gpuProfiles returns the GPU instance profiles supported by a GPU. If they can't
+// be read from the GPU, the built-in profiles are used.
+func gpuProfiles(m migManager, gpu string) []migprofile.Profile {
+	profiles, err := m.GPUInstanceProfiles(gpu)
+	if err != nil || len(profiles) == 0 {
+		slog.Warn("Failed to read the GPU instance profiles, using the built-in profiles", logging.DeviceID, gpu, logging.Error, err)
+		return migprofile.Static
+	}
+	return profiles
+}
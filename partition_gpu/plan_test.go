@@ -0,0 +1,178 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migstatus"
+	"github.com/google/go-cmp/cmp"
+)
+
+func newPlanTestMigManager() *fakeMigManager {
+	return &fakeMigManager{
+		profiles:  map[string][]string{"0": {"9", "9"}, "1": {"19", "19"}, "2": nil, "3": nil, "4": {"19"}},
+		processes: map[string]int{"4": 1},
+		migMode:   map[string]bool{"0": true, "1": true, "2": false, "3": false, "4": true},
+		pending:   map[string]bool{"0": true, "1": true, "2": false, "3": true, "4": true},
+	}
+}
+
+func Test_makePlan(t *testing.T) {
+	m := newPlanTestMigManager()
+	want := &plan{
+		PartitionSize:  "3g.20gb",
+		RebootRequired: true,
+		GPUs: []gpuPlan{
+			{
+				GPU: "0", MigMode: true, PendingMigMode: true,
+				Current: []string{"9", "9"}, Desired: []string{"9", "9"},
+				State: migstatus.Ready,
+			},
+			{
+				GPU: "1", MigMode: true, PendingMigMode: true,
+				Current: []string{"19", "19"}, Desired: []string{"9", "9"},
+				State: migstatus.Reconfiguring,
+				Commands: []string{
+					"nvidia-smi mig -dci -i 1",
+					"nvidia-smi mig -dgi -i 1",
+					"nvidia-smi mig -cgi 9,9 -i 1",
+					"nvidia-smi mig -cci -i 1",
+				},
+			},
+			{
+				GPU: "2", MigMode: false, PendingMigMode: false,
+				Desired: []string{"9", "9"},
+				State:   migstatus.Reconfiguring,
+				Commands: []string{
+					"nvidia-smi -i 2 -mig 1",
+					"nvidia-smi mig -cgi 9,9 -i 2",
+					"nvidia-smi mig -cci -i 2",
+				},
+			},
+			{
+				GPU: "3", MigMode: false, PendingMigMode: true,
+				Desired: []string{"9", "9"},
+				State:   migstatus.RebootRequired, Message: "MIG mode is pending a GPU reset",
+				Commands: []string{
+					"nvidia-smi mig -cgi 9,9 -i 3",
+					"nvidia-smi mig -cci -i 3",
+				},
+				ResetRequired: true,
+			},
+			{
+				GPU: "4", MigMode: true, PendingMigMode: true,
+				Current: []string{"19"}, Desired: []string{"9", "9"},
+				State: migstatus.Blocked, Message: "1 processes are using the GPU",
+			},
+		},
+	}
+	got, err := makePlan(m, GPUConfig{GPUPartitionSize: "3g.20gb"})
+	if err != nil {
+		t.Fatalf("makePlan() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("makePlan() (-want, +got) = %s", diff)
+	}
+	if len(m.destroyed) != 0 {
+		t.Errorf("makePlan() destroyed GPU instances on %v, want no changes", m.destroyed)
+	}
+}
+
+func Test_makePlan_computeInstances(t *testing.T) {
+	m := &fakeMigManager{profiles: map[string][]string{"0": {"9", "9"}}}
+	want := &plan{
+		PartitionSize:       "3g.20gb",
+		ComputeInstanceSize: "1c",
+		GPUs: []gpuPlan{
+			{
+				GPU: "0", MigMode: true, PendingMigMode: true,
+				Current: []string{"9", "9"}, Desired: []string{"9", "9"},
+				ComputeInstances: &computeInstanceLayout{ProfileID: 0, Count: 3},
+				State:            migstatus.Reconfiguring,
+				Commands: []string{
+					"nvidia-smi mig -dci -i 0",
+					"nvidia-smi mig -dgi -i 0",
+					"nvidia-smi mig -cgi 9,9 -i 0",
+					"nvidia-smi mig -cci 0,0,0 -i 0",
+				},
+			},
+		},
+	}
+	got, err := makePlan(m, GPUConfig{GPUPartitionSize: "3g.20gb", ComputeInstanceSize: "1c"})
+	if err != nil {
+		t.Fatalf("makePlan() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("makePlan() (-want, +got) = %s", diff)
+	}
+}
+
+func Test_printPlan(t *testing.T) {
+	var out bytes.Buffer
+	if err := printPlan(newPlanTestMigManager(), GPUConfig{GPUPartitionSize: "3g.20gb"}, &out); err != nil {
+		t.Fatalf("printPlan() error = %v", err)
+	}
+	got := &plan{}
+	if err := json.Unmarshal(out.Bytes(), got); err != nil {
+		t.Fatalf("printPlan() printed invalid JSON %q: %v", out.String(), err)
+	}
+	if !got.RebootRequired || len(got.GPUs) != 5 {
+		t.Errorf("printPlan() printed %+v, want a plan for 5 GPUs that requires a reboot", got)
+	}
+}
+
+func Test_reconciler_reportRebootRequired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partition")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	statusFile := path.Join(dir, "partition_status.json")
+
+	m := &fakeMigManager{
+		profiles: map[string][]string{"0": nil, "1": nil},
+		migMode:  map[string]bool{"0": false, "1": true},
+		pending:  map[string]bool{"0": true, "1": true},
+	}
+	r := newReconciler(m, statusFile)
+	if err := r.reportRebootRequired(GPUConfig{GPUPartitionSize: "3g.20gb"}); err != nil {
+		t.Fatalf("reportRebootRequired() error = %v", err)
+	}
+	if len(m.destroyed) != 0 {
+		t.Errorf("reportRebootRequired() reconfigured GPUs %v, want no changes", m.destroyed)
+	}
+
+	got, err := migstatus.Read(statusFile)
+	if err != nil {
+		t.Fatalf("failed to read status file: %v", err)
+	}
+	want := migstatus.Status{
+		PartitionSize: "3g.20gb",
+		State:         migstatus.RebootRequired,
+		GPUs: map[string]migstatus.GPUStatus{
+			"0": {State: migstatus.RebootRequired, Message: "MIG mode is pending a GPU reset"},
+			"1": {State: migstatus.Reconfiguring},
+		},
+	}
+	got.UpdatedAt = want.UpdatedAt
+	if diff := cmp.Diff(want, *got); diff != "" {
+		t.Errorf("unexpected partition status (-want, +got) = %s", diff)
+	}
+}
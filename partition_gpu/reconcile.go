@@ -0,0 +1,217 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migstatus"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+// reconciler partitions each GPU as described by the GPU config and reports
+// its progress in a status file.
+type reconciler struct {
+	mig        migManager
+	statusFile string
+	status     *migstatus.Status
+}
+
+// newReconciler creates a reconciler that writes its status to statusFile. The
+// generation of an existing status file is carried over, so the device plugin
+// doesn't miss changes across restarts.
+func newReconciler(m migManager, statusFile string) *reconciler {
+	r := &reconciler{mig: m, statusFile: statusFile, status: &migstatus.Status{}}
+	if statusFile == "" {
+		return r
+	}
+	status, err := migstatus.Read(statusFile)
+	if err == nil {
+		r.status.Generation = status.Generation
+	} else if !os.IsNotExist(err) {
+		slog.Error("Failed to read partition status, starting from scratch", logging.Error, err)
+	}
+	return r
+}
+
+// reconcile compares the GPU and compute instances on each GPU with the GPU config,
+// and recreates them on the GPUs that differ. GPUs with running processes are left
+// alone, they are retried on the next reconcile. It returns whether any GPU
+// partitions were changed.
+func (r *reconciler) reconcile(config GPUConfig) (bool, error) {
+	p, err := makePlan(r.mig, config)
+	if err != nil {
+		return false, err
+	}
+
+	r.setStatus(p)
+	var pending []gpuPlan
+	for _, g := range p.GPUs {
+		switch g.State {
+		case migstatus.Blocked:
+			slog.Warn("GPU does not match the desired partitions, but it is blocked. Not reconfiguring it", logging.DeviceID, g.GPU, "reason", g.Message)
+		case migstatus.Reconfiguring:
+			pending = append(pending, g)
+		}
+	}
+	if len(pending) > 0 {
+		r.save()
+	}
+
+	for _, g := range pending {
+		slog.Info("Reconfiguring GPU partitions", logging.DeviceID, g.GPU)
+		if err := r.reconfigureGPU(g.GPU, g.Desired, g.ComputeInstances); err != nil {
+			slog.Error("Failed to reconfigure GPU", logging.DeviceID, g.GPU, logging.Error, err)
+			r.status.GPUs[g.GPU] = migstatus.GPUStatus{State: migstatus.Failed, Message: err.Error()}
+			continue
+		}
+		r.status.GPUs[g.GPU] = migstatus.GPUStatus{State: migstatus.Ready}
+	}
+	if len(pending) > 0 {
+		r.status.Generation++
+	}
+	r.save()
+
+	if r.status.State == migstatus.Failed {
+		return len(pending) > 0, fmt.Errorf("failed to partition all GPUs: %v", r.status.GPUs)
+	}
+	return len(pending) > 0, nil
+}
+
+// reportRebootRequired writes the status of the GPUs without changing them, after
+// MIG mode was enabled on GPUs that need a reboot for it to take effect.
+func (r *reconciler) reportRebootRequired(config GPUConfig) error {
+	p, err := makePlan(r.mig, config)
+	if err != nil {
+		return err
+	}
+	r.setStatus(p)
+	r.save()
+	return nil
+}
+
+// setStatus sets the status of each GPU to its state in the plan.
+func (r *reconciler) setStatus(p *plan) {
+	r.status.PartitionSize = p.PartitionSize
+	r.status.GPUs = make(map[string]migstatus.GPUStatus)
+	for _, g := range p.GPUs {
+		r.status.GPUs[g.GPU] = migstatus.GPUStatus{State: g.State, Message: g.Message}
+	}
+}
+
+// reconfigureGPU replaces all GPU instances on a GPU with GPU instances of the
+// given profiles, each with the compute instances of the layout.
+func (r *reconciler) reconfigureGPU(gpu string, profileIDs []string, ci *computeInstanceLayout) error {
+	if err := r.mig.DestroyGPUInstances(gpu); err != nil {
+		return err
+	}
+	return r.mig.CreateGPUInstances(gpu, profileIDs, ci)
+}
+
+// save writes the status file. Failures are only logged, the status file is
+// informational and is rewritten on the next reconcile.
+func (r *reconciler) save() {
+	r.status.State = overallState(r.status.GPUs)
+	r.status.UpdatedAt = time.Now()
+	if r.statusFile == "" {
+		return
+	}
+	if err := migstatus.Write(r.statusFile, r.status); err != nil {
+		slog.Error("Failed to write partition status", logging.Error, err)
+	}
+}
+
+// overallState is Failed if any GPU failed, otherwise RebootRequired if any GPU
+// needs a reboot, otherwise Blocked if any GPU is blocked, otherwise Reconfiguring if any GPU is being reconfigured, and Ready
+// if all GPUs are ready.
+func overallState(gpus map[string]migstatus.GPUStatus) migstatus.State {
+	state := migstatus.Ready
+	for _, s := range []migstatus.State{migstatus.Reconfiguring, migstatus.Blocked, migstatus.RebootRequired, migstatus.Failed} {
+		for _, gpu := range gpus {
+			if gpu.State == s {
+				state = s
+			}
+		}
+	}
+	return state
+}
+
+// matchesLayout returns whether the GPU instances on a GPU have the given
+// profiles, each with the number of compute instances of the layout, or a single
+// compute instance if the layout is nil.
+func matchesLayout(instances []gpuInstance, profileIDs []string, ci *computeInstanceLayout) bool {
+	if len(instances) != len(profileIDs) {
+		return false
+	}
+	computeInstances := 1
+	if ci != nil {
+		computeInstances = ci.Count
+	}
+	var actual []string
+	for _, gi := range instances {
+		if gi.ComputeInstances != computeInstances {
+			return false
+		}
+		actual = append(actual, gi.ProfileID)
+	}
+	desired := append([]string(nil), profileIDs...)
+	sort.Strings(actual)
+	sort.Strings(desired)
+	return reflect.DeepEqual(actual, desired)
+}
+
+// desiredProfileIDs returns the profile IDs of the GPU instances to create on a
+// GPU with the given profiles for a partition size.
+func desiredProfileIDs(profiles []migprofile.Profile, partitionSize string) ([]string, error) {
+	if partitionSize == "" {
+		return nil, nil
+	}
+
+	p, ok := migprofile.Lookup(profiles, partitionSize)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a valid partition size", partitionSize)
+	}
+
+	var profileIDs []string
+	for i := 0; i < p.MaxCount; i++ {
+		profileIDs = append(profileIDs, strconv.Itoa(p.ID))
+	}
+	return profileIDs, nil
+}
+
+// desiredComputeInstances returns the compute instances to create in each GPU
+// instance for the compute instance size in the GPU config, or nil if it doesn't
+// set one.
+func desiredComputeInstances(profiles []migprofile.Profile, config GPUConfig) (*computeInstanceLayout, error) {
+	if config.ComputeInstanceSize == "" || config.GPUPartitionSize == "" {
+		return nil, nil
+	}
+	p, ok := migprofile.Lookup(profiles, config.GPUPartitionSize)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a valid partition size", config.GPUPartitionSize)
+	}
+	profileID, count, err := migprofile.ComputeInstances(p, config.ComputeInstanceSize)
+	if err != nil {
+		return nil, err
+	}
+	return &computeInstanceLayout{ProfileID: profileID, Count: count}, nil
+}
@@ -0,0 +1,361 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migstatus"
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_matchesLayout(t *testing.T) {
+	gi := func(profileID string, computeInstances int) gpuInstance {
+		return gpuInstance{ProfileID: profileID, ComputeInstances: computeInstances}
+	}
+	tests := []struct {
+		name       string
+		instances  []gpuInstance
+		profileIDs []string
+		ci         *computeInstanceLayout
+		want       bool
+	}{
+		{name: "No GPU instances", instances: nil, profileIDs: []string{"19", "19"}, want: false},
+		{name: "Count matches", instances: []gpuInstance{gi("19", 1), gi("19", 1)}, profileIDs: []string{"19", "19"}, want: true},
+		{name: "Count less than desired", instances: []gpuInstance{gi("19", 1)}, profileIDs: []string{"19", "19"}, want: false},
+		{name: "Count more than desired", instances: []gpuInstance{gi("19", 1), gi("19", 1), gi("19", 1)}, profileIDs: []string{"19", "19"}, want: false},
+		{name: "Different profile", instances: []gpuInstance{gi("14", 1), gi("14", 1)}, profileIDs: []string{"19", "19"}, want: false},
+		{name: "Mixed profiles", instances: []gpuInstance{gi("19", 1), gi("14", 1)}, profileIDs: []string{"19", "19"}, want: false},
+		{name: "Mixed profiles desired", instances: []gpuInstance{gi("14", 1), gi("19", 1)}, profileIDs: []string{"19", "14"}, want: true},
+		{name: "Missing compute instance", instances: []gpuInstance{gi("19", 1), gi("19", 0)}, profileIDs: []string{"19", "19"}, want: false},
+		{name: "Compute instances match", instances: []gpuInstance{gi("9", 3), gi("9", 3)}, profileIDs: []string{"9", "9"}, ci: &computeInstanceLayout{ProfileID: 0, Count: 3}, want: true},
+		{name: "Single compute instance", instances: []gpuInstance{gi("9", 1), gi("9", 1)}, profileIDs: []string{"9", "9"}, ci: &computeInstanceLayout{ProfileID: 0, Count: 3}, want: false},
+		{name: "Compute instances not desired", instances: []gpuInstance{gi("9", 3), gi("9", 3)}, profileIDs: []string{"9", "9"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesLayout(tt.instances, tt.profileIDs, tt.ci); got != tt.want {
+				t.Errorf("matchesLayout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeMigManager emulates MIG on a set of GPUs.
+type fakeMigManager struct {
+	// profiles is the profile ID of each GPU instance, keyed by GPU index.
+	profiles map[string][]string
+	// processes is the number of processes running on each GPU.
+	processes map[string]int
+	// failCreate makes creating GPU instances fail on the given GPU.
+	failCreate string
+	// gpuProfiles is the GPU instance profiles of each GPU. The built-in
+	// profiles are used for GPUs without profiles.
+	gpuProfiles map[string][]migprofile.Profile
+	// migMode is whether MIG mode is enabled on each GPU, and pending whether it
+	// will be enabled after a reset. If migMode is nil, MIG mode is enabled on all GPUs.
+	migMode, pending map[string]bool
+	// needsReset makes enabling MIG mode only take effect after a reset.
+	needsReset bool
+	// computeInstances is the number of compute instances in each GPU instance,
+	// keyed by GPU index. GPU instances have a single compute instance by default.
+	computeInstances map[string]int
+	// persistenceMode is whether persistence mode is enabled on each GPU. A GPU
+	// can't be reset in persistence mode.
+	persistenceMode map[string]bool
+	// failReset makes GPU resets fail, and ignoreMigMode makes them succeed
+	// without applying the pending MIG mode.
+	failReset, ignoreMigMode bool
+	destroyed                []string
+	resets                   []string
+}
+
+func (f *fakeMigManager) GPUs() ([]string, error) {
+	var gpus []string
+	for gpu := range f.profiles {
+		gpus = append(gpus, gpu)
+	}
+	sort.Strings(gpus)
+	return gpus, nil
+}
+
+func (f *fakeMigManager) MigMode(gpu string) (bool, bool, error) {
+	if f.migMode == nil {
+		return true, true, nil
+	}
+	return f.migMode[gpu], f.pending[gpu], nil
+}
+
+func (f *fakeMigManager) SetMigMode(gpu string, enabled bool) error {
+	if f.pending == nil {
+		f.pending = make(map[string]bool)
+	}
+	f.pending[gpu] = enabled
+	if !f.needsReset {
+		f.migMode[gpu] = enabled
+	}
+	return nil
+}
+
+func (f *fakeMigManager) GPUInstanceProfiles(gpu string) ([]migprofile.Profile, error) {
+	return f.gpuProfiles[gpu], nil
+}
+
+func (f *fakeMigManager) GPUInstances() (map[string][]gpuInstance, error) {
+	instances := make(map[string][]gpuInstance)
+	for gpu, profiles := range f.profiles {
+		for i, p := range profiles {
+			computeInstances, ok := f.computeInstances[gpu]
+			if !ok {
+				computeInstances = 1
+			}
+			instances[gpu] = append(instances[gpu], gpuInstance{ID: fmt.Sprint(i + 1), ProfileID: p, ComputeInstances: computeInstances})
+		}
+	}
+	return instances, nil
+}
+
+func (f *fakeMigManager) CreateGPUInstances(gpu string, profileIDs []string, ci *computeInstanceLayout) error {
+	if gpu == f.failCreate {
+		return errors.New("Insufficient resources")
+	}
+	if ci != nil {
+		if f.computeInstances == nil {
+			f.computeInstances = make(map[string]int)
+		}
+		f.computeInstances[gpu] = ci.Count
+	} else {
+		delete(f.computeInstances, gpu)
+	}
+	f.profiles[gpu] = append(f.profiles[gpu], profileIDs...)
+	return nil
+}
+
+func (f *fakeMigManager) DestroyGPUInstances(gpu string) error {
+	f.destroyed = append(f.destroyed, gpu)
+	f.profiles[gpu] = nil
+	return nil
+}
+
+func (f *fakeMigManager) Processes(gpu string) (int, error) {
+	return f.processes[gpu], nil
+}
+
+func (f *fakeMigManager) PersistenceMode(gpu string) (bool, error) {
+	return f.persistenceMode[gpu], nil
+}
+
+func (f *fakeMigManager) SetPersistenceMode(gpu string, enabled bool) error {
+	if f.persistenceMode == nil {
+		f.persistenceMode = make(map[string]bool)
+	}
+	f.persistenceMode[gpu] = enabled
+	return nil
+}
+
+func (f *fakeMigManager) Reset(gpu string) error {
+	f.resets = append(f.resets, gpu)
+	if f.failReset {
+		return errors.New("GPU is currently in use by another process")
+	}
+	if f.persistenceMode[gpu] {
+		return errors.New("Unable to reset GPU in persistence mode")
+	}
+	if !f.ignoreMigMode {
+		f.migMode[gpu] = f.pending[gpu]
+	}
+	return nil
+}
+
+func Test_reconciler_reconcile(t *testing.T) {
+	tests := []struct {
+		name         string
+		fake         *fakeMigManager
+		config       GPUConfig
+		wantChanged  bool
+		wantErr      bool
+		wantStatus   migstatus.Status
+		wantReconfig []string
+	}{
+		{
+			name:        "Partitions match",
+			fake:        &fakeMigManager{profiles: map[string][]string{"0": {"9", "9"}, "1": {"9", "9"}}},
+			wantChanged: false,
+			wantStatus: migstatus.Status{
+				PartitionSize: "3g.20gb",
+				State:         migstatus.Ready,
+				GPUs:          map[string]migstatus.GPUStatus{"0": {State: migstatus.Ready}, "1": {State: migstatus.Ready}},
+				Generation:    1,
+			},
+		},
+		{
+			name:         "Only the GPU that differs is reconfigured",
+			fake:         &fakeMigManager{profiles: map[string][]string{"0": {"9", "9"}, "1": {"19", "19"}}},
+			wantChanged:  true,
+			wantReconfig: []string{"1"},
+			wantStatus: migstatus.Status{
+				PartitionSize: "3g.20gb",
+				State:         migstatus.Ready,
+				GPUs:          map[string]migstatus.GPUStatus{"0": {State: migstatus.Ready}, "1": {State: migstatus.Ready}},
+				Generation:    2,
+			},
+		},
+		{
+			name:         "GPUs in use are not reconfigured",
+			fake:         &fakeMigManager{profiles: map[string][]string{"0": {}, "1": {"19"}}, processes: map[string]int{"1": 2}},
+			wantChanged:  true,
+			wantReconfig: []string{"0"},
+			wantStatus: migstatus.Status{
+				PartitionSize: "3g.20gb",
+				State:         migstatus.Blocked,
+				GPUs: map[string]migstatus.GPUStatus{
+					"0": {State: migstatus.Ready},
+					"1": {State: migstatus.Blocked, Message: "2 processes are using the GPU"},
+				},
+				Generation: 2,
+			},
+		},
+		{
+			name: "Partition size not supported by the GPU",
+			fake: &fakeMigManager{
+				profiles:    map[string][]string{"0": {"9", "9"}, "1": {"9", "9"}},
+				gpuProfiles: map[string][]migprofile.Profile{"1": {{ID: 19, Name: "1g.10gb", MaxCount: 7}}},
+			},
+			wantChanged: false,
+			wantErr:     true,
+			wantStatus: migstatus.Status{
+				PartitionSize: "3g.20gb",
+				State:         migstatus.Failed,
+				GPUs: map[string]migstatus.GPUStatus{
+					"0": {State: migstatus.Ready},
+					"1": {State: migstatus.Failed, Message: "3g.20gb is not a valid partition size"},
+				},
+				Generation: 1,
+			},
+		},
+		{
+			name:         "Compute instances differ",
+			fake:         &fakeMigManager{profiles: map[string][]string{"0": {"9", "9"}, "1": {"9", "9"}}, computeInstances: map[string]int{"0": 3}},
+			config:       GPUConfig{GPUPartitionSize: "3g.20gb", ComputeInstanceSize: "1c"},
+			wantChanged:  true,
+			wantReconfig: []string{"1"},
+			wantStatus: migstatus.Status{
+				PartitionSize: "3g.20gb",
+				State:         migstatus.Ready,
+				GPUs:          map[string]migstatus.GPUStatus{"0": {State: migstatus.Ready}, "1": {State: migstatus.Ready}},
+				Generation:    2,
+			},
+		},
+		{
+			name:        "Compute instance size too large",
+			fake:        &fakeMigManager{profiles: map[string][]string{"0": {"9", "9"}}},
+			config:      GPUConfig{GPUPartitionSize: "3g.20gb", ComputeInstanceSize: "4c"},
+			wantChanged: false,
+			wantErr:     true,
+			wantStatus: migstatus.Status{
+				PartitionSize: "3g.20gb",
+				State:         migstatus.Failed,
+				GPUs: map[string]migstatus.GPUStatus{
+					"0": {State: migstatus.Failed, Message: "compute instance size 4c does not fit in GPU instances of profile 3g.20gb"},
+				},
+				Generation: 1,
+			},
+		},
+		{
+			name:         "Failed reconfiguration",
+			fake:         &fakeMigManager{profiles: map[string][]string{"0": {"19"}}, failCreate: "0"},
+			wantChanged:  true,
+			wantErr:      true,
+			wantReconfig: []string{"0"},
+			wantStatus: migstatus.Status{
+				PartitionSize: "3g.20gb",
+				State:         migstatus.Failed,
+				GPUs: map[string]migstatus.GPUStatus{
+					"0": {State: migstatus.Failed, Message: "Insufficient resources"},
+				},
+				Generation: 2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "partition")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			statusFile := path.Join(dir, "partition_status.json")
+			if err := migstatus.Write(statusFile, &migstatus.Status{Generation: 1}); err != nil {
+				t.Fatalf("failed to write status file: %v", err)
+			}
+
+			config := tt.config
+			if config.GPUPartitionSize == "" {
+				config.GPUPartitionSize = "3g.20gb"
+			}
+			r := newReconciler(tt.fake, statusFile)
+			changed, err := r.reconcile(config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("reconcile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("reconcile() changed = %v, want %v", changed, tt.wantChanged)
+			}
+
+			if !reflect.DeepEqual(tt.fake.destroyed, tt.wantReconfig) {
+				t.Errorf("reconfigured GPUs = %v, want %v", tt.fake.destroyed, tt.wantReconfig)
+			}
+
+			got, err := migstatus.Read(statusFile)
+			if err != nil {
+				t.Fatalf("failed to read status file: %v", err)
+			}
+			got.UpdatedAt = tt.wantStatus.UpdatedAt
+			if diff := cmp.Diff(tt.wantStatus, *got); diff != "" {
+				t.Errorf("unexpected partition status (-want, +got) = %s", diff)
+			}
+		})
+	}
+}
+
+func Test_overallState(t *testing.T) {
+	tests := []struct {
+		name string
+		gpus map[string]migstatus.GPUStatus
+		want migstatus.State
+	}{
+		{name: "No GPUs", gpus: nil, want: migstatus.Ready},
+		{name: "All ready", gpus: map[string]migstatus.GPUStatus{"0": {State: migstatus.Ready}, "1": {State: migstatus.Ready}}, want: migstatus.Ready},
+		{name: "Reconfiguring", gpus: map[string]migstatus.GPUStatus{"0": {State: migstatus.Ready}, "1": {State: migstatus.Reconfiguring}}, want: migstatus.Reconfiguring},
+		{name: "Blocked", gpus: map[string]migstatus.GPUStatus{"0": {State: migstatus.Blocked}, "1": {State: migstatus.Reconfiguring}}, want: migstatus.Blocked},
+		{name: "Reboot required", gpus: map[string]migstatus.GPUStatus{"0": {State: migstatus.Blocked}, "1": {State: migstatus.RebootRequired}}, want: migstatus.RebootRequired},
+		{name: "Failed", gpus: map[string]migstatus.GPUStatus{"0": {State: migstatus.Blocked}, "1": {State: migstatus.Failed}}, want: migstatus.Failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overallState(tt.gpus); got != tt.want {
+				t.Errorf("overallState() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
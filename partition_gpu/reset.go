@@ -0,0 +1,194 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/persistenced"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+// persistencedHolder is how the partitioner identifies itself when it holds
+// nvidia-persistenced.
+const persistencedHolder = "partition-gpus"
+
+var (
+	// procDir is the proc filesystem of the node, in which nvidia-persistenced
+	// is looked up. It is overridden in tests.
+	procDir = "/proc"
+	// persistencedPidFile and persistencedHoldFile are shared with the
+	// nvidia-persistenced supervisor. They are overridden in tests.
+	persistencedPidFile  = persistenced.PidFile
+	persistencedHoldFile = persistenced.HoldFile
+	// persistencedStopTimeout is how long nvidia-persistenced is waited for to
+	// exit.
+	persistencedStopTimeout = 10 * time.Second
+	// signalProcess is unix.Kill, replaced in tests.
+	signalProcess = unix.Kill
+)
+
+// resetGPUs resets the GPUs on which MIG mode is pending, so that it takes effect
+// without rebooting the node. It returns the GPUs that could not be reset, which
+// still need a reboot.
+func resetGPUs(m migManager, gpus []string) []string {
+	// nvidia-persistenced keeps the GPUs open, so they can't be reset while it
+	// runs, even with persistence mode disabled. It is stopped during the
+	// resets, and restarted by its supervisor afterwards.
+	restart, err := stopPersistenced()
+	if err != nil {
+		slog.Error("Failed to stop nvidia-persistenced, falling back to a node reboot", logging.Error, err)
+		return gpus
+	}
+	defer restart()
+
+	var failed []string
+	for _, gpu := range gpus {
+		slog.Info("Resetting GPU to enable MIG mode", logging.DeviceID, gpu)
+		if err := resetGPU(m, gpu); err != nil {
+			slog.Error("Failed to enable MIG mode with a GPU reset, falling back to a node reboot", logging.DeviceID, gpu, logging.Error, err)
+			failed = append(failed, gpu)
+			continue
+		}
+		slog.Info("MIG mode is enabled", logging.DeviceID, gpu)
+	}
+	return failed
+}
+
+// resetGPU resets a GPU that isn't used by any process, and checks that MIG mode
+// took effect. A GPU can't be reset in persistence mode, so persistence mode is
+// disabled during the reset and restored afterwards.
+func resetGPU(m migManager, gpu string) error {
+	processes, err := m.Processes(gpu)
+	if err != nil {
+		return err
+	}
+	if processes > 0 {
+		return fmt.Errorf("%d processes are using the GPU", processes)
+	}
+
+	persistenceMode, err := m.PersistenceMode(gpu)
+	if err != nil {
+		return err
+	}
+	if persistenceMode {
+		if err := m.SetPersistenceMode(gpu, false); err != nil {
+			return err
+		}
+		defer func() {
+			if err := m.SetPersistenceMode(gpu, true); err != nil {
+				slog.Error("Failed to restore persistence mode", logging.DeviceID, gpu, logging.Error, err)
+			}
+		}()
+	}
+
+	if err := m.Reset(gpu); err != nil {
+		return err
+	}
+
+	current, pending, err := m.MigMode(gpu)
+	if err != nil {
+		return err
+	}
+	if !current {
+		return fmt.Errorf("MIG mode is not enabled after the GPU reset, current: %v, pending: %v", current, pending)
+	}
+	return nil
+}
+
+// stopPersistenced stops nvidia-persistenced if it runs, and returns a function
+// that lets its supervisor restart it. The daemon is held first, so that the
+// supervisor doesn't restart it during the resets. A daemon that isn't the one
+// of the supervisor's pid file can't be restarted, so it is not stopped.
+func stopPersistenced() (func(), error) {
+	pids, err := persistencedPids()
+	if err != nil {
+		return nil, err
+	}
+	if len(pids) == 0 {
+		return func() {}, nil
+	}
+	pid, err := persistenced.ReadPid(persistencedPidFile)
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-persistenced is not supervised: %w", err)
+	}
+	if len(pids) != 1 || pids[0] != pid {
+		return nil, fmt.Errorf("nvidia-persistenced processes %v don't match the supervised process %d", pids, pid)
+	}
+
+	release, err := persistenced.Hold(persistencedHoldFile, persistencedHolder)
+	if err != nil {
+		return nil, err
+	}
+	restart := func() {
+		if err := release(); err != nil {
+			slog.Error("Failed to release nvidia-persistenced, its supervisor restarts it once the hold expires", logging.Error, err, "maxHold", persistenced.MaxHold)
+			return
+		}
+		slog.Info("Released nvidia-persistenced to its supervisor")
+	}
+
+	slog.Info("Stopping nvidia-persistenced to reset GPUs", "pid", pid)
+	if err := signalProcess(pid, unix.SIGTERM); err != nil && !errors.Is(err, unix.ESRCH) {
+		restart()
+		return nil, fmt.Errorf("failed to stop nvidia-persistenced: %w", err)
+	}
+	deadline := time.Now().Add(persistencedStopTimeout)
+	for {
+		if _, err := os.Stat(filepath.Join(procDir, strconv.Itoa(pid))); os.IsNotExist(err) {
+			return restart, nil
+		}
+		if time.Now().After(deadline) {
+			restart()
+			return nil, fmt.Errorf("nvidia-persistenced did not stop after %v", persistencedStopTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// persistencedPids returns the nvidia-persistenced processes of the node. The
+// partitioner runs in the host PID namespace, so it sees the processes of the
+// node.
+func persistencedPids() ([]int, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(procDir, e.Name(), "comm"))
+		if err != nil {
+			// The process exited.
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == persistenced.Comm {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/persistenced"
+)
+
+// fakeProcDir returns a proc filesystem with a process of each of the given names.
+func fakeProcDir(t *testing.T, comms ...string) string {
+	dir := t.TempDir()
+	for i, comm := range comms {
+		pidDir := filepath.Join(dir, fmt.Sprint(100+i))
+		if err := os.Mkdir(pidDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(pidDir, "comm"), []byte(comm+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// holdCheckingMigManager records whether nvidia-persistenced was held during
+// each GPU reset.
+type holdCheckingMigManager struct {
+	*fakeMigManager
+	heldDuringResets []bool
+}
+
+func (m *holdCheckingMigManager) Reset(gpu string) error {
+	_, held := persistenced.Held(persistencedHoldFile, time.Now())
+	m.heldDuringResets = append(m.heldDuringResets, held)
+	return m.fakeMigManager.Reset(gpu)
+}
+
+func Test_resetGPUs(t *testing.T) {
+	tests := []struct {
+		name            string
+		processes       int
+		persistenceMode bool
+		failReset       bool
+		ignoreMigMode   bool
+		comms           []string
+		// pidFile is the content of the supervisor's pid file, if any.
+		pidFile string
+		// ignoreSignal keeps nvidia-persistenced running when it is stopped.
+		ignoreSignal        bool
+		wantFailed          []string
+		wantResets          []string
+		wantPersistenceMode bool
+		wantStopped         bool
+	}{
+		{
+			name:       "Reset enables MIG mode",
+			comms:      []string{"containerd", "kubelet"},
+			wantResets: []string{"0"},
+		},
+		{
+			name:                "Persistence mode is disabled during the reset",
+			persistenceMode:     true,
+			wantResets:          []string{"0"},
+			wantPersistenceMode: true,
+		},
+		{
+			name:                "Supervised nvidia-persistenced is stopped during the reset",
+			persistenceMode:     true,
+			comms:               []string{"kubelet", "nvidia-persiste"},
+			pidFile:             "101\n",
+			wantResets:          []string{"0"},
+			wantPersistenceMode: true,
+			wantStopped:         true,
+		},
+		{
+			name:                "Unsupervised nvidia-persistenced falls back to reboot",
+			persistenceMode:     true,
+			comms:               []string{"kubelet", "nvidia-persiste"},
+			wantFailed:          []string{"0"},
+			wantPersistenceMode: true,
+		},
+		{
+			name:                "nvidia-persistenced not matching the pid file falls back to reboot",
+			persistenceMode:     true,
+			comms:               []string{"kubelet", "nvidia-persiste"},
+			pidFile:             "100\n",
+			wantFailed:          []string{"0"},
+			wantPersistenceMode: true,
+		},
+		{
+			name:                "nvidia-persistenced that doesn't stop falls back to reboot",
+			persistenceMode:     true,
+			comms:               []string{"kubelet", "nvidia-persiste"},
+			pidFile:             "101\n",
+			ignoreSignal:        true,
+			wantFailed:          []string{"0"},
+			wantPersistenceMode: true,
+			wantStopped:         true,
+		},
+		{
+			name:       "GPU in use falls back to reboot",
+			processes:  1,
+			wantFailed: []string{"0"},
+		},
+		{
+			name:                "Failed reset falls back to reboot",
+			persistenceMode:     true,
+			failReset:           true,
+			wantFailed:          []string{"0"},
+			wantResets:          []string{"0"},
+			wantPersistenceMode: true,
+		},
+		{
+			name:          "MIG mode still pending after reset falls back to reboot",
+			ignoreMigMode: true,
+			wantFailed:    []string{"0"},
+			wantResets:    []string{"0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &holdCheckingMigManager{fakeMigManager: &fakeMigManager{
+				profiles:        map[string][]string{"0": nil},
+				processes:       map[string]int{"0": tt.processes},
+				migMode:         map[string]bool{"0": false},
+				pending:         map[string]bool{"0": true},
+				persistenceMode: map[string]bool{"0": tt.persistenceMode},
+				failReset:       tt.failReset,
+				ignoreMigMode:   tt.ignoreMigMode,
+			}}
+			defer func(procs, pidFile, holdFile string, timeout time.Duration, signal func(int, syscall.Signal) error) {
+				procDir, persistencedPidFile, persistencedHoldFile, persistencedStopTimeout, signalProcess = procs, pidFile, holdFile, timeout, signal
+			}(procDir, persistencedPidFile, persistencedHoldFile, persistencedStopTimeout, signalProcess)
+			procDir = fakeProcDir(t, tt.comms...)
+			runDir := t.TempDir()
+			persistencedPidFile = filepath.Join(runDir, "nvidia-persistenced.pid")
+			persistencedHoldFile = filepath.Join(runDir, "hold")
+			persistencedStopTimeout = 10 * time.Millisecond
+			if tt.pidFile != "" {
+				if err := os.WriteFile(persistencedPidFile, []byte(tt.pidFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stopped := false
+			signalProcess = func(pid int, sig syscall.Signal) error {
+				if sig != unix.SIGTERM {
+					t.Errorf("nvidia-persistenced was sent %v, want %v", sig, unix.SIGTERM)
+				}
+				stopped = true
+				if tt.ignoreSignal {
+					return nil
+				}
+				return os.RemoveAll(filepath.Join(procDir, fmt.Sprint(pid)))
+			}
+
+			failed := resetGPUs(m, []string{"0"})
+			if diff := cmp.Diff(tt.wantFailed, failed); diff != "" {
+				t.Errorf("resetGPUs() (-want, +got) = %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantResets, m.resets); diff != "" {
+				t.Errorf("unexpected GPU resets (-want, +got) = %s", diff)
+			}
+			if m.persistenceMode["0"] != tt.wantPersistenceMode {
+				t.Errorf("persistence mode = %v, want %v", m.persistenceMode["0"], tt.wantPersistenceMode)
+			}
+			if stopped != tt.wantStopped {
+				t.Errorf("nvidia-persistenced stopped = %v, want %v", stopped, tt.wantStopped)
+			}
+			for _, held := range m.heldDuringResets {
+				if tt.wantStopped && !held {
+					t.Errorf("nvidia-persistenced was not held during the GPU reset")
+				}
+			}
+			if _, held := persistenced.Held(persistencedHoldFile, time.Now()); held {
+				t.Errorf("nvidia-persistenced is still held after resetGPUs()")
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/gpusharing"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+const (
+	checkpointVersion = 1
+
+	// DefaultCheckpointFile is where the device plugin saves the allocations by
+	// default. It is in a directory owned by the device plugin, since the
+	// kubelet wipes its device plugin directory when it restarts.
+	DefaultCheckpointFile = "/var/lib/nvidia-gpu-device-plugin/allocations.json"
+
+	// Path is the HTTP path the allocations are served on.
+	Path = "/debug/allocations"
+)
+
+// reconcileGracePeriod is how long an allocation recorded by Allocate is kept
+// even though the kubelet does not report it yet. The kubelet only stores the
+// assignment after Allocate returns, so a reconciliation racing with Allocate
+// must not drop the fresh entry.
+var reconcileGracePeriod = time.Minute
+
+// ControlDevice is a device node under /dev that the device plugin gives to all
+// containers allocated GPUs, along with the GPU devices.
+type ControlDevice struct {
+	Name string
+	// Required devices are given even if they don't exist, the others only if
+	// they exist.
+	Required bool
+}
+
+// ControlDevices are the control devices of the NVIDIA driver, in the order the
+// device plugin gives them to containers.
+var ControlDevices = []ControlDevice{
+	{Name: "nvidiactl", Required: true},
+	{Name: "nvidia-uvm", Required: true},
+	{Name: "nvidia-modeset"},
+	{Name: "nvidia-uvm-tools"},
+}
+
+// Owner identifies the container a device is allocated to.
+type Owner struct {
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+// Entry describes the allocation of a single device ID.
+type Entry struct {
+	Owner
+	// AllocatedAt is the time at which Allocate handed out the device, or the time
+	// at which it was first seen through the kubelet pod-resources API.
+	AllocatedAt time.Time `json:"allocatedAt"`
+}
+
+type checkpoint struct {
+	Version     int              `json:"version"`
+	Allocations map[string]Entry `json:"allocations"`
+}
+
+// Tracker records which device IDs were handed out by the device plugin and,
+// once known, to which container. If a checkpoint file is set, the state is
+// persisted after every change so it survives device plugin restarts.
+type Tracker struct {
+	sync.Mutex
+	checkpointFile string
+	allocations    map[string]Entry
+}
+
+// NewTracker creates an in-memory allocation Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{
+		allocations: make(map[string]Entry),
+	}
+}
+
+// SetCheckpointFile sets the file the allocation state is saved to and
+// restores any state previously saved there.
+func (t *Tracker) SetCheckpointFile(checkpointFile string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.checkpointFile = checkpointFile
+	if err := os.MkdirAll(path.Dir(checkpointFile), 0755); err != nil {
+		return fmt.Errorf("failed to create allocation checkpoint directory: %v", err)
+	}
+	content, err := ioutil.ReadFile(checkpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read allocation checkpoint %s: %v", checkpointFile, err)
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(content, &cp); err != nil {
+		return fmt.Errorf("failed to parse allocation checkpoint %s: %v", checkpointFile, err)
+	}
+	if cp.Version != checkpointVersion {
+		return fmt.Errorf("unsupported allocation checkpoint version %d in %s, want %d", cp.Version, checkpointFile, checkpointVersion)
+	}
+	for id, e := range cp.Allocations {
+		t.allocations[id] = e
+	}
+	slog.Info("Restored device allocations from checkpoint", "allocations", len(cp.Allocations), "path", checkpointFile)
+	return nil
+}
+
+// Record marks the device IDs as allocated. The owner is filled in by the
+// next Reconcile, since Allocate requests carry no pod information.
+func (t *Tracker) Record(deviceIDs []string) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	for _, id := range deviceIDs {
+		t.allocations[id] = Entry{AllocatedAt: now}
+	}
+	t.save()
+}
+
+// Reconcile replaces the tracked state with the device assignments reported by
+// the kubelet. Devices recorded by Allocate within reconcileGracePeriod are
+// kept even if the kubelet does not report them yet. The checkpoint is only
+// written if the state changed.
+func (t *Tracker) Reconcile(assigned map[string]Owner) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	changed := false
+	for id, e := range t.allocations {
+		if _, ok := assigned[id]; ok {
+			continue
+		}
+		if e.Owner == (Owner{}) && now.Sub(e.AllocatedAt) < reconcileGracePeriod {
+			continue
+		}
+		slog.Debug("Releasing device allocation", logging.DeviceID, id, logging.Namespace, e.Owner.Namespace, logging.Pod, e.Owner.Pod, logging.Container, e.Owner.Container)
+		delete(t.allocations, id)
+		changed = true
+	}
+	for id, owner := range assigned {
+		e, ok := t.allocations[id]
+		if ok && e.Owner == owner {
+			continue
+		}
+		t.allocations[id] = Entry{Owner: owner, AllocatedAt: now}
+		changed = true
+	}
+	if changed {
+		t.save()
+	}
+}
+
+// List returns a copy of the current allocations, keyed by device ID.
+func (t *Tracker) List() map[string]Entry {
+	t.Lock()
+	defer t.Unlock()
+
+	allocations := make(map[string]Entry, len(t.allocations))
+	for id, e := range t.allocations {
+		allocations[id] = e
+	}
+	return allocations
+}
+
+// CountByPhysicalDevice returns the number of allocated device IDs for each
+// physical device (GPU or MIG partition). Virtual device IDs used for GPU
+// sharing are counted against their underlying physical device.
+func (t *Tracker) CountByPhysicalDevice() map[string]int {
+	t.Lock()
+	defer t.Unlock()
+
+	counts := make(map[string]int)
+	for id := range t.allocations {
+		physicalID := id
+		if gpusharing.IsVirtualDeviceID(id) {
+			physicalID, _ = gpusharing.VirtualToPhysicalDeviceID(id)
+		}
+		counts[physicalID]++
+	}
+	return counts
+}
+
+// Handler serves the allocations returned by list as JSON, keyed by device ID.
+func Handler(list func() map[string]Entry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list()); err != nil {
+			slog.Error("Failed to encode allocations", logging.Error, err)
+		}
+	})
+}
+
+// save writes the allocation state to the checkpoint file, if one is set.
+// The caller must hold the lock.
+func (t *Tracker) save() {
+	if t.checkpointFile == "" {
+		return
+	}
+	content, err := json.Marshal(checkpoint{Version: checkpointVersion, Allocations: t.allocations})
+	if err != nil {
+		slog.Error("Failed to encode allocation checkpoint", logging.Error, err)
+		return
+	}
+	// Write to a temporary file first so that a crash never leaves a partial checkpoint behind.
+	tmpFile, err := ioutil.TempFile(path.Dir(t.checkpointFile), path.Base(t.checkpointFile)+".tmp")
+	if err != nil {
+		slog.Error("Failed to create temporary allocation checkpoint", logging.Error, err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		slog.Error("Failed to write allocation checkpoint", logging.Error, err)
+		return
+	}
+	if err := tmpFile.Close(); err != nil {
+		slog.Error("Failed to write allocation checkpoint", logging.Error, err)
+		return
+	}
+	if err := os.Rename(tmpFile.Name(), t.checkpointFile); err != nil {
+		slog.Error("Failed to save allocation checkpoint", "path", t.checkpointFile, logging.Error, err)
+	}
+}
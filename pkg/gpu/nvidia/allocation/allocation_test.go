@@ -0,0 +1,200 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocation
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
+)
+
+func TestReconcile(t *testing.T) {
+	owner := Owner{Namespace: "default", Pod: "pod-a", Container: "main"}
+	cases := []struct {
+		name        string
+		recorded    []string
+		recordedAge time.Duration
+		assigned    map[string]Owner
+		want        map[string]Owner
+	}{{
+		name:     "fresh allocations are kept until the kubelet reports them",
+		recorded: []string{"nvidia0"},
+		assigned: map[string]Owner{},
+		want:     map[string]Owner{"nvidia0": {}},
+	}, {
+		name:        "stale allocations not known to the kubelet are released",
+		recorded:    []string{"nvidia0"},
+		recordedAge: 2 * reconcileGracePeriod,
+		assigned:    map[string]Owner{},
+		want:        map[string]Owner{},
+	}, {
+		name:     "owners are filled in from the kubelet",
+		recorded: []string{"nvidia0"},
+		assigned: map[string]Owner{"nvidia0": owner},
+		want:     map[string]Owner{"nvidia0": owner},
+	}, {
+		name:     "allocations made before a restart are restored from the kubelet",
+		assigned: map[string]Owner{"nvidia1/vgpu0": owner},
+		want:     map[string]Owner{"nvidia1/vgpu0": owner},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tracker := NewTracker()
+			tracker.Record(tc.recorded)
+			for id, e := range tracker.allocations {
+				e.AllocatedAt = e.AllocatedAt.Add(-tc.recordedAge)
+				tracker.allocations[id] = e
+			}
+			tracker.Reconcile(tc.assigned)
+
+			got := make(map[string]Owner)
+			for id, e := range tracker.List() {
+				got[id] = e.Owner
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("unexpected allocations (-want, +got) = %s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	checkpointFile := path.Join(testDir, "allocations.json")
+
+	tracker := NewTracker()
+	if err := tracker.SetCheckpointFile(checkpointFile); err != nil {
+		t.Fatalf("unexpected error setting a missing checkpoint file: %v", err)
+	}
+	tracker.Record([]string{"nvidia0/vgpu0", "nvidia0/vgpu1"})
+	tracker.Reconcile(map[string]Owner{
+		"nvidia0/vgpu0": {Namespace: "default", Pod: "pod-a", Container: "main"},
+	})
+
+	restored := NewTracker()
+	if err := restored.SetCheckpointFile(checkpointFile); err != nil {
+		t.Fatalf("failed to restore checkpoint: %v", err)
+	}
+	if diff := cmp.Diff(tracker.List(), restored.List()); diff != "" {
+		t.Errorf("unexpected restored allocations (-want, +got) = %s", diff)
+	}
+
+	if err := ioutil.WriteFile(checkpointFile, []byte(`{"version": 2}`), 0644); err != nil {
+		t.Fatalf("failed to write checkpoint: %v", err)
+	}
+	if err := NewTracker().SetCheckpointFile(checkpointFile); err == nil {
+		t.Error("expected an error restoring a checkpoint with an unsupported version")
+	}
+}
+
+func TestReconcileSavesChanges(t *testing.T) {
+	checkpointFile := path.Join(t.TempDir(), "state", "allocations.json")
+	owner := Owner{Namespace: "default", Pod: "pod-a", Container: "main"}
+
+	tracker := NewTracker()
+	if err := tracker.SetCheckpointFile(checkpointFile); err != nil {
+		t.Fatalf("unexpected error setting a checkpoint file in a missing directory: %v", err)
+	}
+	tracker.Reconcile(map[string]Owner{"nvidia0": owner})
+	if _, err := os.Stat(checkpointFile); err != nil {
+		t.Fatalf("checkpoint was not saved after the allocations changed: %v", err)
+	}
+
+	if err := os.Remove(checkpointFile); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Reconcile(map[string]Owner{"nvidia0": owner})
+	if _, err := os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("checkpoint was saved although the allocations did not change, err = %v", err)
+	}
+
+	tracker.Reconcile(map[string]Owner{})
+	if _, err := os.Stat(checkpointFile); err != nil {
+		t.Errorf("checkpoint was not saved after an allocation was released: %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Reconcile(map[string]Owner{"nvidia0": {Namespace: "default", Pod: "pod-a", Container: "main"}})
+
+	w := httptest.NewRecorder()
+	Handler(tracker.List).ServeHTTP(w, httptest.NewRequest(http.MethodGet, Path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d, want %d", Path, w.Code, http.StatusOK)
+	}
+	var got map[string]Entry
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode allocations %q: %v", w.Body.String(), err)
+	}
+	if diff := cmp.Diff(tracker.List(), got); diff != "" {
+		t.Errorf("unexpected allocations (-want, +got) = %s", diff)
+	}
+
+	w = httptest.NewRecorder()
+	Handler(tracker.List).ServeHTTP(w, httptest.NewRequest(http.MethodPut, Path, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT %s = %d, want %d", Path, w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCountByPhysicalDevice(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Record([]string{"nvidia0/vgpu0", "nvidia0/vgpu3", "nvidia1/vgpu0", "nvidia0/gi1/vgpu1", "nvidia2"})
+
+	want := map[string]int{
+		"nvidia0":     2,
+		"nvidia1":     1,
+		"nvidia0/gi1": 1,
+		"nvidia2":     1,
+	}
+	if diff := cmp.Diff(want, tracker.CountByPhysicalDevice()); diff != "" {
+		t.Errorf("unexpected counts (-want, +got) = %s", diff)
+	}
+}
+
+func TestAssignmentsFromPodResources(t *testing.T) {
+	resp := &podresources.ListPodResourcesResponse{
+		PodResources: []*podresources.PodResources{{
+			Name:      "pod-a",
+			Namespace: "default",
+			Containers: []*podresources.ContainerResources{{
+				Name: "main",
+				Devices: []*podresources.ContainerDevices{
+					{ResourceName: "nvidia.com/gpu", DeviceIds: []string{"nvidia0", "nvidia1"}},
+					{ResourceName: "example.com/other", DeviceIds: []string{"other0"}},
+				},
+			}},
+		}},
+	}
+	owner := Owner{Namespace: "default", Pod: "pod-a", Container: "main"}
+	want := map[string]Owner{"nvidia0": owner, "nvidia1": owner}
+	if diff := cmp.Diff(want, assignmentsFromPodResources(resp, "nvidia.com/gpu")); diff != "" {
+		t.Errorf("unexpected assignments (-want, +got) = %s", diff)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+	"google.golang.org/grpc"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
+)
+
+var (
+	// PodResourcesSocket is the kubelet pod-resources API endpoint.
+	PodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+	connectionTimeout = 10 * time.Second
+)
+
+// KubeletAssignments returns the devices of resourceName that the kubelet
+// reports as assigned to running containers, keyed by device ID.
+func KubeletAssignments(resourceName string) (map[string]Owner, error) {
+	// Fail fast instead of blocking on the dial when the kubelet is not serving the API.
+	if _, err := os.Stat(PodResourcesSocket); err != nil {
+		return nil, fmt.Errorf("kubelet PodResourceLister endpoint is not available: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(
+		ctx,
+		PodResourcesSocket,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to kubelet PodResourceLister service: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			slog.Warn("Failed to close grpc connection to kubelet PodResourceLister endpoint", logging.Error, err)
+		}
+	}()
+
+	client := podresources.NewPodResourcesListerClient(conn)
+	resp, err := client.List(ctx, &podresources.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing pod resources: %v", err)
+	}
+	return assignmentsFromPodResources(resp, resourceName), nil
+}
+
+func assignmentsFromPodResources(resp *podresources.ListPodResourcesResponse, resourceName string) map[string]Owner {
+	assigned := make(map[string]Owner)
+	for _, pod := range resp.GetPodResources() {
+		for _, c := range pod.GetContainers() {
+			for _, d := range c.GetDevices() {
+				if d.GetResourceName() != resourceName {
+					continue
+				}
+				for _, id := range d.GetDeviceIds() {
+					assigned[id] = Owner{Namespace: pod.GetNamespace(), Pod: pod.GetName(), Container: c.GetName()}
+				}
+			}
+		}
+	}
+	return assigned
+}
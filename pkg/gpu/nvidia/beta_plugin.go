@@ -16,16 +16,17 @@ package nvidia
 
 import (
 	"fmt"
+	"log/slog"
 	"net"
 	"time"
 
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/gpusharing"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 )
 
 type pluginServiceV1Beta1 struct {
@@ -33,22 +34,30 @@ type pluginServiceV1Beta1 struct {
 }
 
 func (s *pluginServiceV1Beta1) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{}, nil
+	return &pluginapi.DevicePluginOptions{
+		// Preferred allocations are only used to place shared GPUs across physical GPUs.
+		GetPreferredAllocationAvailable: s.ngm.gpuConfig.GPUSharingConfig.MaxSharedClientsPerGPU > 0,
+	}, nil
 }
 
 func (s *pluginServiceV1Beta1) ListAndWatch(emtpy *pluginapi.Empty, stream pluginapi.DevicePlugin_ListAndWatchServer) error {
-	glog.Infoln("device-plugin: ListAndWatch start")
+	slog.Info("ListAndWatch started")
 	if err := s.sendDevices(stream); err != nil {
 		return err
 	}
 	for {
 		select {
 		case d := <-s.ngm.Health:
-			glog.Infof("device-plugin: %s device marked as %s", d.ID, d.Health)
+			slog.Info("Device health changed", logging.DeviceID, d.ID, "health", d.Health)
 			s.ngm.SetDeviceHealth(d.ID, d.Health, d.Topology)
 			if err := s.sendDevices(stream); err != nil {
 				return err
 			}
+		case <-s.ngm.devicesChanged:
+			slog.Info("Devices changed")
+			if err := s.sendDevices(stream); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -61,9 +70,41 @@ func (s *pluginServiceV1Beta1) Allocate(ctx context.Context, requests *pluginapi
 			return nil, err
 		}
 
+		deviceIDs, err := s.ngm.InternalDeviceIDs(rqt.DevicesIDs)
+		if err != nil {
+			return nil, err
+		}
+
 		resp := new(pluginapi.ContainerAllocateResponse)
+		resp.Envs = s.ngm.Envs(len(rqt.DevicesIDs))
+		allocationEnvs, err := s.ngm.AllocationEnvs(deviceIDs)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range allocationEnvs {
+			resp.Envs[k] = v
+		}
+		if s.ngm.cdiEnabled() {
+			// Default devices and mounts are part of the CDI spec.
+			names := make(map[string]bool)
+			for _, id := range deviceIDs {
+				name, err := s.ngm.CDIDevice(id)
+				if err != nil {
+					return nil, err
+				}
+				// Shared GPUs on the same physical GPU map to the same CDI device.
+				if names[name] {
+					continue
+				}
+				names[name] = true
+				resp.CDIDevices = append(resp.CDIDevices, &pluginapi.CDIDevice{Name: name})
+			}
+			resps.ContainerResponses = append(resps.ContainerResponses, resp)
+			continue
+		}
+
 		// Add all requested devices to Allocate Response
-		for _, id := range rqt.DevicesIDs {
+		for _, id := range deviceIDs {
 			devices, err := s.ngm.DeviceSpec(id)
 			if err != nil {
 				return nil, err
@@ -86,20 +127,33 @@ func (s *pluginServiceV1Beta1) Allocate(ctx context.Context, requests *pluginapi
 			resp.Mounts = append(resp.Mounts, &s.ngm.mountPaths[i])
 		}
 
-		resp.Envs = s.ngm.Envs(len(rqt.DevicesIDs))
 		resps.ContainerResponses = append(resps.ContainerResponses, resp)
 	}
+	for _, rqt := range requests.ContainerRequests {
+		s.ngm.allocations.Record(rqt.DevicesIDs)
+	}
 	return resps, nil
 }
 
 func (s *pluginServiceV1Beta1) PreStartContainer(ctx context.Context, r *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	glog.Errorf("device-plugin: PreStart should NOT be called for GKE nvidia GPU device plugin\n")
+	slog.Error("PreStartContainer should not be called for the GKE NVIDIA GPU device plugin")
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
 
-func (s *pluginServiceV1Beta1) GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	glog.Errorf("device-plugin: GetPreferredAllocation should NOT be called for GKE nvidia GPU device plugin\n")
-	return &pluginapi.PreferredAllocationResponse{}, nil
+func (s *pluginServiceV1Beta1) GetPreferredAllocation(ctx context.Context, requests *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	resps := new(pluginapi.PreferredAllocationResponse)
+	if s.ngm.gpuConfig.GPUSharingConfig.MaxSharedClientsPerGPU <= 0 {
+		slog.Error("GetPreferredAllocation should not be called for the GKE NVIDIA GPU device plugin without GPU sharing")
+		return resps, nil
+	}
+	for _, rqt := range requests.ContainerRequests {
+		deviceIDs, err := s.ngm.PreferredAllocation(rqt.AvailableDeviceIDs, rqt.MustIncludeDeviceIDs, int(rqt.AllocationSize))
+		if err != nil {
+			return nil, err
+		}
+		resps.ContainerResponses = append(resps.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{DeviceIDs: deviceIDs})
+	}
+	return resps, nil
 }
 
 func (s *pluginServiceV1Beta1) RegisterService() {
@@ -132,12 +186,17 @@ func RegisterWithV1Beta1Kubelet(kubeletEndpoint, pluginEndpoint, resourceName st
 
 func (s *pluginServiceV1Beta1) sendDevices(stream pluginapi.DevicePlugin_ListAndWatchServer) error {
 	resp := new(pluginapi.ListAndWatchResponse)
+	unhealthy := 0
 	for _, dev := range s.ngm.ListDevices() {
 		resp.Devices = append(resp.Devices, &pluginapi.Device{ID: dev.ID, Health: dev.Health, Topology: dev.Topology})
+		if dev.Health != pluginapi.Healthy {
+			unhealthy++
+		}
 	}
-	glog.Infof("ListAndWatch: send devices %v\n", resp)
+	slog.Info("Sending devices to the kubelet", "devices", len(resp.Devices), "unhealthy", unhealthy)
+	slog.Debug("Sending devices to the kubelet", "response", resp.String())
 	if err := stream.Send(resp); err != nil {
-		glog.Errorf("device-plugin: cannot update device states: %v\n", err)
+		slog.Error("Cannot update device states", logging.Error, err)
 		s.ngm.grpcServer.Stop()
 		return err
 	}
@@ -15,16 +15,20 @@
 package nvidia
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/cdi"
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/nvmlutil"
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/net/context"
@@ -241,6 +245,89 @@ func TestNvidiaGPUManagerBetaAPI(t *testing.T) {
 
 }
 
+func TestGetPreferredAllocation(t *testing.T) {
+	gpuConfig := GPUConfig{
+		GPUSharingConfig: GPUSharingConfig{
+			GPUSharingStrategy:     "time-sharing",
+			MaxSharedClientsPerGPU: 2,
+		},
+	}
+	ngm := NewNvidiaGPUManager("", "", nil, gpuConfig)
+	ngm.allocations.Record([]string{"nvidia0/vgpu0"})
+	plugin := &pluginServiceV1Beta1{ngm: ngm}
+
+	options, err := plugin.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	if err != nil {
+		t.Fatalf("unexpected error getting device plugin options: %v", err)
+	}
+	if !options.GetPreferredAllocationAvailable {
+		t.Error("GetPreferredAllocation should be available with GPU sharing")
+	}
+
+	resp, err := plugin.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs: []string{"nvidia0/vgpu1", "nvidia1/vgpu0", "nvidia1/vgpu1"},
+			AllocationSize:     1,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error getting preferred allocation: %v", err)
+	}
+	if diff := cmp.Diff([]string{"nvidia1/vgpu0"}, resp.ContainerResponses[0].DeviceIDs); diff != "" {
+		t.Errorf("unexpected preferred allocation (-want, +got) = %s", diff)
+	}
+}
+
+func TestAllocateWithCDI(t *testing.T) {
+	testDevDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dev dir: %v", err)
+	}
+	defer os.RemoveAll(testDevDir)
+	for _, device := range []string{nvidiaCtlDevice, nvidiaUVMDevice, "nvidia0", "nvidia1"} {
+		if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+			t.Fatalf("failed to create device node (%s): %v", device, err)
+		}
+	}
+	specDir, err := ioutil.TempDir("", "cdi")
+	if err != nil {
+		t.Fatalf("failed to create temp cdi dir: %v", err)
+	}
+	defer os.RemoveAll(specDir)
+
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+	gpuConfig := GPUConfig{
+		GPUSharingConfig: GPUSharingConfig{
+			GPUSharingStrategy:     "time-sharing",
+			MaxSharedClientsPerGPU: 2,
+		},
+	}
+	mountPaths := []pluginapi.Mount{{HostPath: "/home/kubernetes/bin/nvidia", ContainerPath: "/usr/local/nvidia", ReadOnly: true}}
+	ngm := NewNvidiaGPUManager(testDevDir, "", mountPaths, gpuConfig)
+	ngm.EnableCDI(specDir, "")
+	if err := ngm.Start(); err != nil {
+		t.Fatalf("unable to start gpu manager: %v", err)
+	}
+	if _, err := os.Stat(path.Join(specDir, "nvidia-gpu-device-plugin.json")); err != nil {
+		t.Errorf("CDI spec was not written: %v", err)
+	}
+
+	plugin := &pluginServiceV1Beta1{ngm: ngm}
+	resp, err := plugin.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"nvidia1/vgpu1"}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error allocating devices: %v", err)
+	}
+	want := &pluginapi.ContainerAllocateResponse{
+		Envs:       map[string]string{},
+		CDIDevices: []*pluginapi.CDIDevice{{Name: "nvidia.com/gpu=GPU-1"}},
+	}
+	if diff := cmp.Diff(want, resp.ContainerResponses[0]); diff != "" {
+		t.Errorf("unexpected allocate response (-want, +got) = %s", diff)
+	}
+}
+
 func testNvidiaGPUManagerBetaAPI(gpuConfig GPUConfig, wantDevices map[string]*pluginapi.Device, validRequests []*pluginapi.ContainerAllocateRequest, usedRequests []*pluginapi.ContainerAllocateRequest, invalidRequests []*pluginapi.ContainerAllocateRequest, newRequests []*pluginapi.ContainerAllocateRequest) error {
 	testDevDir, err := ioutil.TempDir("", "dev")
 	defer os.RemoveAll(testDevDir)
@@ -249,8 +336,8 @@ func testNvidiaGPUManagerBetaAPI(gpuConfig GPUConfig, wantDevices map[string]*pl
 	deviceNodes := []string{
 		nvidiaCtlDevice,
 		nvidiaUVMDevice,
-		nvidiaUVMToolsDevice,
-		nvidiaModesetDevice,
+		"nvidia-uvm-tools",
+		"nvidia-modeset",
 		"nvidia0",
 		"nvidia1",
 	}
@@ -388,6 +475,194 @@ func testNvidiaGPUManagerBetaAPI(gpuConfig GPUConfig, wantDevices map[string]*pl
 	return nil
 }
 
+func TestAllocateWithCDIVisibleDevicesEnv(t *testing.T) {
+	cases := []struct {
+		name          string
+		allocationEnv AllocationEnvConfig
+		wantSpecEnv   []string
+		wantEnvs      map[string]string
+	}{{
+		name:        "no allocation env",
+		wantSpecEnv: []string{"NVIDIA_VISIBLE_DEVICES=void"},
+		wantEnvs:    map[string]string{},
+	}, {
+		name:          "NVIDIA_VISIBLE_DEVICES set by Allocate",
+		allocationEnv: AllocationEnvConfig{VisibleDevices: "NVIDIA_VISIBLE_DEVICES"},
+		wantEnvs:      map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-1"},
+	}, {
+		name:          "other visible devices env",
+		allocationEnv: AllocationEnvConfig{VisibleDevices: "GPU_UUIDS"},
+		wantSpecEnv:   []string{"NVIDIA_VISIBLE_DEVICES=void"},
+		wantEnvs:      map[string]string{"GPU_UUIDS": "GPU-1"},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testDevDir := t.TempDir()
+			for _, device := range []string{nvidiaCtlDevice, nvidiaUVMDevice, "nvidia0", "nvidia1"} {
+				if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+					t.Fatalf("failed to create device node (%s): %v", device, err)
+				}
+			}
+			specDir := t.TempDir()
+
+			nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+			ngm := NewNvidiaGPUManager(testDevDir, "", nil, GPUConfig{AllocationEnv: tc.allocationEnv})
+			ngm.EnableCDI(specDir, "")
+			if err := ngm.Start(); err != nil {
+				t.Fatalf("unable to start gpu manager: %v", err)
+			}
+			data, err := os.ReadFile(path.Join(specDir, "nvidia-gpu-device-plugin.json"))
+			if err != nil {
+				t.Fatalf("CDI spec was not written: %v", err)
+			}
+			var spec cdi.Spec
+			if err := json.Unmarshal(data, &spec); err != nil {
+				t.Fatalf("invalid CDI spec: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantSpecEnv, spec.ContainerEdits.Env); diff != "" {
+				t.Errorf("unexpected CDI spec env (-want, +got) = %s", diff)
+			}
+
+			plugin := &pluginServiceV1Beta1{ngm: ngm}
+			resp, err := plugin.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"nvidia1"}}},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error allocating devices: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantEnvs, resp.ContainerResponses[0].Envs); diff != "" {
+				t.Errorf("unexpected allocate envs (-want, +got) = %s", diff)
+			}
+		})
+	}
+}
+
+func TestCDISpecLdcacheHook(t *testing.T) {
+	testDevDir := t.TempDir()
+	for _, device := range []string{nvidiaCtlDevice, nvidiaUVMDevice, "nvidia0"} {
+		if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+			t.Fatalf("failed to create device node (%s): %v", device, err)
+		}
+	}
+	hostDir := t.TempDir()
+	if err := os.MkdirAll(path.Join(hostDir, "nvidia", "lib64"), 0755); err != nil {
+		t.Fatalf("failed to create library dir: %v", err)
+	}
+	if err := os.MkdirAll(path.Join(hostDir, "vulkan", "icd.d"), 0755); err != nil {
+		t.Fatalf("failed to create vulkan ICD dir: %v", err)
+	}
+	specDir := t.TempDir()
+
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+	mountPaths := []pluginapi.Mount{
+		{HostPath: path.Join(hostDir, "nvidia"), ContainerPath: "/usr/local/nvidia", ReadOnly: true},
+		{HostPath: path.Join(hostDir, "vulkan", "icd.d"), ContainerPath: "/etc/vulkan/icd.d", ReadOnly: true},
+	}
+	ngm := NewNvidiaGPUManager(testDevDir, "", mountPaths, GPUConfig{})
+	ngm.EnableCDI(specDir, "/home/kubernetes/bin/nvidia/bin/nvidia-ctk")
+	if err := ngm.Start(); err != nil {
+		t.Fatalf("unable to start gpu manager: %v", err)
+	}
+	data, err := os.ReadFile(path.Join(specDir, "nvidia-gpu-device-plugin.json"))
+	if err != nil {
+		t.Fatalf("CDI spec was not written: %v", err)
+	}
+	var spec cdi.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("invalid CDI spec: %v", err)
+	}
+	want := []*cdi.Hook{{
+		HookName: "createContainer",
+		Path:     "/home/kubernetes/bin/nvidia/bin/nvidia-ctk",
+		Args:     []string{"nvidia-ctk", "hook", "update-ldcache", "--folder", "/usr/local/nvidia/lib64"},
+	}}
+	if diff := cmp.Diff(want, spec.ContainerEdits.Hooks); diff != "" {
+		t.Errorf("unexpected CDI spec hooks (-want, +got) = %s", diff)
+	}
+}
+
+func TestAllocateByUUIDWithMinorDeviceIDs(t *testing.T) {
+	cases := []struct {
+		name          string
+		gpuConfig     GPUConfig
+		wantDeviceIDs []string
+		request       []string
+		wantDevices   []string
+	}{{
+		name:          "GPUs",
+		wantDeviceIDs: []string{"nvidia0", "nvidia1"},
+		request:       []string{"GPU-1"},
+		wantDevices:   []string{"nvidia1"},
+	}, {
+		name:          "GPU partitions",
+		gpuConfig:     GPUConfig{GPUPartitionSize: "3g.20gb"},
+		wantDeviceIDs: []string{"nvidia0/gi1", "nvidia0/gi2"},
+		request:       []string{"MIG-0-1", "nvidia0/gi1"},
+		wantDevices:   []string{"nvidia0", "nvidia-caps/nvidia-cap21", "nvidia-caps/nvidia-cap22", "nvidia0", "nvidia-caps/nvidia-cap12", "nvidia-caps/nvidia-cap13"},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testDevDir := t.TempDir()
+			testProcDir := t.TempDir()
+			for _, device := range []string{nvidiaCtlDevice, nvidiaUVMDevice, "nvidia0", "nvidia1"} {
+				if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+					t.Fatalf("failed to create device node (%s): %v", device, err)
+				}
+			}
+			if tc.gpuConfig.GPUPartitionSize != "" {
+				versionFile := path.Join(testProcDir, "driver/nvidia/version")
+				if err := os.MkdirAll(path.Dir(versionFile), 0755); err != nil {
+					t.Fatalf("failed to create proc dir: %v", err)
+				}
+				if err := ioutil.WriteFile(versionFile, []byte("NVRM version: NVIDIA UNIX x86_64 Kernel Module  535.230.02  Tue Jan 21 17:12:21 UTC 2025\n"), 0644); err != nil {
+					t.Fatalf("failed to create driver version file: %v", err)
+				}
+				createMigCapabilities(t, testDevDir, testProcDir, map[string]int{
+					"gpu0/mig/gi1/access":     12,
+					"gpu0/mig/gi1/ci0/access": 13,
+					"gpu0/mig/gi2/access":     21,
+					"gpu0/mig/gi2/ci0/access": 22,
+				})
+			}
+
+			nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+			ngm := NewNvidiaGPUManager(testDevDir, testProcDir, nil, tc.gpuConfig)
+			ngm.SetTolerateMisconfiguredGPUs(true)
+			if err := ngm.Start(); err != nil {
+				t.Fatalf("unable to start gpu manager: %v", err)
+			}
+
+			var gotDeviceIDs []string
+			for id := range ngm.ListDevices() {
+				gotDeviceIDs = append(gotDeviceIDs, id)
+			}
+			sort.Strings(gotDeviceIDs)
+			if diff := cmp.Diff(tc.wantDeviceIDs, gotDeviceIDs); diff != "" {
+				t.Errorf("unexpected advertised device IDs (-want, +got) = %s", diff)
+			}
+
+			plugin := &pluginServiceV1Beta1{ngm: ngm}
+			resp, err := plugin.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: tc.request}},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error allocating %v: %v", tc.request, err)
+			}
+			var gotDevices []string
+			for _, d := range resp.ContainerResponses[0].Devices {
+				if p, ok := strings.CutPrefix(d.HostPath, testDevDir+"/"); ok && p != nvidiaCtlDevice && p != nvidiaUVMDevice {
+					gotDevices = append(gotDevices, p)
+				}
+			}
+			if diff := cmp.Diff(tc.wantDevices, gotDevices); diff != "" {
+				t.Errorf("unexpected allocated devices (-want, +got) = %s", diff)
+			}
+		})
+	}
+}
+
 func testNvidiaGPUManagerBetaAPIWithMig(gpuConfig GPUConfig, wantDevices map[string]*pluginapi.Device, validRequests []*pluginapi.ContainerAllocateRequest, usedRequests []*pluginapi.ContainerAllocateRequest, invalidRequests []*pluginapi.ContainerAllocateRequest, newRequests []*pluginapi.ContainerAllocateRequest) error {
 	testDevDir, err := ioutil.TempDir("", "dev")
 	defer os.RemoveAll(testDevDir)
@@ -408,6 +683,9 @@ func testNvidiaGPUManagerBetaAPIWithMig(gpuConfig GPUConfig, wantDevices map[str
 			os.RemoveAll(path.Join(testProcDir, p))
 		}
 	}()
+	if err := ioutil.WriteFile(path.Join(testProcDir, "driver/nvidia/version"), []byte("NVRM version: NVIDIA UNIX x86_64 Kernel Module  535.230.02  Tue Jan 21 17:12:21 UTC 2025\n"), 0644); err != nil {
+		return fmt.Errorf("failed to create driver version file: %w", err)
+	}
 
 	if err := os.MkdirAll(path.Join(testDevDir, "nvidia-caps"), 0755); err != nil {
 		return fmt.Errorf("failed to make dir: %w", err)
@@ -418,8 +696,8 @@ func testNvidiaGPUManagerBetaAPIWithMig(gpuConfig GPUConfig, wantDevices map[str
 	deviceNodes := []string{
 		nvidiaCtlDevice,
 		nvidiaUVMDevice,
-		nvidiaUVMToolsDevice,
-		nvidiaModesetDevice,
+		"nvidia-uvm-tools",
+		"nvidia-modeset",
 		"nvidia0",
 		"nvidia-caps/nvidia-cap12",
 		"nvidia-caps/nvidia-cap13",
@@ -0,0 +1,176 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cdi generates Container Device Interface (CDI) specs for the GPUs
+// managed by the device plugin.
+// See https://github.com/cncf-tags/container-device-interface/blob/main/SPEC.md
+package cdi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// Version is the CDI spec version generated by this package.
+	Version = "0.6.0"
+	// Kind is the fully qualified kind of the devices in the generated spec.
+	Kind = "nvidia.com/gpu"
+	// SpecFileName is the name of the spec file written to the CDI spec directory.
+	SpecFileName = "nvidia-gpu-device-plugin.json"
+)
+
+// Spec is a CDI spec.
+type Spec struct {
+	Version        string         `json:"cdiVersion"`
+	Kind           string         `json:"kind"`
+	Devices        []Device       `json:"devices"`
+	ContainerEdits ContainerEdits `json:"containerEdits,omitempty"`
+}
+
+// Device is a device in a CDI spec.
+type Device struct {
+	Name           string         `json:"name"`
+	ContainerEdits ContainerEdits `json:"containerEdits"`
+}
+
+// ContainerEdits are the changes applied to a container that is given a device.
+type ContainerEdits struct {
+	Env         []string      `json:"env,omitempty"`
+	DeviceNodes []*DeviceNode `json:"deviceNodes,omitempty"`
+	Hooks       []*Hook       `json:"hooks,omitempty"`
+	Mounts      []*Mount      `json:"mounts,omitempty"`
+}
+
+// DeviceNode is a device node to create in the container.
+type DeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// Mount is a mount to add to the container.
+type Mount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Options       []string `json:"options,omitempty"`
+}
+
+// Hook is an OCI hook to add to the container.
+type Hook struct {
+	HookName string   `json:"hookName"`
+	Path     string   `json:"path"`
+	Args     []string `json:"args,omitempty"`
+	Env      []string `json:"env,omitempty"`
+}
+
+// NewSpec returns an empty spec with the given edits applied to every container
+// that is given a device from the spec.
+func NewSpec(commonEdits ContainerEdits) *Spec {
+	return &Spec{
+		Version:        Version,
+		Kind:           Kind,
+		ContainerEdits: commonEdits,
+	}
+}
+
+// AddDevice adds a device that injects the given device nodes.
+func (s *Spec) AddDevice(name string, deviceSpecs []pluginapi.DeviceSpec) {
+	s.Devices = append(s.Devices, Device{
+		Name:           name,
+		ContainerEdits: ContainerEdits{DeviceNodes: DeviceNodes(deviceSpecs)},
+	})
+}
+
+// QualifiedName returns the fully qualified CDI name of a device, e.g. nvidia.com/gpu=GPU-<uuid>.
+func QualifiedName(name string) string {
+	return Kind + "=" + name
+}
+
+// DeviceNodes converts device plugin device specs to CDI device nodes.
+func DeviceNodes(deviceSpecs []pluginapi.DeviceSpec) []*DeviceNode {
+	var nodes []*DeviceNode
+	for _, d := range deviceSpecs {
+		nodes = append(nodes, &DeviceNode{Path: d.ContainerPath, HostPath: d.HostPath, Permissions: d.Permissions})
+	}
+	return nodes
+}
+
+// Mounts converts device plugin mounts to CDI bind mounts.
+func Mounts(mounts []pluginapi.Mount) []*Mount {
+	var cdiMounts []*Mount
+	for _, m := range mounts {
+		mode := "rw"
+		if m.ReadOnly {
+			mode = "ro"
+		}
+		cdiMounts = append(cdiMounts, &Mount{
+			HostPath:      m.HostPath,
+			ContainerPath: m.ContainerPath,
+			Options:       []string{mode, "nosuid", "nodev", "bind"},
+		})
+	}
+	return cdiMounts
+}
+
+// LdcacheHook returns a createContainer hook that runs nvidia-ctk (at hookPath) to
+// update the container's ldcache with the given library directories.
+func LdcacheHook(hookPath string, folders ...string) *Hook {
+	args := []string{"nvidia-ctk", "hook", "update-ldcache"}
+	for _, f := range folders {
+		args = append(args, "--folder", f)
+	}
+	return &Hook{HookName: "createContainer", Path: hookPath, Args: args}
+}
+
+// WriteSpec writes the spec to SpecFileName under specDir.
+func WriteSpec(specDir string, spec *Spec) error {
+	sort.Slice(spec.Devices, func(i, j int) bool { return spec.Devices[i].Name < spec.Devices[j].Name })
+	content, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode CDI spec: %v", err)
+	}
+	if err := os.MkdirAll(specDir, 0755); err != nil {
+		return fmt.Errorf("failed to create CDI spec directory %s: %v", specDir, err)
+	}
+
+	// Container runtimes watch the spec directory, so the spec is written to a
+	// temporary file first to never expose a partial spec.
+	tmpFile, err := ioutil.TempFile(specDir, "."+SpecFileName)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary CDI spec: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write CDI spec: %v", err)
+	}
+	if err := tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write CDI spec: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write CDI spec: %v", err)
+	}
+	if err := os.Rename(tmpFile.Name(), path.Join(specDir, SpecFileName)); err != nil {
+		return fmt.Errorf("failed to save CDI spec: %v", err)
+	}
+	return nil
+}
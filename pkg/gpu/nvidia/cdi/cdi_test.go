@@ -0,0 +1,94 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cdi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestWriteSpec(t *testing.T) {
+	specDir, err := ioutil.TempDir("", "cdi")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(specDir)
+
+	spec := NewSpec(ContainerEdits{
+		DeviceNodes: DeviceNodes([]pluginapi.DeviceSpec{{HostPath: "/dev/nvidiactl", ContainerPath: "/dev/nvidiactl", Permissions: "mrw"}}),
+		Mounts: Mounts([]pluginapi.Mount{
+			{HostPath: "/home/kubernetes/bin/nvidia", ContainerPath: "/usr/local/nvidia", ReadOnly: true},
+			{HostPath: "/tmp/nvidia-mps", ContainerPath: "/tmp/nvidia-mps"},
+		}),
+		Hooks: []*Hook{LdcacheHook("/home/kubernetes/bin/nvidia/bin/nvidia-ctk", "/usr/local/nvidia/lib64")},
+	})
+	spec.AddDevice("GPU-1", []pluginapi.DeviceSpec{{HostPath: "/dev/nvidia1", ContainerPath: "/dev/nvidia1", Permissions: "mrw"}})
+	spec.AddDevice("GPU-0", []pluginapi.DeviceSpec{{HostPath: "/dev/nvidia0", ContainerPath: "/dev/nvidia0", Permissions: "mrw"}})
+	if err := WriteSpec(specDir, spec); err != nil {
+		t.Fatalf("failed to write CDI spec: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(specDir)
+	if err != nil {
+		t.Fatalf("failed to read spec dir: %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != SpecFileName {
+		t.Fatalf("unexpected files in the CDI spec dir: %v", files)
+	}
+	content, err := ioutil.ReadFile(path.Join(specDir, SpecFileName))
+	if err != nil {
+		t.Fatalf("failed to read CDI spec: %v", err)
+	}
+	var got Spec
+	if err := json.Unmarshal(content, &got); err != nil {
+		t.Fatalf("failed to parse CDI spec: %v", err)
+	}
+
+	want := Spec{
+		Version: Version,
+		Kind:    Kind,
+		Devices: []Device{
+			{Name: "GPU-0", ContainerEdits: ContainerEdits{DeviceNodes: []*DeviceNode{{Path: "/dev/nvidia0", HostPath: "/dev/nvidia0", Permissions: "mrw"}}}},
+			{Name: "GPU-1", ContainerEdits: ContainerEdits{DeviceNodes: []*DeviceNode{{Path: "/dev/nvidia1", HostPath: "/dev/nvidia1", Permissions: "mrw"}}}},
+		},
+		ContainerEdits: ContainerEdits{
+			DeviceNodes: []*DeviceNode{{Path: "/dev/nvidiactl", HostPath: "/dev/nvidiactl", Permissions: "mrw"}},
+			Mounts: []*Mount{
+				{HostPath: "/home/kubernetes/bin/nvidia", ContainerPath: "/usr/local/nvidia", Options: []string{"ro", "nosuid", "nodev", "bind"}},
+				{HostPath: "/tmp/nvidia-mps", ContainerPath: "/tmp/nvidia-mps", Options: []string{"rw", "nosuid", "nodev", "bind"}},
+			},
+			Hooks: []*Hook{{
+				HookName: "createContainer",
+				Path:     "/home/kubernetes/bin/nvidia/bin/nvidia-ctk",
+				Args:     []string{"nvidia-ctk", "hook", "update-ldcache", "--folder", "/usr/local/nvidia/lib64"},
+			}},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected CDI spec (-want, +got) = %s", diff)
+	}
+}
+
+func TestQualifiedName(t *testing.T) {
+	if got, want := QualifiedName("GPU-0"), "nvidia.com/gpu=GPU-0"; got != want {
+		t.Errorf("QualifiedName() = %s, want %s", got, want)
+	}
+}
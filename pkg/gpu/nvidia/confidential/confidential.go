@@ -0,0 +1,252 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package confidential checks that the GPUs of confidential nodes run in
+// confidential computing (CC) mode, optionally attests them, and sets them to
+// the ready state so that they accept work.
+package confidential
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+// NodeType is the confidential computing technology of a node.
+type NodeType string
+
+const (
+	TDX    NodeType = "tdx"
+	SEVSNP NodeType = "sev-snp"
+)
+
+// Steps of enabling confidential GPUs, as reported in the status file.
+const (
+	StepNodeType          = "node-type"
+	StepPersistenceDaemon = "persistence-daemon"
+	StepCCMode            = "cc-mode"
+	StepCapabilities      = "gpu-capabilities"
+	StepAttestation       = "attestation"
+	StepReadyState        = "ready-state"
+)
+
+const defaultAttestationTimeout = 5 * time.Minute
+
+// Confidential computing values reported by NVML.
+const (
+	ccEnvironmentSimulation = 1
+	ccEnvironmentProduction = 2
+	ccFeatureEnabled        = 1
+	ccDevToolsModeEnabled   = 1
+	ccGPUsCapable           = 1
+	ccCPUCapsAMDSEV         = 1
+	ccCPUCapsIntelTDX       = 2
+	ccCPUCapsAMDSEVSNP      = 3
+	ccCPUCapsAMDSNPVTOM     = 4
+)
+
+// SystemState is the confidential computing state of the GPUs.
+type SystemState struct {
+	Environment  uint32
+	CCFeature    uint32
+	DevToolsMode uint32
+}
+
+// Capabilities are the confidential computing capabilities of the CPU and the
+// GPUs.
+type Capabilities struct {
+	CPUCaps  uint32
+	GPUsCaps uint32
+}
+
+// NVML is the confidential computing API of NVML. It is an interface so that
+// tests can fake it.
+type NVML interface {
+	SystemState() (SystemState, error)
+	Capabilities() (Capabilities, error)
+	GPUsReadyState() (bool, error)
+	SetGPUsReadyState(ready bool) error
+}
+
+// Config configures Enable.
+type Config struct {
+	NodeType NodeType
+	// AttestationCommand is a local GPU attestation verifier, e.g. the one of
+	// NVIDIA nvtrust, run before the GPUs are set to the ready state. It must
+	// exit with 0 if the attestation succeeds. If empty, attestation is
+	// skipped.
+	AttestationCommand []string
+	// AttestationTimeout bounds the attestation command. If 0, it is 5
+	// minutes.
+	AttestationTimeout time.Duration
+}
+
+// runCommand runs a command and returns its combined output, replaced in tests.
+var runCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// ParseNodeType returns the confidential node type in the contents of the
+// confidential node type file, and whether it supports confidential GPUs. Case,
+// surrounding spaces and NULs are ignored, and the parts of sev-snp can be
+// separated by - or _ in either order.
+func ParseNodeType(content string) (NodeType, bool) {
+	name := strings.ToLower(strings.Trim(content, " \t\r\n\x00"))
+	switch strings.ReplaceAll(name, "_", "-") {
+	case "tdx":
+		return TDX, true
+	case "sev-snp", "snp-sev":
+		return SEVSNP, true
+	default:
+		return NodeType(name), false
+	}
+}
+
+// Enable checks that the GPUs run in CC mode and are CC capable on a CPU of the
+// node type, runs the attestation command if any, and then sets the GPUs to the
+// ready state. Each step is recorded by r, and Enable stops at the first one
+// that fails.
+func Enable(ctx context.Context, lib NVML, r *Reporter, cfg Config) error {
+	state, err := lib.SystemState()
+	if err != nil {
+		return r.Failed(StepCCMode, fmt.Errorf("failed to get CC state: %w", err))
+	}
+	if state.CCFeature != ccFeatureEnabled {
+		return r.Failed(StepCCMode, fmt.Errorf("CC mode is off"))
+	}
+	msg := fmt.Sprintf("CC mode is on in the %s environment", environmentName(state.Environment))
+	if state.DevToolsMode == ccDevToolsModeEnabled {
+		msg += ", with dev tools mode on"
+		slog.WarnContext(ctx, "Confidential GPUs are in dev tools mode, which does not protect their memory")
+	}
+	r.Succeeded(StepCCMode, msg)
+
+	caps, err := lib.Capabilities()
+	if err != nil {
+		return r.Failed(StepCapabilities, fmt.Errorf("failed to get CC capabilities: %w", err))
+	}
+	if caps.GPUsCaps != ccGPUsCapable {
+		return r.Failed(StepCapabilities, fmt.Errorf("GPUs are not CC capable"))
+	}
+	if !cpuMatches(cfg.NodeType, caps.CPUCaps) {
+		return r.Failed(StepCapabilities, fmt.Errorf("CPU CC capabilities %s do not match node type %s", cpuCapsName(caps.CPUCaps), cfg.NodeType))
+	}
+	r.Succeeded(StepCapabilities, fmt.Sprintf("GPUs are CC capable with %s CPU", cpuCapsName(caps.CPUCaps)))
+
+	if len(cfg.AttestationCommand) == 0 {
+		r.Skipped(StepAttestation, "no attestation command configured")
+	} else if err := attest(ctx, cfg); err != nil {
+		return r.Failed(StepAttestation, err)
+	} else {
+		r.Succeeded(StepAttestation, "attestation succeeded")
+	}
+
+	return setReady(lib, r, "GPUs accept work")
+}
+
+// EnsureReady enables the GPUs again with Enable if they left the ready state,
+// e.g. because the driver reinitialized them while nvidia-persistenced was
+// down. The CC mode, capabilities and attestation are checked again, as the
+// reinitialized GPUs are not known to be the ones that were checked.
+func EnsureReady(ctx context.Context, lib NVML, r *Reporter, cfg Config) error {
+	ready, err := lib.GPUsReadyState()
+	if err != nil {
+		r.SetReady(false)
+		return r.Failed(StepReadyState, fmt.Errorf("failed to get GPUs ready state: %w", err))
+	}
+	if ready {
+		return nil
+	}
+	r.SetReady(false)
+	slog.WarnContext(ctx, "Confidential GPUs left the ready state, enabling them again")
+	return Enable(ctx, lib, r, cfg)
+}
+
+func setReady(lib NVML, r *Reporter, message string) error {
+	if err := lib.SetGPUsReadyState(true); err != nil {
+		return r.Failed(StepReadyState, fmt.Errorf("failed to set GPUs to ready state: %w", err))
+	}
+	r.Succeeded(StepReadyState, message)
+	r.SetReady(true)
+	return nil
+}
+
+// attest runs the attestation command of cfg.
+func attest(ctx context.Context, cfg Config) error {
+	timeout := cfg.AttestationTimeout
+	if timeout == 0 {
+		timeout = defaultAttestationTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	slog.InfoContext(ctx, "Running GPU attestation", "command", strings.Join(cfg.AttestationCommand, " "))
+	out, err := runCommand(ctx, cfg.AttestationCommand[0], cfg.AttestationCommand[1:]...)
+	if err != nil {
+		slog.ErrorContext(ctx, "GPU attestation failed", "output", string(out), logging.Error, err)
+		return fmt.Errorf("attestation command failed: %w: %s", err, lastLine(out))
+	}
+	return nil
+}
+
+// lastLine returns the last non-empty line of out, which is usually the error
+// of a failed command.
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}
+
+// cpuMatches returns true if the CPU CC capabilities are the ones of the node
+// type.
+func cpuMatches(nodeType NodeType, cpuCaps uint32) bool {
+	switch nodeType {
+	case TDX:
+		return cpuCaps == ccCPUCapsIntelTDX
+	case SEVSNP:
+		// Drivers before R550 report SEV-SNP as SEV.
+		return cpuCaps == ccCPUCapsAMDSEV || cpuCaps == ccCPUCapsAMDSEVSNP || cpuCaps == ccCPUCapsAMDSNPVTOM
+	default:
+		return false
+	}
+}
+
+func cpuCapsName(cpuCaps uint32) string {
+	switch cpuCaps {
+	case ccCPUCapsAMDSEV:
+		return "AMD SEV"
+	case ccCPUCapsIntelTDX:
+		return "Intel TDX"
+	case ccCPUCapsAMDSEVSNP:
+		return "AMD SEV-SNP"
+	case ccCPUCapsAMDSNPVTOM:
+		return "AMD SEV-SNP vTOM"
+	default:
+		return fmt.Sprintf("no CC (%d)", cpuCaps)
+	}
+}
+
+func environmentName(environment uint32) string {
+	switch environment {
+	case ccEnvironmentSimulation:
+		return "simulation"
+	case ccEnvironmentProduction:
+		return "production"
+	default:
+		return "unavailable"
+	}
+}
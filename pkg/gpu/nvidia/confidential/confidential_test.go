@@ -0,0 +1,352 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package confidential
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeNVML struct {
+	state         SystemState
+	stateErr      error
+	caps          Capabilities
+	capsErr       error
+	readyStateErr error
+	readyErr      error
+	ready         bool
+	readySets     int
+}
+
+func (f *fakeNVML) SystemState() (SystemState, error)   { return f.state, f.stateErr }
+func (f *fakeNVML) Capabilities() (Capabilities, error) { return f.caps, f.capsErr }
+func (f *fakeNVML) GPUsReadyState() (bool, error)       { return f.ready, f.readyStateErr }
+func (f *fakeNVML) SetGPUsReadyState(ready bool) error {
+	if f.readyErr != nil {
+		return f.readyErr
+	}
+	f.ready = ready
+	f.readySets++
+	return nil
+}
+
+func TestParseNodeType(t *testing.T) {
+	cases := []struct {
+		content     string
+		want        NodeType
+		wantEnabled bool
+	}{
+		{content: "", want: "", wantEnabled: false},
+		{content: "TDX", want: TDX, wantEnabled: true},
+		{content: "tdx  \n\x00", want: TDX, wantEnabled: true},
+		{content: "sev-snp", want: SEVSNP, wantEnabled: true},
+		{content: "SEV_SNP", want: SEVSNP, wantEnabled: true},
+		{content: "snp_sev", want: SEVSNP, wantEnabled: true},
+		{content: "sev", want: "sev", wantEnabled: false},
+		{content: "other  ", want: "other", wantEnabled: false},
+	}
+	for _, tc := range cases {
+		got, enabled := ParseNodeType(tc.content)
+		if got != tc.want || enabled != tc.wantEnabled {
+			t.Errorf("ParseNodeType(%q) = %q, %v, want %q, %v", tc.content, got, enabled, tc.want, tc.wantEnabled)
+		}
+	}
+}
+
+var (
+	ccOn    = SystemState{Environment: ccEnvironmentProduction, CCFeature: ccFeatureEnabled}
+	tdxCaps = Capabilities{CPUCaps: ccCPUCapsIntelTDX, GPUsCaps: ccGPUsCapable}
+)
+
+func TestEnable(t *testing.T) {
+	snpCaps := Capabilities{CPUCaps: ccCPUCapsAMDSEVSNP, GPUsCaps: ccGPUsCapable}
+	cases := []struct {
+		name        string
+		lib         *fakeNVML
+		cfg         Config
+		attestErr   error
+		wantErr     bool
+		wantStates  map[string]StepState
+		wantReady   bool
+		wantCommand []string
+	}{{
+		name: "TDX without attestation",
+		lib:  &fakeNVML{state: ccOn, caps: tdxCaps},
+		cfg:  Config{NodeType: TDX},
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepSucceeded,
+			StepAttestation:  StepSkipped,
+			StepReadyState:   StepSucceeded,
+		},
+		wantReady: true,
+	}, {
+		name: "SEV-SNP with attestation",
+		lib:  &fakeNVML{state: ccOn, caps: snpCaps},
+		cfg:  Config{NodeType: SEVSNP, AttestationCommand: []string{"verifier", "--local"}},
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepSucceeded,
+			StepAttestation:  StepSucceeded,
+			StepReadyState:   StepSucceeded,
+		},
+		wantReady:   true,
+		wantCommand: []string{"verifier", "--local"},
+	}, {
+		name: "SEV-SNP reported as SEV by older drivers",
+		lib:  &fakeNVML{state: ccOn, caps: Capabilities{CPUCaps: ccCPUCapsAMDSEV, GPUsCaps: ccGPUsCapable}},
+		cfg:  Config{NodeType: SEVSNP},
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepSucceeded,
+			StepAttestation:  StepSkipped,
+			StepReadyState:   StepSucceeded,
+		},
+		wantReady: true,
+	}, {
+		name:       "CC mode off",
+		lib:        &fakeNVML{state: SystemState{Environment: ccEnvironmentProduction}, caps: tdxCaps},
+		cfg:        Config{NodeType: TDX},
+		wantErr:    true,
+		wantStates: map[string]StepState{StepCCMode: StepFailed},
+	}, {
+		name:       "CC API not supported",
+		lib:        &fakeNVML{stateErr: errors.New("Function Not Found")},
+		cfg:        Config{NodeType: TDX},
+		wantErr:    true,
+		wantStates: map[string]StepState{StepCCMode: StepFailed},
+	}, {
+		name:    "GPUs not CC capable",
+		lib:     &fakeNVML{state: ccOn, caps: Capabilities{CPUCaps: ccCPUCapsIntelTDX}},
+		cfg:     Config{NodeType: TDX},
+		wantErr: true,
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepFailed,
+		},
+	}, {
+		name:    "CPU does not match node type",
+		lib:     &fakeNVML{state: ccOn, caps: snpCaps},
+		cfg:     Config{NodeType: TDX},
+		wantErr: true,
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepFailed,
+		},
+	}, {
+		name:      "attestation fails",
+		lib:       &fakeNVML{state: ccOn, caps: tdxCaps},
+		cfg:       Config{NodeType: TDX, AttestationCommand: []string{"verifier"}},
+		attestErr: errors.New("exit status 1"),
+		wantErr:   true,
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepSucceeded,
+			StepAttestation:  StepFailed,
+		},
+		wantCommand: []string{"verifier"},
+	}, {
+		name:    "setting ready state fails",
+		lib:     &fakeNVML{state: ccOn, caps: tdxCaps, readyErr: errors.New("Insufficient Permissions")},
+		cfg:     Config{NodeType: TDX},
+		wantErr: true,
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepSucceeded,
+			StepAttestation:  StepSkipped,
+			StepReadyState:   StepFailed,
+		},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotCommand []string
+			runCommand = func(_ context.Context, name string, args ...string) ([]byte, error) {
+				gotCommand = append([]string{name}, args...)
+				return []byte("attestation report\nresult\n"), tc.attestErr
+			}
+			statusFile := filepath.Join(t.TempDir(), "status", "status.json")
+			r := NewReporter(statusFile, tc.cfg.NodeType)
+
+			err := Enable(context.Background(), tc.lib, r, tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Enable() error = %v, want error %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.wantCommand, gotCommand); diff != "" {
+				t.Errorf("attestation command mismatch (-want +got):\n%s", diff)
+			}
+			if tc.lib.ready != tc.wantReady {
+				t.Errorf("GPUs ready state = %v, want %v", tc.lib.ready, tc.wantReady)
+			}
+
+			data, err := os.ReadFile(statusFile)
+			if err != nil {
+				t.Fatalf("failed to read status file: %v", err)
+			}
+			var status Status
+			if err := json.Unmarshal(data, &status); err != nil {
+				t.Fatalf("invalid status file: %v", err)
+			}
+			if diff := cmp.Diff(r.Status(), status); diff != "" {
+				t.Errorf("status file mismatch (-want +got):\n%s", diff)
+			}
+			gotStates := make(map[string]StepState)
+			for _, s := range status.Steps {
+				gotStates[s.Name] = s.State
+			}
+			if diff := cmp.Diff(tc.wantStates, gotStates); diff != "" {
+				t.Errorf("step states mismatch (-want +got):\n%s", diff)
+			}
+			if status.Ready != tc.wantReady || status.NodeType != tc.cfg.NodeType {
+				t.Errorf("status = ready %v, node type %q, want ready %v, node type %q", status.Ready, status.NodeType, tc.wantReady, tc.cfg.NodeType)
+			}
+		})
+	}
+}
+
+func TestReporterWithoutFile(t *testing.T) {
+	r := NewReporter("", TDX)
+	r.now = func() time.Time { return time.Unix(0, 0) }
+	r.Skipped(StepNodeType, "not a confidential node")
+	want := Status{NodeType: TDX, Steps: []Step{{Name: StepNodeType, State: StepSkipped, Message: "not a confidential node", Time: time.Unix(0, 0)}}}
+	if diff := cmp.Diff(want, r.Status()); diff != "" {
+		t.Errorf("status mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestEnsureReady(t *testing.T) {
+	cases := []struct {
+		name          string
+		lib           *fakeNVML
+		cfg           Config
+		attestErr     error
+		wantErr       bool
+		wantReady     bool
+		wantReadySets int
+		wantStates    map[string]StepState
+		wantCommand   []string
+	}{{
+		name:      "already ready",
+		lib:       &fakeNVML{ready: true},
+		cfg:       Config{NodeType: TDX, AttestationCommand: []string{"verifier"}},
+		wantReady: true,
+	}, {
+		name:          "ready state lost",
+		lib:           &fakeNVML{state: ccOn, caps: tdxCaps},
+		cfg:           Config{NodeType: TDX, AttestationCommand: []string{"verifier"}},
+		wantReady:     true,
+		wantReadySets: 1,
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepSucceeded,
+			StepAttestation:  StepSucceeded,
+			StepReadyState:   StepSucceeded,
+		},
+		wantCommand: []string{"verifier"},
+	}, {
+		name:       "CC mode off after ready state lost",
+		lib:        &fakeNVML{state: SystemState{Environment: ccEnvironmentProduction}, caps: tdxCaps},
+		cfg:        Config{NodeType: TDX},
+		wantErr:    true,
+		wantStates: map[string]StepState{StepCCMode: StepFailed},
+	}, {
+		name:      "attestation fails after ready state lost",
+		lib:       &fakeNVML{state: ccOn, caps: tdxCaps},
+		cfg:       Config{NodeType: TDX, AttestationCommand: []string{"verifier"}},
+		attestErr: errors.New("exit status 1"),
+		wantErr:   true,
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepSucceeded,
+			StepAttestation:  StepFailed,
+		},
+		wantCommand: []string{"verifier"},
+	}, {
+		name:       "failed to get ready state",
+		lib:        &fakeNVML{ready: true, readyStateErr: errors.New("Unknown Error")},
+		cfg:        Config{NodeType: TDX},
+		wantErr:    true,
+		wantStates: map[string]StepState{StepReadyState: StepFailed},
+	}, {
+		name:    "failed to set ready state",
+		lib:     &fakeNVML{state: ccOn, caps: tdxCaps, readyErr: errors.New("Insufficient Permissions")},
+		cfg:     Config{NodeType: TDX},
+		wantErr: true,
+		wantStates: map[string]StepState{
+			StepCCMode:       StepSucceeded,
+			StepCapabilities: StepSucceeded,
+			StepAttestation:  StepSkipped,
+			StepReadyState:   StepFailed,
+		},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotCommand []string
+			runCommand = func(_ context.Context, name string, args ...string) ([]byte, error) {
+				gotCommand = append([]string{name}, args...)
+				return []byte("attestation report\nresult\n"), tc.attestErr
+			}
+			r := NewReporter("", tc.cfg.NodeType)
+			r.SetReady(true)
+			err := EnsureReady(context.Background(), tc.lib, r, tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("EnsureReady() error = %v, want error %v", err, tc.wantErr)
+			}
+			if tc.lib.readySets != tc.wantReadySets {
+				t.Errorf("GPUs set to ready state %d times, want %d", tc.lib.readySets, tc.wantReadySets)
+			}
+			status := r.Status()
+			if status.Ready != tc.wantReady {
+				t.Errorf("status ready = %v, want %v", status.Ready, tc.wantReady)
+			}
+			var gotStates map[string]StepState
+			for _, s := range status.Steps {
+				if gotStates == nil {
+					gotStates = make(map[string]StepState)
+				}
+				gotStates[s.Name] = s.State
+			}
+			if diff := cmp.Diff(tc.wantStates, gotStates); diff != "" {
+				t.Errorf("step states mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantCommand, gotCommand); diff != "" {
+				t.Errorf("attestation command mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReporterKeepsLastSteps(t *testing.T) {
+	r := NewReporter("", SEVSNP)
+	for i := 0; i < maxSteps+10; i++ {
+		r.Succeeded(StepPersistenceDaemon, fmt.Sprintf("restart %d", i))
+	}
+	steps := r.Status().Steps
+	if len(steps) != maxSteps {
+		t.Fatalf("got %d steps, want %d", len(steps), maxSteps)
+	}
+	if want := fmt.Sprintf("restart %d", maxSteps+9); steps[maxSteps-1].Message != want {
+		t.Errorf("last step message = %q, want %q", steps[maxSteps-1].Message, want)
+	}
+}
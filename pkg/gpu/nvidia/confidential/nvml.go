@@ -0,0 +1,133 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package confidential
+
+/*
+#cgo linux LDFLAGS: -ldl
+
+#define _GNU_SOURCE
+#include <stddef.h>
+#include <dlfcn.h>
+
+// The confidential computing API of NVML is missing from the vendored nvml.h,
+// so its structs are declared here and its functions are looked up in the
+// library that go-nvml loaded with RTLD_GLOBAL. Drivers without the API return
+// NVML_ERROR_FUNCTION_NOT_FOUND.
+#define NVML_ERROR_FUNCTION_NOT_FOUND 13
+
+typedef struct {
+  unsigned int environment;
+  unsigned int ccFeature;
+  unsigned int devToolsMode;
+} ccSystemState;
+
+typedef struct {
+  unsigned int cpuCaps;
+  unsigned int gpusCaps;
+} ccSystemCaps;
+
+static int ccGetState(ccSystemState *state) {
+  int (*f)(ccSystemState *) = dlsym(RTLD_DEFAULT, "nvmlSystemGetConfComputeState");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(state);
+}
+
+static int ccGetCapabilities(ccSystemCaps *caps) {
+  int (*f)(ccSystemCaps *) = dlsym(RTLD_DEFAULT, "nvmlSystemGetConfComputeCapabilities");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(caps);
+}
+
+static int ccGetGpusReadyState(unsigned int *isAcceptingWork) {
+  int (*f)(unsigned int *) = dlsym(RTLD_DEFAULT, "nvmlSystemGetConfComputeGpusReadyState");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(isAcceptingWork);
+}
+
+static int ccSetGpusReadyState(unsigned int isAcceptingWork) {
+  int (*f)(unsigned int) = dlsym(RTLD_DEFAULT, "nvmlSystemSetConfComputeGpusReadyState");
+  if (f == NULL) {
+    return NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return f(isAcceptingWork);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+type nvmlLib struct{}
+
+// NewNVML initializes NVML and returns its confidential computing API, along
+// with a function that shuts NVML down.
+func NewNVML() (NVML, func(), error) {
+	if ret := nvml.Init(); ret != nvml.SUCCESS {
+		return nil, nil, fmt.Errorf("failed to initialize NVML: %s", nvml.ErrorString(ret))
+	}
+	return nvmlLib{}, func() { nvml.Shutdown() }, nil
+}
+
+func (nvmlLib) SystemState() (SystemState, error) {
+	var state C.ccSystemState
+	if err := nvmlError("nvmlSystemGetConfComputeState", C.ccGetState(&state)); err != nil {
+		return SystemState{}, err
+	}
+	return SystemState{
+		Environment:  uint32(state.environment),
+		CCFeature:    uint32(state.ccFeature),
+		DevToolsMode: uint32(state.devToolsMode),
+	}, nil
+}
+
+func (nvmlLib) Capabilities() (Capabilities, error) {
+	var caps C.ccSystemCaps
+	if err := nvmlError("nvmlSystemGetConfComputeCapabilities", C.ccGetCapabilities(&caps)); err != nil {
+		return Capabilities{}, err
+	}
+	return Capabilities{CPUCaps: uint32(caps.cpuCaps), GPUsCaps: uint32(caps.gpusCaps)}, nil
+}
+
+func (nvmlLib) GPUsReadyState() (bool, error) {
+	var accepting C.uint
+	if err := nvmlError("nvmlSystemGetConfComputeGpusReadyState", C.ccGetGpusReadyState(&accepting)); err != nil {
+		return false, err
+	}
+	return accepting == 1, nil
+}
+
+func (nvmlLib) SetGPUsReadyState(ready bool) error {
+	var accepting C.uint
+	if ready {
+		accepting = 1
+	}
+	return nvmlError("nvmlSystemSetConfComputeGpusReadyState", C.ccSetGpusReadyState(accepting))
+}
+
+func nvmlError(function string, ret C.int) error {
+	if r := nvml.Return(ret); r != nvml.SUCCESS {
+		return fmt.Errorf("%s failed: %s", function, nvml.ErrorString(r))
+	}
+	return nil
+}
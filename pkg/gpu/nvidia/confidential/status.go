@@ -0,0 +1,146 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package confidential
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
+)
+
+// StepState is the outcome of a step.
+type StepState string
+
+const (
+	StepSucceeded StepState = "succeeded"
+	StepFailed    StepState = "failed"
+	StepSkipped   StepState = "skipped"
+)
+
+// Step is a step of enabling confidential GPUs.
+type Step struct {
+	Name    string    `json:"name"`
+	State   StepState `json:"state"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// maxSteps is the number of steps kept in the status, so that it does not grow
+// forever when nvidia-persistenced keeps restarting.
+const maxSteps = 100
+
+// Status is the progress of enabling confidential GPUs, written to the status
+// file after each step. Only the last maxSteps steps are kept.
+type Status struct {
+	NodeType NodeType `json:"nodeType,omitempty"`
+	// Ready is true while the GPUs are in the ready state.
+	Ready bool   `json:"ready"`
+	Steps []Step `json:"steps"`
+}
+
+// Reporter logs the steps of enabling confidential GPUs and writes them to a
+// status file.
+type Reporter struct {
+	sync.Mutex
+	path   string
+	status Status
+	now    func() time.Time
+}
+
+// NewReporter returns a Reporter that writes the status of the node type to
+// path. If path is empty, the status is only logged.
+func NewReporter(path string, nodeType NodeType) *Reporter {
+	return &Reporter{path: path, status: Status{NodeType: nodeType}, now: time.Now}
+}
+
+// Status returns a copy of the current status.
+func (r *Reporter) Status() Status {
+	r.Lock()
+	defer r.Unlock()
+	s := r.status
+	s.Steps = append([]Step(nil), r.status.Steps...)
+	return s
+}
+
+// Succeeded records that step succeeded.
+func (r *Reporter) Succeeded(step, message string) {
+	slog.Info("Confidential GPU step succeeded", "step", step, "message", message)
+	r.record(Step{Name: step, State: StepSucceeded, Message: message})
+}
+
+// Skipped records that step was skipped.
+func (r *Reporter) Skipped(step, message string) {
+	slog.Info("Confidential GPU step skipped", "step", step, "message", message)
+	r.record(Step{Name: step, State: StepSkipped, Message: message})
+}
+
+// Failed records that step failed with err, and returns err.
+func (r *Reporter) Failed(step string, err error) error {
+	slog.Error("Confidential GPU step failed", "step", step, logging.Error, err)
+	r.record(Step{Name: step, State: StepFailed, Message: err.Error()})
+	return err
+}
+
+// SetReady records whether the GPUs are ready.
+func (r *Reporter) SetReady(ready bool) {
+	r.Lock()
+	defer r.Unlock()
+	if r.status.Ready == ready {
+		return
+	}
+	r.status.Ready = ready
+	r.writeLocked()
+}
+
+func (r *Reporter) record(step Step) {
+	r.Lock()
+	defer r.Unlock()
+	step.Time = r.now()
+	r.status.Steps = append(r.status.Steps, step)
+	if n := len(r.status.Steps); n > maxSteps {
+		r.status.Steps = r.status.Steps[n-maxSteps:]
+	}
+	r.writeLocked()
+}
+
+// writeLocked replaces the status file, so that readers never see a partial
+// status. Failures are only logged, since the status file is informational.
+func (r *Reporter) writeLocked() {
+	if r.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(r.status, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode confidential GPU status", logging.Error, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		slog.Error("Failed to create confidential GPU status directory", "path", r.path, logging.Error, err)
+		return
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		slog.Error("Failed to write confidential GPU status", "path", tmp, logging.Error, err)
+		return
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		slog.Error("Failed to write confidential GPU status", "path", r.path, logging.Error, err)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deviceid maps between the device IDs used inside the device plugin,
+// which are based on /dev minor numbers (nvidia0, nvidia0/gi1, nvidia0/gi1/ci2), and the device
+// IDs advertised to the kubelet, which can be based on GPU UUIDs instead.
+package deviceid
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/nvmlutil"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// Scheme is the scheme of the device IDs advertised to the kubelet.
+type Scheme string
+
+const (
+	// Minor advertises devices as nvidia<minor>, nvidia<minor>/gi<id> and
+	// nvidia<minor>/gi<id>/ci<id>.
+	Minor Scheme = "minor"
+	// UUID advertises devices as GPU-<uuid> and MIG-<uuid>.
+	UUID Scheme = "uuid"
+)
+
+var (
+	minorDeviceIDRegexp = regexp.MustCompile(`^nvidia([0-9]+)(?:/gi([0-9]+)(?:/ci([0-9]+))?)?$`)
+	vgpuSuffixRegexp    = regexp.MustCompile(`/vgpu[0-9]+$`)
+)
+
+// ValidateScheme returns an error for unknown schemes. An empty scheme is valid and means Minor.
+func ValidateScheme(scheme Scheme) error {
+	switch scheme {
+	case "", Minor, UUID:
+		return nil
+	default:
+		return fmt.Errorf("invalid device ID scheme: %v, should be one of minor or uuid", scheme)
+	}
+}
+
+// Mapper translates between internal, minor number based, device IDs and the
+// device IDs advertised to the kubelet. Both forms are accepted as input so that
+// device IDs the kubelet handed out before switching schemes keep working.
+type Mapper struct {
+	sync.Mutex
+	scheme     Scheme
+	toExternal map[string]string
+	toInternal map[string]string
+}
+
+// NewMapper creates a Mapper that advertises device IDs with the given scheme.
+func NewMapper(scheme Scheme) *Mapper {
+	if scheme == "" {
+		scheme = Minor
+	}
+	return &Mapper{
+		scheme:     scheme,
+		toExternal: make(map[string]string),
+		toInternal: make(map[string]string),
+	}
+}
+
+// Scheme returns the scheme of the advertised device IDs.
+func (m *Mapper) Scheme() Scheme {
+	return m.scheme
+}
+
+// Add records the UUID of the GPU or GPU partition with the given internal ID.
+func (m *Mapper) Add(internalID, uuid string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if old, ok := m.toExternal[internalID]; ok {
+		delete(m.toInternal, old)
+	}
+	m.toExternal[internalID] = uuid
+	m.toInternal[uuid] = internalID
+}
+
+// External returns the advertised device ID for an internal device ID. Virtual
+// device IDs used for GPU sharing keep their /vgpu<N> suffix.
+func (m *Mapper) External(internalID string) string {
+	if m.scheme != UUID {
+		return internalID
+	}
+	physicalID, suffix := splitVirtualSuffix(internalID)
+
+	m.Lock()
+	defer m.Unlock()
+	uuid, ok := m.toExternal[physicalID]
+	if !ok {
+		return internalID
+	}
+	return uuid + suffix
+}
+
+// Internal returns the internal device ID for a device ID in either scheme.
+func (m *Mapper) Internal(id string) (string, error) {
+	physicalID, suffix := splitVirtualSuffix(id)
+	if minorDeviceIDRegexp.MatchString(physicalID) {
+		return id, nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	internalID, ok := m.toInternal[physicalID]
+	if !ok {
+		return "", fmt.Errorf("unknown device %s", id)
+	}
+	return internalID + suffix, nil
+}
+
+// Canonical returns the advertised form of a device ID in either scheme.
+func (m *Mapper) Canonical(id string) string {
+	internalID, err := m.Internal(id)
+	if err != nil {
+		return id
+	}
+	return m.External(internalID)
+}
+
+// LookupUUID queries NVML for the UUID of a GPU (nvidia<minor>) or of a GPU
+// partition (nvidia<minor>/gi<id> or nvidia<minor>/gi<id>/ci<id>).
+func LookupUUID(internalID string) (string, error) {
+	m := minorDeviceIDRegexp.FindStringSubmatch(internalID)
+	if len(m) != 4 {
+		return "", fmt.Errorf("invalid device ID %s", internalID)
+	}
+	minor, _ := strconv.Atoi(m[1])
+	device, err := nvmlutil.DeviceHandleByMinor(minor)
+	if err != nil {
+		return "", err
+	}
+	if m[3] != "" {
+		gi, _ := strconv.Atoi(m[2])
+		ci, _ := strconv.Atoi(m[3])
+		if device, err = nvmlutil.MigDeviceHandleByComputeInstanceID(device, gi, ci); err != nil {
+			return "", err
+		}
+	} else if m[2] != "" {
+		gi, _ := strconv.Atoi(m[2])
+		if device, err = nvmlutil.MigDeviceHandleByGpuInstanceID(device, gi); err != nil {
+			return "", err
+		}
+	}
+	uuid, ret := nvmlutil.NvmlDeviceInfo.UUID(device)
+	if ret != nvml.SUCCESS {
+		return "", fmt.Errorf("failed to get UUID: %v", nvml.ErrorString(ret))
+	}
+	return uuid, nil
+}
+
+// LookupInternalID queries NVML for the internal device ID of the GPU or GPU
+// partition with the given UUID: nvidia<minor> for a GPU UUID, and
+// nvidia<minor>/gi<id>/ci<id> for a MIG device UUID. GPUs that can't be queried
+// are skipped.
+func LookupInternalID(uuid string) (string, error) {
+	if nvmlutil.NvmlDeviceInfo == nil {
+		nvmlutil.NvmlDeviceInfo = &nvmlutil.DeviceInfo{}
+	}
+	count, ret := nvmlutil.NvmlDeviceInfo.DeviceCount()
+	if ret != nvml.SUCCESS {
+		return "", fmt.Errorf("failed to get devices count: %v", nvml.ErrorString(ret))
+	}
+	for i := 0; i < count; i++ {
+		device, ret := nvmlutil.NvmlDeviceInfo.DeviceHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		minor, ret := nvmlutil.NvmlDeviceInfo.MinorNumber(device)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		if u, ret := nvmlutil.NvmlDeviceInfo.UUID(device); ret == nvml.SUCCESS && u == uuid {
+			return fmt.Sprintf("nvidia%d", minor), nil
+		}
+		migCount, ret := nvmlutil.NvmlDeviceInfo.MaxMigDeviceCount(device)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		for j := 0; j < migCount; j++ {
+			migDevice, ret := nvmlutil.NvmlDeviceInfo.MigDeviceHandleByIndex(device, j)
+			if ret != nvml.SUCCESS {
+				continue
+			}
+			if u, ret := nvmlutil.NvmlDeviceInfo.UUID(migDevice); ret != nvml.SUCCESS || u != uuid {
+				continue
+			}
+			gi, ret := nvmlutil.NvmlDeviceInfo.GpuInstanceID(migDevice)
+			if ret != nvml.SUCCESS {
+				return "", fmt.Errorf("failed to get the GPU instance ID of %s: %v", uuid, nvml.ErrorString(ret))
+			}
+			ci, ret := nvmlutil.NvmlDeviceInfo.ComputeInstanceID(migDevice)
+			if ret != nvml.SUCCESS {
+				return "", fmt.Errorf("failed to get the compute instance ID of %s: %v", uuid, nvml.ErrorString(ret))
+			}
+			return fmt.Sprintf("nvidia%d/gi%d/ci%d", minor, gi, ci), nil
+		}
+	}
+	return "", fmt.Errorf("no accessible GPU or MIG device with UUID %s", uuid)
+}
+
+func splitVirtualSuffix(id string) (string, string) {
+	loc := vgpuSuffixRegexp.FindStringIndex(id)
+	if loc == nil {
+		return id, ""
+	}
+	return id[:loc[0]], id[loc[0]:]
+}
@@ -0,0 +1,171 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceid
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/nvmlutil"
+)
+
+func TestMapper(t *testing.T) {
+	uuidMapper := NewMapper(UUID)
+	uuidMapper.Add("nvidia0", "GPU-0")
+	uuidMapper.Add("nvidia1/gi2", "MIG-1-1")
+	minorMapper := NewMapper("")
+	minorMapper.Add("nvidia0", "GPU-0")
+
+	cases := []struct {
+		name         string
+		mapper       *Mapper
+		id           string
+		wantInternal string
+		wantExternal string
+		wantError    bool
+	}{{
+		name:         "minor scheme",
+		mapper:       minorMapper,
+		id:           "nvidia0",
+		wantInternal: "nvidia0",
+		wantExternal: "nvidia0",
+	}, {
+		name:         "minor scheme accepts UUIDs",
+		mapper:       minorMapper,
+		id:           "GPU-0/vgpu1",
+		wantInternal: "nvidia0/vgpu1",
+		wantExternal: "nvidia0/vgpu1",
+	}, {
+		name:         "UUID scheme, GPU",
+		mapper:       uuidMapper,
+		id:           "GPU-0",
+		wantInternal: "nvidia0",
+		wantExternal: "GPU-0",
+	}, {
+		name:         "UUID scheme, shared MIG partition",
+		mapper:       uuidMapper,
+		id:           "MIG-1-1/vgpu3",
+		wantInternal: "nvidia1/gi2/vgpu3",
+		wantExternal: "MIG-1-1/vgpu3",
+	}, {
+		name:         "UUID scheme accepts minor based IDs",
+		mapper:       uuidMapper,
+		id:           "nvidia0/vgpu0",
+		wantInternal: "nvidia0/vgpu0",
+		wantExternal: "GPU-0/vgpu0",
+	}, {
+		name:      "unknown UUID",
+		mapper:    uuidMapper,
+		id:        "GPU-7",
+		wantError: true,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			internalID, err := tc.mapper.Internal(tc.id)
+			if (err != nil) != tc.wantError {
+				t.Fatalf("Internal(%s) error = %v, wantError %v", tc.id, err, tc.wantError)
+			}
+			if tc.wantError {
+				return
+			}
+			if internalID != tc.wantInternal {
+				t.Errorf("Internal(%s) = %s, want %s", tc.id, internalID, tc.wantInternal)
+			}
+			if got := tc.mapper.External(internalID); got != tc.wantExternal {
+				t.Errorf("External(%s) = %s, want %s", internalID, got, tc.wantExternal)
+			}
+			if got := tc.mapper.Canonical(tc.id); got != tc.wantExternal {
+				t.Errorf("Canonical(%s) = %s, want %s", tc.id, got, tc.wantExternal)
+			}
+		})
+	}
+}
+
+func TestLookupUUID(t *testing.T) {
+	testDevDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dev dir: %v", err)
+	}
+	defer os.RemoveAll(testDevDir)
+	for _, device := range []string{"nvidia0", "nvidia1"} {
+		if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+			t.Fatalf("failed to create device node (%s): %v", device, err)
+		}
+	}
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+
+	for id, want := range map[string]string{
+		"nvidia1":         "GPU-1",
+		"nvidia0/gi2":     "MIG-0-1",
+		"nvidia0/gi3/ci0": "MIG-0-2",
+	} {
+		got, err := LookupUUID(id)
+		if err != nil {
+			t.Errorf("unexpected error getting UUID of %s: %v", id, err)
+		}
+		if got != want {
+			t.Errorf("LookupUUID(%s) = %s, want %s", id, got, want)
+		}
+	}
+	if _, err := LookupUUID("nvidia3"); err == nil {
+		t.Error("expected an error for a missing GPU")
+	}
+	if _, err := LookupUUID("GPU-0"); err == nil {
+		t.Error("expected an error for an invalid device ID")
+	}
+}
+
+func TestLookupInternalID(t *testing.T) {
+	testDevDir := t.TempDir()
+	for _, device := range []string{"nvidia0", "nvidia1"} {
+		if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+			t.Fatalf("failed to create device node (%s): %v", device, err)
+		}
+	}
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+
+	for uuid, want := range map[string]string{
+		"GPU-1":   "nvidia1",
+		"MIG-0-1": "nvidia0/gi2/ci0",
+		"MIG-1-6": "nvidia1/gi7/ci0",
+	} {
+		got, err := LookupInternalID(uuid)
+		if err != nil {
+			t.Errorf("unexpected error getting internal ID of %s: %v", uuid, err)
+		}
+		if got != want {
+			t.Errorf("LookupInternalID(%s) = %s, want %s", uuid, got, want)
+		}
+	}
+	for _, uuid := range []string{"GPU-3", "MIG-0-7"} {
+		if _, err := LookupInternalID(uuid); err == nil {
+			t.Errorf("expected an error for missing device %s", uuid)
+		}
+	}
+}
+
+func TestValidateScheme(t *testing.T) {
+	for _, scheme := range []Scheme{"", Minor, UUID} {
+		if err := ValidateScheme(scheme); err != nil {
+			t.Errorf("unexpected error for scheme %q: %v", scheme, err)
+		}
+	}
+	if err := ValidateScheme("index"); err == nil {
+		t.Error("expected an error for an invalid scheme")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package driver discovers the version of the NVIDIA driver and of the CUDA
+// driver API, and checks that it supports the features a binary relies on.
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// procfsVersionFile is the version of the loaded kernel module, relative to
+// /proc.
+const procfsVersionFile = "driver/nvidia/version"
+
+var (
+	// kernelModuleRE matches the version in e.g.
+	// "NVRM version: NVIDIA UNIX x86_64 Kernel Module  535.230.02  ..." or
+	// "NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  550.90.07  ...".
+	kernelModuleRE = regexp.MustCompile(`Kernel Module(?:\s+for\s+\S+)?\s+(\d+\.\d+(?:\.\d+)?)`)
+	versionRE      = regexp.MustCompile(`\d+\.\d+(?:\.\d+)?`)
+
+	// The NVML functions, replaced in tests.
+	systemGetDriverVersion        = nvml.SystemGetDriverVersion
+	systemGetCudaDriverVersion_v2 = nvml.SystemGetCudaDriverVersion_v2
+)
+
+// Version is a driver or CUDA version, e.g. 535.230.02 or 12.2. Versions are
+// compared component by component, as numbers.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+	// raw is the version as reported, which keeps leading zeros, e.g. the 02 of
+	// 535.230.02.
+	raw string
+}
+
+// Parse parses a version with two or three numeric components.
+func Parse(s string) (Version, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q: want major.minor[.patch]", s)
+	}
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q: %q is not a number", s, p)
+		}
+		nums[i] = n
+	}
+	return Version{Major: nums[0], Minor: nums[1], Patch: nums[2], raw: s}, nil
+}
+
+// String returns the version as reported by the driver, or as major.minor.patch
+// for versions that were not parsed.
+func (v Version) String() string {
+	if v.raw != "" {
+		return v.raw
+	}
+	if v.Patch == 0 {
+		return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+	}
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// IsZero returns whether v is the zero version, e.g. an unknown version.
+func (v Version) IsZero() bool {
+	return v.Major == 0 && v.Minor == 0 && v.Patch == 0
+}
+
+// Compare returns -1, 0 or 1 if v is older than, the same as, or newer than o.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// AtLeast returns whether v is the same as or newer than o.
+func (v Version) AtLeast(o Version) bool {
+	return v.Compare(o) >= 0
+}
+
+// FromProcfs returns the version of the loaded NVIDIA kernel module, read from
+// driver/nvidia/version under procDir. It doesn't need NVML, so it also works
+// before the user space driver is installed.
+func FromProcfs(procDir string) (Version, error) {
+	path := filepath.Join(procDir, procfsVersionFile)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Version{}, fmt.Errorf("failed to read NVIDIA driver version: %w", err)
+	}
+	var version string
+	if m := kernelModuleRE.FindSubmatch(content); m != nil {
+		version = string(m[1])
+	} else {
+		version = versionRE.FindString(string(content))
+	}
+	if version == "" {
+		return Version{}, fmt.Errorf("no NVIDIA driver version in %s", path)
+	}
+	return Parse(version)
+}
+
+// FromNVML returns the version of the NVIDIA driver reported by NVML, which
+// must be initialized.
+func FromNVML() (Version, error) {
+	version, ret := systemGetDriverVersion()
+	if ret != nvml.SUCCESS {
+		return Version{}, fmt.Errorf("failed to get NVIDIA driver version: %s", nvml.ErrorString(ret))
+	}
+	return Parse(version)
+}
+
+// CUDAFromNVML returns the version of the CUDA driver API reported by NVML,
+// which must be initialized. It is the newest CUDA version the driver
+// supports.
+func CUDAFromNVML() (Version, error) {
+	version, ret := systemGetCudaDriverVersion_v2()
+	if ret != nvml.SUCCESS {
+		return Version{}, fmt.Errorf("failed to get CUDA driver version: %s", nvml.ErrorString(ret))
+	}
+	return cudaVersion(version), nil
+}
+
+// cudaVersion converts a CUDA version as reported by the driver API, e.g. 12020,
+// to 12.2.
+func cudaVersion(v int) Version {
+	return Version{Major: v / 1000, Minor: v % 1000 / 10}
+}
+
+// Feature is a feature that needs a minimum NVIDIA driver version.
+type Feature struct {
+	Name string
+	Min  Version
+}
+
+var (
+	// MIG is multi-instance GPU partitioning.
+	MIG = Feature{Name: "MIG", Min: Version{Major: 450}}
+	// MPS is GPU sharing with MPS, which limits the pinned device memory of
+	// each client. The limit was added in CUDA 11.5.
+	MPS = Feature{Name: "MPS with memory limits", Min: Version{Major: 495}}
+	// ConfidentialComputing is confidential computing with the GPUs in CC mode.
+	ConfidentialComputing = Feature{Name: "confidential computing", Min: Version{Major: 535}}
+	// UVMPersistence is the --uvm-persistence-mode of nvidia-persistenced.
+	UVMPersistence = Feature{Name: "UVM persistence", Min: Version{Major: 550}}
+)
+
+// String returns the name and the minimum driver version of f, e.g.
+// "MIG (R450+)".
+func (f Feature) String() string {
+	return fmt.Sprintf("%s (%s+)", f.Name, f.minString())
+}
+
+// minString returns the minimum driver version of f as a release branch, e.g.
+// R550, unless it needs a release within the branch.
+func (f Feature) minString() string {
+	if f.Min.Minor == 0 && f.Min.Patch == 0 {
+		return fmt.Sprintf("R%d", f.Min.Major)
+	}
+	return f.Min.String()
+}
+
+// Supported returns whether driver version v supports f.
+func (f Feature) Supported(v Version) bool {
+	return v.AtLeast(f.Min)
+}
+
+// UnsupportedError is returned for a feature the driver doesn't support.
+type UnsupportedError struct {
+	Feature Feature
+	Version Version
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s needs NVIDIA driver %s or later, the node has %s", e.Feature.Name, e.Feature.minString(), e.Version)
+}
+
+// Check returns an *UnsupportedError for each of features that driver version
+// v doesn't support, joined with errors.Join.
+func Check(v Version, features ...Feature) error {
+	var errs []error
+	for _, f := range features {
+		if !f.Supported(v) {
+			errs = append(errs, &UnsupportedError{Feature: f, Version: v})
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,190 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/google/go-cmp/cmp"
+)
+
+var allowVersion = cmp.AllowUnexported(Version{})
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    Version
+		wantErr bool
+	}{
+		{in: "535.230.02", want: Version{Major: 535, Minor: 230, Patch: 2, raw: "535.230.02"}},
+		{in: "550.54\n", want: Version{Major: 550, Minor: 54, raw: "550.54"}},
+		{in: "12.2", want: Version{Major: 12, Minor: 2, raw: "12.2"}},
+		{in: "535", wantErr: true},
+		{in: "1.2.3.4", wantErr: true},
+		{in: "535.x.02", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := Parse(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Parse(%q) error = %v, want error %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, allowVersion); diff != "" {
+			t.Errorf("Parse(%q) mismatch (-want +got):\n%s", tc.in, diff)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{a: "535.230.02", b: "535.230.2", want: 0},
+		{a: "535.230.02", b: "550.54", want: -1},
+		{a: "550.54.15", b: "550.54", want: 1},
+		{a: "535.104.05", b: "535.54.03", want: 1},
+		{a: "450.80.02", b: "450.80.02", want: 0},
+	}
+	for _, tc := range cases {
+		a, b := mustParse(t, tc.a), mustParse(t, tc.b)
+		if got := a.Compare(b); got != tc.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := a.AtLeast(b); got != (tc.want >= 0) {
+			t.Errorf("%s.AtLeast(%s) = %v, want %v", tc.a, tc.b, got, tc.want >= 0)
+		}
+	}
+}
+
+func TestFromProcfs(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "proprietary kernel module",
+			content: "NVRM version: NVIDIA UNIX x86_64 Kernel Module  535.230.02  Tue Jan 21 17:12:21 UTC 2025\nGCC version:  gcc version 12.2.0 (GCC)\n",
+			want:    "535.230.02",
+		},
+		{
+			name:    "open kernel module",
+			content: "NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  550.90.07  Release Build  (dvs-builder@U16-I3-B03-4-3)  Fri May 31 09:35:42 UTC 2024\nGCC version:  gcc version 12.2.0 (GCC)\n",
+			want:    "550.90.07",
+		},
+		{
+			name:    "unknown format",
+			content: "NVIDIA driver 570.124.06\n",
+			want:    "570.124.06",
+		},
+		{
+			name:    "no version",
+			content: "NVRM version: unknown\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			procDir := t.TempDir()
+			if tc.content != "" {
+				path := filepath.Join(procDir, procfsVersionFile)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatalf("failed to create dir: %v", err)
+				}
+				if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+					t.Fatalf("failed to write version file: %v", err)
+				}
+			}
+			got, err := FromProcfs(procDir)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("FromProcfs() error = %v, want error %v", err, tc.wantErr)
+			}
+			if got.String() != tc.want && !tc.wantErr {
+				t.Errorf("FromProcfs() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFromNVML(t *testing.T) {
+	origDriver, origCUDA := systemGetDriverVersion, systemGetCudaDriverVersion_v2
+	defer func() { systemGetDriverVersion, systemGetCudaDriverVersion_v2 = origDriver, origCUDA }()
+
+	systemGetDriverVersion = func() (string, nvml.Return) { return "550.90.07", nvml.SUCCESS }
+	systemGetCudaDriverVersion_v2 = func() (int, nvml.Return) { return 12040, nvml.SUCCESS }
+	if v, err := FromNVML(); err != nil || v.String() != "550.90.07" {
+		t.Errorf("FromNVML() = %s, %v, want 550.90.07", v, err)
+	}
+	if v, err := CUDAFromNVML(); err != nil || v.String() != "12.4" {
+		t.Errorf("CUDAFromNVML() = %s, %v, want 12.4", v, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		version  string
+		features []Feature
+		wantErrs []string
+	}{
+		{version: "535.230.02", features: []Feature{MIG, MPS, ConfidentialComputing}},
+		{version: "550.54.15", features: []Feature{UVMPersistence}},
+		{version: "535.230.02", features: []Feature{UVMPersistence}, wantErrs: []string{
+			"UVM persistence needs NVIDIA driver R550 or later, the node has 535.230.02",
+		}},
+		{version: "440.118.02", features: []Feature{MIG, MPS}, wantErrs: []string{
+			"MIG needs NVIDIA driver R450 or later, the node has 440.118.02",
+			"MPS with memory limits needs NVIDIA driver R495 or later, the node has 440.118.02",
+		}},
+		{version: "535.54.03", features: []Feature{{Name: "fix", Min: Version{Major: 535, Minor: 104, Patch: 5}}}, wantErrs: []string{
+			"fix needs NVIDIA driver 535.104.5 or later, the node has 535.54.03",
+		}},
+	}
+	for _, tc := range cases {
+		err := Check(mustParse(t, tc.version), tc.features...)
+		var gotErrs []string
+		if err != nil {
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				var unsupported *UnsupportedError
+				if !errors.As(e, &unsupported) {
+					t.Errorf("Check(%s) returned %v, want an *UnsupportedError", tc.version, e)
+				}
+				gotErrs = append(gotErrs, e.Error())
+			}
+		}
+		if diff := cmp.Diff(tc.wantErrs, gotErrs); diff != "" {
+			t.Errorf("Check(%s, %v) errors mismatch (-want +got):\n%s", tc.version, tc.features, diff)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) Version {
+	t.Helper()
+	v, err := Parse(s)
+	if err != nil {
+		t.Fatalf("Parse(%q) failed: %v", s, err)
+	}
+	return v
+}
@@ -61,7 +61,7 @@ func VirtualToPhysicalDeviceID(virtualDeviceID string) (string, error) {
 
 // isVirtualDeviceID returns true if a input device ID comes from a virtual GPU device.
 func IsVirtualDeviceID(virtualDeviceID string) bool {
-	return isVirtualDeviceIDForDefaultMode(virtualDeviceID) || isVirtualDeviceIDForMIGMode(virtualDeviceID)
+	return isVirtualDeviceIDForDefaultMode(virtualDeviceID) || isVirtualDeviceIDForMIGMode(virtualDeviceID) || isVirtualDeviceIDForUUIDMode(virtualDeviceID)
 }
 
 func isVirtualDeviceIDForDefaultMode(virtualDeviceID string) bool {
@@ -71,7 +71,15 @@ func isVirtualDeviceIDForDefaultMode(virtualDeviceID string) bool {
 }
 
 func isVirtualDeviceIDForMIGMode(virtualDeviceID string) bool {
-	// In MIG case, the virtualDeviceID will form as `nvidia0/gi0/vgpu0`, with the underlying physicalDeviceID as 'nvidia0/gi0'.
-	validMigRegex := regexp.MustCompile("nvidia([0-9]+)\\/gi([0-9]+)\\/vgpu([0-9]+)$")
+	// In MIG case, the virtualDeviceID will form as `nvidia0/gi0/vgpu0`, with the underlying physicalDeviceID as 'nvidia0/gi0',
+	// or as `nvidia0/gi0/ci1/vgpu0` when the GPU instance is split into compute instances.
+	validMigRegex := regexp.MustCompile("nvidia([0-9]+)\\/gi([0-9]+)(\\/ci([0-9]+))?\\/vgpu([0-9]+)$")
 	return validMigRegex.MatchString(virtualDeviceID)
 }
+
+func isVirtualDeviceIDForUUIDMode(virtualDeviceID string) bool {
+	// With UUID based device IDs, the virtualDeviceID will form as 'GPU-<uuid>/vgpu0' or 'MIG-<uuid>/vgpu0',
+	// with the underlying physicalDeviceID as 'GPU-<uuid>' or 'MIG-<uuid>'.
+	validUUIDRegex := regexp.MustCompile("^(GPU|MIG)-.+\\/vgpu([0-9]+)$")
+	return validUUIDRegex.MatchString(virtualDeviceID)
+}
@@ -98,6 +98,26 @@ func TestVirtualToPhysicalDeviceID(t *testing.T) {
 		virtualDeviceID: "nvidia0/gi0/vgpu0",
 		wantDeviceID:    "nvidia0/gi0",
 		wantError:       nil,
+	}, {
+		name:            "virtual device ID of a compute instance",
+		virtualDeviceID: "nvidia0/gi1/ci2/vgpu0",
+		wantDeviceID:    "nvidia0/gi1/ci2",
+		wantError:       nil,
+	}, {
+		name:            "virtual device ID based on a GPU UUID",
+		virtualDeviceID: "GPU-5c89852c-d268-c3f3-1b07-005d5ae1dc3f/vgpu3",
+		wantDeviceID:    "GPU-5c89852c-d268-c3f3-1b07-005d5ae1dc3f",
+		wantError:       nil,
+	}, {
+		name:            "virtual device ID based on a MIG UUID",
+		virtualDeviceID: "MIG-b8d2d5a0-7b48-5bd6-8e3c-3a2f3c6c3a2b/vgpu0",
+		wantDeviceID:    "MIG-b8d2d5a0-7b48-5bd6-8e3c-3a2f3c6c3a2b",
+		wantError:       nil,
+	}, {
+		name:            "GPU UUID is not a virtual device ID",
+		virtualDeviceID: "GPU-5c89852c-d268-c3f3-1b07-005d5ae1dc3f",
+		wantDeviceID:    "",
+		wantError:       errors.New("virtual device ID (GPU-5c89852c-d268-c3f3-1b07-005d5ae1dc3f) is not valid"),
 	}}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
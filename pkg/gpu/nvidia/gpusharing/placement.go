@@ -0,0 +1,165 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gpusharing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PlacementStrategy decides which physical device virtual devices are picked from.
+type PlacementStrategy string
+
+const (
+	// Spread picks virtual devices from the least loaded physical device.
+	Spread PlacementStrategy = "spread"
+	// Pack picks virtual devices from the most loaded physical device that still has virtual devices available.
+	Pack PlacementStrategy = "pack"
+)
+
+// ValidatePlacementStrategy returns an error for unknown placement strategies.
+// An empty strategy is valid and means Spread.
+func ValidatePlacementStrategy(strategy PlacementStrategy) error {
+	switch strategy {
+	case "", Spread, Pack:
+		return nil
+	default:
+		return fmt.Errorf("invalid placement strategy: %v, should be one of spread or pack", strategy)
+	}
+}
+
+// PreferredAllocation picks size virtual device IDs out of availableIDs, always including
+// mustIncludeIDs. allocated is the number of virtual devices already in use on each
+// physical device. With Spread, every pick goes to the physical device with the fewest
+// virtual devices in use; with Pack, to the one with the most. Ties are broken by device ID,
+// comparing the GPU, GPU instance and virtual device indexes as numbers, so that nvidia2
+// comes before nvidia10.
+func PreferredAllocation(availableIDs, mustIncludeIDs []string, size int, allocated map[string]int, strategy PlacementStrategy) ([]string, error) {
+	load := make(map[string]int)
+	for id, n := range allocated {
+		load[id] = n
+	}
+
+	picked := make(map[string]bool)
+	var preferred []string
+	for _, id := range mustIncludeIDs {
+		physicalID, err := VirtualToPhysicalDeviceID(id)
+		if err != nil {
+			return nil, err
+		}
+		picked[id] = true
+		preferred = append(preferred, id)
+		load[physicalID]++
+	}
+
+	// Group the remaining virtual devices by their physical device.
+	candidates := make(map[string][]string)
+	for _, id := range availableIDs {
+		if picked[id] {
+			continue
+		}
+		physicalID, err := VirtualToPhysicalDeviceID(id)
+		if err != nil {
+			return nil, err
+		}
+		candidates[physicalID] = append(candidates[physicalID], id)
+	}
+	for physicalID := range candidates {
+		sortDeviceIDs(candidates[physicalID])
+	}
+
+	for len(preferred) < size {
+		physicalID := pickPhysicalDevice(candidates, load, strategy)
+		if physicalID == "" {
+			return nil, fmt.Errorf("not enough available devices: want %d, got %d", size, len(preferred))
+		}
+		preferred = append(preferred, candidates[physicalID][0])
+		candidates[physicalID] = candidates[physicalID][1:]
+		load[physicalID]++
+	}
+	return preferred, nil
+}
+
+// pickPhysicalDevice returns the physical device to pick the next virtual device from,
+// or an empty string if no virtual devices are left.
+func pickPhysicalDevice(candidates map[string][]string, load map[string]int, strategy PlacementStrategy) string {
+	var physicalIDs []string
+	for physicalID, ids := range candidates {
+		if len(ids) > 0 {
+			physicalIDs = append(physicalIDs, physicalID)
+		}
+	}
+	if len(physicalIDs) == 0 {
+		return ""
+	}
+	sortDeviceIDs(physicalIDs)
+
+	best := physicalIDs[0]
+	for _, physicalID := range physicalIDs[1:] {
+		if strategy == Pack && load[physicalID] > load[best] {
+			best = physicalID
+		}
+		if strategy != Pack && load[physicalID] < load[best] {
+			best = physicalID
+		}
+	}
+	return best
+}
+
+// sortDeviceIDs sorts device IDs in natural order: runs of digits, such as GPU indexes,
+// are compared as numbers, and the rest as strings.
+func sortDeviceIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool { return lessDeviceID(ids[i], ids[j]) })
+}
+
+func lessDeviceID(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return a[i] < b[j]
+			}
+			i++
+			j++
+			continue
+		}
+		// Compare the numbers starting at i and j, ignoring leading zeros.
+		si, sj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		na := strings.TrimLeft(a[si:i], "0")
+		nb := strings.TrimLeft(b[sj:j], "0")
+		if len(na) != len(nb) {
+			return len(na) < len(nb)
+		}
+		if na != nb {
+			return na < nb
+		}
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	// Only leading zeros differ.
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,168 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gpusharing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// virtualDeviceIDs returns the virtual device IDs of numGPUs GPUs shared by clientsPerGPU clients,
+// leaving out the IDs in used.
+func virtualDeviceIDs(numGPUs, clientsPerGPU int, used ...string) []string {
+	skip := make(map[string]bool)
+	for _, id := range used {
+		skip[id] = true
+	}
+	var ids []string
+	for gpu := 0; gpu < numGPUs; gpu++ {
+		for vgpu := 0; vgpu < clientsPerGPU; vgpu++ {
+			id := fmt.Sprintf("nvidia%d/vgpu%d", gpu, vgpu)
+			if !skip[id] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func TestPreferredAllocation(t *testing.T) {
+	cases := []struct {
+		name        string
+		available   []string
+		mustInclude []string
+		size        int
+		allocated   map[string]int
+		strategy    PlacementStrategy
+		want        []string
+		wantError   bool
+	}{{
+		name:      "1 GPU, spread",
+		available: virtualDeviceIDs(1, 4, "nvidia0/vgpu0"),
+		size:      1,
+		allocated: map[string]int{"nvidia0": 1},
+		want:      []string{"nvidia0/vgpu1"},
+	}, {
+		name:      "1 GPU, multiple devices",
+		available: virtualDeviceIDs(1, 4),
+		size:      3,
+		strategy:  Pack,
+		want:      []string{"nvidia0/vgpu0", "nvidia0/vgpu1", "nvidia0/vgpu2"},
+	}, {
+		name:      "2 GPUs, spread to the idle GPU",
+		available: virtualDeviceIDs(2, 4, "nvidia0/vgpu0", "nvidia0/vgpu1"),
+		size:      1,
+		allocated: map[string]int{"nvidia0": 2},
+		strategy:  Spread,
+		want:      []string{"nvidia1/vgpu0"},
+	}, {
+		name:      "2 GPUs, pack on the busy GPU",
+		available: virtualDeviceIDs(2, 4, "nvidia0/vgpu0", "nvidia0/vgpu1"),
+		size:      1,
+		allocated: map[string]int{"nvidia0": 2},
+		strategy:  Pack,
+		want:      []string{"nvidia0/vgpu2"},
+	}, {
+		name:      "2 GPUs, pack moves on when a GPU is full",
+		available: virtualDeviceIDs(2, 2, "nvidia0/vgpu0", "nvidia0/vgpu1"),
+		size:      1,
+		allocated: map[string]int{"nvidia0": 2},
+		strategy:  Pack,
+		want:      []string{"nvidia1/vgpu0"},
+	}, {
+		name:      "2 GPUs, spread multiple devices",
+		available: virtualDeviceIDs(2, 4),
+		size:      3,
+		want:      []string{"nvidia0/vgpu0", "nvidia1/vgpu0", "nvidia0/vgpu1"},
+	}, {
+		name:        "2 GPUs, must include devices count towards the load",
+		available:   virtualDeviceIDs(2, 4),
+		mustInclude: []string{"nvidia0/vgpu3"},
+		size:        2,
+		want:        []string{"nvidia0/vgpu3", "nvidia1/vgpu0"},
+	}, {
+		name:      "8 GPUs, spread to the least loaded GPU",
+		available: virtualDeviceIDs(8, 2, "nvidia0/vgpu0", "nvidia1/vgpu0", "nvidia2/vgpu0", "nvidia3/vgpu0", "nvidia4/vgpu0", "nvidia6/vgpu0", "nvidia7/vgpu0"),
+		size:      1,
+		allocated: map[string]int{"nvidia0": 1, "nvidia1": 1, "nvidia2": 1, "nvidia3": 1, "nvidia4": 1, "nvidia6": 1, "nvidia7": 1},
+		want:      []string{"nvidia5/vgpu0"},
+	}, {
+		name:      "8 GPUs, pack on the most loaded GPU",
+		available: virtualDeviceIDs(8, 4, "nvidia3/vgpu0", "nvidia3/vgpu1", "nvidia6/vgpu0"),
+		size:      2,
+		allocated: map[string]int{"nvidia3": 2, "nvidia6": 1},
+		strategy:  Pack,
+		want:      []string{"nvidia3/vgpu2", "nvidia3/vgpu3"},
+	}, {
+		name:      "16 GPUs, spread breaks ties on the GPU index",
+		available: virtualDeviceIDs(16, 12),
+		size:      3,
+		want:      []string{"nvidia0/vgpu0", "nvidia1/vgpu0", "nvidia2/vgpu0"},
+	}, {
+		name:      "16 GPUs, spread to the least loaded GPUs in GPU index order",
+		available: virtualDeviceIDs(16, 2),
+		size:      2,
+		allocated: map[string]int{"nvidia0": 1, "nvidia1": 1, "nvidia2": 1, "nvidia3": 1, "nvidia4": 1, "nvidia5": 1, "nvidia6": 1, "nvidia7": 1, "nvidia8": 1, "nvidia9": 1, "nvidia11": 1, "nvidia12": 1, "nvidia13": 1, "nvidia14": 1},
+		want:      []string{"nvidia10/vgpu0", "nvidia15/vgpu0"},
+	}, {
+		name:      "16 GPUs, pack breaks ties on the GPU index",
+		available: virtualDeviceIDs(16, 12),
+		size:      12,
+		strategy:  Pack,
+		want: []string{
+			"nvidia0/vgpu0", "nvidia0/vgpu1", "nvidia0/vgpu2", "nvidia0/vgpu3", "nvidia0/vgpu4", "nvidia0/vgpu5",
+			"nvidia0/vgpu6", "nvidia0/vgpu7", "nvidia0/vgpu8", "nvidia0/vgpu9", "nvidia0/vgpu10", "nvidia0/vgpu11",
+		},
+	}, {
+		name:      "8 GPUs, not enough devices",
+		available: virtualDeviceIDs(8, 1)[:3],
+		size:      4,
+		wantError: true,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := PreferredAllocation(tc.available, tc.mustInclude, tc.size, tc.allocated, tc.strategy)
+			if (err != nil) != tc.wantError {
+				t.Fatalf("PreferredAllocation() error = %v, wantError %v", err, tc.wantError)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("unexpected preferred allocation (-want, +got) = %s", diff)
+			}
+		})
+	}
+}
+
+func TestSortDeviceIDs(t *testing.T) {
+	ids := []string{"nvidia10", "nvidia2/gi10", "nvidia2", "nvidia1", "nvidia2/gi3", "GPU-b", "nvidia02", "GPU-a"}
+	sortDeviceIDs(ids)
+	want := []string{"GPU-a", "GPU-b", "nvidia1", "nvidia02", "nvidia2", "nvidia2/gi3", "nvidia2/gi10", "nvidia10"}
+	if diff := cmp.Diff(want, ids); diff != "" {
+		t.Errorf("unexpected device ID order (-want, +got) = %s", diff)
+	}
+}
+
+func TestValidatePlacementStrategy(t *testing.T) {
+	for _, strategy := range []PlacementStrategy{"", Spread, Pack} {
+		if err := ValidatePlacementStrategy(strategy); err != nil {
+			t.Errorf("unexpected error for placement strategy %q: %v", strategy, err)
+		}
+	}
+	if err := ValidatePlacementStrategy("random"); err == nil {
+		t.Error("expected an error for an invalid placement strategy")
+	}
+}
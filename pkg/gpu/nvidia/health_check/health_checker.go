@@ -16,11 +16,14 @@ package healthcheck
 
 import (
 	"fmt"
+	"log/slog"
+	"maps"
 	"strings"
+	"sync"
 
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/util"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
-	"github.com/golang/glog"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -29,8 +32,13 @@ import (
 // device naming pattern in device manager, GPUHealthChecker will not work with
 // MIG devices.
 type GPUHealthChecker struct {
-	devices           map[string]pluginapi.Device
-	nvmlDevices       map[string]*nvml.Device
+	// mu guards devices, nvmlDevices and registered, which are updated when the
+	// device manager rediscovers the devices.
+	mu          sync.Mutex
+	devices     map[string]pluginapi.Device
+	nvmlDevices map[string]*nvml.Device
+	// registered are the UUIDs of the GPUs registered for Xid events.
+	registered        map[string]bool
 	health            chan pluginapi.Device
 	eventSet          nvml.EventSet
 	stop              chan bool
@@ -42,6 +50,7 @@ func NewGPUHealthChecker(devices map[string]pluginapi.Device, health chan plugin
 	hc := &GPUHealthChecker{
 		devices:           make(map[string]pluginapi.Device),
 		nvmlDevices:       make(map[string]*nvml.Device),
+		registered:        make(map[string]bool),
 		health:            health,
 		stop:              make(chan bool),
 		healthCriticalXid: make(map[uint64]bool),
@@ -52,7 +61,7 @@ func NewGPUHealthChecker(devices map[string]pluginapi.Device, health chan plugin
 		hc.devices[id] = d
 	}
 	for _, c := range codes {
-		glog.Infof("reading code %v", c)
+		slog.Debug("Adding health critical Xid", logging.Xid, c)
 		hc.healthCriticalXid[uint64(c)] = true
 	}
 	// By default, we check Double Bit ECC Error
@@ -62,19 +71,73 @@ func NewGPUHealthChecker(devices map[string]pluginapi.Device, health chan plugin
 
 // Start registers NVML events and starts listening to them
 func (hc *GPUHealthChecker) Start() error {
-	glog.Info("Starting GPU Health Checker")
+	slog.Info("Starting GPU health checker")
 
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
 	for name, device := range hc.devices {
-		glog.Infof("Healthchecker receives device %s, device %v+", name, device)
+		slog.Info("Health checker received device", logging.DeviceID, name, "health", device.Health)
+	}
+	if err := hc.discoverNvmlDevices(); err != nil {
+		return err
+	}
+	hc.eventSet = nvml.NewEventSet()
+	if err := hc.registerEvents(); err != nil {
+		return err
 	}
 
-	// Building mapping between device ID and their nvml represetation
+	go func() {
+		if err := hc.listenToEvents(); err != nil {
+			slog.Error("GPU health checker stopped listening to events", logging.Error, err)
+		}
+	}()
+
+	return nil
+}
+
+// UpdateDevices replaces the monitored devices, e.g. after the device manager
+// rediscovered them when GPUs were repartitioned, and registers the GPUs that
+// weren't monitored yet for Xid events. Nothing changes if the device IDs are
+// the same.
+func (hc *GPUHealthChecker) UpdateDevices(devices map[string]pluginapi.Device) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if sameDeviceIDs(hc.devices, devices) {
+		return
+	}
+	hc.devices = maps.Clone(devices)
+	hc.nvmlDevices = make(map[string]*nvml.Device)
+	if err := hc.discoverNvmlDevices(); err != nil {
+		slog.Error("Failed to rediscover GPU devices for health check", logging.Error, err)
+	}
+	if err := hc.registerEvents(); err != nil {
+		slog.Error("Failed to register GPU devices for health check", logging.Error, err)
+	}
+	slog.Info("Updated devices for health monitoring", "devices", len(hc.devices), "monitored", len(hc.nvmlDevices))
+}
+
+func sameDeviceIDs(a, b map[string]pluginapi.Device) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id := range a {
+		if _, ok := b[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// discoverNvmlDevices builds the mapping between the monitored device IDs and
+// their NVML representation. The caller must hold mu.
+func (hc *GPUHealthChecker) discoverNvmlDevices() error {
 	count, err := nvml.GetDeviceCount()
 	if err != nil {
 		return fmt.Errorf("failed to get device count: %s", err)
 	}
 
-	glog.Infof("Found %d GPU devices", count)
+	slog.Info("Found GPU devices", "count", count)
 	for i := uint(0); i < count; i++ {
 		device, err := nvml.NewDeviceLite(i)
 		if err != nil {
@@ -83,90 +146,120 @@ func (hc *GPUHealthChecker) Start() error {
 
 		deviceName, err := util.DeviceNameFromPath(device.Path)
 		if err != nil {
-			glog.Errorf("Invalid GPU device path found: %s. Skipping this device", device.Path)
+			slog.Error("Invalid GPU device path found, skipping this device", "path", device.Path)
 			continue
 		}
 
 		migEnabled, err := device.IsMigEnabled()
 		if err != nil {
-			glog.Errorf("Error checking if MIG is enabled on device %s. Skipping this device. Error: %v", deviceName, err)
+			slog.Error("Failed to check if MIG is enabled, skipping this device", logging.DeviceID, deviceName, logging.Error, err)
 			continue
 		}
 
 		if migEnabled {
 			if err := hc.addMigEnabledDevice(deviceName, device); err != nil {
-				glog.Errorf("Failed to add MIG-enabled device %s for health check. Skipping this device. Error: %v", deviceName, err)
+				slog.Error("Failed to add MIG-enabled device for health check, skipping this device", logging.DeviceID, deviceName, logging.Error, err)
 				continue
 			}
 		} else {
 			hc.addDevice(deviceName, device)
 		}
 	}
+	return nil
+}
 
-	hc.eventSet = nvml.NewEventSet()
+// registerEvents registers the GPUs of the monitored devices that aren't
+// registered yet for Xid events. The caller must hold mu.
+func (hc *GPUHealthChecker) registerEvents() error {
 	for _, d := range hc.nvmlDevices {
 		gpu, _, _, err := nvml.ParseMigDeviceUUID(d.UUID)
 		if err != nil {
 			gpu = d.UUID
 		}
+		if hc.registered[gpu] {
+			continue
+		}
 
-		glog.Infof("Registering device %v. UUID: %s", d.Path, d.UUID)
+		slog.Info("Registering device for Xid events", "path", d.Path, logging.UUID, d.UUID)
 		err = nvml.RegisterEventForDevice(hc.eventSet, nvml.XidCriticalError, gpu)
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "Not Supported") {
-				glog.Warningf("Warning: %s is too old to support healthchecking: %v. It will always be marked healthy.", d.Path, err)
+				slog.Warn("Device is too old to support health checking, it will always be marked healthy", "path", d.Path, logging.Error, err)
+				hc.registered[gpu] = true
 				continue
 			} else {
 				return fmt.Errorf("failed to register device %s for NVML eventSet: %v", d.Path, err)
 			}
 		}
+		hc.registered[gpu] = true
 	}
-
-	go func() {
-		if err := hc.listenToEvents(); err != nil {
-			glog.Errorf("GPUHealthChecker listenToEvents error: %v", err)
-		}
-	}()
-
 	return nil
 }
 
 func (hc *GPUHealthChecker) addDevice(deviceName string, device *nvml.Device) {
 	if _, ok := hc.devices[deviceName]; !ok {
 		// Only monitor the devices passed in
-		glog.Warningf("Ignoring device %s for health check.", deviceName)
+		slog.Warn("Ignoring device for health check", logging.DeviceID, deviceName)
 		return
 	}
-	glog.Infof("Found non-mig device %s for health monitoring. UUID: %s", deviceName, device.UUID)
+	slog.Info("Found non-MIG device for health monitoring", logging.DeviceID, deviceName, logging.UUID, device.UUID)
 	hc.nvmlDevices[deviceName] = device
 }
 
 func (hc *GPUHealthChecker) addMigEnabledDevice(deviceName string, device *nvml.Device) error {
-	glog.Infof("HealthChecker detects MIG is enabled on device %s", deviceName)
+	slog.Info("Health checker detected MIG is enabled", logging.DeviceID, deviceName)
 
 	migs, err := device.GetMigDevices()
 	if err != nil {
 		return fmt.Errorf("error getting MIG devices on device %s. err: %v.", deviceName, err)
 	}
 
-	for _, mig := range migs {
-		gpu, gi, _, err := nvml.ParseMigDeviceUUID(mig.UUID)
+	instances := make([]migInstance, len(migs))
+	for i, mig := range migs {
+		gpu, gi, ci, err := nvml.ParseMigDeviceUUID(mig.UUID)
 		if err != nil {
 			return fmt.Errorf("error parsing MIG UUID on device %s, MIG UUID: %s, error %v", gpu, mig.UUID, err)
 		}
-		migDeviceName := fmt.Sprintf("%s/gi%d", deviceName, gi)
+		instances[i] = migInstance{gi: gi, ci: ci}
+	}
 
+	for i, migDeviceName := range migDeviceNames(deviceName, instances) {
 		if _, ok := hc.devices[migDeviceName]; !ok {
 			// Only monitor the devices passed in
-			glog.Warningf("Ignoring device %s for health check.", migDeviceName)
+			slog.Warn("Ignoring device for health check", logging.DeviceID, migDeviceName)
 			continue
 		}
-		glog.Infof("Found mig device %s for health monitoring. UUID: %s", migDeviceName, mig.UUID)
-		hc.nvmlDevices[migDeviceName] = mig
+		slog.Info("Found MIG device for health monitoring", logging.DeviceID, migDeviceName, logging.UUID, migs[i].UUID)
+		hc.nvmlDevices[migDeviceName] = migs[i]
 	}
 	return nil
 }
 
+// migInstance is the GPU instance and compute instance of a MIG device.
+type migInstance struct {
+	gi, ci uint
+}
+
+// migDeviceNames returns the device names of the MIG devices of a GPU, in the
+// order of instances. Like mig.DeviceManager, a GPU instance with a single
+// compute instance is named nvidia<gpu>/gi<gi>, and the compute instances of a
+// GPU instance split into several are named nvidia<gpu>/gi<gi>/ci<ci>, so the
+// split is decided per GPU instance.
+func migDeviceNames(deviceName string, instances []migInstance) []string {
+	computeInstances := make(map[uint]int)
+	for _, in := range instances {
+		computeInstances[in.gi]++
+	}
+	names := make([]string, len(instances))
+	for i, in := range instances {
+		names[i] = fmt.Sprintf("%s/gi%d", deviceName, in.gi)
+		if computeInstances[in.gi] > 1 {
+			names[i] += fmt.Sprintf("/ci%d", in.ci)
+		}
+	}
+	return names
+}
+
 type callDevice interface {
 	parseMigDeviceUUID(UUID string) (string, uint, uint, error)
 }
@@ -179,32 +272,50 @@ func (gd *GPUDevice) parseMigDeviceUUID(UUID string) (string, uint, uint, error)
 func (hc *GPUHealthChecker) catchError(e nvml.Event, cd callDevice) {
 	// Skip the error if it's not Xid critical
 	if e.Etype != nvml.XidCriticalError {
-		glog.Infof("Skip error Xid=%d as it is not Xid Critical", e.Edata)
+		slog.Info("Skipping Xid as it is not critical", logging.Xid, e.Edata)
 		return
 	}
 	// Only marking device unhealthy on Double Bit ECC Error or customer-configured codes
 	// See https://docs.nvidia.com/deploy/xid-errors/index.html#topic_4
 	if _, ok := hc.healthCriticalXid[e.Edata]; !ok {
-		glog.Infof("Health checker is skipping Xid %v error", e.Edata)
+		slog.Info("Skipping Xid as it is not health critical", logging.Xid, e.Edata)
 		return
 	}
 
+	for _, d := range hc.unhealthyDevices(e, cd) {
+		hc.health <- d
+	}
+}
+
+// unhealthyDevices marks the devices affected by a health critical Xid event
+// unhealthy, and returns them. They are sent to the device manager without
+// holding mu, so that UpdateDevices isn't blocked while nothing receives them.
+func (hc *GPUHealthChecker) unhealthyDevices(e nvml.Event, cd callDevice) []pluginapi.Device {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	var unhealthy []pluginapi.Device
 	if e.UUID == nil || len(*e.UUID) == 0 {
 		// All devices are unhealthy
-		glog.Errorf("XidCriticalError: Xid=%d, All devices will go unhealthy.", e.Edata)
+		slog.Error("Critical Xid error on all devices, all devices will go unhealthy", logging.Xid, e.Edata)
 		for id, d := range hc.devices {
 			d.Health = pluginapi.Unhealthy
 			hc.devices[id] = d
-			hc.health <- d
+			unhealthy = append(unhealthy, d)
 		}
-		return
+		return unhealthy
 	}
 
-	founderrordevice := false
 	for _, d := range hc.devices {
+		nvmlDevice, ok := hc.nvmlDevices[d.ID]
+		if !ok {
+			// The device was not found through NVML, e.g. it was added after the
+			// GPU was last enumerated.
+			continue
+		}
 		// Please see https://github.com/NVIDIA/gpu-monitoring-tools/blob/148415f505c96052cb3b7fdf443b34ac853139ec/bindings/go/nvml/nvml.h#L1424
 		// for the rationale why gi and ci can be set as such when the UUID is a full GPU UUID and not a MIG device UUID.
-		uuid := hc.nvmlDevices[d.ID].UUID
+		uuid := nvmlDevice.UUID
 		gpu, gi, ci, err := cd.parseMigDeviceUUID(uuid)
 		if err != nil {
 			gpu = uuid
@@ -212,17 +323,20 @@ func (hc *GPUHealthChecker) catchError(e nvml.Event, cd callDevice) {
 			ci = 0xFFFFFFFF
 		}
 
-		if gpu == *e.UUID && gi == *e.GpuInstanceId && ci == *e.ComputeInstanceId {
-			glog.Errorf("XidCriticalError: Xid=%d on Device=%s, uuid=%s, the device will go unhealthy.", e.Edata, d.ID, uuid)
+		// An event on a GPU instance without a compute instance ID affects all the
+		// compute instances of the GPU instance, which are advertised separately
+		// when the GPU instance is split into compute instances.
+		if gpu == *e.UUID && gi == *e.GpuInstanceId && (ci == *e.ComputeInstanceId || *e.ComputeInstanceId == 0xFFFFFFFF) {
+			slog.Error("Critical Xid error, the device will go unhealthy", logging.Xid, e.Edata, logging.DeviceID, d.ID, logging.UUID, uuid)
 			d.Health = pluginapi.Unhealthy
 			hc.devices[d.ID] = d
-			hc.health <- d
-			founderrordevice = true
+			unhealthy = append(unhealthy, d)
 		}
 	}
-	if !founderrordevice {
-		glog.Errorf("XidCriticalError: Xid=%d on unknown device.", e.Edata)
+	if len(unhealthy) == 0 {
+		slog.Error("Critical Xid error on unknown device", logging.Xid, e.Edata)
 	}
+	return unhealthy
 }
 
 // listenToEvents listens to events from NVML to detect GPU critical errors
@@ -52,7 +52,7 @@ func TestCatchError(t *testing.T) {
 	tests := []struct {
 		name             string
 		event            nvml.Event
-		hc               GPUHealthChecker
+		hc               *GPUHealthChecker
 		wantErrorDevices []v1beta1.Device
 	}{
 		{
@@ -64,7 +64,7 @@ func TestCatchError(t *testing.T) {
 				Etype:             0,
 				Edata:             uint64(72),
 			},
-			hc: GPUHealthChecker{
+			hc: &GPUHealthChecker{
 				devices: map[string]v1beta1.Device{
 					"device1": device1,
 					"device2": device2,
@@ -93,7 +93,7 @@ func TestCatchError(t *testing.T) {
 				Etype:             nvml.XidCriticalError,
 				Edata:             uint64(88),
 			},
-			hc: GPUHealthChecker{
+			hc: &GPUHealthChecker{
 				devices: map[string]v1beta1.Device{
 					"device1": device1,
 					"device2": device2,
@@ -122,7 +122,7 @@ func TestCatchError(t *testing.T) {
 				Etype:             nvml.XidCriticalError,
 				Edata:             uint64(72),
 			},
-			hc: GPUHealthChecker{
+			hc: &GPUHealthChecker{
 				devices: map[string]v1beta1.Device{
 					"device1": device1,
 					"device2": device2,
@@ -142,6 +142,34 @@ func TestCatchError(t *testing.T) {
 			},
 			wantErrorDevices: []v1beta1.Device{udevice1},
 		},
+		{
+			name: "catching xid 72 on all compute instances of a GPU instance",
+			event: nvml.Event{
+				UUID:              pointer("GPU-f053fce6-851c-1235-90ae-037069703604"),
+				GpuInstanceId:     pointer(uint(3173334309191009974)),
+				ComputeInstanceId: pointer(uint(0xFFFFFFFF)),
+				Etype:             nvml.XidCriticalError,
+				Edata:             uint64(72),
+			},
+			hc: &GPUHealthChecker{
+				devices: map[string]v1beta1.Device{
+					"device1": device1,
+					"device2": device2,
+				},
+				nvmlDevices: map[string]*nvml.Device{
+					"device1": {
+						UUID: "GPU-f053fce6-851c-1235-90ae-037069703604",
+					},
+					"device2": {
+						UUID: "GPU-f053fce6-851c-1235-90ae-037069703633",
+					},
+				},
+				healthCriticalXid: map[uint64]bool{
+					72: true,
+				},
+			},
+			wantErrorDevices: []v1beta1.Device{udevice1},
+		},
 		{
 			name: "unknown device",
 			event: nvml.Event{
@@ -151,7 +179,7 @@ func TestCatchError(t *testing.T) {
 				Etype:             nvml.XidCriticalError,
 				Edata:             uint64(72),
 			},
-			hc: GPUHealthChecker{
+			hc: &GPUHealthChecker{
 				devices: map[string]v1beta1.Device{
 					"device1": device1,
 					"device2": device2,
@@ -180,7 +208,7 @@ func TestCatchError(t *testing.T) {
 				Etype:             nvml.XidCriticalError,
 				Edata:             uint64(72),
 			},
-			hc: GPUHealthChecker{
+			hc: &GPUHealthChecker{
 				devices: map[string]v1beta1.Device{
 					"device1": device1,
 				},
@@ -193,6 +221,31 @@ func TestCatchError(t *testing.T) {
 			},
 			wantErrorDevices: []v1beta1.Device{},
 		},
+		{
+			name: "device not found through NVML",
+			event: nvml.Event{
+				UUID:              pointer("GPU-f053fce6-851c-1235-90ae-037069703604"),
+				GpuInstanceId:     pointer(uint(3173334309191009974)),
+				ComputeInstanceId: pointer(uint(1015241)),
+				Etype:             nvml.XidCriticalError,
+				Edata:             uint64(72),
+			},
+			hc: &GPUHealthChecker{
+				devices: map[string]v1beta1.Device{
+					"device1": device1,
+					"device2": device2,
+				},
+				nvmlDevices: map[string]*nvml.Device{
+					"device1": {
+						UUID: "GPU-f053fce6-851c-1235-90ae-037069703604",
+					},
+				},
+				healthCriticalXid: map[uint64]bool{
+					72: true,
+				},
+			},
+			wantErrorDevices: []v1beta1.Device{udevice1},
+		},
 		{
 			name: "catching all devices error",
 			event: nvml.Event{
@@ -202,7 +255,7 @@ func TestCatchError(t *testing.T) {
 				Etype:             nvml.XidCriticalError,
 				Edata:             uint64(48),
 			},
-			hc: GPUHealthChecker{
+			hc: &GPUHealthChecker{
 				devices: map[string]v1beta1.Device{
 					"device1": device1,
 					"device2": device2,
@@ -241,3 +294,41 @@ func TestCatchError(t *testing.T) {
 		})
 	}
 }
+
+func TestMigDeviceNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []migInstance
+		want      []string
+	}{
+		{
+			name:      "GPU instances with a single compute instance",
+			instances: []migInstance{{gi: 1, ci: 0}, {gi: 2, ci: 0}},
+			want:      []string{"nvidia0/gi1", "nvidia0/gi2"},
+		},
+		{
+			name:      "GPU instance split into compute instances",
+			instances: []migInstance{{gi: 1, ci: 0}, {gi: 1, ci: 1}},
+			want:      []string{"nvidia0/gi1/ci0", "nvidia0/gi1/ci1"},
+		},
+		{
+			name:      "mixed layout",
+			instances: []migInstance{{gi: 1, ci: 0}, {gi: 1, ci: 1}, {gi: 1, ci: 2}, {gi: 2, ci: 0}, {gi: 5, ci: 3}},
+			want:      []string{"nvidia0/gi1/ci0", "nvidia0/gi1/ci1", "nvidia0/gi1/ci2", "nvidia0/gi2", "nvidia0/gi5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := migDeviceNames("nvidia0", tt.instances)
+			if len(got) != len(tt.want) {
+				t.Fatalf("migDeviceNames() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("migDeviceNames() = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
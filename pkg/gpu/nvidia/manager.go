@@ -19,10 +19,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"maps"
 	"net"
 	"os"
 	"os/exec"
 	"path"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -33,39 +36,54 @@ import (
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/util"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	"github.com/fsnotify/fsnotify"
-	"github.com/golang/glog"
 	"google.golang.org/grpc"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/allocation"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/cdi"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/deviceid"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/driver"
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/gpusharing"
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/mig"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migstatus"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 )
 
 const (
 	// All NVIDIA GPUs cards should be mounted with nvidiactl and nvidia-uvm
 	// If the driver installed correctly, these two devices will be there.
+	// The optional devices are in allocation.ControlDevices.
 	nvidiaCtlDevice = "nvidiactl"
 	nvidiaUVMDevice = "nvidia-uvm"
 
-	// Optional devices.
-	nvidiaUVMToolsDevice = "nvidia-uvm-tools"
-	nvidiaModesetDevice  = "nvidia-modeset"
-
 	nvidiaDeviceRE            = `^nvidia[0-9]*$`
 	gpuCheckInterval          = 10 * time.Second
 	pluginSocketCheckInterval = 1 * time.Second
+	// gpuPartitionsSettleInterval is how long to wait after a GPU partition
+	// changed before rediscovering, so that creating or destroying several
+	// partitions results in a single update.
+	gpuPartitionsSettleInterval = 1 * time.Second
 
 	nvidiaMpsDir       = "/tmp/nvidia-mps"
 	mpsControlBin      = "/usr/local/nvidia/bin/nvidia-cuda-mps-control"
 	mpsActiveThreadCmd = "get_default_active_thread_percentage"
 	mpsMemLimitEnv     = "CUDA_MPS_PINNED_DEVICE_MEM_LIMIT"
 	mpsThreadLimitEnv  = "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE"
+
+	// nvidiaVisibleDevicesEnv selects the GPUs the NVIDIA container runtime hooks inject.
+	nvidiaVisibleDevicesEnv = "NVIDIA_VISIBLE_DEVICES"
 )
 
 var (
 	resourceName   = "nvidia.com/gpu"
 	pciDevicesRoot = "/sys/bus/pci/devices"
+
+	envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	minorRegexp   = regexp.MustCompile(`^nvidia([0-9]+)`)
+
+	// kubeletAssignments is overridden in tests.
+	kubeletAssignments = allocation.KubeletAssignments
 )
 
 // GPUConfig stores the settings used to configure the GPUs on a node.
@@ -78,6 +96,27 @@ type GPUConfig struct {
 	GPUSharingConfig GPUSharingConfig
 	// Xid error codes that will set the node to unhealthy
 	HealthCriticalXid []int
+	// DeviceIDScheme is the scheme of the device IDs advertised to the kubelet. Values are "minor" (default),
+	// e.g. nvidia0, nvidia0/gi1 and nvidia0/gi1/ci2, or "uuid", e.g. GPU-<uuid> and MIG-<uuid>.
+	// Device IDs of either scheme are accepted on allocation, so existing allocations keep working after a switch.
+	DeviceIDScheme deviceid.Scheme
+	// AllocationEnv names the env vars that describe the devices allocated to a container.
+	AllocationEnv AllocationEnvConfig
+}
+
+// AllocationEnvConfig stores the names of the env vars set on containers that are allocated GPUs.
+// Env vars with an empty name are not set.
+type AllocationEnvConfig struct {
+	// VisibleDevices is set to the comma separated UUIDs of the allocated GPUs, or GPU partitions with MIG,
+	// in the order of the allocation request, e.g. NVIDIA_VISIBLE_DEVICES. With CDI, NVIDIA_VISIBLE_DEVICES is
+	// otherwise set to void so that the NVIDIA container runtime hooks don't inject GPUs on top of CDI.
+	VisibleDevices string
+	// PhysicalIndex is set to the comma separated minor numbers (/dev/nvidia<N>) of the allocated physical GPUs.
+	PhysicalIndex string
+	// SharingStrategy is set to the GPU sharing strategy of the node, or "none" without GPU sharing.
+	SharingStrategy string
+	// ShareCount is set to the number of shared GPUs allocated to the container. It is only set with GPU sharing.
+	ShareCount string
 }
 
 type GPUSharingConfig struct {
@@ -85,12 +124,14 @@ type GPUSharingConfig struct {
 	GPUSharingStrategy gpusharing.GPUSharingStrategy
 	// MaxSharedClientsPerGPU is the maximum number of clients that are allowed to share a single GPU.
 	MaxSharedClientsPerGPU int
+	// PlacementStrategy decides which physical GPU shared GPUs are picked from. Values are "spread" (default) or "pack".
+	PlacementStrategy gpusharing.PlacementStrategy
 }
 
 func (config *GPUConfig) AddDefaultsAndValidate() error {
 	if config.MaxTimeSharedClientsPerGPU > 0 {
 		if config.GPUSharingConfig.GPUSharingStrategy != "" || config.GPUSharingConfig.MaxSharedClientsPerGPU > 0 {
-			glog.Infof("Both MaxTimeSharedClientsPerGPU and GPUSharingConfig are set, use the value of MaxTimeSharedClientsPerGPU")
+			slog.Warn("Both MaxTimeSharedClientsPerGPU and GPUSharingConfig are set, using the value of MaxTimeSharedClientsPerGPU")
 		}
 
 		config.GPUSharingConfig.GPUSharingStrategy = gpusharing.TimeSharing
@@ -110,18 +151,44 @@ func (config *GPUConfig) AddDefaultsAndValidate() error {
 			return fmt.Errorf("invalid GPU Sharing strategy: %v, should be one of time-sharing or mps", config.GPUSharingConfig.GPUSharingStrategy)
 		}
 	}
+	if err := gpusharing.ValidatePlacementStrategy(config.GPUSharingConfig.PlacementStrategy); err != nil {
+		return err
+	}
+	if err := deviceid.ValidateScheme(config.DeviceIDScheme); err != nil {
+		return err
+	}
+	if err := config.AllocationEnv.validate(); err != nil {
+		return err
+	}
 	gpusharing.SharingStrategy = config.GPUSharingConfig.GPUSharingStrategy
 	return nil
 }
 
+func (config AllocationEnvConfig) validate() error {
+	seen := make(map[string]bool)
+	for _, name := range []string{config.VisibleDevices, config.PhysicalIndex, config.SharingStrategy, config.ShareCount} {
+		if name == "" {
+			continue
+		}
+		if !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid allocation env var name: %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("allocation env var %s is configured more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
 func (config *GPUConfig) AddHealthCriticalXid() error {
 	xidConfig := os.Getenv("XID_CONFIG")
 	if len(xidConfig) == 0 {
-		glog.Infof("There is no Xid config specified ")
+		slog.Info("No Xid config specified")
 		return nil
 	}
 
-	glog.Infof("Detect HealthCriticalXid : %s ", xidConfig)
+	slog.Info("Detected health critical Xids", "xid_config", xidConfig)
 	xidStrs := strings.Split(xidConfig, ",")
 	xidArry := make([]int, len(xidStrs))
 	var err error
@@ -139,25 +206,40 @@ func (config *GPUConfig) AddHealthCriticalXid() error {
 // nvidiaGPUManager manages nvidia gpu devices.
 type nvidiaGPUManager struct {
 	devDirectory        string
+	procDirectory       string
 	mountPaths          []pluginapi.Mount
 	defaultDevices      []string
 	devices             map[string]pluginapi.Device
 	grpcServer          *grpc.Server
 	socket              string
 	stop                chan bool
-	devicesMutex        sync.Mutex
+	devicesMutex        sync.RWMutex
 	nvidiaCtlDevicePath string
 	nvidiaUVMDevicePath string
 	gpuConfig           GPUConfig
-	migDeviceManager    mig.DeviceManager
+	migDeviceManager    *mig.DeviceManager
 	Health              chan pluginapi.Device
-	totalMemPerGPU      uint64 // Total memory available per GPU (in MB)
+	devicesChanged      chan struct{}   // Signals ListAndWatch that devices were added or removed
+	gpuIndices          map[string]int  // NVML index of each GPU, keyed by device name
+	lostGPUs            map[string]bool // GPUs marked unhealthy because they were lost
+	totalMemPerGPU      uint64          // Total memory available per GPU (in MB)
+	allocations         *allocation.Tracker
+	cdiSpecDir          string
+	cdiHookPath         string
+	cdiDeviceNames      map[string]string
+	deviceIDs           *deviceid.Mapper
+	migStatusFile       string
+	migGeneration       int64
+	// devicesRefreshed is called with the physical devices after they were
+	// rediscovered. It can be nil.
+	devicesRefreshed func(map[string]pluginapi.Device)
 }
 
 func NewNvidiaGPUManager(devDirectory, procDirectory string, mountPaths []pluginapi.Mount, gpuConfig GPUConfig) *nvidiaGPUManager {
 	return &nvidiaGPUManager{
 
 		devDirectory:        devDirectory,
+		procDirectory:       procDirectory,
 		mountPaths:          mountPaths,
 		devices:             make(map[string]pluginapi.Device),
 		stop:                make(chan bool),
@@ -166,13 +248,21 @@ func NewNvidiaGPUManager(devDirectory, procDirectory string, mountPaths []plugin
 		gpuConfig:           gpuConfig,
 		migDeviceManager:    mig.NewDeviceManager(devDirectory, procDirectory),
 		Health:              make(chan pluginapi.Device),
+		devicesChanged:      make(chan struct{}, 1),
+		gpuIndices:          make(map[string]int),
+		lostGPUs:            make(map[string]bool),
+		allocations:         allocation.NewTracker(),
+		deviceIDs:           deviceid.NewMapper(gpuConfig.DeviceIDScheme),
 	}
 }
 
 // ListPhysicalDevices lists all physical GPU devices (including partitions) available on this node.
+// It returns a copy, as the devices are updated while they are sent to the kubelet.
 func (ngm *nvidiaGPUManager) ListPhysicalDevices() map[string]pluginapi.Device {
 	if ngm.gpuConfig.GPUPartitionSize == "" {
-		return ngm.devices
+		ngm.devicesMutex.RLock()
+		defer ngm.devicesMutex.RUnlock()
+		return maps.Clone(ngm.devices)
 	}
 	return ngm.migDeviceManager.ListGPUPartitionDevices()
 }
@@ -190,17 +280,56 @@ func (ngm *nvidiaGPUManager) ListDevices() map[string]pluginapi.Device {
 		virtualGPUDevices := map[string]pluginapi.Device{}
 		for _, device := range physicalGPUDevices {
 			for i := 0; i < ngm.gpuConfig.GPUSharingConfig.MaxSharedClientsPerGPU; i++ {
-				virtualDeviceID := fmt.Sprintf("%s/vgpu%d", device.ID, i)
+				virtualDeviceID := fmt.Sprintf("%s/vgpu%d", ngm.deviceIDs.External(device.ID), i)
 				// When sharing GPUs, the virtual GPU device will inherit the health status from its underlying physical GPU device.
 				virtualGPUDevices[virtualDeviceID] = pluginapi.Device{ID: virtualDeviceID, Health: device.Health, Topology: device.Topology}
 			}
 		}
 		return virtualGPUDevices
+	case ngm.deviceIDs.Scheme() == deviceid.UUID:
+		devices := map[string]pluginapi.Device{}
+		for _, device := range physicalGPUDevices {
+			id := ngm.deviceIDs.External(device.ID)
+			devices[id] = pluginapi.Device{ID: id, Health: device.Health, Topology: device.Topology}
+		}
+		return devices
 	default:
 		return physicalGPUDevices
 	}
 }
 
+// InternalDeviceIDs maps device IDs advertised to the kubelet, in either device
+// ID scheme, to the minor number based device IDs used by the manager.
+func (ngm *nvidiaGPUManager) InternalDeviceIDs(deviceIDs []string) ([]string, error) {
+	internalIDs := make([]string, 0, len(deviceIDs))
+	for _, id := range deviceIDs {
+		internalID, err := ngm.deviceIDs.Internal(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allocation request: %v", err)
+		}
+		internalIDs = append(internalIDs, internalID)
+	}
+	return internalIDs, nil
+}
+
+// updateDeviceUUIDs looks up the UUIDs of all GPUs and GPU partitions, so that they can be allocated by UUID
+// in either device ID scheme. Without UUID based device IDs, devices whose UUID can't be looked up can still be
+// allocated by their minor number based device ID.
+func (ngm *nvidiaGPUManager) updateDeviceUUIDs() error {
+	for id := range ngm.ListPhysicalDevices() {
+		uuid, err := deviceid.LookupUUID(id)
+		if err != nil {
+			if ngm.deviceIDs.Scheme() == deviceid.UUID {
+				return fmt.Errorf("failed to get the UUID of device %s: %v", id, err)
+			}
+			slog.Warn("Failed to get the UUID of device, it can't be allocated by UUID", logging.DeviceID, id, logging.Error, err)
+			continue
+		}
+		ngm.deviceIDs.Add(id, uuid)
+	}
+	return nil
+}
+
 // DeviceSpec returns the device spec that inclues list of devices to allocate for a deviceID.
 func (ngm *nvidiaGPUManager) DeviceSpec(deviceID string) ([]pluginapi.DeviceSpec, error) {
 	deviceSpecs := make([]pluginapi.DeviceSpec, 0)
@@ -214,7 +343,9 @@ func (ngm *nvidiaGPUManager) DeviceSpec(deviceID string) ([]pluginapi.DeviceSpec
 		deviceID = physicalDeviceID
 	}
 	if ngm.gpuConfig.GPUPartitionSize == "" {
+		ngm.devicesMutex.RLock()
 		dev, ok := ngm.devices[deviceID]
+		ngm.devicesMutex.RUnlock()
 		if !ok {
 			return deviceSpecs, fmt.Errorf("invalid allocation request with non-existing device %s", deviceID)
 		}
@@ -231,6 +362,143 @@ func (ngm *nvidiaGPUManager) DeviceSpec(deviceID string) ([]pluginapi.DeviceSpec
 	return ngm.migDeviceManager.DeviceSpec(deviceID)
 }
 
+// PreferredAllocation picks size shared GPU device IDs out of availableIDs, based on
+// the devices already allocated on each physical GPU.
+func (ngm *nvidiaGPUManager) PreferredAllocation(availableIDs, mustIncludeIDs []string, size int) ([]string, error) {
+	// Allocations made before a device ID scheme switch are counted against the same physical GPU.
+	allocated := make(map[string]int)
+	for id, n := range ngm.allocations.CountByPhysicalDevice() {
+		allocated[ngm.deviceIDs.Canonical(id)] += n
+	}
+	return gpusharing.PreferredAllocation(availableIDs, mustIncludeIDs, size, allocated, ngm.gpuConfig.GPUSharingConfig.PlacementStrategy)
+}
+
+// SetAllocationCheckpoint saves the device allocations to checkpointFile and
+// restores the allocations saved there by a previous run of the device plugin.
+func (ngm *nvidiaGPUManager) SetAllocationCheckpoint(checkpointFile string) error {
+	return ngm.allocations.SetCheckpointFile(checkpointFile)
+}
+
+// ListAllocations lists the device IDs currently allocated to containers, along
+// with the container that owns them when known.
+func (ngm *nvidiaGPUManager) ListAllocations() map[string]allocation.Entry {
+	return ngm.allocations.List()
+}
+
+// reconcileAllocations cross-checks the tracked allocations with the device
+// assignments known to the kubelet.
+func (ngm *nvidiaGPUManager) reconcileAllocations() {
+	assigned, err := kubeletAssignments(resourceName)
+	if err != nil {
+		slog.Debug("Unable to reconcile device allocations with the kubelet", logging.Error, err)
+		return
+	}
+	ngm.allocations.Reconcile(assigned)
+}
+
+// EnableCDI makes the manager write a CDI spec for the discovered GPUs to specDir
+// and return CDI device names instead of device specs and mounts on Allocate.
+// If hookPath is set, it is the path to nvidia-ctk on the host, used to update
+// the ldcache of containers with the mounted NVIDIA libraries.
+func (ngm *nvidiaGPUManager) EnableCDI(specDir, hookPath string) {
+	ngm.cdiSpecDir = specDir
+	ngm.cdiHookPath = hookPath
+}
+
+func (ngm *nvidiaGPUManager) cdiEnabled() bool {
+	return ngm.cdiSpecDir != ""
+}
+
+// CDIDevice returns the fully qualified CDI name of the physical device backing deviceID.
+func (ngm *nvidiaGPUManager) CDIDevice(deviceID string) (string, error) {
+	// DeviceSpec validates the device ID and the health of the device.
+	if _, err := ngm.DeviceSpec(deviceID); err != nil {
+		return "", err
+	}
+	if ngm.gpuConfig.GPUSharingConfig.MaxSharedClientsPerGPU > 0 {
+		deviceID, _ = gpusharing.VirtualToPhysicalDeviceID(deviceID)
+	}
+
+	ngm.devicesMutex.RLock()
+	defer ngm.devicesMutex.RUnlock()
+	name, ok := ngm.cdiDeviceNames[deviceID]
+	if !ok {
+		return "", fmt.Errorf("no CDI device for device %s", deviceID)
+	}
+	return cdi.QualifiedName(name), nil
+}
+
+// hasLibraries returns whether mount holds libraries in its lib64 folder, as
+// opposed to e.g. the Vulkan ICD files. The folder is looked up under the host
+// path, or under the container path when the device plugin runs in a container
+// that mounts the host path where containers do.
+func hasLibraries(mount pluginapi.Mount) bool {
+	for _, dir := range []string{mount.HostPath, mount.ContainerPath} {
+		if info, err := os.Stat(path.Join(dir, "lib64")); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCDISpec generates a CDI spec with a device for every GPU or GPU partition,
+// named after its UUID, and writes it to the CDI spec directory.
+func (ngm *nvidiaGPUManager) writeCDISpec() error {
+	var defaultDevices []pluginapi.DeviceSpec
+	for _, d := range ngm.defaultDevices {
+		defaultDevices = append(defaultDevices, pluginapi.DeviceSpec{HostPath: d, ContainerPath: d, Permissions: "mrw"})
+	}
+	commonEdits := cdi.ContainerEdits{
+		DeviceNodes: cdi.DeviceNodes(defaultDevices),
+		Mounts:      cdi.Mounts(ngm.mountPaths),
+	}
+	// Keep the NVIDIA container runtime hooks, if installed, from injecting GPUs on top of CDI, unless
+	// NVIDIA_VISIBLE_DEVICES is set by Allocate, which CDI edits would override. The hooks then inject the
+	// same GPUs as CDI.
+	if ngm.gpuConfig.AllocationEnv.VisibleDevices != nvidiaVisibleDevicesEnv {
+		commonEdits.Env = []string{nvidiaVisibleDevicesEnv + "=void"}
+	}
+	if ngm.cdiHookPath != "" {
+		var folders []string
+		for _, m := range ngm.mountPaths {
+			if hasLibraries(m) {
+				folders = append(folders, path.Join(m.ContainerPath, "lib64"))
+			}
+		}
+		commonEdits.Hooks = append(commonEdits.Hooks, cdi.LdcacheHook(ngm.cdiHookPath, folders...))
+	}
+	spec := cdi.NewSpec(commonEdits)
+
+	names := make(map[string]string)
+	for id := range ngm.ListPhysicalDevices() {
+		var deviceSpecs []pluginapi.DeviceSpec
+		if ngm.gpuConfig.GPUPartitionSize == "" {
+			deviceSpecs = []pluginapi.DeviceSpec{{HostPath: path.Join(ngm.devDirectory, id), ContainerPath: path.Join(ngm.devDirectory, id), Permissions: "mrw"}}
+		} else {
+			var err error
+			if deviceSpecs, err = ngm.migDeviceManager.DeviceSpec(id); err != nil {
+				return err
+			}
+		}
+		uuid, err := deviceid.LookupUUID(id)
+		if err != nil {
+			return fmt.Errorf("failed to get the UUID of device %s: %v", id, err)
+		}
+		spec.AddDevice(uuid, deviceSpecs)
+		names[id] = uuid
+	}
+
+	if err := cdi.WriteSpec(ngm.cdiSpecDir, spec); err != nil {
+		return err
+	}
+	slog.Info("Wrote CDI spec", "devices", len(names), "dir", ngm.cdiSpecDir)
+
+	ngm.devicesMutex.Lock()
+	ngm.cdiDeviceNames = names
+	ngm.devicesMutex.Unlock()
+	return nil
+}
+
 // Discovers all NVIDIA GPU devices available on the local node by walking nvidiaGPUManager's devDirectory.
 func (ngm *nvidiaGPUManager) discoverGPUs() error {
 	if nvmlutil.NvmlDeviceInfo == nil {
@@ -244,6 +512,10 @@ func (ngm *nvidiaGPUManager) discoverGPUs() error {
 
 	for i := 0; i < devicesCount; i++ {
 		device, ret := nvmlutil.NvmlDeviceInfo.DeviceHandleByIndex((i))
+		if ret == nvml.ERROR_GPU_IS_LOST {
+			slog.Error("GPU is lost, skipping it", "index", i)
+			continue
+		}
 		if ret != nvml.SUCCESS {
 			return fmt.Errorf("failed to get the device handle for index %d: %v", i, nvml.ErrorString(ret))
 		}
@@ -254,51 +526,145 @@ func (ngm *nvidiaGPUManager) discoverGPUs() error {
 		}
 
 		path := fmt.Sprintf("nvidia%d", minor)
-		glog.V(3).Infof("Found Nvidia GPU %q\n", path)
+		slog.Debug("Found NVIDIA GPU", logging.DeviceID, path)
 
 		topologyInfo, err := nvmlutil.Topology(device, pciDevicesRoot)
 		if err != nil {
-			glog.Errorf("unable to get topology for device with index %d", i, err)
+			slog.Error("Unable to get GPU topology", logging.DeviceID, path, logging.Error, err)
+		}
+		ngm.devicesMutex.Lock()
+		if _, ok := ngm.devices[path]; !ok {
+			ngm.devices[path] = pluginapi.Device{ID: path, Health: pluginapi.Healthy, Topology: topologyInfo}
 		}
-		ngm.SetDeviceHealth(path, pluginapi.Healthy, topologyInfo)
+		ngm.gpuIndices[path] = i
+		ngm.devicesMutex.Unlock()
 	}
 
 	return nil
 }
 
 func (ngm *nvidiaGPUManager) hasAdditionalGPUsInstalled() bool {
-	ngm.devicesMutex.Lock()
+	ngm.devicesMutex.RLock()
 	originalDeviceCount := len(ngm.devices)
-	ngm.devicesMutex.Unlock()
+	ngm.devicesMutex.RUnlock()
 	deviceCount, err := ngm.discoverNumGPUs()
 	if err != nil {
-		glog.Errorln(err)
+		slog.Error("Failed to count GPUs", logging.Error, err)
 		return false
 	}
 
 	if deviceCount > originalDeviceCount {
-		glog.Infof("Found %v GPUs, while only %v are registered. Stopping device-plugin server.", deviceCount, originalDeviceCount)
+		slog.Info("Found additional GPUs", "gpus", deviceCount, "registered", originalDeviceCount)
 		return true
 	}
 	return false
 }
 
+// checkGPUs updates the advertised devices if GPUs were installed or lost, and
+// sends them to the kubelet. It returns true if the devices changed.
+func (ngm *nvidiaGPUManager) checkGPUs() bool {
+	changed := false
+	if ngm.hasAdditionalGPUsInstalled() {
+		if err := ngm.discoverGPUs(); err != nil {
+			slog.Error("Failed to discover GPUs", logging.Error, err)
+		}
+		changed = true
+	}
+	if ngm.checkLostGPUs() {
+		changed = true
+	}
+	if changed {
+		ngm.refreshDevices()
+		ngm.notifyDevicesChanged()
+	}
+	return changed
+}
+
+// checkLostGPUs marks the GPUs whose device nodes disappeared, or that NVML
+// reports as lost, e.g. after they fell off the bus (Xid 79), as unhealthy along
+// with their partitions. GPUs that come back are marked healthy again. It
+// returns true if the health of any GPU changed.
+func (ngm *nvidiaGPUManager) checkLostGPUs() bool {
+	ngm.devicesMutex.RLock()
+	indices := make(map[string]int)
+	for name := range ngm.devices {
+		index, ok := ngm.gpuIndices[name]
+		if !ok {
+			index = -1
+		}
+		indices[name] = index
+	}
+	ngm.devicesMutex.RUnlock()
+
+	changed := false
+	for name, index := range indices {
+		reason := ngm.gpuLostReason(name, index)
+		ngm.devicesMutex.Lock()
+		wasLost := ngm.lostGPUs[name]
+		switch {
+		case reason != "" && !wasLost:
+			slog.Error("GPU is lost, marking it unhealthy", logging.DeviceID, name, "reason", reason)
+			ngm.lostGPUs[name] = true
+			ngm.setGPUHealth(name, pluginapi.Unhealthy)
+			changed = true
+		case reason == "" && wasLost:
+			slog.Info("GPU is back, marking it healthy", logging.DeviceID, name)
+			delete(ngm.lostGPUs, name)
+			ngm.setGPUHealth(name, pluginapi.Healthy)
+			changed = true
+		}
+		ngm.devicesMutex.Unlock()
+	}
+	return changed
+}
+
+// gpuLostReason returns why the GPU with the device name and NVML index is lost,
+// or an empty string if it is not. A negative index skips the NVML check.
+func (ngm *nvidiaGPUManager) gpuLostReason(name string, index int) string {
+	if _, err := os.Stat(path.Join(ngm.devDirectory, name)); os.IsNotExist(err) {
+		return "device node removed"
+	}
+	if index >= 0 && nvmlutil.IsGPULost(index) {
+		return "NVML reports the GPU as lost"
+	}
+	return ""
+}
+
+// setGPUHealth sets the health of a GPU and of all its partitions. The caller
+// must hold devicesMutex.
+func (ngm *nvidiaGPUManager) setGPUHealth(name, health string) {
+	if d, ok := ngm.devices[name]; ok {
+		ngm.devices[name] = pluginapi.Device{ID: name, Health: health, Topology: d.Topology}
+	}
+	for id, d := range ngm.migDeviceManager.ListGPUPartitionDevices() {
+		if strings.HasPrefix(id, name+"/") {
+			ngm.migDeviceManager.SetDeviceHealth(id, health, d.Topology)
+		}
+	}
+}
+
 func (ngm *nvidiaGPUManager) discoverNumGPUs() (int, error) {
+	gpus, err := ngm.listGPUDeviceNames()
+	return len(gpus), err
+}
+
+// listGPUDeviceNames lists the names of the GPU device nodes in devDirectory, e.g. nvidia0.
+func (ngm *nvidiaGPUManager) listGPUDeviceNames() ([]string, error) {
 	reg := regexp.MustCompile(nvidiaDeviceRE)
-	deviceCount := 0
+	var gpus []string
 	files, err := ioutil.ReadDir(ngm.devDirectory)
 	if err != nil {
-		return deviceCount, err
+		return nil, err
 	}
 	for _, f := range files {
 		if f.IsDir() {
 			continue
 		}
 		if reg.MatchString(f.Name()) {
-			deviceCount++
+			gpus = append(gpus, f.Name())
 		}
 	}
-	return deviceCount, nil
+	return gpus, nil
 }
 
 // isMpsHealthy checks whether MPS control daemon is running and healhty on the node.
@@ -326,7 +692,7 @@ func (ngm *nvidiaGPUManager) isMpsHealthy() error {
 	}
 
 	reader.Close()
-	glog.Infof("MPS is healthy, active thread percentage = %s", out.String())
+	slog.Info("MPS is healthy", "active_thread_percentage", strings.TrimSpace(out.String()))
 	return nil
 }
 
@@ -345,7 +711,68 @@ func (ngm *nvidiaGPUManager) Envs(numDevicesRequested int) map[string]string {
 	return map[string]string{}
 }
 
-// SetDeviceHealth sets the health status for a GPU device or partition if MIG is enabled
+// AllocationEnvs returns the env vars configured in GPUConfig.AllocationEnv for a
+// container that is allocated the devices with the given internal device IDs.
+func (ngm *nvidiaGPUManager) AllocationEnvs(deviceIDs []string) (map[string]string, error) {
+	config := ngm.gpuConfig.AllocationEnv
+	envs := make(map[string]string)
+
+	// Shared GPUs on the same physical GPU or GPU partition are listed once.
+	var uuids, minors []string
+	seenDevices := make(map[string]bool)
+	seenMinors := make(map[string]bool)
+	for _, id := range deviceIDs {
+		if gpusharing.IsVirtualDeviceID(id) {
+			physicalID, err := gpusharing.VirtualToPhysicalDeviceID(id)
+			if err != nil {
+				return nil, err
+			}
+			id = physicalID
+		}
+		if seenDevices[id] {
+			continue
+		}
+		seenDevices[id] = true
+
+		if config.VisibleDevices != "" {
+			uuid, err := deviceid.LookupUUID(id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the UUID of device %s: %v", id, err)
+			}
+			uuids = append(uuids, uuid)
+		}
+		m := minorRegexp.FindStringSubmatch(id)
+		if m == nil {
+			return nil, fmt.Errorf("invalid device ID %s", id)
+		}
+		if !seenMinors[m[1]] {
+			seenMinors[m[1]] = true
+			minors = append(minors, m[1])
+		}
+	}
+
+	if config.VisibleDevices != "" {
+		envs[config.VisibleDevices] = strings.Join(uuids, ",")
+	}
+	if config.PhysicalIndex != "" {
+		envs[config.PhysicalIndex] = strings.Join(minors, ",")
+	}
+	sharingStrategy := ngm.gpuConfig.GPUSharingConfig.GPUSharingStrategy
+	if config.SharingStrategy != "" {
+		if sharingStrategy == gpusharing.Undefined {
+			envs[config.SharingStrategy] = "none"
+		} else {
+			envs[config.SharingStrategy] = string(sharingStrategy)
+		}
+	}
+	if config.ShareCount != "" && sharingStrategy != gpusharing.Undefined {
+		envs[config.ShareCount] = strconv.Itoa(len(deviceIDs))
+	}
+	return envs, nil
+}
+
+// SetDeviceHealth sets the health status for a GPU device or partition if MIG is enabled.
+// Devices that are no longer advertised, e.g. GPUs that were removed, are ignored.
 func (ngm *nvidiaGPUManager) SetDeviceHealth(name string, health string, topology *pluginapi.TopologyInfo) {
 	ngm.devicesMutex.Lock()
 	defer ngm.devicesMutex.Unlock()
@@ -353,6 +780,9 @@ func (ngm *nvidiaGPUManager) SetDeviceHealth(name string, health string, topolog
 	reg := regexp.MustCompile(nvidiaDeviceRE)
 
 	if reg.MatchString(name) {
+		if _, ok := ngm.devices[name]; !ok {
+			return
+		}
 		ngm.devices[name] = pluginapi.Device{ID: name, Health: health, Topology: topology}
 	} else {
 		ngm.migDeviceManager.SetDeviceHealth(name, health, topology)
@@ -374,23 +804,22 @@ func (ngm *nvidiaGPUManager) CheckDevicePaths() error {
 
 // Discovers Nvidia GPU devices and sets up device access environment.
 func (ngm *nvidiaGPUManager) Start() error {
-	ngm.defaultDevices = []string{ngm.nvidiaCtlDevicePath, ngm.nvidiaUVMDevicePath}
-
-	nvidiaModesetDevicePath := path.Join(ngm.devDirectory, nvidiaModesetDevice)
-	if _, err := os.Stat(nvidiaModesetDevicePath); err == nil {
-		ngm.defaultDevices = append(ngm.defaultDevices, nvidiaModesetDevicePath)
+	if err := ngm.checkDriverFeatures(); err != nil {
+		return err
 	}
-
-	nvidiaUVMToolsDevicePath := path.Join(ngm.devDirectory, nvidiaUVMToolsDevice)
-	if _, err := os.Stat(nvidiaUVMToolsDevicePath); err == nil {
-		ngm.defaultDevices = append(ngm.defaultDevices, nvidiaUVMToolsDevicePath)
+	ngm.defaultDevices = nil
+	for _, d := range allocation.ControlDevices {
+		devicePath := path.Join(ngm.devDirectory, d.Name)
+		if _, err := os.Stat(devicePath); err == nil || d.Required {
+			ngm.defaultDevices = append(ngm.defaultDevices, devicePath)
+		}
 	}
 
 	if err := ngm.discoverGPUs(); err != nil {
 		return err
 	}
 	if ngm.gpuConfig.GPUPartitionSize != "" {
-		if err := ngm.migDeviceManager.Start(ngm.gpuConfig.GPUPartitionSize); err != nil {
+		if err := ngm.startMigDeviceManager(); err != nil {
 			return fmt.Errorf("failed to start mig device manager: %v", err)
 		}
 	}
@@ -406,9 +835,213 @@ func (ngm *nvidiaGPUManager) Start() error {
 			return fmt.Errorf("failed to query total memory available per GPU: %v", err)
 		}
 	}
+
+	if err := ngm.updateDeviceUUIDs(); err != nil {
+		return err
+	}
+
+	if ngm.cdiEnabled() {
+		if err := ngm.writeCDISpec(); err != nil {
+			return fmt.Errorf("failed to write CDI spec: %v", err)
+		}
+	}
+
+	// Pick up allocations made before a device plugin restart.
+	ngm.reconcileAllocations()
 	return nil
 }
 
+// checkDriverFeatures returns a *driver.UnsupportedError for each feature of the
+// GPU config that the loaded NVIDIA driver doesn't support.
+func (ngm *nvidiaGPUManager) checkDriverFeatures() error {
+	var features []driver.Feature
+	if ngm.gpuConfig.GPUPartitionSize != "" {
+		features = append(features, driver.MIG)
+	}
+	if ngm.gpuConfig.GPUSharingConfig.GPUSharingStrategy == "mps" {
+		features = append(features, driver.MPS)
+	}
+	if len(features) == 0 {
+		return nil
+	}
+	version, err := driver.FromProcfs(ngm.procDirectory)
+	if err != nil {
+		return err
+	}
+	slog.Info("Found NVIDIA driver", "driver_version", version.String())
+	return driver.Check(version, features...)
+}
+
+// SetMigStatusFile makes the manager rediscover the GPU partitions whenever the
+// GPU partitioner reports new partitions in statusFile.
+func (ngm *nvidiaGPUManager) SetMigStatusFile(statusFile string) {
+	ngm.migStatusFile = statusFile
+}
+
+// SetDevicesRefreshedHandler makes the manager call f with the physical devices
+// whenever they were rediscovered, e.g. to update the devices monitored by the
+// health checker after GPUs were repartitioned. It must be called before Serve.
+func (ngm *nvidiaGPUManager) SetDevicesRefreshedHandler(f func(map[string]pluginapi.Device)) {
+	ngm.devicesRefreshed = f
+}
+
+// SetTolerateMisconfiguredGPUs makes the manager advertise the partitions of the
+// GPUs that are partitioned as expected when other GPUs are not, instead of
+// failing to start. The GPU partitions are rediscovered until all GPUs recover.
+func (ngm *nvidiaGPUManager) SetTolerateMisconfiguredGPUs(tolerate bool) {
+	ngm.migDeviceManager.TolerateMisconfiguredGPUs(tolerate)
+}
+
+// startMigDeviceManager discovers the GPU partitions and remembers the generation
+// of the partitioner status they belong to.
+func (ngm *nvidiaGPUManager) startMigDeviceManager() error {
+	// The generation is read first, so partitions that change during discovery
+	// are picked up by the next check.
+	if ngm.migStatusFile != "" {
+		if status, err := migstatus.Read(ngm.migStatusFile); err == nil {
+			ngm.migGeneration = status.Generation
+		}
+	}
+	ngm.devicesMutex.Lock()
+	defer ngm.devicesMutex.Unlock()
+	return ngm.migDeviceManager.Start(ngm.gpuConfig.GPUPartitionSize)
+}
+
+// hasGPUPartitionsChanged returns true if the GPU partitioner finished changing the
+// GPU partitions since they were last discovered.
+func (ngm *nvidiaGPUManager) hasGPUPartitionsChanged() bool {
+	if ngm.migStatusFile == "" || ngm.gpuConfig.GPUPartitionSize == "" {
+		return false
+	}
+	status, err := migstatus.Read(ngm.migStatusFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read GPU partition status", logging.Error, err)
+		}
+		return false
+	}
+	if status.State != migstatus.Ready || status.Generation == ngm.migGeneration {
+		return false
+	}
+	slog.Info("GPU partitions changed", "generation", status.Generation, "previous_generation", ngm.migGeneration)
+	return true
+}
+
+// shouldRediscoverGPUPartitions returns true if the GPU partitions may have
+// changed since they were last discovered: the GPU partitioner reported new
+// partitions, partitions were created or destroyed, or some GPUs are not
+// partitioned as expected and may have recovered.
+func (ngm *nvidiaGPUManager) shouldRediscoverGPUPartitions() bool {
+	if ngm.gpuConfig.GPUPartitionSize == "" {
+		return false
+	}
+	if ngm.hasGPUPartitionsChanged() {
+		return true
+	}
+	ngm.devicesMutex.Lock()
+	defer ngm.devicesMutex.Unlock()
+	return ngm.migDeviceManager.HasLayoutChanged() || len(ngm.migDeviceManager.Problems()) > 0
+}
+
+// updateGPUPartitions rediscovers the GPU partitions, and sends them to the
+// kubelet without restarting the device-plugin server if they changed. It
+// returns true if the partitions, or the GPUs that are not partitioned as
+// expected, changed.
+func (ngm *nvidiaGPUManager) updateGPUPartitions() bool {
+	if ngm.gpuConfig.GPUPartitionSize == "" {
+		return false
+	}
+
+	ngm.devicesMutex.Lock()
+	problems := ngm.migDeviceManager.Problems()
+	previous := ngm.migDeviceManager.ListGPUPartitionDevices()
+	previousSpecs := make(map[string][]pluginapi.DeviceSpec)
+	for id := range previous {
+		previousSpecs[id], _ = ngm.migDeviceManager.DeviceSpec(id)
+	}
+	ngm.devicesMutex.Unlock()
+
+	if err := ngm.startMigDeviceManager(); err != nil {
+		slog.Error("Failed to rediscover GPU partitions", logging.Error, err)
+	}
+
+	// Partitions that still exist on GPUs that were partitioned as expected keep
+	// the health reported by the health checker.
+	ngm.devicesMutex.Lock()
+	partitions := ngm.migDeviceManager.ListGPUPartitionDevices()
+	for id, d := range previous {
+		gpu := strings.SplitN(id, "/", 2)[0]
+		if _, misconfigured := problems[gpu]; misconfigured || d.Health == pluginapi.Healthy {
+			continue
+		}
+		if _, ok := partitions[id]; ok {
+			ngm.migDeviceManager.SetDeviceHealth(id, d.Health, d.Topology)
+		}
+	}
+	for id, d := range partitions {
+		if ngm.lostGPUs[strings.SplitN(id, "/", 2)[0]] {
+			ngm.migDeviceManager.SetDeviceHealth(id, pluginapi.Unhealthy, d.Topology)
+		}
+	}
+	current := ngm.migDeviceManager.ListGPUPartitionDevices()
+	currentSpecs := make(map[string][]pluginapi.DeviceSpec)
+	for id := range current {
+		currentSpecs[id], _ = ngm.migDeviceManager.DeviceSpec(id)
+	}
+	currentProblems := ngm.migDeviceManager.Problems()
+	ngm.devicesMutex.Unlock()
+
+	if reflect.DeepEqual(previous, current) && reflect.DeepEqual(previousSpecs, currentSpecs) && reflect.DeepEqual(problems, currentProblems) {
+		return false
+	}
+	if !reflect.DeepEqual(problems, currentProblems) {
+		slog.Info("GPUs not partitioned as expected changed", "previous", problems, "current", currentProblems)
+	}
+	slog.Info("GPU partitions changed", "partitions", len(current))
+	ngm.refreshDevices()
+	ngm.notifyDevicesChanged()
+	return true
+}
+
+// notifyDevicesChanged makes ListAndWatch send the devices to the kubelet. It
+// doesn't block, pending notifications are merged.
+func (ngm *nvidiaGPUManager) notifyDevicesChanged() {
+	select {
+	case ngm.devicesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// watchGPUPartitions adds the paths that change when GPU partitions are created
+// or destroyed to watcher. Paths that are already watched or don't exist are
+// skipped.
+func (ngm *nvidiaGPUManager) watchGPUPartitions(watcher *fsnotify.Watcher) {
+	ngm.devicesMutex.Lock()
+	paths := ngm.migDeviceManager.WatchPaths()
+	ngm.devicesMutex.Unlock()
+	for _, p := range paths {
+		if err := watcher.Add(p); err != nil && !os.IsNotExist(err) {
+			slog.Error("Failed to watch path", "path", p, logging.Error, err)
+		}
+	}
+}
+
+// refreshDevices updates the device UUIDs and the CDI spec after devices were
+// rediscovered, and calls the devices refreshed handler.
+func (ngm *nvidiaGPUManager) refreshDevices() {
+	if err := ngm.updateDeviceUUIDs(); err != nil {
+		slog.Error("Failed to update device UUIDs", logging.Error, err)
+	}
+	if ngm.cdiEnabled() {
+		if err := ngm.writeCDISpec(); err != nil {
+			slog.Error("Failed to update CDI spec", logging.Error, err)
+		}
+	}
+	if ngm.devicesRefreshed != nil {
+		ngm.devicesRefreshed(ngm.ListPhysicalDevices())
+	}
+}
+
 // totalMemPerGPU returns the GPU memory available on each GPU device.
 func totalMemPerGPU() (uint64, error) {
 	count, ret := nvml.DeviceGetCount()
@@ -434,16 +1067,33 @@ func (ngm *nvidiaGPUManager) Serve(pMountPath, kEndpoint, pluginEndpoint string)
 	// Check if the unix socket device-plugin/kubelet.sock is at the host path.
 	kubeletEndpointPath := path.Join(pMountPath, kEndpoint)
 	if _, err := os.Stat(kubeletEndpointPath); err == nil {
-		glog.Infof("registered with kubelet, will use beta API\n")
+		slog.Info("Found kubelet socket, registering with the beta API")
 		registerWithKubelet = true
 	} else {
-		glog.Infof("no kubelet.sock to register.\n")
+		slog.Info("No kubelet socket to register with")
 	}
 
 	// Create a watcher to watch /device-plugin directory.
 	watcher, _ := util.Files(pMountPath)
 	defer watcher.Close()
-	glog.Info("Starting filesystem watcher.")
+	slog.Info("Starting filesystem watcher")
+
+	// Create a watcher to watch the GPU partitions being created or destroyed.
+	var migWatcher *fsnotify.Watcher
+	var migEvents <-chan fsnotify.Event
+	var migErrors <-chan error
+	var rediscoverGPUPartitions <-chan time.Time
+	if ngm.gpuConfig.GPUPartitionSize != "" {
+		var err error
+		if migWatcher, err = util.Files(); err != nil {
+			slog.Error("Failed to watch GPU partitions, they are only checked periodically", "interval", gpuCheckInterval, logging.Error, err)
+		} else {
+			defer migWatcher.Close()
+			ngm.watchGPUPartitions(migWatcher)
+			migEvents = migWatcher.Events
+			migErrors = migWatcher.Errors
+		}
+	}
 
 	for {
 		select {
@@ -453,10 +1103,10 @@ func (ngm *nvidiaGPUManager) Serve(pMountPath, kEndpoint, pluginEndpoint string)
 		default:
 			{
 				pluginEndpointPath := path.Join(pMountPath, pluginEndpoint)
-				glog.Infof("starting device-plugin server at: %s\n", pluginEndpointPath)
+				slog.Info("Starting device-plugin server", "socket", pluginEndpointPath)
 				lis, err := net.Listen("unix", pluginEndpointPath)
 				if err != nil {
-					glog.Fatalf("starting device-plugin server failed: %v", err)
+					logging.Fatal("Starting device-plugin server failed", logging.Error, err)
 				}
 				ngm.socket = pluginEndpointPath
 				ngm.grpcServer = grpc.NewServer()
@@ -472,7 +1122,7 @@ func (ngm *nvidiaGPUManager) Serve(pMountPath, kEndpoint, pluginEndpoint string)
 					defer wg.Done()
 					// Blocking call to accept incoming connections.
 					err := ngm.grpcServer.Serve(lis)
-					glog.Errorf("device-plugin server stopped serving: %v", err)
+					slog.Error("Device-plugin server stopped serving", logging.Error, err)
 				}()
 
 				if registerWithKubelet {
@@ -480,20 +1130,21 @@ func (ngm *nvidiaGPUManager) Serve(pMountPath, kEndpoint, pluginEndpoint string)
 					for len(ngm.grpcServer.GetServiceInfo()) <= 0 {
 						time.Sleep(1 * time.Second)
 					}
-					glog.Infoln("device-plugin server started serving")
+					slog.Info("Device-plugin server started serving")
 					// Registers with Kubelet.
 					err = RegisterWithV1Beta1Kubelet(path.Join(pMountPath, kEndpoint), pluginEndpoint, resourceName)
 					if err != nil {
 						ngm.grpcServer.Stop()
 						wg.Wait()
-						glog.Fatal(err)
+						logging.Fatal("Failed to register with the kubelet", logging.Error, err)
 					}
-					glog.Infoln("device-plugin registered with the kubelet")
+					slog.Info("Device-plugin registered with the kubelet")
 				}
 
-				// This is checking if the plugin socket was deleted
-				// and also if there are additional GPU devices installed.
-				// If so, stop the grpc server and start the whole thing again.
+				// This is checking if the plugin socket was deleted, and if so,
+				// stops the grpc server and starts the whole thing again. It also
+				// checks if GPUs or GPU partitions were added or removed, and
+				// sends the updated devices to the kubelet.
 				gpuCheck := time.NewTicker(gpuCheckInterval)
 				pluginSocketCheck := time.NewTicker(pluginSocketCheckInterval)
 				defer gpuCheck.Stop()
@@ -504,32 +1155,42 @@ func (ngm *nvidiaGPUManager) Serve(pMountPath, kEndpoint, pluginEndpoint string)
 					// Restart the device plugin if plugin endpoint file disappears.
 					case <-pluginSocketCheck.C:
 						if _, err := os.Lstat(pluginEndpointPath); err != nil {
-							glog.Infof("stopping device-plugin server at: %s\n", pluginEndpointPath)
-							glog.Errorln(err)
+							slog.Info("Plugin socket disappeared, stopping device-plugin server", "socket", pluginEndpointPath, logging.Error, err)
 							ngm.grpcServer.Stop()
 							break statusCheck
 						}
-					// Restart the device plugin if additional GPU installers.
+					// Update the advertised devices if GPUs were installed, removed or partitioned.
 					case <-gpuCheck.C:
-						if ngm.hasAdditionalGPUsInstalled() {
-							ngm.grpcServer.Stop()
-							for {
-								err := ngm.discoverGPUs()
-								if err == nil {
-									break statusCheck
-								}
+						ngm.reconcileAllocations()
+						gpusChanged := ngm.checkGPUs()
+						if (gpusChanged && ngm.gpuConfig.GPUPartitionSize != "") || ngm.shouldRediscoverGPUPartitions() {
+							ngm.updateGPUPartitions()
+							if migWatcher != nil {
+								ngm.watchGPUPartitions(migWatcher)
 							}
 						}
+					// Rediscover the GPU partitions once they stopped changing.
+					case event := <-migEvents:
+						slog.Debug("GPU partitions changed", "event", event.String())
+						if rediscoverGPUPartitions == nil {
+							rediscoverGPUPartitions = time.After(gpuPartitionsSettleInterval)
+						}
+					case <-rediscoverGPUPartitions:
+						rediscoverGPUPartitions = nil
+						ngm.updateGPUPartitions()
+						ngm.watchGPUPartitions(migWatcher)
+					case err := <-migErrors:
+						slog.Warn("Filesystem watcher error", logging.Error, err)
 					// Restart the device plugin if kubelet socket gets recreated, which indicates a kubelet restart.
 					case event := <-watcher.Events:
 						if event.Name == kubeletEndpointPath && event.Op&fsnotify.Create == fsnotify.Create {
-							glog.Infof(" %s recreated, stopping device-plugin server", kubeletEndpointPath)
+							slog.Info("Kubelet socket recreated, stopping device-plugin server", "socket", kubeletEndpointPath)
 							ngm.grpcServer.Stop()
 							break statusCheck
 						}
 					// Log for any other fs errors and log them. This will not induce a device plugin restart.
 					case err := <-watcher.Errors:
-						glog.Infof("inotify: %s", err)
+						slog.Warn("Filesystem watcher error", logging.Error, err)
 					}
 				}
 				wg.Wait()
@@ -539,7 +1200,7 @@ func (ngm *nvidiaGPUManager) Serve(pMountPath, kEndpoint, pluginEndpoint string)
 }
 
 func (ngm *nvidiaGPUManager) Stop() error {
-	glog.Infof("removing device plugin socket %s\n", ngm.socket)
+	slog.Info("Removing device-plugin socket", "socket", ngm.socket)
 	if err := os.Remove(ngm.socket); err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -15,12 +15,19 @@
 package nvidia
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/allocation"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/deviceid"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/driver"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migstatus"
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/nvmlutil"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	"github.com/google/go-cmp/cmp"
@@ -32,6 +39,7 @@ func TestGPUConfig_AddDefaultsAndValidate(t *testing.T) {
 		GPUPartitionSize           string
 		MaxTimeSharedClientsPerGPU int
 		GPUSharingConfig           GPUSharingConfig
+		DeviceIDScheme             deviceid.Scheme
 	}
 	tests := []struct {
 		name       string
@@ -67,6 +75,33 @@ func TestGPUConfig_AddDefaultsAndValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid placement strategy",
+			fields: fields{
+				GPUSharingConfig: GPUSharingConfig{
+					GPUSharingStrategy:     "time-sharing",
+					MaxSharedClientsPerGPU: 10,
+					PlacementStrategy:      "random",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "UUID device IDs",
+			fields: fields{
+				DeviceIDScheme: deviceid.UUID,
+			},
+			wantFields: fields{
+				DeviceIDScheme: deviceid.UUID,
+			},
+		},
+		{
+			name: "invalid device ID scheme",
+			fields: fields{
+				DeviceIDScheme: "index",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -74,6 +109,7 @@ func TestGPUConfig_AddDefaultsAndValidate(t *testing.T) {
 				GPUPartitionSize:           tt.fields.GPUPartitionSize,
 				MaxTimeSharedClientsPerGPU: tt.fields.MaxTimeSharedClientsPerGPU,
 				GPUSharingConfig:           tt.fields.GPUSharingConfig,
+				DeviceIDScheme:             tt.fields.DeviceIDScheme,
 			}
 			if err := config.AddDefaultsAndValidate(); (err != nil) != tt.wantErr {
 				t.Errorf("GPUConfig.AddDefaultsAndValidate() error = %v, wantErr %v", err, tt.wantErr)
@@ -82,6 +118,7 @@ func TestGPUConfig_AddDefaultsAndValidate(t *testing.T) {
 				GPUPartitionSize:           tt.wantFields.GPUPartitionSize,
 				MaxTimeSharedClientsPerGPU: tt.wantFields.MaxTimeSharedClientsPerGPU,
 				GPUSharingConfig:           tt.wantFields.GPUSharingConfig,
+				DeviceIDScheme:             tt.wantFields.DeviceIDScheme,
 			}
 			if !tt.wantErr && !reflect.DeepEqual(config, wantConfig) {
 				t.Errorf("GPUConfig was not defaulted correctly, got = %v, want = %v", config, wantConfig)
@@ -220,6 +257,632 @@ func Test_nvidiaGPUManager_Envs(t *testing.T) {
 	}
 }
 
+func Test_nvidiaGPUManager_AllocationEnvs(t *testing.T) {
+	testDevDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dev dir: %v", err)
+	}
+	defer os.RemoveAll(testDevDir)
+	for _, device := range []string{"nvidia0", "nvidia1", "nvidia2"} {
+		if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+			t.Fatalf("failed to create device node (%s): %v", device, err)
+		}
+	}
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+
+	allEnvs := AllocationEnvConfig{
+		VisibleDevices:  "NVIDIA_VISIBLE_DEVICES",
+		PhysicalIndex:   "GPU_PHYSICAL_INDEX",
+		SharingStrategy: "GPU_SHARING_STRATEGY",
+		ShareCount:      "GPU_SHARE_COUNT",
+	}
+	tests := []struct {
+		name      string
+		gpuConfig GPUConfig
+		deviceIDs []string
+		want      map[string]string
+	}{
+		{
+			name:      "no env configured",
+			deviceIDs: []string{"nvidia0"},
+			want:      map[string]string{},
+		},
+		{
+			name:      "GPUs in request order",
+			gpuConfig: GPUConfig{AllocationEnv: allEnvs},
+			deviceIDs: []string{"nvidia2", "nvidia0"},
+			want: map[string]string{
+				"NVIDIA_VISIBLE_DEVICES": "GPU-2,GPU-0",
+				"GPU_PHYSICAL_INDEX":     "2,0",
+				"GPU_SHARING_STRATEGY":   "none",
+			},
+		},
+		{
+			name: "shared GPUs",
+			gpuConfig: GPUConfig{
+				AllocationEnv: allEnvs,
+				GPUSharingConfig: GPUSharingConfig{
+					GPUSharingStrategy:     "mps",
+					MaxSharedClientsPerGPU: 4,
+				},
+			},
+			deviceIDs: []string{"nvidia1/vgpu0", "nvidia1/vgpu3"},
+			want: map[string]string{
+				"NVIDIA_VISIBLE_DEVICES": "GPU-1",
+				"GPU_PHYSICAL_INDEX":     "1",
+				"GPU_SHARING_STRATEGY":   "mps",
+				"GPU_SHARE_COUNT":        "2",
+			},
+		},
+		{
+			name:      "GPU partitions",
+			gpuConfig: GPUConfig{AllocationEnv: AllocationEnvConfig{VisibleDevices: "NVIDIA_VISIBLE_DEVICES", PhysicalIndex: "GPU_PHYSICAL_INDEX"}},
+			deviceIDs: []string{"nvidia0/gi1", "nvidia0/gi2"},
+			want: map[string]string{
+				"NVIDIA_VISIBLE_DEVICES": "MIG-0-0,MIG-0-1",
+				"GPU_PHYSICAL_INDEX":     "0",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ngm := &nvidiaGPUManager{gpuConfig: tt.gpuConfig}
+			got, err := ngm.AllocationEnvs(tt.deviceIDs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("nvidiaGPUManager.AllocationEnvs() (-want, +got) = %s", diff)
+			}
+		})
+	}
+}
+
+func TestAllocationEnvConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  AllocationEnvConfig
+		wantErr bool
+	}{
+		{
+			name:   "empty",
+			config: AllocationEnvConfig{},
+		},
+		{
+			name:   "valid names",
+			config: AllocationEnvConfig{VisibleDevices: "NVIDIA_VISIBLE_DEVICES", ShareCount: "GPU_SHARE_COUNT"},
+		},
+		{
+			name:    "invalid name",
+			config:  AllocationEnvConfig{PhysicalIndex: "GPU-INDEX"},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate name",
+			config:  AllocationEnvConfig{SharingStrategy: "GPU_SHARING", ShareCount: "GPU_SHARING"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("AllocationEnvConfig.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_nvidiaGPUManager_reconcileAllocations(t *testing.T) {
+	owner := allocation.Owner{Namespace: "default", Pod: "pod-a", Container: "main"}
+	defer func() { kubeletAssignments = allocation.KubeletAssignments }()
+	kubeletAssignments = func(string) (map[string]allocation.Owner, error) {
+		return map[string]allocation.Owner{"nvidia0/vgpu1": owner}, nil
+	}
+
+	ngm := NewNvidiaGPUManager("", "", nil, GPUConfig{})
+	ngm.reconcileAllocations()
+
+	got := ngm.ListAllocations()
+	if len(got) != 1 || got["nvidia0/vgpu1"].Owner != owner {
+		t.Errorf("unexpected allocations after reconciliation: %+v", got)
+	}
+}
+
+func Test_nvidiaGPUManager_hasGPUPartitionsChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migstatus")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name          string
+		partitionSize string
+		status        *migstatus.Status
+		want          bool
+	}{
+		{
+			name:          "no status file",
+			partitionSize: "1g.5gb",
+			want:          false,
+		},
+		{
+			name:          "same generation",
+			partitionSize: "1g.5gb",
+			status:        &migstatus.Status{State: migstatus.Ready, Generation: 2},
+			want:          false,
+		},
+		{
+			name:          "new generation, still reconfiguring",
+			partitionSize: "1g.5gb",
+			status:        &migstatus.Status{State: migstatus.Reconfiguring, Generation: 3},
+			want:          false,
+		},
+		{
+			name:          "new generation, ready",
+			partitionSize: "1g.5gb",
+			status:        &migstatus.Status{State: migstatus.Ready, Generation: 3},
+			want:          true,
+		},
+		{
+			name:   "GPUs not partitioned",
+			status: &migstatus.Status{State: migstatus.Ready, Generation: 3},
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statusFile := path.Join(dir, "partition_status.json")
+			os.Remove(statusFile)
+			if tt.status != nil {
+				if err := migstatus.Write(statusFile, tt.status); err != nil {
+					t.Fatalf("failed to write status file: %v", err)
+				}
+			}
+			ngm := &nvidiaGPUManager{
+				gpuConfig:     GPUConfig{GPUPartitionSize: tt.partitionSize},
+				migStatusFile: statusFile,
+				migGeneration: 2,
+			}
+			if got := ngm.hasGPUPartitionsChanged(); got != tt.want {
+				t.Errorf("nvidiaGPUManager.hasGPUPartitionsChanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_nvidiaGPUManager_checkDriverFeatures(t *testing.T) {
+	tests := []struct {
+		name          string
+		driverVersion string
+		gpuConfig     GPUConfig
+		wantErr       string
+	}{
+		{
+			name:          "no feature needs a driver version",
+			driverVersion: "",
+			gpuConfig:     GPUConfig{GPUSharingConfig: GPUSharingConfig{GPUSharingStrategy: "time-sharing"}},
+		},
+		{
+			name:          "MIG and MPS supported",
+			driverVersion: "535.230.02",
+			gpuConfig:     GPUConfig{GPUPartitionSize: "1g.5gb", GPUSharingConfig: GPUSharingConfig{GPUSharingStrategy: "mps"}},
+		},
+		{
+			name:          "MIG unsupported",
+			driverVersion: "440.118.02",
+			gpuConfig:     GPUConfig{GPUPartitionSize: "1g.5gb"},
+			wantErr:       "MIG needs NVIDIA driver R450 or later, the node has 440.118.02",
+		},
+		{
+			name:          "MPS unsupported",
+			driverVersion: "470.256.02",
+			gpuConfig:     GPUConfig{GPUSharingConfig: GPUSharingConfig{GPUSharingStrategy: "mps"}},
+			wantErr:       "MPS with memory limits needs NVIDIA driver R495 or later, the node has 470.256.02",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testProcDir := t.TempDir()
+			if tt.driverVersion != "" {
+				versionFile := path.Join(testProcDir, "driver/nvidia/version")
+				if err := os.MkdirAll(path.Dir(versionFile), 0755); err != nil {
+					t.Fatalf("failed to make dir: %v", err)
+				}
+				content := fmt.Sprintf("NVRM version: NVIDIA UNIX x86_64 Kernel Module  %s  Tue Jan 21 17:12:21 UTC 2025\n", tt.driverVersion)
+				if err := ioutil.WriteFile(versionFile, []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write driver version file: %v", err)
+				}
+			}
+			ngm := &nvidiaGPUManager{procDirectory: testProcDir, gpuConfig: tt.gpuConfig}
+			err := ngm.checkDriverFeatures()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("nvidiaGPUManager.checkDriverFeatures() returned unexpected error %v", err)
+				}
+				return
+			}
+			var unsupported *driver.UnsupportedError
+			if !errors.As(err, &unsupported) || err.Error() != tt.wantErr {
+				t.Errorf("nvidiaGPUManager.checkDriverFeatures() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// createMigCapabilities creates the MIG capability files, relative to
+// driver/nvidia/capabilities, with their device minors, along with the
+// nvidia-caps device nodes of the minors.
+func createMigCapabilities(t *testing.T, devDir, procDir string, capToMinor map[string]int) {
+	t.Helper()
+	if err := os.MkdirAll(path.Join(devDir, "nvidia-caps"), 0755); err != nil {
+		t.Fatalf("failed to create capabilities device dir: %v", err)
+	}
+	for file, minor := range capToMinor {
+		capFile := path.Join(procDir, "driver/nvidia/capabilities", file)
+		if err := os.MkdirAll(path.Dir(capFile), 0755); err != nil {
+			t.Fatalf("failed to create capabilities dir: %v", err)
+		}
+		if err := ioutil.WriteFile(capFile, []byte(fmt.Sprintf("DeviceFileMinor: %d\n", minor)), 0644); err != nil {
+			t.Fatalf("failed to create capabilities file: %v", err)
+		}
+		if _, err := os.Create(path.Join(devDir, "nvidia-caps", fmt.Sprintf("nvidia-cap%d", minor))); err != nil {
+			t.Fatalf("failed to create device node: %v", err)
+		}
+	}
+}
+
+// partitionGPU creates the capabilities of a GPU with a single 7g.40gb
+// partition, whose GPU and compute instances have the device minors minor and
+// minor+1.
+func partitionGPU(t *testing.T, devDir, procDir string, gpu, minor int) {
+	t.Helper()
+	createMigCapabilities(t, devDir, procDir, map[string]int{
+		fmt.Sprintf("gpu%d/mig/gi1/access", gpu):     minor,
+		fmt.Sprintf("gpu%d/mig/gi1/ci0/access", gpu): minor + 1,
+	})
+}
+
+func Test_nvidiaGPUManager_updateGPUPartitions(t *testing.T) {
+	testDevDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dev dir: %v", err)
+	}
+	defer os.RemoveAll(testDevDir)
+	testProcDir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("failed to create temp proc dir: %v", err)
+	}
+	defer os.RemoveAll(testProcDir)
+
+	for _, device := range []string{"nvidia0", "nvidia1"} {
+		if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+			t.Fatalf("failed to create device node (%s): %v", device, err)
+		}
+	}
+	partitionGPU(t, testDevDir, testProcDir, 0, 10)
+
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{}
+	ngm := NewNvidiaGPUManager(testDevDir, testProcDir, nil, GPUConfig{GPUPartitionSize: "7g.40gb"})
+	ngm.SetTolerateMisconfiguredGPUs(true)
+	if err := ngm.startMigDeviceManager(); err != nil {
+		t.Fatalf("failed to start MIG device manager: %v", err)
+	}
+	if _, ok := ngm.ListPhysicalDevices()["nvidia0/gi1"]; !ok {
+		t.Errorf("partition of the partitioned GPU is not advertised: %v", ngm.ListPhysicalDevices())
+	}
+	ngm.SetDeviceHealth("nvidia0/gi1", pluginapi.Unhealthy, nil)
+	var refreshed map[string]pluginapi.Device
+	ngm.SetDevicesRefreshedHandler(func(devices map[string]pluginapi.Device) { refreshed = devices })
+
+	if ngm.updateGPUPartitions() {
+		t.Errorf("updateGPUPartitions() = true without changes, want false")
+	}
+	if got := ngm.ListPhysicalDevices()["nvidia0/gi1"].Health; got != pluginapi.Unhealthy {
+		t.Errorf("health of nvidia0/gi1 after rediscovery = %s, want %s", got, pluginapi.Unhealthy)
+	}
+
+	partitionGPU(t, testDevDir, testProcDir, 1, 20)
+	if !ngm.updateGPUPartitions() {
+		t.Errorf("updateGPUPartitions() = false after the GPU was partitioned, want true")
+	}
+	if len(ngm.ListPhysicalDevices()) != 2 {
+		t.Errorf("GPU partitions after recovery = %v, want 2 partitions", ngm.ListPhysicalDevices())
+	}
+	if diff := cmp.Diff(ngm.ListPhysicalDevices(), refreshed); diff != "" {
+		t.Errorf("devices passed to the devices refreshed handler (-want, +got) = %s", diff)
+	}
+	select {
+	case <-ngm.devicesChanged:
+	default:
+		t.Errorf("devices changed without notifying ListAndWatch")
+	}
+	if ngm.updateGPUPartitions() {
+		t.Errorf("updateGPUPartitions() = true after all GPUs recovered, want false")
+	}
+
+	// Destroying the partition of a GPU is picked up without restarting the server.
+	if err := os.RemoveAll(path.Join(testProcDir, "driver/nvidia/capabilities/gpu1")); err != nil {
+		t.Fatalf("failed to remove capabilities dir: %v", err)
+	}
+	if !ngm.shouldRediscoverGPUPartitions() {
+		t.Errorf("shouldRediscoverGPUPartitions() = false after a GPU partition was destroyed, want true")
+	}
+	if !ngm.updateGPUPartitions() {
+		t.Errorf("updateGPUPartitions() = false after a GPU partition was destroyed, want true")
+	}
+	if _, ok := ngm.ListPhysicalDevices()["nvidia1/gi1"]; ok {
+		t.Errorf("destroyed GPU partition nvidia1/gi1 is still advertised: %v", ngm.ListPhysicalDevices())
+	}
+}
+
+func Test_nvidiaGPUManager_updateGPUPartitionsConcurrently(t *testing.T) {
+	testDevDir := t.TempDir()
+	testProcDir := t.TempDir()
+	for gpu := 0; gpu < 2; gpu++ {
+		if _, err := os.Create(path.Join(testDevDir, fmt.Sprintf("nvidia%d", gpu))); err != nil {
+			t.Fatalf("failed to create device node: %v", err)
+		}
+		partitionGPU(t, testDevDir, testProcDir, gpu, 10*(gpu+1))
+	}
+
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{}
+	ngm := NewNvidiaGPUManager(testDevDir, testProcDir, nil, GPUConfig{GPUPartitionSize: "7g.40gb"})
+	ngm.SetTolerateMisconfiguredGPUs(true)
+	if err := ngm.startMigDeviceManager(); err != nil {
+		t.Fatalf("failed to start MIG device manager: %v", err)
+	}
+
+	// Rediscovery runs on the health check goroutine while the kubelet lists
+	// and allocates devices; run with -race to catch unguarded accesses.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			ngm.updateGPUPartitions()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if got := len(ngm.ListDevices()); got != 2 {
+				t.Errorf("ListDevices() after rediscovery returned %d devices, want 2", got)
+			}
+			return
+		default:
+		}
+		for id := range ngm.ListDevices() {
+			if _, err := ngm.DeviceSpec(id); err != nil {
+				t.Errorf("DeviceSpec(%s) failed during rediscovery: %v", id, err)
+			}
+		}
+		ngm.SetDeviceHealth("nvidia0/gi1", pluginapi.Healthy, nil)
+	}
+}
+
+func Test_nvidiaGPUManager_checkGPUs(t *testing.T) {
+	cases := []struct {
+		name        string
+		removeNodes []string
+		lostIndices []int
+		wantHealth  map[string]string
+	}{
+		{
+			name: "no lost GPUs",
+			wantHealth: map[string]string{
+				"nvidia0": pluginapi.Healthy,
+				"nvidia1": pluginapi.Healthy,
+				"nvidia2": pluginapi.Healthy,
+			},
+		},
+		{
+			name:        "device node removed",
+			removeNodes: []string{"nvidia1"},
+			wantHealth: map[string]string{
+				"nvidia0": pluginapi.Healthy,
+				"nvidia1": pluginapi.Unhealthy,
+				"nvidia2": pluginapi.Healthy,
+			},
+		},
+		{
+			name:        "GPU fell off the bus",
+			lostIndices: []int{2},
+			wantHealth: map[string]string{
+				"nvidia0": pluginapi.Healthy,
+				"nvidia1": pluginapi.Healthy,
+				"nvidia2": pluginapi.Unhealthy,
+			},
+		},
+		{
+			name:        "device node removed and GPU fell off the bus",
+			removeNodes: []string{"nvidia0"},
+			lostIndices: []int{0, 1},
+			wantHealth: map[string]string{
+				"nvidia0": pluginapi.Unhealthy,
+				"nvidia1": pluginapi.Unhealthy,
+				"nvidia2": pluginapi.Healthy,
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testDevDir, err := ioutil.TempDir("", "dev")
+			if err != nil {
+				t.Fatalf("failed to create temp dev dir: %v", err)
+			}
+			defer os.RemoveAll(testDevDir)
+			for _, device := range []string{"nvidia0", "nvidia1", "nvidia2"} {
+				if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+					t.Fatalf("failed to create device node (%s): %v", device, err)
+				}
+			}
+
+			mockInfo := &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+			nvmlutil.NvmlDeviceInfo = mockInfo
+			ngm := NewNvidiaGPUManager(testDevDir, "", nil, GPUConfig{})
+			if err := ngm.discoverGPUs(); err != nil {
+				t.Fatalf("failed to discover GPUs: %v", err)
+			}
+
+			for _, device := range tc.removeNodes {
+				if err := os.Remove(path.Join(testDevDir, device)); err != nil {
+					t.Fatalf("failed to remove device node (%s): %v", device, err)
+				}
+			}
+			mockInfo.LostDevices = make(map[int]bool)
+			for _, i := range tc.lostIndices {
+				mockInfo.LostDevices[i] = true
+			}
+
+			wantChanged := len(tc.removeNodes) > 0 || len(tc.lostIndices) > 0
+			if got := ngm.checkGPUs(); got != wantChanged {
+				t.Errorf("checkGPUs() = %v, want %v", got, wantChanged)
+			}
+			gotHealth := make(map[string]string)
+			for id, d := range ngm.ListPhysicalDevices() {
+				gotHealth[id] = d.Health
+			}
+			if diff := cmp.Diff(tc.wantHealth, gotHealth); diff != "" {
+				t.Errorf("device health after checkGPUs() (-want +got):\n%s", diff)
+			}
+			select {
+			case <-ngm.devicesChanged:
+				if !wantChanged {
+					t.Errorf("ListAndWatch was notified without changes")
+				}
+			default:
+				if wantChanged {
+					t.Errorf("ListAndWatch was not notified of lost GPUs")
+				}
+			}
+
+			// The lost GPUs come back.
+			for _, device := range tc.removeNodes {
+				if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+					t.Fatalf("failed to create device node (%s): %v", device, err)
+				}
+			}
+			mockInfo.LostDevices = nil
+			if got := ngm.checkGPUs(); got != wantChanged {
+				t.Errorf("checkGPUs() after the GPUs came back = %v, want %v", got, wantChanged)
+			}
+			for id, d := range ngm.ListPhysicalDevices() {
+				if d.Health != pluginapi.Healthy {
+					t.Errorf("health of %s after the GPUs came back = %s, want %s", id, d.Health, pluginapi.Healthy)
+				}
+			}
+		})
+	}
+}
+
+func Test_nvidiaGPUManager_checkGPUsConcurrently(t *testing.T) {
+	testDevDir := t.TempDir()
+	for _, device := range []string{"nvidia0", "nvidia1", "nvidia2"} {
+		if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+			t.Fatalf("failed to create device node (%s): %v", device, err)
+		}
+	}
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+	ngm := NewNvidiaGPUManager(testDevDir, "", nil, GPUConfig{})
+	ngm.EnableCDI(t.TempDir(), "")
+	if err := ngm.discoverGPUs(); err != nil {
+		t.Fatalf("failed to discover GPUs: %v", err)
+	}
+	ngm.refreshDevices()
+
+	// Lost GPUs are marked unhealthy, and the device UUIDs and CDI spec are
+	// updated, on the health check goroutine while the kubelet lists and
+	// allocates devices; run with -race to catch unguarded accesses.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if i%2 == 0 {
+				os.Remove(path.Join(testDevDir, "nvidia1"))
+			} else {
+				os.Create(path.Join(testDevDir, "nvidia1"))
+			}
+			ngm.checkGPUs()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			for id, d := range ngm.ListDevices() {
+				if d.Health != pluginapi.Healthy {
+					t.Errorf("health of %s after the GPU came back = %s, want %s", id, d.Health, pluginapi.Healthy)
+				}
+			}
+			return
+		default:
+		}
+		for id := range ngm.ListDevices() {
+			// nvidia1 may be unhealthy, which fails the allocation.
+			if _, err := ngm.DeviceSpec(id); err != nil && !strings.Contains(err.Error(), "unhealthy") {
+				t.Errorf("DeviceSpec(%s) failed while GPUs were checked: %v", id, err)
+			}
+			if _, err := ngm.CDIDevice(id); err != nil && !strings.Contains(err.Error(), "unhealthy") {
+				t.Errorf("CDIDevice(%s) failed while GPUs were checked: %v", id, err)
+			}
+		}
+	}
+}
+
+func Test_nvidiaGPUManager_checkLostGPUsWithPartitions(t *testing.T) {
+	testDevDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dev dir: %v", err)
+	}
+	defer os.RemoveAll(testDevDir)
+	testProcDir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("failed to create temp proc dir: %v", err)
+	}
+	defer os.RemoveAll(testProcDir)
+
+	for gpu := 0; gpu < 2; gpu++ {
+		if _, err := os.Create(path.Join(testDevDir, fmt.Sprintf("nvidia%d", gpu))); err != nil {
+			t.Fatalf("failed to create device node: %v", err)
+		}
+		partitionGPU(t, testDevDir, testProcDir, gpu, 10*gpu)
+	}
+
+	mockInfo := &nvmlutil.MockDeviceInfo{TestDevDir: testDevDir}
+	nvmlutil.NvmlDeviceInfo = mockInfo
+	ngm := NewNvidiaGPUManager(testDevDir, testProcDir, nil, GPUConfig{GPUPartitionSize: "7g.40gb"})
+	if err := ngm.discoverGPUs(); err != nil {
+		t.Fatalf("failed to discover GPUs: %v", err)
+	}
+	if err := ngm.startMigDeviceManager(); err != nil {
+		t.Fatalf("failed to start MIG device manager: %v", err)
+	}
+
+	mockInfo.LostDevices = map[int]bool{1: true}
+	if !ngm.checkLostGPUs() {
+		t.Errorf("checkLostGPUs() = false after nvidia1 fell off the bus, want true")
+	}
+	wantHealth := map[string]string{
+		"nvidia0/gi1": pluginapi.Healthy,
+		"nvidia1/gi1": pluginapi.Unhealthy,
+	}
+	gotHealth := make(map[string]string)
+	for id, d := range ngm.ListPhysicalDevices() {
+		gotHealth[id] = d.Health
+	}
+	if diff := cmp.Diff(wantHealth, gotHealth); diff != "" {
+		t.Errorf("partition health after nvidia1 fell off the bus (-want +got):\n%s", diff)
+	}
+
+	// Rediscovering the partitions keeps the partitions of the lost GPU
+	// unhealthy until checkLostGPUs sees it back. The mock stops reporting the
+	// GPU as lost, as NVML errors can't be formatted without the NVML library.
+	mockInfo.LostDevices = nil
+	ngm.updateGPUPartitions()
+	if got := ngm.ListPhysicalDevices()["nvidia1/gi1"].Health; got != pluginapi.Unhealthy {
+		t.Errorf("health of nvidia1/gi1 after rediscovery = %s, want %s", got, pluginapi.Unhealthy)
+	}
+}
+
 func Test_topology(t *testing.T) {
 	testDevDir, err := ioutil.TempDir("", "pci")
 	defer os.RemoveAll(testDevDir)
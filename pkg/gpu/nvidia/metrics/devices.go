@@ -17,6 +17,7 @@ package metrics
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"regexp"
 	"time"
@@ -24,7 +25,7 @@ import (
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/gpusharing"
-	"github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 	"google.golang.org/grpc"
 	podresources "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
 )
@@ -37,6 +38,9 @@ var (
 	connectionTimeout = 10 * time.Second
 
 	gpuDevices map[string]*nvml.Device
+	// gpuDevicesByUUID indexes the same devices by UUID, for device plugins that
+	// advertise UUID based device IDs.
+	gpuDevicesByUUID map[string]*nvml.Device
 )
 
 // ContainerID uniquely identifies a container.
@@ -59,7 +63,7 @@ func GetDevicesForAllContainers() (map[ContainerID][]string, error) {
 	defer func() {
 		err := conn.Close()
 		if err != nil {
-			glog.Warningf("Failed to close grpc connection to kubelet PodResourceLister endpoint: %v", err)
+			slog.Warn("Failed to close grpc connection to kubelet PodResourceLister endpoint", logging.Error, err)
 		}
 	}()
 
@@ -111,8 +115,9 @@ func DiscoverGPUDevices() error {
 		return fmt.Errorf("failed to get device count: %s", nvml.ErrorString(ret))
 	}
 
-	glog.Infof("Found %d GPU devices", count)
+	slog.Info("Found GPU devices", "count", count)
 	gpuDevices = make(map[string]*nvml.Device)
+	gpuDevicesByUUID = make(map[string]*nvml.Device)
 	for i := int(0); i < count; i++ {
 		device, ret := nvml.DeviceGetHandleByIndex(i)
 		if ret != nvml.SUCCESS {
@@ -120,11 +125,15 @@ func DiscoverGPUDevices() error {
 		}
 		minor, ret := device.GetMinorNumber()
 		if ret != nvml.SUCCESS {
-			glog.Errorf("Invalid GPU device minor number found. Skipping this device")
+			slog.Error("Invalid GPU device minor number found, skipping this device", "index", i)
+			continue
 		}
 		deviceName := fmt.Sprintf("nvidia%d", minor)
-		glog.Infof("Found device %s for metrics collection", deviceName)
+		slog.Info("Found device for metrics collection", logging.DeviceID, deviceName)
 		gpuDevices[deviceName] = &device
+		if uuid, ret := device.GetUUID(); ret == nvml.SUCCESS {
+			gpuDevicesByUUID[uuid] = &device
+		}
 	}
 	return nil
 }
@@ -132,6 +141,9 @@ func DiscoverGPUDevices() error {
 // DeviceFromName returns the device object for a given device name.
 func DeviceFromName(deviceName string) (*nvml.Device, error) {
 	device, ok := gpuDevices[deviceName]
+	if !ok {
+		device, ok = gpuDevicesByUUID[deviceName]
+	}
 	if !ok {
 		return &nvml.Device{}, fmt.Errorf("device %s not found", deviceName)
 	}
@@ -16,11 +16,13 @@ package metrics
 
 import (
 	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/driver"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
-	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -135,15 +137,15 @@ func NewMetricServer(collectionInterval, port int, metricsEndpointPath string) *
 
 // Start performs necessary initializations and starts the metric server.
 func (m *MetricServer) Start() error {
-	glog.Infoln("Starting metrics server")
+	slog.Info("Starting metrics server")
 
-	driverVersion, ret := nvml.SystemGetDriverVersion()
-	if ret != nvml.SUCCESS {
-		return fmt.Errorf("failed to query nvml: %v", nvml.ErrorString(ret))
+	driverVersion, err := driver.FromNVML()
+	if err != nil {
+		return fmt.Errorf("failed to query nvml: %v", err)
 	}
-	glog.Infof("nvml initialized successfully. Driver version: %s", driverVersion)
+	slog.Info("NVML initialized", "driver_version", driverVersion.String())
 
-	err := DiscoverGPUDevices()
+	err = DiscoverGPUDevices()
 	if err != nil {
 		return fmt.Errorf("failed to discover GPU devices: %v", err)
 	}
@@ -152,7 +154,7 @@ func (m *MetricServer) Start() error {
 		http.Handle(m.metricsEndpointPath, promhttp.Handler())
 		err := http.ListenAndServe(fmt.Sprintf(":%d", m.port), nil)
 		if err != nil {
-			glog.Infof("Failed to start metric server: %v", err)
+			slog.Error("Failed to start metrics server", logging.Error, err)
 		}
 	}()
 
@@ -170,7 +172,7 @@ func (m *MetricServer) collectMetrics() {
 		case <-t.C:
 			devices, err := GetDevicesForAllContainers()
 			if err != nil {
-				glog.Errorf("Failed to get devices for containers: %v", err)
+				slog.Error("Failed to get devices for containers", logging.Error, err)
 				continue
 			}
 			gpuDevices := GetAllGpuDevices()
@@ -212,12 +214,12 @@ func (m *MetricServer) updateMetrics(containerDevices map[ContainerID][]string,
 		for _, device := range devices {
 			d, err := gmc.collectGPUDevice(device)
 			if err != nil {
-				glog.Errorf("Failed to get device for %s: %v", device, err)
+				slog.Error("Failed to get device", logging.DeviceID, device, logging.Error, err)
 				continue
 			}
 			mi, err := gmc.collectGpuMetricsInfo(device, d)
 			if err != nil {
-				glog.Infof("Error calculating duty cycle for device: %s: %v. Skipping this device", device, err)
+				slog.Warn("Failed to calculate duty cycle, skipping this device", logging.DeviceID, device, logging.Error, err)
 				continue
 			}
 			DutyCycle.WithLabelValues(container.namespace, container.pod, container.container, "nvidia", mi.uuid, mi.deviceModel).Set(float64(mi.dutyCycle))
@@ -228,7 +230,7 @@ func (m *MetricServer) updateMetrics(containerDevices map[ContainerID][]string,
 	for device, d := range gpuDevices {
 		mi, err := gmc.collectGpuMetricsInfo(device, d)
 		if err != nil {
-			glog.Infof("Error calculating duty cycle for device: %s: %v. Skipping this device", device, err)
+			slog.Warn("Failed to calculate duty cycle, skipping this device", logging.DeviceID, device, logging.Error, err)
 			continue
 		}
 
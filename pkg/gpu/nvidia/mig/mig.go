@@ -17,87 +17,93 @@ package mig
 import (
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"reflect"
 	"regexp"
 	"strconv"
+	"sync"
 
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
 	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/nvmlutil"
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/logging"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
-	"github.com/golang/glog"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 const nvidiaDeviceRE = `^nvidia[0-9]*$`
 
-// Max number of GPU partitions that can be created for each partition size.
-// Source: https://docs.nvidia.com/datacenter/tesla/mig-user-guide/#partitioning
 var (
-	gpuPartitionSizeMaxCount = map[string]int{
-		//nvidia-tesla-a100
-		"1g.5gb":  7,
-		"2g.10gb": 3,
-		"3g.20gb": 2,
-		"7g.40gb": 1,
-		//nvidia-a100-80gb, nvidia-h100-80gb
-		"1g.10gb": 7,
-		"2g.20gb": 3,
-		"3g.40gb": 2,
-		"7g.80gb": 1,
-		//nvidia-h100-80gb
-		"1g.20gb": 4,
-		//nvidia-h200-141gb
-		"1g.18gb":  7,
-		"1g.35gb":  4,
-		"2g.35gb":  3,
-		"3g.71gb":  2,
-		"4g.71gb":  1,
-		"7g.141gb": 1,
-		//nvidia-b200, nvidia-gb200
-		"1g.23gb": 7,
-		//nvidia-b200
-		"1g.45gb":  4,
-		"2g.45gb":  3,
-		"3g.90gb":  2,
-		"4g.90gb":  1,
-		"7g.180gb": 1,
-		//nvidia-gb200
-		"1g.47gb":  4,
-		"2g.47gb":  3,
-		"3g.93gb":  2,
-		"4g.93gb":  1,
-		"7g.186gb": 1,
-	}
-	pciDevicesRoot = "/sys/bus/pci/devices"
+	pciDevicesRoot    = "/sys/bus/pci/devices"
+	deviceMinorRegexp = regexp.MustCompile("DeviceFileMinor: ([0-9]+)")
 )
 
-// DeviceManager performs various management operations on mig devices.
+// DeviceManager performs various management operations on mig devices. It is
+// safe for concurrent use: Start swaps in the rediscovered partitions, so
+// partitions can be listed and allocated while they are rediscovered.
 type DeviceManager struct {
-	devDirectory      string
-	procDirectory     string
+	devDirectory  string
+	procDirectory string
+	// mu guards the partitions, their specs and problems.
+	mu                sync.RWMutex
 	gpuPartitionSpecs map[string][]pluginapi.DeviceSpec
 	gpuPartitions     map[string]pluginapi.Device
+	// tolerateMisconfiguredGPUs makes Start advertise the GPUs that are
+	// partitioned as expected when others are not, see TolerateMisconfiguredGPUs.
+	tolerateMisconfiguredGPUs bool
+	// problems holds why GPUs are not partitioned as expected, keyed by GPU
+	// device name, e.g. nvidia0.
+	problems map[string]string
+	// layout holds the capability directories of the GPU partitions found by
+	// the last Start, see HasLayoutChanged.
+	layout []string
 }
 
 // NewDeviceManager creates a new DeviceManager to handle MIG devices on the node.
-func NewDeviceManager(devDirectory, procDirectory string) DeviceManager {
-	return DeviceManager{
+func NewDeviceManager(devDirectory, procDirectory string) *DeviceManager {
+	return &DeviceManager{
 		devDirectory:      devDirectory,
 		procDirectory:     procDirectory,
 		gpuPartitionSpecs: make(map[string][]pluginapi.DeviceSpec),
 		gpuPartitions:     make(map[string]pluginapi.Device),
+		problems:          make(map[string]string),
 	}
 }
 
+// TolerateMisconfiguredGPUs makes Start succeed when some GPUs are not
+// partitioned as expected. The partitions of GPUs with an unexpected number of
+// partitions are advertised as unhealthy, GPUs whose partitions can't be
+// discovered or that aren't partitioned are left out, and the reasons are
+// returned by Problems.
+func (d *DeviceManager) TolerateMisconfiguredGPUs(tolerate bool) {
+	d.tolerateMisconfiguredGPUs = tolerate
+}
+
+// Problems returns why GPUs were not partitioned as expected on the last Start,
+// keyed by GPU device name, e.g. nvidia0. It is only set when misconfigured GPUs
+// are tolerated.
+func (d *DeviceManager) Problems() map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return maps.Clone(d.problems)
+}
+
 // ListGPUPartitionDevices lists all the GPU partitions as devices that can be advertised as
 // resources available on the node.
+// The returned map is a copy.
 func (d *DeviceManager) ListGPUPartitionDevices() map[string]pluginapi.Device {
-	return d.gpuPartitions
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return maps.Clone(d.gpuPartitions)
 }
 
 // DeviceSpec returns the device spec that inclues list of devices to allocate for a deviceID.
 func (d *DeviceManager) DeviceSpec(deviceID string) ([]pluginapi.DeviceSpec, error) {
+	d.mu.RLock()
 	deviceSpecs, ok := d.gpuPartitionSpecs[deviceID]
+	d.mu.RUnlock()
 	if !ok {
 		return []pluginapi.DeviceSpec{}, fmt.Errorf("invalid allocation request with non-existing GPU partition: %s", deviceID)
 	}
@@ -111,12 +117,17 @@ func (d *DeviceManager) Start(partitionSize string) error {
 		return nil
 	}
 
-	maxPartitionCount, ok := gpuPartitionSizeMaxCount[partitionSize]
-	if !ok {
-		return fmt.Errorf("%s is not a valid GPU partition size", partitionSize)
-	}
-
-	d.gpuPartitionSpecs = make(map[string][]pluginapi.DeviceSpec)
+	gpuPartitionSpecs := make(map[string][]pluginapi.DeviceSpec)
+	gpuPartitions := make(map[string]pluginapi.Device)
+	problems := make(map[string]string)
+	layout := d.capabilityDirs()
+	// The partitions discovered before an error are swapped in too, as they
+	// are still advertised when the error is only logged.
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.gpuPartitionSpecs, d.gpuPartitions, d.problems, d.layout = gpuPartitionSpecs, gpuPartitions, problems, layout
+	}()
 
 	nvidiaCapDir := path.Join(d.procDirectory, "driver/nvidia/capabilities")
 	capFiles, err := ioutil.ReadDir(nvidiaCapDir)
@@ -125,10 +136,7 @@ func (d *DeviceManager) Start(partitionSize string) error {
 	}
 
 	gpuFileRegexp := regexp.MustCompile("gpu([0-9]+)")
-	giFileRegexp := regexp.MustCompile("gi([0-9]+)")
-	deviceRegexp := regexp.MustCompile("DeviceFileMinor: ([0-9]+)")
-
-	numPartitionedGPUs := 0
+	partitionedGPUs := make(map[string]bool)
 
 	for _, capFile := range capFiles {
 		m := gpuFileRegexp.FindStringSubmatch(capFile.Name())
@@ -138,70 +146,129 @@ func (d *DeviceManager) Start(partitionSize string) error {
 		}
 
 		gpuID := m[1]
-		numPartitionedGPUs++
+		partitionedGPUs["nvidia"+gpuID] = true
 
-		giBasePath := path.Join(nvidiaCapDir, capFile.Name(), "mig")
-		giFiles, err := ioutil.ReadDir(giBasePath)
+		partitions, specs, err := d.discoverGPUPartitions(path.Join(nvidiaCapDir, capFile.Name()), gpuID, partitionSize)
+		if err != nil && !d.tolerateMisconfiguredGPUs {
+			return err
+		}
 		if err != nil {
-			return fmt.Errorf("failed to read GPU instance capabilities dir (%s): %v", giBasePath, err)
+			slog.Error("GPU is not partitioned as expected, its partitions are not advertised as healthy", logging.DeviceID, "nvidia"+gpuID, logging.Error, err)
+			problems["nvidia"+gpuID] = err.Error()
 		}
-
-		numPartitions := 0
-		for _, giFile := range giFiles {
-			if !giFileRegexp.MatchString(giFile.Name()) {
-				continue
+		for id, partition := range partitions {
+			if err != nil {
+				partition.Health = pluginapi.Unhealthy
 			}
+			gpuPartitions[id] = partition
+			gpuPartitionSpecs[id] = specs[id]
+		}
+	}
 
-			numPartitions++
+	gpus, err := d.discoverGPUs()
+	if err != nil {
+		return err
+	}
+	if len(partitionedGPUs) == len(gpus) {
+		return nil
+	}
+	if !d.tolerateMisconfiguredGPUs {
+		return fmt.Errorf("Not all GPUs are partitioned as expected. Total number of GPUs: %d, number of partitioned GPUs: %d", len(gpus), len(partitionedGPUs))
+	}
+	for _, gpu := range gpus {
+		if !partitionedGPUs[gpu] {
+			slog.Error("GPU is not partitioned", logging.DeviceID, gpu)
+			problems[gpu] = "GPU is not partitioned"
+		}
+	}
+	return nil
+}
 
-			gpuInstanceID := "nvidia" + gpuID + "/" + giFile.Name()
-			giAccessFile := path.Join(giBasePath, giFile.Name(), "access")
-			content, err := ioutil.ReadFile(giAccessFile)
-			if err != nil {
-				return fmt.Errorf("failed to read GPU Instance access file (%s): %v", giAccessFile, err)
-			}
+// discoverGPUPartitions discovers the partitions of a GPU from its capabilities
+// directory. If the GPU doesn't have the expected number of partitions, the
+// partitions are returned along with an error.
+func (d *DeviceManager) discoverGPUPartitions(gpuCapDir, gpuID, partitionSize string) (map[string]pluginapi.Device, map[string][]pluginapi.DeviceSpec, error) {
+	giFileRegexp := regexp.MustCompile("gi([0-9]+)")
+	ciFileRegexp := regexp.MustCompile("^ci([0-9]+)$")
+	partitions := make(map[string]pluginapi.Device)
+	specs := make(map[string][]pluginapi.DeviceSpec)
 
-			m := deviceRegexp.FindStringSubmatch(string(content))
-			if len(m) != 2 {
-				return fmt.Errorf("unexpected contents in GPU instance access file(%s): %v", giAccessFile, err)
-			}
-			giMinorDevice, err := strconv.Atoi(m[1])
-			if err != nil {
-				return fmt.Errorf("failed to find minor device from GPU instance access file(%s): %v", giAccessFile, err)
-			}
+	profile, err := d.partitionProfile(gpuID, partitionSize)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			ciAccessFile := path.Join(giBasePath, giFile.Name(), "ci0", "access")
-			content, err = ioutil.ReadFile(ciAccessFile)
-			if err != nil {
-				return fmt.Errorf("unable to read Compute Instance access file (%s): %v", ciAccessFile, err)
-			}
+	giBasePath := path.Join(gpuCapDir, "mig")
+	giFiles, err := ioutil.ReadDir(giBasePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read GPU instance capabilities dir (%s): %v", giBasePath, err)
+	}
 
-			m = deviceRegexp.FindStringSubmatch(string(content))
-			if len(m) != 2 {
-				return fmt.Errorf("unexpected contents in compute instance access file(%s): %v", ciAccessFile, err)
-			}
-			ciMinorDevice, err := strconv.Atoi(m[1])
-			if err != nil {
-				return fmt.Errorf("failed to find minor device from compute instance access file(%s): %v", ciAccessFile, err)
-			}
+	numPartitions := 0
+	for _, giFile := range giFiles {
+		if !giFileRegexp.MatchString(giFile.Name()) {
+			continue
+		}
+
+		numPartitions++
+
+		giPath := path.Join(giBasePath, giFile.Name())
+		giMinorDevice, err := capabilityMinor(path.Join(giPath, "access"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find minor device of GPU instance: %v", err)
+		}
+
+		gpuDevice := path.Join(d.devDirectory, "nvidia"+gpuID)
+		if _, err := os.Stat(gpuDevice); err != nil {
+			return nil, nil, fmt.Errorf("GPU device (%s) not fount: %v", gpuDevice, err)
+		}
+
+		giDevice := path.Join(d.devDirectory, "nvidia-caps", "nvidia-cap"+strconv.Itoa(giMinorDevice))
+		if _, err := os.Stat(giDevice); err != nil {
+			return nil, nil, fmt.Errorf("GPU instance device (%s) not fount: %v", giDevice, err)
+		}
 
-			gpuDevice := path.Join(d.devDirectory, "nvidia"+gpuID)
-			if _, err := os.Stat(gpuDevice); err != nil {
-				return fmt.Errorf("GPU device (%s) not fount: %v", gpuDevice, err)
+		ciFiles, err := ioutil.ReadDir(giPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read compute instance capabilities dir (%s): %v", giPath, err)
+		}
+		var computeInstances []string
+		for _, ciFile := range ciFiles {
+			if ciFileRegexp.MatchString(ciFile.Name()) {
+				computeInstances = append(computeInstances, ciFile.Name())
 			}
+		}
+		if len(computeInstances) == 0 {
+			return nil, nil, fmt.Errorf("no compute instance found in GPU instance (%s)", giPath)
+		}
 
-			giDevice := path.Join(d.devDirectory, "nvidia-caps", "nvidia-cap"+strconv.Itoa(giMinorDevice))
-			if _, err := os.Stat(giDevice); err != nil {
-				return fmt.Errorf("GPU instance device (%s) not fount: %v", giDevice, err)
+		topologyInfo, err := d.topology(gpuID)
+		if err != nil {
+			slog.Error("Unable to get GPU topology", logging.DeviceID, "nvidia"+gpuID, logging.Error, err)
+		}
+
+		// A GPU instance with a single compute instance is advertised as
+		// nvidia<gpu>/gi<gi>. A GPU instance split into several compute
+		// instances is shared, and each compute instance is advertised as
+		// nvidia<gpu>/gi<gi>/ci<ci>.
+		for _, ciName := range computeInstances {
+			ciMinorDevice, err := capabilityMinor(path.Join(giPath, ciName, "access"))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to find minor device of compute instance: %v", err)
 			}
 
 			ciDevice := path.Join(d.devDirectory, "nvidia-caps", "nvidia-cap"+strconv.Itoa(ciMinorDevice))
 			if _, err := os.Stat(ciDevice); err != nil {
-				return fmt.Errorf("Compute instance device (%s) not fount: %v", ciDevice, err)
+				return nil, nil, fmt.Errorf("Compute instance device (%s) not fount: %v", ciDevice, err)
 			}
 
-			glog.Infof("Discovered GPU partition: %s", gpuInstanceID)
-			d.gpuPartitionSpecs[gpuInstanceID] = []pluginapi.DeviceSpec{
+			partitionID := "nvidia" + gpuID + "/" + giFile.Name()
+			if len(computeInstances) > 1 {
+				partitionID += "/" + ciName
+			}
+
+			slog.Info("Discovered GPU partition", logging.DeviceID, partitionID)
+			specs[partitionID] = []pluginapi.DeviceSpec{
 				{
 					ContainerPath: gpuDevice,
 					HostPath:      gpuDevice,
@@ -218,42 +285,115 @@ func (d *DeviceManager) Start(partitionSize string) error {
 					Permissions:   "mrw",
 				},
 			}
-			topologyInfo, err := d.topology(gpuID)
-			if err != nil {
-				glog.Errorf("unable to get topology for device with index %d: %v", gpuID, err)
-			}
-			d.gpuPartitions[gpuInstanceID] = pluginapi.Device{ID: gpuInstanceID, Health: pluginapi.Healthy, Topology: topologyInfo}
+			partitions[partitionID] = pluginapi.Device{ID: partitionID, Health: pluginapi.Healthy, Topology: topologyInfo}
 		}
+	}
 
-		if numPartitions != maxPartitionCount {
-			return fmt.Errorf("Number of partitions (%d) for GPU %s does not match expected partition count (%d)", numPartitions, gpuID, maxPartitionCount)
-		}
+	if numPartitions != profile.MaxCount {
+		return partitions, specs, fmt.Errorf("Number of partitions (%d) for GPU %s does not match expected partition count (%d)", numPartitions, gpuID, profile.MaxCount)
 	}
+	return partitions, specs, nil
+}
 
-	numGPUs, err := d.discoverNumGPUs()
+// capabilityMinor returns the minor number of the device that grants the
+// capability described by a capability access file.
+func capabilityMinor(accessFile string) (int, error) {
+	content, err := ioutil.ReadFile(accessFile)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to read access file (%s): %v", accessFile, err)
+	}
+	m := deviceMinorRegexp.FindStringSubmatch(string(content))
+	if len(m) != 2 {
+		return 0, fmt.Errorf("unexpected contents in access file (%s): %s", accessFile, content)
 	}
-	if numPartitionedGPUs != numGPUs {
-		return fmt.Errorf("Not all GPUs are partitioned as expected. Total number of GPUs: %d, number of partitioned GPUs: %d", numGPUs, numPartitionedGPUs)
+	minor, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse minor device from access file (%s): %v", accessFile, err)
 	}
+	return minor, nil
+}
 
-	return nil
+// WatchPaths returns the directories that change when GPU partitions are
+// created or destroyed. New GPU instance and compute instance directories only
+// show up in the list after the partitions were rediscovered, so the paths
+// should be watched again after every Start.
+func (d *DeviceManager) WatchPaths() []string {
+	return append([]string{path.Join(d.devDirectory, "nvidia-caps")}, d.capabilityDirs()...)
+}
+
+// HasLayoutChanged returns true if GPU instances or compute instances were
+// created or destroyed since the last Start. It only lists directories, so it is
+// cheap enough to poll, which is needed as procfs doesn't report changes to
+// filesystem watchers.
+func (d *DeviceManager) HasLayoutChanged() bool {
+	d.mu.RLock()
+	layout := d.layout
+	d.mu.RUnlock()
+	return !reflect.DeepEqual(layout, d.capabilityDirs())
+}
+
+// capabilityDirs lists the capabilities directory along with the MIG, GPU
+// instance and compute instance capability directories of every GPU.
+func (d *DeviceManager) capabilityDirs() []string {
+	nvidiaCapDir := path.Join(d.procDirectory, "driver/nvidia/capabilities")
+	dirs := []string{nvidiaCapDir}
+	gpuFiles, err := ioutil.ReadDir(nvidiaCapDir)
+	if err != nil {
+		return dirs
+	}
+	gpuFileRegexp := regexp.MustCompile("^gpu[0-9]+$")
+	giFileRegexp := regexp.MustCompile("^gi[0-9]+$")
+	ciFileRegexp := regexp.MustCompile("^ci[0-9]+$")
+	for _, gpuFile := range gpuFiles {
+		if !gpuFileRegexp.MatchString(gpuFile.Name()) {
+			continue
+		}
+		migDir := path.Join(nvidiaCapDir, gpuFile.Name(), "mig")
+		giFiles, err := ioutil.ReadDir(migDir)
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, migDir)
+		for _, giFile := range giFiles {
+			if !giFile.IsDir() || !giFileRegexp.MatchString(giFile.Name()) {
+				continue
+			}
+			giDir := path.Join(migDir, giFile.Name())
+			dirs = append(dirs, giDir)
+			ciFiles, err := ioutil.ReadDir(giDir)
+			if err != nil {
+				continue
+			}
+			for _, ciFile := range ciFiles {
+				if ciFile.IsDir() && ciFileRegexp.MatchString(ciFile.Name()) {
+					dirs = append(dirs, path.Join(giDir, ciFile.Name()))
+				}
+			}
+		}
+	}
+	return dirs
 }
 
-// SetDeviceHealth sets the health status for a GPU partition
+// SetDeviceHealth sets the health status for a GPU partition. Partitions that
+// are not advertised, e.g. because they were destroyed since the health check
+// started, are ignored.
 func (d *DeviceManager) SetDeviceHealth(name string, health string, topology *pluginapi.TopologyInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.gpuPartitions[name]; !ok {
+		return
+	}
 	d.gpuPartitions[name] = pluginapi.Device{ID: name, Health: health, Topology: topology}
 }
 
-// Discovers all NVIDIA GPU devices available on the local node by walking nvidiaGPUManager's devDirectory.
-func (d *DeviceManager) discoverNumGPUs() (int, error) {
-	numGPUs := 0
+// discoverGPUs lists the NVIDIA GPU devices available on the local node by walking the devDirectory.
+func (d *DeviceManager) discoverGPUs() ([]string, error) {
+	var gpus []string
 
 	reg := regexp.MustCompile(nvidiaDeviceRE)
 	files, err := ioutil.ReadDir(d.devDirectory)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read devices on node: %v", err)
+		return nil, fmt.Errorf("failed to read devices on node: %v", err)
 	}
 
 	for _, f := range files {
@@ -261,10 +401,41 @@ func (d *DeviceManager) discoverNumGPUs() (int, error) {
 			continue
 		}
 		if reg.MatchString(f.Name()) {
-			numGPUs++
+			gpus = append(gpus, f.Name())
 		}
 	}
-	return numGPUs, nil
+	return gpus, nil
+}
+
+// partitionProfile returns the GPU instance profile of the partition size on a GPU.
+// The profiles are read from the GPU, and the built-in profiles are used if that fails.
+func (d *DeviceManager) partitionProfile(deviceIndex string, partitionSize string) (migprofile.Profile, error) {
+	profiles, err := d.gpuProfiles(deviceIndex)
+	if err != nil || len(profiles) == 0 {
+		slog.Warn("Failed to read the GPU instance profiles, using the built-in profiles", logging.DeviceID, "nvidia"+deviceIndex, logging.Error, err)
+		profiles = migprofile.Static
+	}
+	profile, ok := migprofile.Lookup(profiles, partitionSize)
+	if !ok {
+		return migprofile.Profile{}, fmt.Errorf("%s is not a valid GPU partition size", partitionSize)
+	}
+	return profile, nil
+}
+
+func (d *DeviceManager) gpuProfiles(deviceIndex string) ([]migprofile.Profile, error) {
+	index, err := strconv.Atoi(deviceIndex)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert deviceIndex %q string to int: %v", deviceIndex, err)
+	}
+
+	if nvmlutil.NvmlDeviceInfo == nil {
+		nvmlutil.NvmlDeviceInfo = &nvmlutil.DeviceInfo{}
+	}
+	device, ret := nvmlutil.NvmlDeviceInfo.DeviceHandleByIndex(index)
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("failed to get device handle: %v", nvml.ErrorString(ret))
+	}
+	return migprofile.Query(nvmlutil.ProfileDevice(device))
 }
 
 func (d *DeviceManager) topology(deviceIndex string) (*pluginapi.TopologyInfo, error) {
@@ -147,3 +147,274 @@ func TestDiscoverGPUPartitions(t *testing.T) {
 		}
 	}
 }
+
+func TestDiscoverComputeInstances(t *testing.T) {
+	testDevDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dev dir: %v", err)
+	}
+	defer os.RemoveAll(testDevDir)
+
+	testProcDir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("failed to create temp proc dir: %v", err)
+	}
+	defer os.RemoveAll(testProcDir)
+
+	// gi1 is split into two compute instances, gi2 has a single one.
+	capToMinorDevices := map[string]int{
+		"driver/nvidia/capabilities/gpu0/mig/gi1/access":     12,
+		"driver/nvidia/capabilities/gpu0/mig/gi1/ci0/access": 13,
+		"driver/nvidia/capabilities/gpu0/mig/gi1/ci1/access": 14,
+		"driver/nvidia/capabilities/gpu0/mig/gi2/access":     21,
+		"driver/nvidia/capabilities/gpu0/mig/gi2/ci0/access": 22,
+	}
+	if err := os.MkdirAll(path.Join(testDevDir, "nvidia-caps"), 0755); err != nil {
+		t.Fatalf("failed to create capabilities device dir: %v", err)
+	}
+	for file, minor := range capToMinorDevices {
+		if err := os.MkdirAll(path.Dir(path.Join(testProcDir, file)), 0755); err != nil {
+			t.Fatalf("failed to create capabilities dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(testProcDir, file), []byte(fmt.Sprintf("DeviceFileMinor: %d\nDeviceFileMode: 292", minor)), 0644); err != nil {
+			t.Fatalf("failed to create proc capabilities file (%s): %v", file, err)
+		}
+		if _, err := os.Create(path.Join(testDevDir, "nvidia-caps", fmt.Sprintf("nvidia-cap%d", minor))); err != nil {
+			t.Fatalf("failed to create device node for minor %d: %v", minor, err)
+		}
+	}
+	if _, err := os.Create(path.Join(testDevDir, "nvidia0")); err != nil {
+		t.Fatalf("failed to create device node nvidia0: %v", err)
+	}
+
+	// overriding nvmlutil.NvmlDeviceInfo to nvmlutil.MockDeviceInfo interface
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{}
+
+	deviceManager := NewDeviceManager(testDevDir, testProcDir)
+	if err := deviceManager.Start("3g.20gb"); err != nil {
+		t.Fatalf("Mig device manager failed to start: %v", err)
+	}
+
+	wantCapDevices := map[string][]int{
+		"nvidia0/gi1/ci0": {12, 13},
+		"nvidia0/gi1/ci1": {12, 14},
+		"nvidia0/gi2":     {21, 22},
+	}
+	devices := deviceManager.ListGPUPartitionDevices()
+	if len(devices) != len(wantCapDevices) {
+		t.Errorf("incorrect number of GPU partitions. got = %d, want = %d", len(devices), len(wantCapDevices))
+	}
+	for id, minors := range wantCapDevices {
+		if _, ok := devices[id]; !ok {
+			t.Errorf("device id %s not found", id)
+		}
+		specGot, err := deviceManager.DeviceSpec(id)
+		if err != nil {
+			t.Errorf("failed to look up device spec for %s", id)
+			continue
+		}
+		var pathsGot []string
+		for _, spec := range specGot {
+			pathsGot = append(pathsGot, spec.HostPath)
+		}
+		pathsWant := []string{
+			path.Join(testDevDir, "nvidia0"),
+			path.Join(testDevDir, "nvidia-caps", fmt.Sprintf("nvidia-cap%d", minors[0])),
+			path.Join(testDevDir, "nvidia-caps", fmt.Sprintf("nvidia-cap%d", minors[1])),
+		}
+		if !reflect.DeepEqual(pathsGot, pathsWant) {
+			t.Errorf("device paths for device %s do not match. got: %v, want %v", id, pathsGot, pathsWant)
+		}
+	}
+}
+
+func TestTolerateMisconfiguredGPUs(t *testing.T) {
+	testDevDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dev dir: %v", err)
+	}
+	defer os.RemoveAll(testDevDir)
+
+	testProcDir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("failed to create temp proc dir: %v", err)
+	}
+	defer os.RemoveAll(testProcDir)
+
+	// nvidia0 has the two 3g.20gb partitions it should have, nvidia1 has only
+	// one, and nvidia2 is not partitioned.
+	capToMinorDevices := map[string]int{
+		"driver/nvidia/capabilities/gpu0/mig/gi1/access":     12,
+		"driver/nvidia/capabilities/gpu0/mig/gi1/ci0/access": 13,
+		"driver/nvidia/capabilities/gpu0/mig/gi2/access":     21,
+		"driver/nvidia/capabilities/gpu0/mig/gi2/ci0/access": 22,
+		"driver/nvidia/capabilities/gpu1/mig/gi1/access":     112,
+		"driver/nvidia/capabilities/gpu1/mig/gi1/ci0/access": 113,
+	}
+	if err := os.MkdirAll(path.Join(testDevDir, "nvidia-caps"), 0755); err != nil {
+		t.Fatalf("failed to create capabilities device dir: %v", err)
+	}
+	for file, minor := range capToMinorDevices {
+		if err := os.MkdirAll(path.Dir(path.Join(testProcDir, file)), 0755); err != nil {
+			t.Fatalf("failed to create capabilities dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(testProcDir, file), []byte(fmt.Sprintf("DeviceFileMinor: %d\nDeviceFileMode: 292", minor)), 0644); err != nil {
+			t.Fatalf("failed to create proc capabilities file (%s): %v", file, err)
+		}
+		if _, err := os.Create(path.Join(testDevDir, "nvidia-caps", fmt.Sprintf("nvidia-cap%d", minor))); err != nil {
+			t.Fatalf("failed to create device node for minor %d: %v", minor, err)
+		}
+	}
+	for _, device := range []string{"nvidia0", "nvidia1", "nvidia2"} {
+		if _, err := os.Create(path.Join(testDevDir, device)); err != nil {
+			t.Fatalf("failed to create device node (%s): %v", device, err)
+		}
+	}
+
+	// overriding nvmlutil.NvmlDeviceInfo to nvmlutil.MockDeviceInfo interface
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{}
+
+	deviceManager := NewDeviceManager(testDevDir, testProcDir)
+	if err := deviceManager.Start("3g.20gb"); err == nil {
+		t.Errorf("Mig device manager started with misconfigured GPUs, want error")
+	}
+
+	deviceManager.TolerateMisconfiguredGPUs(true)
+	if err := deviceManager.Start("3g.20gb"); err != nil {
+		t.Fatalf("Mig device manager failed to start with misconfigured GPUs tolerated: %v", err)
+	}
+
+	wantHealth := map[string]string{
+		"nvidia0/gi1": pluginapi.Healthy,
+		"nvidia0/gi2": pluginapi.Healthy,
+		"nvidia1/gi1": pluginapi.Unhealthy,
+	}
+	gotHealth := make(map[string]string)
+	for id, device := range deviceManager.ListGPUPartitionDevices() {
+		gotHealth[id] = device.Health
+	}
+	if !reflect.DeepEqual(gotHealth, wantHealth) {
+		t.Errorf("GPU partition health = %v, want %v", gotHealth, wantHealth)
+	}
+
+	wantProblems := map[string]string{
+		"nvidia1": "Number of partitions (1) for GPU 1 does not match expected partition count (2)",
+		"nvidia2": "GPU is not partitioned",
+	}
+	if got := deviceManager.Problems(); !reflect.DeepEqual(got, wantProblems) {
+		t.Errorf("Problems() = %v, want %v", got, wantProblems)
+	}
+}
+
+func TestHasLayoutChanged(t *testing.T) {
+	testDevDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dev dir: %v", err)
+	}
+	defer os.RemoveAll(testDevDir)
+
+	testProcDir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("failed to create temp proc dir: %v", err)
+	}
+	defer os.RemoveAll(testProcDir)
+
+	capToMinorDevices := map[string]int{
+		"driver/nvidia/capabilities/gpu0/mig/gi1/access":     12,
+		"driver/nvidia/capabilities/gpu0/mig/gi1/ci0/access": 13,
+		"driver/nvidia/capabilities/gpu0/mig/gi2/access":     21,
+		"driver/nvidia/capabilities/gpu0/mig/gi2/ci0/access": 22,
+	}
+	if err := os.MkdirAll(path.Join(testDevDir, "nvidia-caps"), 0755); err != nil {
+		t.Fatalf("failed to create capabilities device dir: %v", err)
+	}
+	for file, minor := range capToMinorDevices {
+		if err := os.MkdirAll(path.Dir(path.Join(testProcDir, file)), 0755); err != nil {
+			t.Fatalf("failed to create capabilities dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(testProcDir, file), []byte(fmt.Sprintf("DeviceFileMinor: %d\nDeviceFileMode: 292", minor)), 0644); err != nil {
+			t.Fatalf("failed to create proc capabilities file (%s): %v", file, err)
+		}
+		if _, err := os.Create(path.Join(testDevDir, "nvidia-caps", fmt.Sprintf("nvidia-cap%d", minor))); err != nil {
+			t.Fatalf("failed to create device node for minor %d: %v", minor, err)
+		}
+	}
+	if _, err := os.Create(path.Join(testDevDir, "nvidia0")); err != nil {
+		t.Fatalf("failed to create device node nvidia0: %v", err)
+	}
+
+	// overriding nvmlutil.NvmlDeviceInfo to nvmlutil.MockDeviceInfo interface
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{}
+
+	deviceManager := NewDeviceManager(testDevDir, testProcDir)
+	if err := deviceManager.Start("3g.20gb"); err != nil {
+		t.Fatalf("Mig device manager failed to start: %v", err)
+	}
+
+	capDir := path.Join(testProcDir, "driver/nvidia/capabilities")
+	wantPaths := []string{
+		path.Join(testDevDir, "nvidia-caps"),
+		capDir,
+		path.Join(capDir, "gpu0/mig"),
+		path.Join(capDir, "gpu0/mig/gi1"),
+		path.Join(capDir, "gpu0/mig/gi1/ci0"),
+		path.Join(capDir, "gpu0/mig/gi2"),
+		path.Join(capDir, "gpu0/mig/gi2/ci0"),
+	}
+	if got := deviceManager.WatchPaths(); !reflect.DeepEqual(got, wantPaths) {
+		t.Errorf("WatchPaths() = %v, want %v", got, wantPaths)
+	}
+	if deviceManager.HasLayoutChanged() {
+		t.Errorf("HasLayoutChanged() = true without changes, want false")
+	}
+
+	// Destroying a GPU instance changes the layout.
+	if err := os.RemoveAll(path.Join(capDir, "gpu0/mig/gi2")); err != nil {
+		t.Fatalf("failed to remove GPU instance capabilities: %v", err)
+	}
+	if !deviceManager.HasLayoutChanged() {
+		t.Errorf("HasLayoutChanged() = false after a GPU instance was destroyed, want true")
+	}
+
+	// Health updates for destroyed partitions are dropped after rediscovery.
+	deviceManager.Start("3g.20gb")
+	if deviceManager.HasLayoutChanged() {
+		t.Errorf("HasLayoutChanged() = true after rediscovery, want false")
+	}
+	deviceManager.SetDeviceHealth("nvidia0/gi2", pluginapi.Unhealthy, nil)
+	if _, ok := deviceManager.ListGPUPartitionDevices()["nvidia0/gi2"]; ok {
+		t.Errorf("destroyed GPU partition nvidia0/gi2 is advertised after a health update")
+	}
+}
+
+func TestPartitionProfile(t *testing.T) {
+	// overriding nvmlutil.NvmlDeviceInfo to nvmlutil.MockDeviceInfo interface, which reports an A100 40GB
+	nvmlutil.NvmlDeviceInfo = &nvmlutil.MockDeviceInfo{}
+
+	tests := []struct {
+		partitionSize string
+		wantID        int
+		wantMaxCount  int
+		wantErr       bool
+	}{
+		{partitionSize: "3g.20gb", wantID: 9, wantMaxCount: 2},
+		{partitionSize: "4g.20gb", wantID: 5, wantMaxCount: 1},
+		{partitionSize: "1g.10gb", wantErr: true},
+		{partitionSize: "8g.40gb", wantErr: true},
+	}
+	deviceManager := NewDeviceManager("", "")
+	for _, tt := range tests {
+		t.Run(tt.partitionSize, func(t *testing.T) {
+			profile, err := deviceManager.partitionProfile("0", tt.partitionSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("partitionProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if profile.ID != tt.wantID || profile.MaxCount != tt.wantMaxCount {
+				t.Errorf("partitionProfile() = %+v, want ID %d and max count %d", profile, tt.wantID, tt.wantMaxCount)
+			}
+		})
+	}
+}
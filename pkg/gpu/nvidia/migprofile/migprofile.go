@@ -0,0 +1,198 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migprofile discovers the MIG GPU instance profiles supported by a GPU,
+// and maps compute instance sizes to compute instance profiles.
+// It is shared by the GPU partitioner and the device plugin, so that both agree
+// on the valid partition sizes.
+package migprofile
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// Profile is a GPU instance profile supported by a GPU.
+type Profile struct {
+	// Index is the NVML profile index, e.g. nvml.GPU_INSTANCE_PROFILE_1_SLICE.
+	// It is not known when the profiles are read with nvidia-smi.
+	Index int
+	// ID is the profile ID used by nvidia-smi, e.g. 19 for 1g.5gb on A100.
+	ID int
+	// Name is the profile name without the MIG prefix, e.g. 1g.5gb. It is the
+	// partition size in the GPU config.
+	Name string
+	// MaxCount is the maximum number of GPU instances of the profile on the GPU.
+	MaxCount int
+	// MemoryMB is the memory of a GPU instance of the profile.
+	MemoryMB uint64
+	// SliceCount is the number of GPU slices of a GPU instance of the profile.
+	SliceCount int
+	// MultiprocessorCount is the number of SMs of a GPU instance of the profile.
+	MultiprocessorCount int
+}
+
+// Static lists the profiles of the MIG capable GPUs supported on GKE. It is used
+// in tests, and as a fallback when the profiles can't be read from the GPU.
+// Only the fields that follow from the profile name are set.
+// Source: https://docs.nvidia.com/datacenter/tesla/mig-user-guide/#supported-mig-profiles
+var Static = []Profile{
+	//nvidia-tesla-a100
+	{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE, ID: 19, Name: "1g.5gb", MaxCount: 7, SliceCount: 1},
+	{Index: nvml.GPU_INSTANCE_PROFILE_2_SLICE, ID: 14, Name: "2g.10gb", MaxCount: 3, SliceCount: 2},
+	{Index: nvml.GPU_INSTANCE_PROFILE_3_SLICE, ID: 9, Name: "3g.20gb", MaxCount: 2, SliceCount: 3},
+	{Index: nvml.GPU_INSTANCE_PROFILE_4_SLICE, ID: 5, Name: "4g.20gb", MaxCount: 1, SliceCount: 4},
+	{Index: nvml.GPU_INSTANCE_PROFILE_7_SLICE, ID: 0, Name: "7g.40gb", MaxCount: 1, SliceCount: 7},
+	//nvidia-a100-80gb, nvidia-h100-80gb
+	{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE, ID: 19, Name: "1g.10gb", MaxCount: 7, SliceCount: 1},
+	{Index: nvml.GPU_INSTANCE_PROFILE_2_SLICE, ID: 14, Name: "2g.20gb", MaxCount: 3, SliceCount: 2},
+	{Index: nvml.GPU_INSTANCE_PROFILE_3_SLICE, ID: 9, Name: "3g.40gb", MaxCount: 2, SliceCount: 3},
+	{Index: nvml.GPU_INSTANCE_PROFILE_4_SLICE, ID: 5, Name: "4g.40gb", MaxCount: 1, SliceCount: 4},
+	{Index: nvml.GPU_INSTANCE_PROFILE_7_SLICE, ID: 0, Name: "7g.80gb", MaxCount: 1, SliceCount: 7},
+	//nvidia-h100-80gb
+	{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE_REV2, ID: 15, Name: "1g.20gb", MaxCount: 4, SliceCount: 1},
+	//nvidia-h200-141gb
+	{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE, ID: 19, Name: "1g.18gb", MaxCount: 7, SliceCount: 1},
+	{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE_REV2, ID: 15, Name: "1g.35gb", MaxCount: 4, SliceCount: 1},
+	{Index: nvml.GPU_INSTANCE_PROFILE_2_SLICE, ID: 14, Name: "2g.35gb", MaxCount: 3, SliceCount: 2},
+	{Index: nvml.GPU_INSTANCE_PROFILE_3_SLICE, ID: 9, Name: "3g.71gb", MaxCount: 2, SliceCount: 3},
+	{Index: nvml.GPU_INSTANCE_PROFILE_4_SLICE, ID: 5, Name: "4g.71gb", MaxCount: 1, SliceCount: 4},
+	{Index: nvml.GPU_INSTANCE_PROFILE_7_SLICE, ID: 0, Name: "7g.141gb", MaxCount: 1, SliceCount: 7},
+	//nvidia-b200, nvidia-gb200
+	{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE, ID: 19, Name: "1g.23gb", MaxCount: 7, SliceCount: 1},
+	//nvidia-b200
+	{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE_REV2, ID: 15, Name: "1g.45gb", MaxCount: 4, SliceCount: 1},
+	{Index: nvml.GPU_INSTANCE_PROFILE_2_SLICE, ID: 14, Name: "2g.45gb", MaxCount: 3, SliceCount: 2},
+	{Index: nvml.GPU_INSTANCE_PROFILE_3_SLICE, ID: 9, Name: "3g.90gb", MaxCount: 2, SliceCount: 3},
+	{Index: nvml.GPU_INSTANCE_PROFILE_4_SLICE, ID: 5, Name: "4g.90gb", MaxCount: 1, SliceCount: 4},
+	{Index: nvml.GPU_INSTANCE_PROFILE_7_SLICE, ID: 0, Name: "7g.180gb", MaxCount: 1, SliceCount: 7},
+	//nvidia-gb200
+	{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE_REV2, ID: 15, Name: "1g.47gb", MaxCount: 4, SliceCount: 1},
+	{Index: nvml.GPU_INSTANCE_PROFILE_2_SLICE, ID: 14, Name: "2g.47gb", MaxCount: 3, SliceCount: 2},
+	{Index: nvml.GPU_INSTANCE_PROFILE_3_SLICE, ID: 9, Name: "3g.93gb", MaxCount: 2, SliceCount: 3},
+	{Index: nvml.GPU_INSTANCE_PROFILE_4_SLICE, ID: 5, Name: "4g.93gb", MaxCount: 1, SliceCount: 4},
+	{Index: nvml.GPU_INSTANCE_PROFILE_7_SLICE, ID: 0, Name: "7g.186gb", MaxCount: 1, SliceCount: 7},
+}
+
+// Device is the subset of an NVML device needed to read its GPU instance profiles.
+type Device interface {
+	GetGpuInstanceProfileInfo(profile int) (nvml.GpuInstanceProfileInfo, nvml.Return)
+	// GpuInstanceProfileName returns the name of a GPU instance profile, or an
+	// empty string if the driver doesn't report it.
+	GpuInstanceProfileName(profile int) string
+}
+
+// NVMLDevice implements Device with an nvml.Device.
+type NVMLDevice struct {
+	nvml.Device
+}
+
+// GpuInstanceProfileName reads the profile name from the v2 profile info, which
+// is only available with recent drivers.
+func (d NVMLDevice) GpuInstanceProfileName(profile int) string {
+	info, ret := d.Device.GetGpuInstanceProfileInfoV(profile).V2()
+	if ret != nvml.SUCCESS {
+		return ""
+	}
+	var name strings.Builder
+	for _, c := range info.Name {
+		if c == 0 {
+			break
+		}
+		name.WriteByte(byte(c))
+	}
+	return name.String()
+}
+
+// Query returns the GPU instance profiles supported by a device, in NVML profile
+// index order. Profiles the device doesn't support are skipped.
+func Query(d Device) ([]Profile, error) {
+	var profiles []Profile
+	for i := 0; i < nvml.GPU_INSTANCE_PROFILE_COUNT; i++ {
+		info, ret := d.GetGpuInstanceProfileInfo(i)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("failed to get GPU instance profile %d: %v", i, nvml.ErrorString(ret))
+		}
+		name := strings.TrimPrefix(d.GpuInstanceProfileName(i), "MIG ")
+		if name == "" {
+			name = Name(int(info.SliceCount), info.MemorySizeMB)
+		}
+		profiles = append(profiles, Profile{
+			Index:               i,
+			ID:                  int(info.Id),
+			Name:                name,
+			MaxCount:            int(info.InstanceCount),
+			MemoryMB:            info.MemorySizeMB,
+			SliceCount:          int(info.SliceCount),
+			MultiprocessorCount: int(info.MultiprocessorCount),
+		})
+	}
+	return profiles, nil
+}
+
+// Name returns the name nvidia-smi gives a profile, e.g. 1g.5gb for a single
+// slice with 4864MB of memory. Memory is rounded up to whole GB.
+func Name(sliceCount int, memoryMB uint64) string {
+	return fmt.Sprintf("%dg.%dgb", sliceCount, (memoryMB+1023)/1024)
+}
+
+// Lookup returns the profile with the given name.
+func Lookup(profiles []Profile, name string) (Profile, bool) {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// computeInstanceProfiles maps the number of slices of a compute instance to its
+// NVML compute instance profile index, which nvidia-smi also uses as profile ID.
+var computeInstanceProfiles = map[int]int{
+	1: nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE,
+	2: nvml.COMPUTE_INSTANCE_PROFILE_2_SLICE,
+	3: nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE,
+	4: nvml.COMPUTE_INSTANCE_PROFILE_4_SLICE,
+	6: nvml.COMPUTE_INSTANCE_PROFILE_6_SLICE,
+	7: nvml.COMPUTE_INSTANCE_PROFILE_7_SLICE,
+	8: nvml.COMPUTE_INSTANCE_PROFILE_8_SLICE,
+}
+
+var computeInstanceSizeRegexp = regexp.MustCompile(`^([0-9]+)c$`)
+
+// ComputeInstances returns the compute instance profile for a compute instance
+// size such as 1c, and how many compute instances of that size fit in a GPU
+// instance of profile p.
+func ComputeInstances(p Profile, size string) (profileIndex int, count int, err error) {
+	m := computeInstanceSizeRegexp.FindStringSubmatch(size)
+	if m == nil {
+		return 0, 0, fmt.Errorf("%s is not a valid compute instance size, should be the number of slices followed by c, e.g. 1c", size)
+	}
+	slices, _ := strconv.Atoi(m[1])
+	profileIndex, ok := computeInstanceProfiles[slices]
+	if !ok {
+		return 0, 0, fmt.Errorf("%s is not a valid compute instance size", size)
+	}
+	if slices > p.SliceCount {
+		return 0, 0, fmt.Errorf("compute instance size %s does not fit in GPU instances of profile %s", size, p.Name)
+	}
+	return profileIndex, p.SliceCount / slices, nil
+}
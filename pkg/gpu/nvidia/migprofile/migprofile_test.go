@@ -0,0 +1,137 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package migprofile
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeDevice reports the profiles of an A100 40GB, with names for some of them.
+type fakeDevice struct {
+	names map[int]string
+}
+
+func (d fakeDevice) GetGpuInstanceProfileInfo(profile int) (nvml.GpuInstanceProfileInfo, nvml.Return) {
+	switch profile {
+	case nvml.GPU_INSTANCE_PROFILE_1_SLICE:
+		return nvml.GpuInstanceProfileInfo{Id: 19, SliceCount: 1, InstanceCount: 7, MultiprocessorCount: 14, MemorySizeMB: 4864}, nvml.SUCCESS
+	case nvml.GPU_INSTANCE_PROFILE_3_SLICE:
+		return nvml.GpuInstanceProfileInfo{Id: 9, SliceCount: 3, InstanceCount: 2, MultiprocessorCount: 42, MemorySizeMB: 19968}, nvml.SUCCESS
+	case nvml.GPU_INSTANCE_PROFILE_7_SLICE:
+		return nvml.GpuInstanceProfileInfo{Id: 0, SliceCount: 7, InstanceCount: 1, MultiprocessorCount: 98, MemorySizeMB: 40192}, nvml.SUCCESS
+	case nvml.GPU_INSTANCE_PROFILE_1_SLICE_REV1:
+		return nvml.GpuInstanceProfileInfo{Id: 20, SliceCount: 1, InstanceCount: 1, MultiprocessorCount: 14, MemorySizeMB: 4864}, nvml.SUCCESS
+	case nvml.GPU_INSTANCE_PROFILE_8_SLICE:
+		return nvml.GpuInstanceProfileInfo{}, nvml.ERROR_INVALID_ARGUMENT
+	}
+	return nvml.GpuInstanceProfileInfo{}, nvml.ERROR_NOT_SUPPORTED
+}
+
+func (d fakeDevice) GpuInstanceProfileName(profile int) string {
+	return d.names[profile]
+}
+
+func TestQuery(t *testing.T) {
+	d := fakeDevice{names: map[int]string{nvml.GPU_INSTANCE_PROFILE_1_SLICE_REV1: "MIG 1g.5gb+me"}}
+	want := []Profile{
+		{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE, ID: 19, Name: "1g.5gb", MaxCount: 7, MemoryMB: 4864, SliceCount: 1, MultiprocessorCount: 14},
+		{Index: nvml.GPU_INSTANCE_PROFILE_3_SLICE, ID: 9, Name: "3g.20gb", MaxCount: 2, MemoryMB: 19968, SliceCount: 3, MultiprocessorCount: 42},
+		{Index: nvml.GPU_INSTANCE_PROFILE_7_SLICE, ID: 0, Name: "7g.40gb", MaxCount: 1, MemoryMB: 40192, SliceCount: 7, MultiprocessorCount: 98},
+		{Index: nvml.GPU_INSTANCE_PROFILE_1_SLICE_REV1, ID: 20, Name: "1g.5gb+me", MaxCount: 1, MemoryMB: 4864, SliceCount: 1, MultiprocessorCount: 14},
+	}
+	got, err := Query(d)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Query() (-want, +got) = %s", diff)
+	}
+}
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		sliceCount int
+		memoryMB   uint64
+		want       string
+	}{
+		{sliceCount: 1, memoryMB: 4864, want: "1g.5gb"},
+		{sliceCount: 2, memoryMB: 9984, want: "2g.10gb"},
+		{sliceCount: 7, memoryMB: 40192, want: "7g.40gb"},
+		{sliceCount: 1, memoryMB: 10240, want: "1g.10gb"},
+	}
+	for _, tt := range tests {
+		if got := Name(tt.sliceCount, tt.memoryMB); got != tt.want {
+			t.Errorf("Name(%d, %d) = %s, want %s", tt.sliceCount, tt.memoryMB, got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	p, ok := Lookup(Static, "3g.20gb")
+	if !ok || p.ID != 9 || p.MaxCount != 2 {
+		t.Errorf("Lookup(3g.20gb) = %+v, %v, want profile 9 with 2 instances", p, ok)
+	}
+	if _, ok := Lookup(Static, "8g.40gb"); ok {
+		t.Errorf("Lookup(8g.40gb) found a profile, want none")
+	}
+}
+
+func TestStatic(t *testing.T) {
+	names := make(map[string]bool)
+	for _, p := range Static {
+		if names[p.Name] {
+			t.Errorf("profile %s is listed more than once", p.Name)
+		}
+		names[p.Name] = true
+		if !strings.HasPrefix(p.Name, fmt.Sprintf("%dg.", p.SliceCount)) {
+			t.Errorf("profile %s has %d slices", p.Name, p.SliceCount)
+		}
+	}
+}
+
+func TestComputeInstances(t *testing.T) {
+	gi3g, _ := Lookup(Static, "3g.20gb")
+	gi7g, _ := Lookup(Static, "7g.40gb")
+	tests := []struct {
+		profile     Profile
+		size        string
+		wantProfile int
+		wantCount   int
+		wantErr     bool
+	}{
+		{profile: gi3g, size: "1c", wantProfile: nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE, wantCount: 3},
+		{profile: gi3g, size: "3c", wantProfile: nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, wantCount: 1},
+		{profile: gi7g, size: "2c", wantProfile: nvml.COMPUTE_INSTANCE_PROFILE_2_SLICE, wantCount: 3},
+		{profile: gi3g, size: "4c", wantErr: true},
+		{profile: gi7g, size: "5c", wantErr: true},
+		{profile: gi7g, size: "1g", wantErr: true},
+		{profile: gi7g, size: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile.Name+"/"+tt.size, func(t *testing.T) {
+			gotProfile, gotCount, err := ComputeInstances(tt.profile, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ComputeInstances() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotProfile != tt.wantProfile || gotCount != tt.wantCount {
+				t.Errorf("ComputeInstances() = %d, %d, want %d, %d", gotProfile, gotCount, tt.wantProfile, tt.wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migstatus defines the status file the GPU partitioner writes to report
+// the progress of MIG reconfiguration to the device plugin.
+package migstatus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultPath is the default location of the status file on the host.
+const DefaultPath = "/etc/nvidia/partition_status.json"
+
+// State is the state of the GPU partitions on a node, or on a single GPU.
+type State string
+
+const (
+	// Reconfiguring means GPU partitions are being destroyed or created.
+	Reconfiguring State = "Reconfiguring"
+	// Ready means the GPU partitions match the GPU config.
+	Ready State = "Ready"
+	// Blocked means the GPU partitions don't match the GPU config, but can't be
+	// changed because processes are using the GPU.
+	Blocked State = "Blocked"
+	// RebootRequired means MIG mode was enabled, but only takes effect after the
+	// node is rebooted, and the partitioner was told not to reboot.
+	RebootRequired State = "RebootRequired"
+	// Failed means changing the GPU partitions failed.
+	Failed State = "Failed"
+)
+
+// GPUStatus is the status of the partitions on a single GPU.
+type GPUStatus struct {
+	State   State  `json:"state"`
+	Message string `json:"message,omitempty"`
+}
+
+// Status is the status of the GPU partitions on a node.
+type Status struct {
+	// PartitionSize is the partition size from the GPU config.
+	PartitionSize string `json:"partitionSize"`
+	// State is Ready only if every GPU is Ready.
+	State State `json:"state"`
+	// GPUs is the status of each GPU, keyed by GPU index.
+	GPUs map[string]GPUStatus `json:"gpus,omitempty"`
+	// Generation is incremented every time GPU partitions are created or destroyed.
+	Generation int64     `json:"generation"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Read reads the status file at path.
+func Read(path string) (*Status, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{}
+	if err := json.Unmarshal(content, status); err != nil {
+		return nil, fmt.Errorf("failed to parse partition status %s: %v", path, err)
+	}
+	return status, nil
+}
+
+// Write saves status to path. The device plugin polls the file, so it is written
+// to a temporary file first to never expose a partial status.
+func Write(path string, status *Status) error {
+	content, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode partition status: %v", err)
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary partition status: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write partition status: %v", err)
+	}
+	if err := tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write partition status: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write partition status: %v", err)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to save partition status: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migstatus
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migstatus")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	statusFile := path.Join(dir, "partition_status.json")
+
+	if _, err := Read(statusFile); !os.IsNotExist(err) {
+		t.Errorf("Read() of a missing file error = %v, want a not exist error", err)
+	}
+
+	want := &Status{
+		PartitionSize: "1g.5gb",
+		State:         Blocked,
+		GPUs: map[string]GPUStatus{
+			"0": {State: Ready},
+			"1": {State: Blocked, Message: "2 processes are using the GPU"},
+		},
+		Generation: 3,
+		UpdatedAt:  time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := Write(statusFile, want); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	got, err := Read(statusFile)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected partition status (-want, +got) = %s", diff)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("temporary files were left behind: %v", files)
+	}
+}
@@ -17,6 +17,7 @@
 package nvmlutil
 
 import (
+	"fmt"
 	"io/ioutil"
 	"regexp"
 
@@ -29,6 +30,11 @@ type MockDeviceInfo struct {
 	CurrentDevice int
 	TestDevDir    string
 	BusID         [32]int8
+	// CurrentMigDevice is the index of the last MIG device handle returned, or -1
+	// if the last handle returned was a GPU handle.
+	CurrentMigDevice int
+	// LostDevices holds the indices of the GPUs that fell off the bus.
+	LostDevices map[int]bool
 }
 
 func (gpuDeviceInfo *MockDeviceInfo) DeviceCount() (int, nvml.Return) {
@@ -48,12 +54,18 @@ func (gpuDeviceInfo *MockDeviceInfo) DeviceCount() (int, nvml.Return) {
 	return numDevices, nvml.SUCCESS
 }
 
+// DeviceHandleByIndex fails with ERROR_GPU_IS_LOST for the GPUs in LostDevices.
 func (gpuDeviceInfo *MockDeviceInfo) DeviceHandleByIndex(i int) (nvml.Device, nvml.Return) {
+	if gpuDeviceInfo.LostDevices[i] {
+		return nvml.Device{}, nvml.ERROR_GPU_IS_LOST
+	}
 	gpuDeviceInfo.CurrentDevice = i
+	gpuDeviceInfo.CurrentMigDevice = -1
 	return nvml.Device{}, nvml.SUCCESS
 }
 
 func (gpuDeviceInfo *MockDeviceInfo) MigDeviceHandleByIndex(d nvml.Device, i int) (nvml.Device, nvml.Return) {
+	gpuDeviceInfo.CurrentMigDevice = i
 	return nvml.Device{}, nvml.SUCCESS
 }
 
@@ -68,3 +80,48 @@ func (gpuDeviceInfo *MockDeviceInfo) MinorNumber(d nvml.Device) (int, nvml.Retur
 func (gpuDeviceInfo *MockDeviceInfo) PciInfo(d nvml.Device) (nvml.PciInfo, nvml.Return) {
 	return nvml.PciInfo{BusId: gpuDeviceInfo.BusID}, nvml.SUCCESS
 }
+
+// UUID returns GPU-<index> for GPUs and MIG-<index>-<mig index> for MIG devices.
+func (gpuDeviceInfo *MockDeviceInfo) UUID(d nvml.Device) (string, nvml.Return) {
+	if gpuDeviceInfo.CurrentMigDevice >= 0 {
+		return fmt.Sprintf("MIG-%d-%d", gpuDeviceInfo.CurrentDevice, gpuDeviceInfo.CurrentMigDevice), nvml.SUCCESS
+	}
+	return fmt.Sprintf("GPU-%d", gpuDeviceInfo.CurrentDevice), nvml.SUCCESS
+}
+
+func (gpuDeviceInfo *MockDeviceInfo) MaxMigDeviceCount(d nvml.Device) (int, nvml.Return) {
+	return 7, nvml.SUCCESS
+}
+
+// GpuInstanceID maps the MIG device with index i to GPU instance i+1.
+func (gpuDeviceInfo *MockDeviceInfo) GpuInstanceID(d nvml.Device) (int, nvml.Return) {
+	return gpuDeviceInfo.CurrentMigDevice + 1, nvml.SUCCESS
+}
+
+// ComputeInstanceID reports compute instance 0 for all MIG devices.
+func (gpuDeviceInfo *MockDeviceInfo) ComputeInstanceID(d nvml.Device) (int, nvml.Return) {
+	return 0, nvml.SUCCESS
+}
+
+// mockGpuInstanceProfiles are the GPU instance profiles of an A100 40GB.
+var mockGpuInstanceProfiles = map[int]nvml.GpuInstanceProfileInfo{
+	nvml.GPU_INSTANCE_PROFILE_1_SLICE: {Id: 19, SliceCount: 1, InstanceCount: 7, MultiprocessorCount: 14, MemorySizeMB: 4864},
+	nvml.GPU_INSTANCE_PROFILE_2_SLICE: {Id: 14, SliceCount: 2, InstanceCount: 3, MultiprocessorCount: 28, MemorySizeMB: 9984},
+	nvml.GPU_INSTANCE_PROFILE_3_SLICE: {Id: 9, SliceCount: 3, InstanceCount: 2, MultiprocessorCount: 42, MemorySizeMB: 19968},
+	nvml.GPU_INSTANCE_PROFILE_4_SLICE: {Id: 5, SliceCount: 4, InstanceCount: 1, MultiprocessorCount: 56, MemorySizeMB: 19968},
+	nvml.GPU_INSTANCE_PROFILE_7_SLICE: {Id: 0, SliceCount: 7, InstanceCount: 1, MultiprocessorCount: 98, MemorySizeMB: 40192},
+}
+
+// GpuInstanceProfileInfo reports the GPU instance profiles of an A100 40GB.
+func (gpuDeviceInfo *MockDeviceInfo) GpuInstanceProfileInfo(d nvml.Device, profile int) (nvml.GpuInstanceProfileInfo, nvml.Return) {
+	info, ok := mockGpuInstanceProfiles[profile]
+	if !ok {
+		return nvml.GpuInstanceProfileInfo{}, nvml.ERROR_NOT_SUPPORTED
+	}
+	return info, nvml.SUCCESS
+}
+
+// GpuInstanceProfileName returns no names, like drivers without v2 profile info.
+func (gpuDeviceInfo *MockDeviceInfo) GpuInstanceProfileName(d nvml.Device, profile int) string {
+	return ""
+}
@@ -17,12 +17,13 @@ package nvmlutil
 import (
 	"bytes"
 	"fmt"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/GoogleCloudPlatform/container-engine-accelerators/pkg/gpu/nvidia/migprofile"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
-	"github.com/golang/glog"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -34,6 +35,12 @@ type NvmlOperations interface {
 	MigMode(nvml.Device) (int, int, nvml.Return)
 	MinorNumber(nvml.Device) (int, nvml.Return)
 	PciInfo(d nvml.Device) (nvml.PciInfo, nvml.Return)
+	UUID(nvml.Device) (string, nvml.Return)
+	MaxMigDeviceCount(nvml.Device) (int, nvml.Return)
+	GpuInstanceID(nvml.Device) (int, nvml.Return)
+	ComputeInstanceID(nvml.Device) (int, nvml.Return)
+	GpuInstanceProfileInfo(nvml.Device, int) (nvml.GpuInstanceProfileInfo, nvml.Return)
+	GpuInstanceProfileName(nvml.Device, int) string
 }
 
 // Declare an interface variable for NVML operations.
@@ -73,6 +80,149 @@ func (gpuDeviceInfo *DeviceInfo) PciInfo(d nvml.Device) (nvml.PciInfo, nvml.Retu
 	return d.GetPciInfo()
 }
 
+func (gpuDeviceInfo *DeviceInfo) UUID(d nvml.Device) (string, nvml.Return) {
+	return d.GetUUID()
+}
+
+func (gpuDeviceInfo *DeviceInfo) MaxMigDeviceCount(d nvml.Device) (int, nvml.Return) {
+	return d.GetMaxMigDeviceCount()
+}
+
+func (gpuDeviceInfo *DeviceInfo) GpuInstanceID(d nvml.Device) (int, nvml.Return) {
+	return d.GetGpuInstanceId()
+}
+
+func (gpuDeviceInfo *DeviceInfo) ComputeInstanceID(d nvml.Device) (int, nvml.Return) {
+	return d.GetComputeInstanceId()
+}
+
+func (gpuDeviceInfo *DeviceInfo) GpuInstanceProfileInfo(d nvml.Device, profile int) (nvml.GpuInstanceProfileInfo, nvml.Return) {
+	return d.GetGpuInstanceProfileInfo(profile)
+}
+
+func (gpuDeviceInfo *DeviceInfo) GpuInstanceProfileName(d nvml.Device, profile int) string {
+	return migprofile.NVMLDevice{Device: d}.GpuInstanceProfileName(profile)
+}
+
+// ProfileDevice returns d as a migprofile.Device, to read its GPU instance
+// profiles through NvmlDeviceInfo.
+func ProfileDevice(d nvml.Device) migprofile.Device {
+	if NvmlDeviceInfo == nil {
+		NvmlDeviceInfo = &DeviceInfo{}
+	}
+	return profileDevice{d}
+}
+
+type profileDevice struct {
+	device nvml.Device
+}
+
+func (d profileDevice) GetGpuInstanceProfileInfo(profile int) (nvml.GpuInstanceProfileInfo, nvml.Return) {
+	return NvmlDeviceInfo.GpuInstanceProfileInfo(d.device, profile)
+}
+
+func (d profileDevice) GpuInstanceProfileName(profile int) string {
+	return NvmlDeviceInfo.GpuInstanceProfileName(d.device, profile)
+}
+
+// DeviceHandleByMinor returns the handle of the GPU exposed as /dev/nvidia<minor>.
+func DeviceHandleByMinor(minor int) (nvml.Device, error) {
+	if NvmlDeviceInfo == nil {
+		NvmlDeviceInfo = &DeviceInfo{}
+	}
+
+	count, ret := NvmlDeviceInfo.DeviceCount()
+	if ret != nvml.SUCCESS {
+		return nvml.Device{}, fmt.Errorf("failed to get devices count: %v", nvml.ErrorString(ret))
+	}
+	// GPUs that can't be queried, e.g. because they fell off the bus, are
+	// skipped so that they don't hide the others.
+	for i := 0; i < count; i++ {
+		device, ret := NvmlDeviceInfo.DeviceHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		m, ret := NvmlDeviceInfo.MinorNumber(device)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		if m == minor {
+			return device, nil
+		}
+	}
+	return nvml.Device{}, fmt.Errorf("no accessible GPU with minor number %d", minor)
+}
+
+// IsGPULost returns true if NVML reports the GPU with the index as lost, which
+// happens when it fell off the bus or is otherwise inaccessible.
+func IsGPULost(index int) bool {
+	if NvmlDeviceInfo == nil {
+		NvmlDeviceInfo = &DeviceInfo{}
+	}
+
+	device, ret := NvmlDeviceInfo.DeviceHandleByIndex(index)
+	if ret != nvml.SUCCESS {
+		return ret == nvml.ERROR_GPU_IS_LOST
+	}
+	_, ret = NvmlDeviceInfo.UUID(device)
+	return ret == nvml.ERROR_GPU_IS_LOST
+}
+
+// MigDeviceHandleByGpuInstanceID returns the handle of the MIG device backed by
+// GPU instance gi on the GPU d.
+func MigDeviceHandleByGpuInstanceID(d nvml.Device, gi int) (nvml.Device, error) {
+	return migDeviceHandle(d, gi, -1)
+}
+
+// MigDeviceHandleByComputeInstanceID returns the handle of the MIG device backed
+// by compute instance ci of GPU instance gi on the GPU d.
+func MigDeviceHandleByComputeInstanceID(d nvml.Device, gi, ci int) (nvml.Device, error) {
+	return migDeviceHandle(d, gi, ci)
+}
+
+// migDeviceHandle returns the handle of the MIG device backed by GPU instance gi
+// and compute instance ci on the GPU d. A negative ci matches any compute instance.
+func migDeviceHandle(d nvml.Device, gi, ci int) (nvml.Device, error) {
+	if NvmlDeviceInfo == nil {
+		NvmlDeviceInfo = &DeviceInfo{}
+	}
+
+	count, ret := NvmlDeviceInfo.MaxMigDeviceCount(d)
+	if ret != nvml.SUCCESS {
+		return nvml.Device{}, fmt.Errorf("failed to get the max MIG device count: %v", nvml.ErrorString(ret))
+	}
+	for i := 0; i < count; i++ {
+		migDevice, ret := NvmlDeviceInfo.MigDeviceHandleByIndex(d, i)
+		if ret == nvml.ERROR_NOT_FOUND {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nvml.Device{}, fmt.Errorf("failed to get the MIG device handle for index %d: %v", i, nvml.ErrorString(ret))
+		}
+		id, ret := NvmlDeviceInfo.GpuInstanceID(migDevice)
+		if ret != nvml.SUCCESS {
+			return nvml.Device{}, fmt.Errorf("failed to get the GPU instance ID for MIG device with index %d: %v", i, nvml.ErrorString(ret))
+		}
+		if id != gi {
+			continue
+		}
+		if ci < 0 {
+			return migDevice, nil
+		}
+		id, ret = NvmlDeviceInfo.ComputeInstanceID(migDevice)
+		if ret != nvml.SUCCESS {
+			return nvml.Device{}, fmt.Errorf("failed to get the compute instance ID for MIG device with index %d: %v", i, nvml.ErrorString(ret))
+		}
+		if id == ci {
+			return migDevice, nil
+		}
+	}
+	if ci >= 0 {
+		return nvml.Device{}, fmt.Errorf("no MIG device for compute instance %d of GPU instance %d", ci, gi)
+	}
+	return nvml.Device{}, fmt.Errorf("no MIG device for GPU instance %d", gi)
+}
+
 // topology determines the NUMA topology information for a GPU device.
 // Returns a TopologyInfo containing the NUMA node ID for the GPU device
 // if NUMA is enabled, nil otherwise.
@@ -132,7 +282,7 @@ func numaNode(d nvml.Device, pciDevicesRoot string) (numaEnabled bool, numaNode
 	busID := strings.ToLower(strings.TrimPrefix(string(bytesT), "0000"))
 
 	numaNodeFile := fmt.Sprintf("%s/%s/numa_node", pciDevicesRoot, busID)
-	glog.V(3).Infof("Reading NUMA node information from %q", numaNodeFile)
+	slog.Debug("Reading NUMA node information", "path", numaNodeFile)
 	b, err := os.ReadFile(numaNodeFile)
 	if err != nil {
 		return false, 0, fmt.Errorf("failed to read NUMA information from %q file: %v", numaNodeFile, err)
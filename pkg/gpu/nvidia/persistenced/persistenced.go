@@ -0,0 +1,104 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package persistenced lets the components that need nvidia-persistenced
+// stopped, e.g. to reset GPUs, coordinate with the supervisor that restarts
+// it. A component holds the daemon by creating a hold file in its run
+// directory, which the supervisor checks before restarting the daemon.
+package persistenced
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RunDir is the run directory of nvidia-persistenced, shared by the
+	// containers that supervise or stop it.
+	RunDir = "/var/run/nvidia-persistenced"
+	// PidFile is the pid file written by nvidia-persistenced.
+	PidFile = RunDir + "/nvidia-persistenced.pid"
+	// Socket is the socket nvidia-persistenced listens on.
+	Socket = RunDir + "/socket"
+	// HoldFile keeps the supervisor from restarting nvidia-persistenced while
+	// it exists.
+	HoldFile = RunDir + "/hold"
+	// Comm is the process name of nvidia-persistenced, truncated by the kernel
+	// to 15 characters.
+	Comm = "nvidia-persiste"
+	// MaxHold is how long a hold keeps the daemon stopped, in case its holder
+	// died without releasing it.
+	MaxHold = 5 * time.Minute
+)
+
+// Hold creates holdFile on behalf of holder, and returns a function that
+// releases the hold. It fails if the daemon is already held.
+func Hold(holdFile, holder string) (func() error, error) {
+	f, err := os.OpenFile(holdFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		if current, held := Held(holdFile, time.Now()); held {
+			return nil, fmt.Errorf("nvidia-persistenced is already held by %s", current)
+		}
+		// The hold expired, take it over.
+		if err := os.Remove(holdFile); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(holdFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to hold nvidia-persistenced: %w", err)
+	}
+	_, err = f.WriteString(holder + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(holdFile)
+		return nil, fmt.Errorf("failed to hold nvidia-persistenced: %w", err)
+	}
+	return func() error {
+		if err := os.Remove(holdFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to release nvidia-persistenced: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// Held returns whether holdFile holds the daemon at now, and who holds it.
+// Holds older than MaxHold have expired.
+func Held(holdFile string, now time.Time) (string, bool) {
+	info, err := os.Stat(holdFile)
+	if err != nil || now.Sub(info.ModTime()) >= MaxHold {
+		return "", false
+	}
+	holder, _ := os.ReadFile(holdFile)
+	return strings.TrimSpace(string(holder)), true
+}
+
+// ReadPid returns the pid in pidFile.
+func ReadPid(pidFile string) (int, error) {
+	content, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s: %q", pidFile, content)
+	}
+	return pid, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistenced
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHold(t *testing.T) {
+	holdFile := filepath.Join(t.TempDir(), "hold")
+	if _, held := Held(holdFile, time.Now()); held {
+		t.Fatalf("Held() = true before the daemon was held")
+	}
+
+	release, err := Hold(holdFile, "partition-gpus")
+	if err != nil {
+		t.Fatalf("Hold() error = %v", err)
+	}
+	if holder, held := Held(holdFile, time.Now()); !held || holder != "partition-gpus" {
+		t.Errorf("Held() = %q, %v, want partition-gpus, true", holder, held)
+	}
+	if _, err := Hold(holdFile, "other"); err == nil {
+		t.Errorf("Hold() of a held daemon succeeded, want error")
+	}
+	if _, held := Held(holdFile, time.Now().Add(MaxHold)); held {
+		t.Errorf("Held() = true after MaxHold, want the hold to expire")
+	}
+
+	if err := release(); err != nil {
+		t.Fatalf("release() error = %v", err)
+	}
+	if _, held := Held(holdFile, time.Now()); held {
+		t.Errorf("Held() = true after the hold was released")
+	}
+}
+
+func TestHoldTakesOverExpiredHold(t *testing.T) {
+	holdFile := filepath.Join(t.TempDir(), "hold")
+	if err := os.WriteFile(holdFile, []byte("crashed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-MaxHold)
+	if err := os.Chtimes(holdFile, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Hold(holdFile, "partition-gpus"); err != nil {
+		t.Fatalf("Hold() of an expired hold error = %v", err)
+	}
+	if holder, held := Held(holdFile, time.Now()); !held || holder != "partition-gpus" {
+		t.Errorf("Held() = %q, %v, want partition-gpus, true", holder, held)
+	}
+}
+
+func TestReadPid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{name: "valid", content: "1234\n", want: 1234},
+		{name: "invalid", content: "abc", wantErr: true},
+		{name: "negative", content: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "pid")
+			if err := os.WriteFile(pidFile, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadPid(pidFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadPid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReadPid() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if _, err := ReadPid(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("ReadPid() of a missing pid file succeeded, want error")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging sets up the structured logging shared by all binaries. Logs
+// are written to stderr as JSON through the default log/slog logger, and the
+// log level can be changed at runtime through an HTTP endpoint on localhost.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Keys of the fields logged by all binaries.
+const (
+	DeviceID  = "device_id"
+	UUID      = "uuid"
+	Pod       = "pod"
+	Namespace = "namespace"
+	Container = "container"
+	Xid       = "xid"
+	Error     = "error"
+)
+
+// LevelPath is the path of the HTTP endpoint that reports the log level on GET.
+// On -admin-port, it also sets the level to the one in the request body on PUT
+// or POST.
+const LevelPath = "/debug/loglevel"
+
+var (
+	level = new(slog.LevelVar)
+
+	logLevel  string
+	verbosity int
+	adminPort int
+)
+
+// AddFlags registers the logging flags on fs. -v and -logtostderr are kept for
+// compatibility with the glog flags the binaries used to take.
+func AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error. Can be changed at runtime through "+LevelPath)
+	fs.IntVar(&verbosity, "v", 0, "Deprecated, use -log-level. A verbosity above 0 logs at debug level")
+	fs.Bool("logtostderr", true, "Deprecated, logs are always written to stderr")
+	fs.IntVar(&adminPort, "admin-port", 0, "Port on localhost to serve "+LevelPath+" on, which can only change the log level there. If 0, the log level is read-only, and only served on the metrics port of binaries that have one")
+}
+
+// Setup makes the default logger write JSON logs with the component field to
+// stderr at the level given by the flags, and registers the read-only log level
+// endpoint on http.DefaultServeMux, which binaries may serve on all interfaces.
+// If -admin-port is set, it serves http.DefaultServeMux on localhost on that
+// port, where the log level endpoint can also change the level.
+func Setup(component string) error {
+	l, err := parseLevel(logLevel, verbosity)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	slog.SetDefault(New(os.Stderr).With("component", component))
+	http.Handle(LevelPath, ReadOnlyLevelHandler())
+
+	if adminPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle(LevelPath, LevelHandler())
+		mux.Handle("/", http.DefaultServeMux)
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", adminPort), mux); err != nil {
+				slog.Error("Admin server stopped", Error, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// New returns a logger that writes JSON logs to w at the shared log level.
+func New(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// SetLevel changes the log level of the loggers created by New.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// Level returns the log level of the loggers created by New.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// LevelHandler reports the log level on GET, and sets it to the level in the
+// request body, e.g. debug, on PUT or POST.
+func LevelHandler() http.Handler {
+	return levelHandler(true)
+}
+
+// ReadOnlyLevelHandler reports the log level on GET, and rejects other methods.
+func ReadOnlyLevelHandler() http.Handler {
+	return levelHandler(false)
+}
+
+func levelHandler(writable bool) http.Handler {
+	allow := "GET"
+	if writable {
+		allow = "GET, PUT, POST"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			if !writable {
+				w.Header().Set("Allow", allow)
+				http.Error(w, "the log level can only be changed on -admin-port", http.StatusMethodNotAllowed)
+				return
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var l slog.Level
+			if err := l.UnmarshalText([]byte(strings.TrimSpace(string(body)))); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if l != level.Level() {
+				slog.Info("Changing log level", "from", level.Level().String(), "to", l.String())
+				level.Set(l)
+			}
+		default:
+			w.Header().Set("Allow", allow)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, strings.ToLower(level.Level().String()))
+	})
+}
+
+// Fatal logs msg at error level and exits with code 1.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// parseLevel returns the level named by name, or debug if the glog verbosity is
+// above 0 and name is the default.
+func parseLevel(name string, verbosity int) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return l, fmt.Errorf("invalid log level %q: %v", name, err)
+	}
+	if verbosity > 0 && l == slog.LevelInfo {
+		l = slog.LevelDebug
+	}
+	return l, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2025 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		name      string
+		level     string
+		verbosity int
+		want      slog.Level
+		wantErr   bool
+	}{
+		{name: "default", level: "info", want: slog.LevelInfo},
+		{name: "debug", level: "debug", want: slog.LevelDebug},
+		{name: "upper case", level: "WARN", want: slog.LevelWarn},
+		{name: "glog verbosity", level: "info", verbosity: 3, want: slog.LevelDebug},
+		{name: "log level wins over glog verbosity", level: "error", verbosity: 3, want: slog.LevelError},
+		{name: "invalid", level: "verbose", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseLevel(tc.level, tc.verbosity)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseLevel(%q, %d) error = %v, wantErr %v", tc.level, tc.verbosity, err, tc.wantErr)
+			}
+			if err == nil && got != tc.want {
+				t.Errorf("parseLevel(%q, %d) = %v, want %v", tc.level, tc.verbosity, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	defer SetLevel(Level())
+	SetLevel(slog.LevelInfo)
+
+	cases := []struct {
+		name       string
+		readOnly   bool
+		method     string
+		body       string
+		wantStatus int
+		wantBody   string
+		wantLevel  slog.Level
+	}{
+		{name: "get", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "info\n", wantLevel: slog.LevelInfo},
+		{name: "put", method: http.MethodPut, body: "debug\n", wantStatus: http.StatusOK, wantBody: "debug\n", wantLevel: slog.LevelDebug},
+		{name: "post", method: http.MethodPost, body: "warn", wantStatus: http.StatusOK, wantBody: "warn\n", wantLevel: slog.LevelWarn},
+		{name: "invalid level", method: http.MethodPut, body: "verbose", wantStatus: http.StatusBadRequest, wantLevel: slog.LevelWarn},
+		{name: "invalid method", method: http.MethodDelete, wantStatus: http.StatusMethodNotAllowed, wantLevel: slog.LevelWarn},
+		{name: "read-only get", readOnly: true, method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "warn\n", wantLevel: slog.LevelWarn},
+		{name: "read-only put", readOnly: true, method: http.MethodPut, body: "debug", wantStatus: http.StatusMethodNotAllowed, wantLevel: slog.LevelWarn},
+		{name: "read-only post", readOnly: true, method: http.MethodPost, body: "debug", wantStatus: http.StatusMethodNotAllowed, wantLevel: slog.LevelWarn},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := LevelHandler()
+			if tc.readOnly {
+				h = ReadOnlyLevelHandler()
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tc.method, LevelPath, strings.NewReader(tc.body)))
+			if rec.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if tc.wantBody != "" && rec.Body.String() != tc.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tc.wantBody)
+			}
+			if got := Level(); got != tc.wantLevel {
+				t.Errorf("Level() = %v, want %v", got, tc.wantLevel)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	defer SetLevel(Level())
+	SetLevel(slog.LevelInfo)
+
+	var buf bytes.Buffer
+	logger := New(&buf)
+	logger.Debug("Not logged")
+	logger.Info("Device marked unhealthy", DeviceID, "nvidia0", Xid, 79)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("failed to parse log line %q: %v", buf.String(), err)
+	}
+	delete(got, "time")
+	want := map[string]any{
+		"level":  "INFO",
+		"msg":    "Device marked unhealthy",
+		DeviceID: "nvidia0",
+		Xid:      float64(79),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("log line (-want +got):\n%s", diff)
+	}
+}